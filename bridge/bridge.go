@@ -0,0 +1,551 @@
+// Package bridge contains the code which is shared by the bridges, which
+// read test-results from redis and pass them on to humans.
+//
+// A bridge is created, given the chance to register its own flags, and
+// then run with a function which processes each result:
+//
+//	func main() {
+//		b, err := bridge.New("example")
+//		if err != nil {
+//			fmt.Printf("%s\n", err.Error())
+//			os.Exit(1)
+//		}
+//		url := flag.String("url", "", "The URL to notify")
+//
+//		err = b.Parse()
+//		if err != nil {
+//			fmt.Printf("%s\n", err.Error())
+//			os.Exit(1)
+//		}
+//
+//		err = b.Run(func(res bridge.Result) error {
+//			if !res.Failed() {
+//				return nil
+//			}
+//			resp, err := http.Post(*url, "application/json", bytes.NewReader(res.JSON()))
+//			if err != nil {
+//				return err
+//			}
+//			return resp.Body.Close()
+//		})
+//		...
+//	}
+//
+// The bridge handles:
+//
+//   - Connecting to redis, and reading the configuration file.
+//   - Reading results from the results list, or stream.
+//   - Decoding each result, and skipping those which don't match the
+//     filter given via -result, -type, -tag, and -target.
+//   - Retrying results which the function fails to process, and moving
+//     those which fail too often to the dead-letter list.
+//   - Registering the bridge, so that `overseer status` can report upon it.
+//   - Stopping cleanly upon SIGINT or SIGTERM.
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/skx/overseer/config"
+	"github.com/skx/overseer/logger"
+	"github.com/skx/overseer/queue"
+	"github.com/skx/overseer/redisconn"
+)
+
+// DeadLetterMax is the number of results the dead-letter list is trimmed
+// to, so that a bridge which fails everything can't fill redis.
+const DeadLetterMax = 10000
+
+// pollInterval is how long we wait for a result before checking whether
+// we've been asked to stop.
+const pollInterval = 2 * time.Second
+
+// Handler processes a single test-result.
+//
+// If an error is returned the result is retried, unless the error was
+// created via Permanent, in which case it is moved to the dead-letter
+// list immediately.
+type Handler func(res Result) error
+
+// permanentError wraps an error which retrying won't fix.
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+// Permanent marks an error as one which retrying won't fix, such as a
+// result which the receiving system rejects as invalid.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// IsPermanent returns true if the error was created via Permanent.
+func IsPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// Options holds the settings which every bridge shares.
+type Options struct {
+
+	// Redis describes how to connect to redis.
+	Redis redisconn.Options
+
+	// Log configures our logger.
+	Log logger.Options
+
+	// Stream configures reading from the results stream, rather
+	// than the list.
+	Stream queue.ConsumerOptions
+
+	// Filter selects the results which are processed.
+	Filter Filter
+
+	// MaxDeliveries is the number of times a result may fail to be
+	// processed before it is moved to the dead-letter list, zero to
+	// retry forever.
+	MaxDeliveries int64
+
+	// DeadLetter is the name of the dead-letter list, empty to discard
+	// results which can't be processed.
+	DeadLetter string
+
+	// RetryDelay is the delay before a result read from the list is
+	// retried, which doubles after each attempt.
+	//
+	// (Results read from the stream are retried once they've been
+	// pending for Stream.ClaimIdle.)
+	RetryDelay time.Duration
+}
+
+// SetFlags registers the command-line flags which populate our options,
+// using the configuration file for defaults.
+func (o *Options) SetFlags(f *flag.FlagSet, name string, cfg *config.Config) {
+	o.Redis.SetFlags(f, cfg.Redis)
+	o.Log.SetFlags(f, cfg.Log)
+	o.Stream.SetFlags(f, name, cfg.Results)
+	o.Filter.SetFlags(f)
+
+	f.Int64Var(&o.MaxDeliveries, "max-deliveries", 5, "Move results which have failed this many times to the dead-letter list, zero to retry forever.")
+	f.StringVar(&o.DeadLetter, "dead-letter", queue.DeadLetterKey, "The redis list to move results which can't be processed to, empty to discard them.")
+	o.RetryDelay = time.Second
+}
+
+// Bridge reads test-results, and passes each to a Handler.
+type Bridge struct {
+
+	// Name is the name of the bridge, such as "email".
+	Name string
+
+	// ID identifies this instance of the bridge.
+	ID string
+
+	// Options are the settings of the bridge.
+	Options Options
+
+	// Log is our logger, which is valid once Parse has been called.
+	Log *logger.Logger
+
+	// Redis is the connection to redis, which is valid once Parse
+	// has been called.
+	Redis redis.UniversalClient
+
+	// flags and cfg are our flags, and configuration file.
+	flags *flag.FlagSet
+	cfg   *config.Config
+
+	// ctx is cancelled when we're asked to stop.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// stats holds the counters we publish.
+	stats struct {
+		sync.Mutex
+		Started   time.Time
+		Processed int64
+		Skipped   int64
+		Failed    int64
+		Dead      int64
+	}
+}
+
+// New creates a bridge, loading the configuration file named by the
+// OVERSEER environmental variable and registering our flags upon the
+// default command-line.
+//
+// The bridge may register further flags of its own before calling Parse.
+func New(name string) (*Bridge, error) {
+	cfg, err := config.FromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return NewWithFlags(name, flag.CommandLine, cfg), nil
+}
+
+// NewWithFlags creates a bridge which registers its flags upon the given
+// set, using the given configuration for defaults.
+func NewWithFlags(name string, f *flag.FlagSet, cfg *config.Config) *Bridge {
+	host, _ := os.Hostname()
+
+	b := &Bridge{
+		Name:  name,
+		ID:    fmt.Sprintf("%s-%s-%d", name, host, os.Getpid()),
+		flags: f,
+		cfg:   cfg,
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.Options.SetFlags(f, name, cfg)
+	return b
+}
+
+// Parse applies the settings of the bridge from the configuration file,
+// parses the command-line, then creates our logger and connects to redis.
+func (b *Bridge) Parse() error {
+	return b.ParseArgs(os.Args[1:])
+}
+
+// ParseArgs is like Parse, but parses the given arguments.
+func (b *Bridge) ParseArgs(args []string) error {
+
+	err := b.cfg.ApplyBridge(b.Name, b.flags)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %s", err.Error())
+	}
+	err = b.flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	return b.Connect()
+}
+
+// Connect creates our logger, and connects to redis, without parsing any
+// flags.
+//
+// This is for bridges whose flags have already been parsed, such as
+// `overseer notify`, which should call ApplyBridge upon the configuration
+// file before parsing them.
+func (b *Bridge) Connect() error {
+
+	var err error
+	b.Log, err = b.Options.Log.New()
+	if err != nil {
+		return err
+	}
+	b.Log = b.Log.With(logger.FieldBridge, b.ID)
+
+	b.Redis, err = b.Options.Redis.Connect()
+	if err != nil {
+		return fmt.Errorf("redis connection failed: %s", err.Error())
+	}
+	return nil
+}
+
+// Context returns a context which is cancelled once the bridge has been
+// asked to stop.
+func (b *Bridge) Context() context.Context {
+	return b.ctx
+}
+
+// Stop asks the bridge to stop, once it has finished processing the
+// current result.
+func (b *Bridge) Stop() {
+	b.cancel()
+}
+
+// Every calls the given function at the given interval, in the
+// background, until the bridge stops.
+//
+// This may be used to send heartbeats to the system the bridge notifies,
+// or to send batched notifications.
+func (b *Bridge) Every(interval time.Duration, fn func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Run processes test-results until the bridge is stopped, via Stop or
+// a SIGINT or SIGTERM.
+func (b *Bridge) Run(h Handler) error {
+
+	b.stats.Lock()
+	b.stats.Started = time.Now()
+	b.stats.Unlock()
+	defer b.Stop()
+
+	//
+	// Stop cleanly when we're asked to.
+	//
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case s := <-sig:
+			b.Log.Info("Stopping", "signal", s.String())
+			b.Stop()
+		case <-b.ctx.Done():
+		}
+	}()
+
+	//
+	// Register ourselves, and keep our registration fresh.
+	//
+	err := b.register()
+	if err != nil {
+		b.Log.Error("Failed to register bridge", logger.FieldError, err)
+	}
+	b.Every(queue.HeartbeatInterval, func() {
+		err := b.register()
+		if err != nil {
+			b.Log.Error("Failed to update bridge registration", logger.FieldError, err)
+		}
+	})
+	defer b.unregister()
+
+	if b.Options.Stream.Stream {
+		return b.consume(h)
+	}
+	return b.pop(h)
+}
+
+// stopped returns true if we've been asked to stop.
+func (b *Bridge) stopped() bool {
+	return b.ctx.Err() != nil
+}
+
+// sleep waits for the given duration, returning false if we were asked
+// to stop first.
+func (b *Bridge) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-b.ctx.Done():
+		return false
+	}
+}
+
+// consume processes results from the stream, acknowledging each once
+// it has been processed.
+//
+// Results which fail are left pending, and are retried once they've been
+// pending for long enough to be claimed.  Results which are pending when
+// we stop are processed when we start again.
+func (b *Bridge) consume(h Handler) error {
+
+	consumer, err := b.Options.Stream.Consumer(b.Redis)
+	if err != nil {
+		return err
+	}
+
+	for !b.stopped() {
+		results, err := consumer.Read(pollInterval)
+		if err != nil {
+			b.Log.Error("Error reading from the results stream", logger.FieldError, err)
+			b.sleep(time.Second)
+			continue
+		}
+
+		for _, res := range results {
+			if b.stopped() {
+				break
+			}
+			if b.handle(h, res.JSON(), res.Deliveries) {
+				consumer.Ack(res.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// pop processes results from the list.
+//
+// Results which fail are retried here, after a delay, as there's nothing
+// to redeliver them.  If we're stopped while waiting to retry then the
+// result is returned to the head of the list.
+func (b *Bridge) pop(h Handler) error {
+
+	for !b.stopped() {
+		msg, err := b.Redis.BLPop(pollInterval, queue.ResultsKey).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			b.Log.Error("Error reading from the results list", logger.FieldError, err)
+			b.sleep(time.Second)
+			continue
+		}
+
+		//
+		//   msg[0] will be "overseer.results"
+		//
+		//   msg[1] will be the value removed from the list.
+		//
+		raw := []byte(msg[1])
+		delay := b.Options.RetryDelay
+		for deliveries := int64(1); !b.handle(h, raw, deliveries); deliveries++ {
+			if !b.sleep(delay) {
+				b.Redis.LPush(queue.ResultsKey, msg[1])
+				break
+			}
+			delay *= 2
+			if delay > time.Minute {
+				delay = time.Minute
+			}
+		}
+	}
+	return nil
+}
+
+// handle processes a single result, returning true if we're done with it
+// or false if it should be retried.
+func (b *Bridge) handle(h Handler, raw []byte, deliveries int64) bool {
+
+	res, err := Decode(raw)
+	if err != nil {
+		b.deadLetter(raw, err, deliveries)
+		return true
+	}
+	res.Deliveries = deliveries
+
+	if !b.Options.Filter.Match(res) {
+		b.count(&b.stats.Skipped)
+		return true
+	}
+
+	tlog := b.Log.With(logger.FieldTestID, res.ID, logger.FieldType, res.Type, logger.FieldTarget, res.Target)
+
+	err = call(h, res)
+	if err == nil {
+		b.count(&b.stats.Processed)
+		return true
+	}
+	b.count(&b.stats.Failed)
+
+	max := b.Options.MaxDeliveries
+	if IsPermanent(err) || (max > 0 && deliveries >= max) {
+		tlog.Error("Failed to process result", logger.FieldError, err)
+		b.deadLetter(raw, err, deliveries)
+		return true
+	}
+
+	tlog.Warn("Failed to process result, it will be retried", logger.FieldAttempt, fmt.Sprintf("%d/%d", deliveries, max), logger.FieldError, err)
+	return false
+}
+
+// call invokes the handler, treating a panic as a permanent failure so
+// that a single bad result can't stop the bridge.
+func call(h Handler, res Result) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = Permanent(fmt.Errorf("panic: %v", r))
+		}
+	}()
+	return h(res)
+}
+
+// count increments one of our counters.
+func (b *Bridge) count(counter *int64) {
+	b.stats.Lock()
+	*counter++
+	b.stats.Unlock()
+}
+
+// deadLetter moves a result which can't be processed to the dead-letter
+// list, along with the reason why.
+func (b *Bridge) deadLetter(raw []byte, reason error, deliveries int64) {
+	b.count(&b.stats.Dead)
+
+	key := b.Options.DeadLetter
+	if key == "" {
+		b.Log.Error("Discarding result", "result", string(raw), logger.FieldError, reason)
+		return
+	}
+
+	entry, _ := json.Marshal(map[string]interface{}{
+		"bridge":     b.Name,
+		"id":         b.ID,
+		"error":      reason.Error(),
+		"deliveries": deliveries,
+		"time":       time.Now().Unix(),
+		"result":     string(raw),
+	})
+
+	_, err := b.Redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(key, entry)
+		pipe.LTrim(key, -DeadLetterMax, -1)
+		return nil
+	})
+	if err != nil {
+		b.Log.Error("Failed to add result to the dead-letter list", "result", string(raw), logger.FieldError, err)
+		return
+	}
+	b.Log.Warn("Moved result to the dead-letter list", "key", key, logger.FieldError, reason)
+}
+
+// register publishes our state to redis, so that `overseer status` can
+// report upon it.
+//
+// The registration expires unless it is refreshed, which allows dead
+// bridges to be detected.
+func (b *Bridge) register() error {
+
+	mode := "list"
+	if b.Options.Stream.Stream {
+		mode = "stream:" + b.Options.Stream.Group
+	}
+
+	b.stats.Lock()
+	info := map[string]interface{}{
+		"id":        b.ID,
+		"name":      b.Name,
+		"mode":      mode,
+		"started":   b.stats.Started.Unix(),
+		"heartbeat": time.Now().Unix(),
+		"processed": b.stats.Processed,
+		"skipped":   b.stats.Skipped,
+		"failed":    b.stats.Failed,
+		"dead":      b.stats.Dead,
+	}
+	b.stats.Unlock()
+
+	key := queue.BridgeKey(b.ID)
+	_, err := b.Redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(key)
+		pipe.HMSet(key, info)
+		pipe.Expire(key, queue.HeartbeatExpiry)
+		pipe.SAdd(queue.BridgesKey, b.ID)
+		return nil
+	})
+	return err
+}
+
+// unregister removes our registration, as we're stopping.
+func (b *Bridge) unregister() {
+	b.Redis.SRem(queue.BridgesKey, b.ID)
+	b.Redis.Del(queue.BridgeKey(b.ID))
+}
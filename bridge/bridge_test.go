@@ -0,0 +1,143 @@
+package bridge
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"testing"
+
+	"github.com/skx/overseer/config"
+	"github.com/skx/overseer/logger"
+)
+
+// Test that results are decoded.
+func TestDecode(t *testing.T) {
+
+	res, err := Decode([]byte(`{"id":"abc","input":"example.com must run ssh","result":"failed","error":"refused","type":"ssh","target":"1.2.3.4","tag":"dc1","severity":"critical","time":"1600000000","extra":"x"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if res.ID != "abc" || res.Type != "ssh" || res.Target != "1.2.3.4" || res.Tag != "dc1" || res.Severity != "critical" {
+		t.Errorf("Wrong result: %v", res)
+	}
+	if !res.Failed() || res.Error != "refused" {
+		t.Errorf("Expected a failure: %v", res)
+	}
+	if res.Time.Unix() != 1600000000 {
+		t.Errorf("Wrong time: %v", res.Time)
+	}
+	if res.Fields["extra"] != "x" {
+		t.Errorf("Missing field: %v", res.Fields)
+	}
+
+	//
+	// Older workers didn't publish the result.
+	//
+	res, _ = Decode([]byte(`{"input":"x","error":"failed"}`))
+	if !res.Failed() {
+		t.Errorf("Expected a failure: %v", res)
+	}
+	res, _ = Decode([]byte(`{"input":"x"}`))
+	if res.Failed() {
+		t.Errorf("Expected a pass: %v", res)
+	}
+
+	for _, raw := range []string{"", "null", "[]", `{"x":1}`, "{"} {
+		_, err := Decode([]byte(raw))
+		if err == nil {
+			t.Errorf("Expected an error decoding '%s'", raw)
+		}
+	}
+}
+
+// Test that results are filtered.
+func TestFilter(t *testing.T) {
+
+	res := Result{Result: "failed", Type: "http", Tag: "dc1", Target: "10.0.1.2"}
+
+	matches := []Filter{
+		{},
+		{Result: "failed"},
+		{Type: "ssh,http"},
+		{Tag: "dc1", Target: "10.0.*"},
+		{Target: "192.168.*, 10.0.1.2"},
+	}
+	for _, f := range matches {
+		if !f.Match(res) {
+			t.Errorf("Expected %v to match", f)
+		}
+	}
+
+	misses := []Filter{
+		{Result: "passed"},
+		{Type: "ssh"},
+		{Result: "failed", Tag: "dc2"},
+		{Target: "10.1.*"},
+	}
+	for _, f := range misses {
+		if f.Match(res) {
+			t.Errorf("Expected %v not to match", f)
+		}
+	}
+}
+
+// Test that permanent errors are recognised.
+func TestPermanent(t *testing.T) {
+	if Permanent(nil) != nil {
+		t.Errorf("Expected nil")
+	}
+	err := Permanent(errors.New("invalid"))
+	if !IsPermanent(err) || err.Error() != "invalid" {
+		t.Errorf("Expected a permanent error: %v", err)
+	}
+	if IsPermanent(errors.New("invalid")) {
+		t.Errorf("Unexpected permanent error")
+	}
+}
+
+// testBridge returns a bridge which isn't connected to redis.
+func testBridge(args ...string) *Bridge {
+	b := NewWithFlags("test", flag.NewFlagSet("test", flag.ContinueOnError), config.Default())
+	b.flags.Parse(args)
+	b.Log = logger.New(ioutil.Discard, logger.LevelError, logger.FormatText)
+	return b
+}
+
+// Test how results are handled.
+func TestHandle(t *testing.T) {
+
+	b := testBridge("-result=failed", "-max-deliveries=3")
+
+	calls := 0
+	h := func(res Result) error {
+		calls++
+		if res.Error == "retry" {
+			return errors.New("try again")
+		}
+		return nil
+	}
+
+	if !b.handle(h, []byte(`{"result":"passed"}`), 1) || calls != 0 {
+		t.Errorf("Expected the result to be skipped")
+	}
+	if !b.handle(h, []byte(`{"result":"failed","error":"x"}`), 1) || calls != 1 {
+		t.Errorf("Expected the result to be processed")
+	}
+	if b.handle(h, []byte(`{"result":"failed","error":"retry"}`), 2) {
+		t.Errorf("Expected the result to be retried")
+	}
+
+	b.stats.Lock()
+	defer b.stats.Unlock()
+	if b.stats.Processed != 1 || b.stats.Skipped != 1 || b.stats.Failed != 1 {
+		t.Errorf("Wrong counters: %d processed, %d skipped, %d failed", b.stats.Processed, b.stats.Skipped, b.stats.Failed)
+	}
+}
+
+// Test that panics are caught.
+func TestPanic(t *testing.T) {
+	err := call(func(res Result) error { panic("oops") }, Result{})
+	if !IsPermanent(err) {
+		t.Errorf("Expected a permanent error: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package bridge
+
+import (
+	"flag"
+	"path"
+	"strings"
+)
+
+// Filter selects the test-results which a bridge processes.
+//
+// Each field is a comma-separated list of values, any of which may
+// match, and an empty field matches everything.
+type Filter struct {
+
+	// Result is "passed", or "failed".
+	Result string
+
+	// Type is the type of the test, such as "http".
+	Type string
+
+	// Tag is the tag of the worker which executed the test.
+	Tag string
+
+	// Target is the address the test was executed against, which may
+	// be a glob such as "10.0.*".
+	Target string
+}
+
+// SetFlags registers the command-line flags which populate our filter.
+func (f *Filter) SetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.Result, "result", "", "Only process results which are 'passed', or 'failed'.")
+	fs.StringVar(&f.Type, "type", "", "Only process results of these test-types, comma-separated.")
+	fs.StringVar(&f.Tag, "tag", "", "Only process results from workers with these tags, comma-separated.")
+	fs.StringVar(&f.Target, "target", "", "Only process results for targets matching these globs, comma-separated.")
+}
+
+// Match returns true if the result should be processed.
+func (f Filter) Match(res Result) bool {
+	return MatchPatterns(f.Result, res.Result) &&
+		MatchPatterns(f.Type, res.Type) &&
+		MatchPatterns(f.Tag, res.Tag) &&
+		MatchPatterns(f.Target, res.Target)
+}
+
+// MatchPatterns returns true if the value matches one of the comma-separated
+// patterns, which are globs such as "10.0.*", or there are none.
+func MatchPatterns(patterns string, value string) bool {
+	if patterns == "" {
+		return true
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		ok, err := path.Match(strings.TrimSpace(pattern), value)
+		if ok && err == nil {
+			return true
+		}
+	}
+	return false
+}
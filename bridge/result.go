@@ -0,0 +1,108 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Result is a test-result, as published by a worker.
+type Result struct {
+
+	// ID is the stable ID of the test, which is empty for results
+	// published by older workers.
+	ID string
+
+	// Input is the test, as read from the configuration file.
+	Input string
+
+	// Result is either "passed" or "failed".
+	Result string
+
+	// Error is the reason the test failed, if it did.
+	Error string
+
+	// Type is the type of the test, such as "http".
+	Type string
+
+	// Target is the address the test was executed against.
+	Target string
+
+	// Tag and Location describe the worker which executed the test.
+	Tag      string
+	Location string
+
+	// Severity is the severity of the test, if set.
+	Severity string
+
+	// Time is the time at which the result was published.
+	Time time.Time
+
+	// Fields contains every field of the result, including any which
+	// aren't described above.
+	Fields map[string]string
+
+	// Deliveries is the number of times the result has been delivered
+	// to the bridge, including this one.
+	Deliveries int64
+}
+
+// Decode parses a test-result, which is a JSON object.
+func Decode(raw []byte) (Result, error) {
+
+	var fields map[string]string
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		return Result{}, fmt.Errorf("invalid test-result: %s", err.Error())
+	}
+	if fields == nil {
+		return Result{}, fmt.Errorf("invalid test-result: null")
+	}
+
+	return FromFields(fields), nil
+}
+
+// FromFields creates a result from its fields.
+func FromFields(fields map[string]string) Result {
+	res := Result{
+		ID:       fields["id"],
+		Input:    fields["input"],
+		Result:   fields["result"],
+		Error:    fields["error"],
+		Type:     fields["type"],
+		Target:   fields["target"],
+		Tag:      fields["tag"],
+		Location: fields["location"],
+		Severity: fields["severity"],
+		Fields:   fields,
+	}
+
+	//
+	// Older workers only recorded failures via the error.
+	//
+	if res.Result == "" {
+		res.Result = "passed"
+		if res.Error != "" {
+			res.Result = "failed"
+		}
+	}
+
+	secs, err := strconv.ParseInt(fields["time"], 10, 64)
+	if err == nil {
+		res.Time = time.Unix(secs, 0)
+	}
+	return res
+}
+
+// Failed returns true if the test failed.
+func (r Result) Failed() bool {
+	return r.Result == "failed"
+}
+
+// JSON returns the result as a JSON object, in the form in which it was
+// published.
+func (r Result) JSON() []byte {
+	j, _ := json.Marshal(r.Fields)
+	return j
+}
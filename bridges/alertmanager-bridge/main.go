@@ -0,0 +1,368 @@
+//
+// This is the Alertmanager bridge, which reads test-results from redis, and
+// submits them as alerts to a Prometheus Alertmanager.
+//
+// The program should be built like so:
+//
+//     go build .
+//
+// Once built launch it like so:
+//
+//     $ ./alertmanager-bridge -url=http://alertmanager.example.com:9093/
+//
+// Each failing test raises an alert, labelled with the ID, type, and
+// target of the test, along with the tag and location of the worker.
+// Once the test passes again the alert is resolved.
+//
+// Alerts expire unless they're refreshed, so each active alert is re-sent
+// periodically, for as long as the test continues to fail.  The active
+// alerts are stored in redis, so that they're still refreshed, and then
+// resolved, if the bridge is restarted.
+//
+// Steve
+// --
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/skx/overseer/bridge"
+	"github.com/skx/overseer/logger"
+	"github.com/skx/overseer/test"
+)
+
+// Alert is an alert, as submitted to the Alertmanager API.
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// ActiveKey is the name of the redis hash which contains the alerts which
+// are active, keyed by test ID and target, so that we refresh and resolve
+// them.
+const ActiveKey = "overseer.alertmanager.active"
+
+// The redis handle
+var r redis.UniversalClient
+
+// Our logger
+var log *logger.Logger
+
+// The Alertmanager(s) we submit alerts to
+var amURLs []string
+
+// The name of the alerts we raise
+var alertName *string
+
+// The credentials to authenticate with, if any
+var basicAuth *string
+
+// How often active alerts are re-sent
+var resend *time.Duration
+
+// The HTTP client we use
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// The mutex which serializes changes to the active alerts, and their
+// submission, so that a refresh doesn't re-raise a resolved alert.
+var mutex sync.Mutex
+
+// Raise, or resolve, the alert for a test-result.
+//
+// Failures to submit an alert are logged, rather than retried, as the
+// alert will be re-sent while it remains active.
+func process(res bridge.Result) error {
+
+	data := res.Fields
+
+	//
+	// Results from older workers don't contain the ID of the test.
+	//
+	id := res.ID
+	if id == "" {
+		tmp := test.Test{Input: res.Input}
+		id = tmp.ID()
+	}
+
+	labels := map[string]string{
+		"alertname": *alertName,
+		"test_id":   id,
+		"type":      data["type"],
+		"target":    data["target"],
+	}
+	for _, field := range []string{"tag", "location", "severity"} {
+		if data[field] != "" {
+			labels[field] = data[field]
+		}
+	}
+
+	key := id + "/" + data["target"]
+	now := time.Now()
+
+	tlog := log.With(logger.FieldTestID, id, logger.FieldType, data["type"], logger.FieldTarget, data["target"])
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	alert, ok, err := lookup(key)
+	if err != nil {
+		return err
+	}
+
+	//
+	// If the test passed we resolve the alert, if it was active.
+	//
+	// It stays active until Alertmanager has been told, so that if we
+	// fail the result is retried rather than the alert being left to
+	// fire until it expires.
+	//
+	if !res.Failed() {
+		if !ok {
+			return nil
+		}
+
+		alert.EndsAt = now
+		tlog.Info("Resolving alert")
+		err = send([]Alert{alert})
+		if err != nil {
+			return fmt.Errorf("failed to resolve alert - %s", err.Error())
+		}
+		return r.HDel(ActiveKey, key).Err()
+	}
+
+	//
+	// The test failed, so raise the alert - keeping the time it
+	// started if it was already active.
+	//
+	if !ok {
+		alert.StartsAt = now
+		if !res.Time.IsZero() {
+			alert.StartsAt = res.Time
+		}
+	}
+	alert.Labels = labels
+	alert.Annotations = map[string]string{
+		"summary": fmt.Sprintf("The %s test against %s failed", data["type"], data["target"]),
+		"error":   data["error"],
+		"input":   data["input"],
+	}
+	alert.EndsAt = expiry(now)
+
+	j, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	err = r.HSet(ActiveKey, key, j).Err()
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		tlog.Info("Raising alert")
+	}
+	err = send([]Alert{alert})
+	if err != nil {
+		tlog.Error("Failed to raise alert", logger.FieldError, err)
+	}
+	return nil
+}
+
+// lookup returns the active alert with the given key, if there is one.
+func lookup(key string) (Alert, bool, error) {
+	var alert Alert
+
+	j, err := r.HGet(ActiveKey, key).Result()
+	if err == redis.Nil {
+		return alert, false, nil
+	}
+	if err != nil {
+		return alert, false, err
+	}
+
+	err = json.Unmarshal([]byte(j), &alert)
+	if err != nil {
+		return alert, false, fmt.Errorf("invalid alert %s - %s", key, err.Error())
+	}
+	return alert, true, nil
+}
+
+// expiry returns the time at which an alert raised now will expire,
+// unless it is re-sent.
+//
+// This allows a couple of resends to fail before the alert expires.
+func expiry(now time.Time) time.Time {
+	return now.Add(3 * *resend)
+}
+
+// refresh re-sends each active alert, so that it doesn't expire.
+func refresh() {
+
+	now := time.Now()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	all, err := r.HGetAll(ActiveKey).Result()
+	if err != nil {
+		log.Error("Failed to find the active alerts", logger.FieldError, err)
+		return
+	}
+
+	var alerts []Alert
+	for key, j := range all {
+		var alert Alert
+		err = json.Unmarshal([]byte(j), &alert)
+		if err != nil {
+			log.Warn("Ignoring invalid alert", "key", key, logger.FieldError, err)
+			continue
+		}
+		alert.EndsAt = expiry(now)
+		alerts = append(alerts, alert)
+	}
+
+	if len(alerts) == 0 {
+		return
+	}
+
+	log.Debug("Re-sending active alerts", "alerts", len(alerts))
+	err = send(alerts)
+	if err != nil {
+		log.Error("Failed to re-send active alerts", logger.FieldError, err)
+	}
+}
+
+// send submits alerts to each Alertmanager.
+//
+// Alertmanagers which are clustered share their alerts, so we succeed if
+// any of them accept the alerts.
+func send(alerts []Alert) error {
+
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, u := range amURLs {
+		err = post(u, body)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) == len(amURLs) {
+		return fmt.Errorf("failed to submit alerts: %s", strings.Join(errs, "; "))
+	}
+	for _, e := range errs {
+		log.Warn("Failed to submit alerts to an Alertmanager", logger.FieldError, e)
+	}
+	return nil
+}
+
+// post submits the alerts, in JSON, to a single Alertmanager.
+func post(base string, body []byte) error {
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(base, "/")+"/api/v2/alerts", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if *basicAuth != "" {
+		parts := strings.SplitN(*basicAuth, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("basic-auth must be of the form user:password")
+		}
+		req.SetBasicAuth(parts[0], parts[1])
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	response, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status code was %d: %s", base, res.StatusCode, bytes.TrimSpace(response))
+	}
+	return nil
+}
+
+//
+// Entry Point
+//
+func main() {
+
+	//
+	// Create our bridge, which registers the common flags, and then
+	// add our own.
+	//
+	b, err := bridge.New("alertmanager")
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	urls := flag.String("url", "", "The URL of the Alertmanager, or a comma-separated list of them")
+	alertName = flag.String("alertname", "OverseerTestFailed", "The name of the alerts which are raised")
+	basicAuth = flag.String("basic-auth", "", "The user:password to authenticate with")
+	resend = flag.Duration("resend", time.Minute, "How often to re-send active alerts")
+
+	//
+	// Parse our flags, using the configuration file for defaults,
+	// and connect to redis.
+	//
+	err = b.Parse()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	log = b.Log
+	r = b.Redis
+
+	//
+	// Sanity-check
+	//
+	for _, u := range strings.Split(*urls, ",") {
+		if strings.TrimSpace(u) != "" {
+			amURLs = append(amURLs, strings.TrimSpace(u))
+		}
+	}
+	if len(amURLs) == 0 {
+		fmt.Printf("Usage: alertmanager-bridge -url=http://alertmanager.example.com:9093/ [-redis-host=127.0.0.1:6379] [-redis-pass=secret]\n")
+		os.Exit(1)
+	}
+	if *resend <= 0 {
+		fmt.Printf("The resend interval must be greater than zero\n")
+		os.Exit(1)
+	}
+
+	//
+	// Keep our active alerts from expiring.
+	//
+	b.Every(*resend, refresh)
+
+	//
+	// Process results until we're stopped.
+	//
+	err = b.Run(process)
+	if err != nil {
+		log.Error("Failed to read test-results", logger.FieldError, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/skx/overseer/bridge"
+)
+
+// fakeAlertmanager is a fake Alertmanager, which records the alerts it
+// receives, or fails if told to.
+type fakeAlertmanager struct {
+	sync.Mutex
+	fail  bool
+	posts [][]Alert
+}
+
+func (f *fakeAlertmanager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if req.URL.Path != "/api/v2/alerts" || f.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	var alerts []Alert
+	json.Unmarshal(body, &alerts)
+	f.posts = append(f.posts, alerts)
+}
+
+// last returns the alerts most recently received.
+func (f *fakeAlertmanager) last(t *testing.T) []Alert {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.posts) == 0 {
+		t.Fatalf("No alerts were received")
+	}
+	return f.posts[len(f.posts)-1]
+}
+
+// setup points the bridge at a fake Alertmanager, and a fresh redis.
+func setup(t *testing.T) (*fakeAlertmanager, *miniredis.Miniredis) {
+	am := &fakeAlertmanager{}
+	server := httptest.NewServer(am)
+	t.Cleanup(server.Close)
+
+	m := miniredis.RunT(t)
+	r = redis.NewClient(&redis.Options{Addr: m.Addr()})
+
+	name := "OverseerTestFailed"
+	empty := ""
+	interval := time.Minute
+	amURLs = []string{server.URL}
+	alertName = &name
+	basicAuth = &empty
+	resend = &interval
+
+	return am, m
+}
+
+// result returns a test-result.
+func result(passed bool) bridge.Result {
+	res := bridge.FromFields(map[string]string{
+		"id":       "0123456789abcdef",
+		"input":    "http://example.com/ must run http",
+		"result":   "failed",
+		"error":    "status code was 500 not 200",
+		"type":     "http",
+		"target":   "1.2.3.4",
+		"tag":      "dc1",
+		"severity": "critical",
+	})
+	if passed {
+		res = bridge.FromFields(map[string]string{
+			"id":     "0123456789abcdef",
+			"input":  "http://example.com/ must run http",
+			"result": "passed",
+			"type":   "http",
+			"target": "1.2.3.4",
+		})
+	}
+	return res
+}
+
+// Test that a failure raises an alert, and a pass resolves it, even if
+// the bridge was restarted in between.
+func TestRaiseResolve(t *testing.T) {
+	am, m := setup(t)
+
+	err := process(result(false))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	raised := am.last(t)
+	if len(raised) != 1 {
+		t.Fatalf("Expected one alert, got %d", len(raised))
+	}
+	labels := raised[0].Labels
+	if labels["alertname"] != "OverseerTestFailed" || labels["test_id"] != "0123456789abcdef" || labels["target"] != "1.2.3.4" || labels["tag"] != "dc1" || labels["severity"] != "critical" {
+		t.Errorf("Wrong labels: %v", labels)
+	}
+	if raised[0].Annotations["error"] != "status code was 500 not 200" {
+		t.Errorf("Wrong annotations: %v", raised[0].Annotations)
+	}
+	if !raised[0].EndsAt.After(time.Now()) {
+		t.Errorf("The alert has already ended: %v", raised[0].EndsAt)
+	}
+
+	//
+	// The alert is recorded in redis, rather than our memory.
+	//
+	if m.HGet(ActiveKey, "0123456789abcdef/1.2.3.4") == "" {
+		t.Fatalf("The alert wasn't recorded as active")
+	}
+
+	//
+	// Restart, by reconnecting to redis, then the test passes.
+	//
+	r = redis.NewClient(&redis.Options{Addr: m.Addr()})
+
+	err = process(result(true))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	resolved := am.last(t)
+	if len(am.posts) != 2 || len(resolved) != 1 {
+		t.Fatalf("Expected the alert to be resolved, got %v", am.posts)
+	}
+	if !resolved[0].StartsAt.Equal(raised[0].StartsAt) {
+		t.Errorf("The alert started at %v, not %v", resolved[0].StartsAt, raised[0].StartsAt)
+	}
+	if resolved[0].EndsAt.After(time.Now()) {
+		t.Errorf("The alert hasn't ended: %v", resolved[0].EndsAt)
+	}
+	if m.Exists(ActiveKey) {
+		t.Errorf("The alert is still active")
+	}
+
+	//
+	// Further passes are ignored.
+	//
+	err = process(result(true))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(am.posts) != 2 {
+		t.Errorf("Expected no further alerts, got %v", am.posts)
+	}
+}
+
+// Test that an alert stays active if it can't be resolved, so that the
+// result will be retried.
+func TestResolveFailure(t *testing.T) {
+	am, m := setup(t)
+
+	err := process(result(false))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	am.Lock()
+	am.fail = true
+	am.Unlock()
+
+	err = process(result(true))
+	if err == nil || bridge.IsPermanent(err) {
+		t.Fatalf("Expected a temporary error, got %v", err)
+	}
+	if m.HGet(ActiveKey, "0123456789abcdef/1.2.3.4") == "" {
+		t.Fatalf("The alert is no longer active")
+	}
+
+	//
+	// Once Alertmanager recovers the retry resolves it.
+	//
+	am.Lock()
+	am.fail = false
+	am.Unlock()
+
+	err = process(result(true))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if resolved := am.last(t); len(am.posts) != 2 || resolved[0].EndsAt.After(time.Now()) {
+		t.Errorf("Expected the alert to be resolved, got %v", am.posts)
+	}
+	if m.Exists(ActiveKey) {
+		t.Errorf("The alert is still active")
+	}
+}
+
+// Test that active alerts are refreshed, including those raised before a
+// restart.
+func TestRefresh(t *testing.T) {
+	am, m := setup(t)
+
+	err := process(result(false))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	raised := am.last(t)
+
+	//
+	// Restart, and refresh.
+	//
+	r = redis.NewClient(&redis.Options{Addr: m.Addr()})
+	time.Sleep(10 * time.Millisecond)
+	refresh()
+
+	refreshed := am.last(t)
+	if len(am.posts) != 2 || len(refreshed) != 1 {
+		t.Fatalf("Expected the alert to be refreshed, got %v", am.posts)
+	}
+	if refreshed[0].Labels["test_id"] != "0123456789abcdef" {
+		t.Errorf("Wrong alert refreshed: %v", refreshed[0])
+	}
+	if !refreshed[0].EndsAt.After(raised[0].EndsAt) {
+		t.Errorf("The alert wasn't extended: %v, then %v", raised[0].EndsAt, refreshed[0].EndsAt)
+	}
+
+	//
+	// Once resolved there's nothing to refresh.
+	//
+	err = process(result(true))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	refresh()
+	if len(am.posts) != 3 {
+		t.Errorf("Expected only the resolution, got %v", am.posts)
+	}
+}
+
+// Test that we succeed if any Alertmanager accepts the alerts.
+func TestCluster(t *testing.T) {
+	am, _ := setup(t)
+
+	broken := &fakeAlertmanager{fail: true}
+	server := httptest.NewServer(broken)
+	defer server.Close()
+
+	amURLs = append([]string{server.URL}, amURLs...)
+
+	err := send([]Alert{{Labels: map[string]string{"alertname": "test"}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(am.posts) != 1 {
+		t.Errorf("Expected the working Alertmanager to receive the alert")
+	}
+
+	am.fail = true
+	err = send([]Alert{{Labels: map[string]string{"alertname": "test"}}})
+	if err == nil {
+		t.Errorf("Expected an error when every Alertmanager fails")
+	}
+}
@@ -7,7 +7,18 @@
 //
 //     $ ./email-bridge -email=sysadmin@example.com
 //
-// When a test fails an email will sent, by executing /usr/sbin/sendmail.
+// When a test fails an email will sent, by executing /usr/sbin/sendmail,
+// or via SMTP if an SMTP server is given:
+//
+//     $ ./email-bridge -email=sysadmin@example.com \
+//         -smtp-host=smtp.example.com:587 -smtp-user=overseer -smtp-pass=secret
+//
+// When the test passes again a recovery email is sent.
+//
+// In digest mode the failures, and recoveries, are collected over a period
+// of time and sent as a single email, grouped by host:
+//
+//     $ ./email-bridge -email=sysadmin@example.com -digest=15m
 //
 // Steve
 // --
@@ -17,27 +28,78 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/sha1"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
-	"os/exec"
+	"sort"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/skx/overseer/bridge"
+	"github.com/skx/overseer/logger"
 )
 
-// The email we notify
+// FailingKey is the name of the redis set which contains the IDs of the
+// tests we've reported as failing, so that we know to send a recovery
+// email when they pass.
+const FailingKey = "overseer.email.failing"
+
+// The email we notify, and the addresses it is split into.
 var email *string
+var recipients []string
+
+// The address we send from
+var from *string
+
+// The path to sendmail
+var sendmailPath *string
+
+// The SMTP server, and how we talk to it
+var smtpHost *string
+var smtpTLS *string
+var smtpUser *string
+var smtpPass *string
+var smtpInsecure *bool
+
+// Should we send recovery emails?
+var recovery *bool
 
 // The redis handle
-var r *redis.Client
+var r redis.UniversalClient
+
+// Our logger
+var log *logger.Logger
+
+// The templates we use for single notifications, and digests.
+var tmpl *template.Template
+var digestTmpl *template.Template
+
+// The results waiting to be sent in the next digest, keyed by the ID of
+// the test, and the mutex which protects them.
+var pending = make(map[string]Result)
+var mutex sync.Mutex
 
 // Template is our text/template which is used to generate the email
 // notification to the user.
 var Template = `From: {{.From}}
 To: {{.To}}
+Date: {{.Date}}
+{{if .Recovered -}}
+Subject: The {{.Type}} test recovered against {{.Target}}
+
+The {{.Type}} test against {{.Target}} is passing again.
+
+The complete test was:
+
+   {{.Input}}
+{{else -}}
 Subject: The {{.Type}} test failed against {{.Target}}
 
 The {{.Type}} test failed against {{.Target}}.
@@ -49,107 +111,236 @@ The complete test was:
 The failure was:
 
    {{.Failure}}
-
+{{end}}
 `
 
-//
-// Given a JSON string decode it and post it via email if it describes
-// a test-failure.
-//
-func process(msg []byte) {
-	data := map[string]string{}
+// DigestTemplate is our text/template which is used to generate a digest
+// of the failures, and recoveries, grouped by host.
+var DigestTemplate = `From: {{.From}}
+To: {{.To}}
+Date: {{.Date}}
+Subject: Overseer: {{.Failures}} failing, {{.Recoveries}} recovered
+
+{{.Failures}} test(s) failed, and {{.Recoveries}} recovered, in the {{.Window}} before {{.Date}}.
+{{range .Hosts}}
+{{.Host}}
+{{range .Results}}  {{if .Recovered}}RECOVERED{{else}}FAILED   {{end}} {{.Input}}
+{{- if not .Recovered}}
+            {{.Failure}}{{end}}
+{{end}}{{end}}`
+
+// Result is a single test-result, as given to the templates.
+type Result struct {
+	To        string
+	From      string
+	Date      string
+	Host      string
+	Target    string
+	Type      string
+	Input     string
+	Failure   string
+	Recovered bool
+	Time      time.Time
+}
+
+// HostResults holds the results for a single host, in a digest.
+type HostResults struct {
+	Host    string
+	Results []Result
+}
 
-	if err := json.Unmarshal(msg, &data); err != nil {
-		panic(err)
+// Digest is given to the digest template.
+type Digest struct {
+	To         string
+	From       string
+	Date       string
+	Window     time.Duration
+	Failures   int
+	Recoveries int
+	Hosts      []HostResults
+}
+
+// hostname returns the host a test was run against, as it was written
+// in the test, rather than the address it resolved to.
+func hostname(input string, target string) string {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return target
+	}
+	u, err := url.Parse(fields[0])
+	if err == nil && u.Hostname() != "" {
+		return u.Hostname()
 	}
+	return fields[0]
+}
 
-	//
-	// If the test passed then we don't care.
-	//
-	result := data["error"]
-	if result == "" {
-		return
+// loadTemplate parses the template in the given file, or the default
+// if no file is given.
+func loadTemplate(path string, def string) (*template.Template, error) {
+	src := def
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		src = string(data)
 	}
+	return template.New("email").Parse(src)
+}
+
+//
+// Email a test-result if it describes a test failure, or the recovery
+// of a test which was failing.
+//
+func process(res bridge.Result) error {
 
 	//
-	// Here is a temporary structure we'll use to popular our email
-	// template.
+	// We need a stable ID for each test - get one by hashing the
+	// complete input-line and the target we executed against.
 	//
-	type TemplateParms struct {
-		To      string
-		From    string
-		Target  string
-		Type    string
-		Input   string
-		Failure string
-	}
+	hasher := sha1.New()
+	hasher.Write([]byte(res.Target))
+	hasher.Write([]byte(res.Input))
+	id := hex.EncodeToString(hasher.Sum(nil))
 
 	//
-	// Populate it appropriately.
+	// If the test passed then we only care if it was failing.
 	//
-	var x TemplateParms
-	x.To = *email
-	x.From = *email
-	x.Type = data["type"]
-	x.Target = data["target"]
-	x.Input = data["input"]
-	x.Failure = result
+	if !res.Failed() {
+		if !*recovery {
+			return nil
+		}
+		failing, err := r.SIsMember(FailingKey, id).Result()
+		if err != nil || !failing {
+			return err
+		}
+	}
 
 	//
-	// Render our template into a buffer.
+	// Populate our result appropriately.
 	//
-	src := string(Template)
-	t := template.Must(template.New("tmpl").Parse(src))
-	buf := &bytes.Buffer{}
-	err := t.Execute(buf, x)
-	if err != nil {
-		fmt.Printf("Failed to compile email-template %s\n", err.Error())
-		return
+	var x Result
+	x.To = strings.Join(recipients, ", ")
+	x.From = *from
+	x.Date = time.Now().Format(time.RFC1123Z)
+	x.Type = res.Type
+	x.Target = res.Target
+	x.Host = hostname(res.Input, res.Target)
+	x.Input = res.Input
+	x.Failure = res.Error
+	x.Recovered = !res.Failed()
+	x.Time = res.Time
+	if x.Time.IsZero() {
+		x.Time = time.Now()
 	}
 
+	tlog := log.With(logger.FieldType, x.Type, logger.FieldTarget, x.Target)
+
 	//
-	// Prepare to run sendmail, with a pipe we can write our message to.
+	// In digest mode we save the result for later, replacing any
+	// earlier result of the same test.
 	//
-	sendmail := exec.Command("/usr/sbin/sendmail", "-f", *email, *email)
-	stdin, err := sendmail.StdinPipe()
-	if err != nil {
-		fmt.Printf("Error sending email: %s\n", err.Error())
-		return
+	if digestTmpl != nil {
+		mutex.Lock()
+		pending[id] = x
+		mutex.Unlock()
+	} else {
+
+		//
+		// Render our template into a buffer.
+		//
+		buf := &bytes.Buffer{}
+		err := tmpl.Execute(buf, x)
+		if err != nil {
+			return bridge.Permanent(fmt.Errorf("failed to render email-template: %s", err.Error()))
+		}
+
+		err = deliver(buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("error sending email: %s", err.Error())
+		}
+
+		tlog.Info("Sent email", "to", x.To, "recovered", x.Recovered)
 	}
 
 	//
-	// Get the output pipe.
+	// Record the state of the test, so we know whether to send a
+	// recovery email later.
 	//
-	stdout, err := sendmail.StdoutPipe()
-	if err != nil {
-		fmt.Printf("Error sending email: %s\n", err.Error())
+	if !*recovery {
+		return nil
+	}
+	if x.Recovered {
+		return r.SRem(FailingKey, id).Err()
+	}
+	return r.SAdd(FailingKey, id).Err()
+}
+
+//
+// Send a digest of the results we've collected, grouped by host.
+//
+func sendDigest(window time.Duration) {
+
+	mutex.Lock()
+	results := pending
+	pending = make(map[string]Result)
+	mutex.Unlock()
+
+	if len(results) == 0 {
 		return
 	}
 
-	//
-	// Run the command, and pipe in the rendered template-result
-	//
-	sendmail.Start()
-	_, err = stdin.Write(buf.Bytes())
-	if err != nil {
-		fmt.Printf("Failed to write to sendmail pipe: %s\n", err.Error())
+	d := Digest{
+		To:     strings.Join(recipients, ", "),
+		From:   *from,
+		Date:   time.Now().Format(time.RFC1123Z),
+		Window: window,
+	}
+
+	hosts := make(map[string][]Result)
+	for _, x := range results {
+		if x.Recovered {
+			d.Recoveries++
+		} else {
+			d.Failures++
+		}
+		hosts[x.Host] = append(hosts[x.Host], x)
+	}
+	for host, res := range hosts {
+		sort.Slice(res, func(i, j int) bool {
+			if res[i].Recovered != res[j].Recovered {
+				return !res[i].Recovered
+			}
+			return res[i].Input < res[j].Input
+		})
+		d.Hosts = append(d.Hosts, HostResults{Host: host, Results: res})
+	}
+	sort.Slice(d.Hosts, func(i, j int) bool { return d.Hosts[i].Host < d.Hosts[j].Host })
+
+	buf := &bytes.Buffer{}
+	err := digestTmpl.Execute(buf, d)
+	if err == nil {
+		err = deliver(buf.Bytes())
 	}
-	stdin.Close()
 
 	//
-	// Read the output of Sendmail.
+	// If we failed then we'll try again next time, unless there
+	// are newer results for the same tests.
 	//
-	_, err = ioutil.ReadAll(stdout)
 	if err != nil {
-		fmt.Printf("Error reading mail output: %s\n", err.Error())
+		log.Error("Error sending digest", logger.FieldError, err)
+
+		mutex.Lock()
+		for id, x := range results {
+			if _, ok := pending[id]; !ok {
+				pending[id] = x
+			}
+		}
+		mutex.Unlock()
 		return
 	}
 
-	err = sendmail.Wait()
-
-	if err != nil {
-		fmt.Printf("Waiting for process to terminate failed: %s\n", err.Error())
-	}
+	log.Info("Sent digest", "to", d.To, "failures", d.Failures, "recoveries", d.Recoveries)
 }
 
 //
@@ -158,55 +349,97 @@ func process(msg []byte) {
 func main() {
 
 	//
-	// Parse our flags
+	// Create our bridge, which registers the common flags, and then
+	// add our own.
 	//
-	redisHost := flag.String("redis-host", "127.0.0.1:6379", "Specify the address of the redis queue.")
-	redisPass := flag.String("redis-pass", "", "Specify the password of the redis queue.")
-	email = flag.String("email", "", "The email address to notify")
-	flag.Parse()
+	b, err := bridge.New("email")
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	email = flag.String("email", "", "The email address to notify, or a comma-separated list of them")
+	from = flag.String("from", "", "The address to send email from, by default the first address we notify")
+	sendmailPath = flag.String("sendmail", "/usr/sbin/sendmail", "The sendmail binary to use, if no SMTP server is given")
+	smtpHost = flag.String("smtp-host", "", "The host:port of the SMTP server to send email via")
+	smtpTLS = flag.String("smtp-tls", TLSAuto, "Use STARTTLS if available ('auto'), always ('starttls'), connect via TLS ('implicit'), or never ('none')")
+	smtpUser = flag.String("smtp-user", "", "The username to authenticate to the SMTP server with")
+	smtpPass = flag.String("smtp-pass", "", "The password to authenticate to the SMTP server with")
+	smtpInsecure = flag.Bool("smtp-insecure", false, "Don't verify the certificate of the SMTP server")
+	tmplFile := flag.String("template", "", "The file containing the text/template used to generate each email")
+	digestFile := flag.String("digest-template", "", "The file containing the text/template used to generate digests")
+	digest := flag.Duration("digest", 0, "Collect results over this period, and send them as a single digest")
+	recovery = flag.Bool("recovery", true, "Send an email when a failing test passes again")
+
+	//
+	// Parse our flags, using the configuration file for defaults,
+	// and connect to redis.
+	//
+	err = b.Parse()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	log = b.Log
+	r = b.Redis
 
 	//
 	// Sanity-check.
 	//
-	if *email == "" {
+	for _, addr := range strings.Split(*email, ",") {
+		if strings.TrimSpace(addr) != "" {
+			recipients = append(recipients, strings.TrimSpace(addr))
+		}
+	}
+	if len(recipients) == 0 {
 		fmt.Printf("Usage: email-bridge -email=sysadmin@example.com [-redis-host=127.0.0.1:6379] [-redis-pass=foo]\n")
 		os.Exit(1)
 	}
+	if *from == "" {
+		*from = recipients[0]
+	}
+	switch *smtpTLS {
+	case TLSAuto, TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		fmt.Printf("Unknown -smtp-tls mode '%s'\n", *smtpTLS)
+		os.Exit(1)
+	}
+
+	tmpl, err = loadTemplate(*tmplFile, Template)
+	if err != nil {
+		fmt.Printf("Failed to load template: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if *digest > 0 {
+		digestTmpl, err = loadTemplate(*digestFile, DigestTemplate)
+		if err != nil {
+			fmt.Printf("Failed to load digest template: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
 
 	//
-	// Create the redis client
+	// Send our digests regularly.
 	//
-	r = redis.NewClient(&redis.Options{
-		Addr:     *redisHost,
-		Password: *redisPass,
-		DB:       0, // use default DB
-	})
+	if digestTmpl != nil {
+		b.Every(*digest, func() {
+			sendDigest(*digest)
+		})
+	}
 
 	//
-	// And run a ping, just to make sure it worked.
+	// Process results until we're stopped.
 	//
-	_, err := r.Ping().Result()
+	err = b.Run(process)
 	if err != nil {
-		fmt.Printf("Redis connection failed: %s\n", err.Error())
+		log.Error("Failed to read test-results", logger.FieldError, err)
 		os.Exit(1)
 	}
 
-	for {
-
-		//
-		// Get test-results
-		//
-		msg, _ := r.BLPop(0, "overseer.results").Result()
-
-		//
-		// If they were non-empty, process them.
-		//
-		//   msg[0] will be "overseer.results"
-		//
-		//   msg[1] will be the value removed from the list.
-		//
-		if len(msg) >= 1 {
-			process([]byte(msg[1]))
-		}
+	//
+	// Send whatever we've collected, rather than losing it.
+	//
+	if digestTmpl != nil {
+		sendDigest(*digest)
 	}
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/skx/overseer/bridge"
+)
+
+// outbox holds the messages which were delivered by our fake sendmail.
+type outbox struct {
+	dir string
+}
+
+// messages returns the messages delivered so far, in order.
+func (o outbox) messages(t *testing.T) []string {
+	files, _ := filepath.Glob(filepath.Join(o.dir, "msg.*"))
+	sort.Strings(files)
+
+	var out []string
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatalf("failed to read message: %s", err.Error())
+		}
+		out = append(out, string(data))
+	}
+	return out
+}
+
+// fail makes our fake sendmail fail, or succeed, from now on.
+func (o outbox) fail(t *testing.T, fail bool) {
+	path := filepath.Join(o.dir, "fail")
+	if !fail {
+		os.Remove(path)
+		return
+	}
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err.Error())
+	}
+}
+
+// setup points the bridge at a fake sendmail, which saves each message
+// in a file, and a fresh redis.
+func setup(t *testing.T, digest bool) (outbox, *miniredis.Miniredis) {
+	o := outbox{dir: t.TempDir()}
+
+	script := fmt.Sprintf(`#!/bin/sh
+[ -e %[1]s/fail ] && exit 1
+n=$(ls %[1]s | grep -c '^msg\.')
+cat > %[1]s/msg.$(printf %%03d $n)
+`, o.dir)
+	path := filepath.Join(o.dir, "sendmail")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write sendmail: %s", err.Error())
+	}
+
+	m := miniredis.RunT(t)
+	r = redis.NewClient(&redis.Options{Addr: m.Addr()})
+
+	sender := "overseer@example.com"
+	host := ""
+	enabled := true
+	from = &sender
+	smtpHost = &host
+	sendmailPath = &path
+	recovery = &enabled
+	recipients = []string{"ops@example.com", "dev@example.com"}
+
+	var err error
+	tmpl, err = loadTemplate("", Template)
+	if err != nil {
+		t.Fatalf("failed to load template: %s", err.Error())
+	}
+	digestTmpl = nil
+	if digest {
+		digestTmpl, err = loadTemplate("", DigestTemplate)
+		if err != nil {
+			t.Fatalf("failed to load template: %s", err.Error())
+		}
+	}
+	pending = make(map[string]Result)
+
+	return o, m
+}
+
+// result returns a test-result.
+func result(input string, target string, failure string) bridge.Result {
+	fields := map[string]string{
+		"input":  input,
+		"result": "passed",
+		"type":   strings.Fields(input)[3],
+		"target": target,
+	}
+	if failure != "" {
+		fields["result"] = "failed"
+		fields["error"] = failure
+	}
+	return bridge.FromFields(fields)
+}
+
+// Test the host a test was written against is found.
+func TestHostname(t *testing.T) {
+	tests := map[string]string{
+		"https://www.example.com:8443/path must run http": "www.example.com",
+		"mail.example.com must run smtp":                  "mail.example.com",
+		"10.0.0.1 must run ping":                          "10.0.0.1",
+		"":                                                "1.2.3.4",
+	}
+	for input, expected := range tests {
+		if out := hostname(input, "1.2.3.4"); out != expected {
+			t.Errorf("hostname(%s) gave %s, not %s", input, out, expected)
+		}
+	}
+}
+
+// Test that a failure is emailed, and then its recovery.
+func TestFailureRecovery(t *testing.T) {
+	o, m := setup(t, false)
+
+	//
+	// Passing tests which weren't failing are ignored.
+	//
+	err := process(result("mail.example.com must run smtp", "1.2.3.4", ""))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(o.messages(t)) != 0 {
+		t.Fatalf("An email was sent for a passing test")
+	}
+
+	err = process(result("mail.example.com must run smtp", "1.2.3.4", "connection refused"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	msgs := o.messages(t)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one email, got %d", len(msgs))
+	}
+	for _, expected := range []string{
+		"From: overseer@example.com\n",
+		"To: ops@example.com, dev@example.com\n",
+		"Subject: The smtp test failed against 1.2.3.4\n",
+		"\n   mail.example.com must run smtp\n",
+		"The failure was:\n\n   connection refused\n",
+	} {
+		if !strings.Contains(msgs[0], expected) {
+			t.Errorf("The email doesn't contain %q:\n%s", expected, msgs[0])
+		}
+	}
+
+	members, _ := m.Members(FailingKey)
+	if len(members) != 1 {
+		t.Fatalf("Expected the test to be failing, got %v", members)
+	}
+
+	//
+	// Now it recovers.
+	//
+	err = process(result("mail.example.com must run smtp", "1.2.3.4", ""))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	msgs = o.messages(t)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected a recovery email, got %d emails", len(msgs))
+	}
+	if !strings.Contains(msgs[1], "Subject: The smtp test recovered against 1.2.3.4\n") || strings.Contains(msgs[1], "failure") {
+		t.Errorf("Wrong recovery email:\n%s", msgs[1])
+	}
+	if m.Exists(FailingKey) {
+		t.Errorf("The test is still failing")
+	}
+
+	//
+	// The same test, against another address, is separate.
+	//
+	err = process(result("mail.example.com must run smtp", "5.6.7.8", ""))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(o.messages(t)) != 2 {
+		t.Errorf("A recovery email was sent for another address")
+	}
+}
+
+// Test that no recovery emails are sent, or state kept, if disabled.
+func TestNoRecovery(t *testing.T) {
+	o, m := setup(t, false)
+	disabled := false
+	recovery = &disabled
+
+	process(result("mail.example.com must run smtp", "1.2.3.4", "connection refused"))
+	process(result("mail.example.com must run smtp", "1.2.3.4", ""))
+
+	if len(o.messages(t)) != 1 {
+		t.Errorf("Expected only the failure to be emailed")
+	}
+	if m.Exists(FailingKey) {
+		t.Errorf("The failing tests were recorded")
+	}
+}
+
+// Test that a failure to send is retried, and doesn't record the test as
+// failing.
+func TestDeliveryFailure(t *testing.T) {
+	o, m := setup(t, false)
+	o.fail(t, true)
+
+	err := process(result("mail.example.com must run smtp", "1.2.3.4", "connection refused"))
+	if err == nil || bridge.IsPermanent(err) {
+		t.Fatalf("Expected a temporary error, got %v", err)
+	}
+	if m.Exists(FailingKey) {
+		t.Errorf("The test was recorded as failing")
+	}
+
+	o.fail(t, false)
+	err = process(result("mail.example.com must run smtp", "1.2.3.4", "connection refused"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(o.messages(t)) != 1 || !m.Exists(FailingKey) {
+		t.Errorf("The retry wasn't sent")
+	}
+}
+
+// Test that a digest groups the results by host, keeping only the latest
+// result of each test.
+func TestDigest(t *testing.T) {
+	o, m := setup(t, true)
+
+	process(result("mail.example.com must run smtp", "1.2.3.4", "connection refused"))
+	process(result("https://www.example.com/ must run http", "5.6.7.8", "status code was 500 not 200"))
+	process(result("https://www.example.com/ must run http", "5.6.7.8", "status code was 502 not 200"))
+	process(result("mail.example.com must run imap", "1.2.3.4", "timeout"))
+
+	//
+	// Nothing is sent until the digest is due.
+	//
+	if len(o.messages(t)) != 0 {
+		t.Fatalf("An email was sent before the digest")
+	}
+
+	//
+	// Recoveries replace the failures of the same tests.
+	//
+	process(result("mail.example.com must run smtp", "1.2.3.4", ""))
+	process(result("mail.example.com must run pop3", "1.2.3.4", "timeout"))
+	process(result("mail.example.com must run pop3", "1.2.3.4", ""))
+
+	sendDigest(time.Hour)
+
+	msgs := o.messages(t)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one digest, got %d emails", len(msgs))
+	}
+	digest := msgs[0]
+
+	if !strings.Contains(digest, "Subject: Overseer: 2 failing, 2 recovered\n") {
+		t.Errorf("Wrong subject:\n%s", digest)
+	}
+	body := digest[strings.Index(digest, "\n\n")+2:]
+	body = body[strings.Index(body, "\n")+1:]
+
+	expected := `
+mail.example.com
+  FAILED    mail.example.com must run imap
+            timeout
+  RECOVERED mail.example.com must run pop3
+  RECOVERED mail.example.com must run smtp
+
+www.example.com
+  FAILED    https://www.example.com/ must run http
+            status code was 502 not 200
+`
+	if body != expected {
+		t.Errorf("Wrong digest, got:\n%s\nexpected:\n%s", body, expected)
+	}
+
+	members, _ := m.Members(FailingKey)
+	if len(members) != 2 {
+		t.Errorf("Expected two failing tests, got %v", members)
+	}
+
+	//
+	// The digest has been sent, so there's nothing more to send.
+	//
+	sendDigest(time.Hour)
+	if len(o.messages(t)) != 1 {
+		t.Errorf("The digest was sent twice")
+	}
+}
+
+// Test that a digest which fails to send is retried, with any newer
+// results replacing those which failed.
+func TestDigestRetry(t *testing.T) {
+	o, _ := setup(t, true)
+
+	process(result("mail.example.com must run smtp", "1.2.3.4", "connection refused"))
+	process(result("mail.example.com must run imap", "1.2.3.4", "timeout"))
+
+	o.fail(t, true)
+	sendDigest(time.Hour)
+	if len(pending) != 2 {
+		t.Fatalf("Expected the results to be kept, got %v", pending)
+	}
+
+	process(result("mail.example.com must run imap", "1.2.3.4", "authentication failed"))
+
+	o.fail(t, false)
+	sendDigest(time.Hour)
+
+	msgs := o.messages(t)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one digest, got %d emails", len(msgs))
+	}
+	if !strings.Contains(msgs[0], "connection refused") || !strings.Contains(msgs[0], "authentication failed") || strings.Contains(msgs[0], "timeout") {
+		t.Errorf("Wrong digest:\n%s", msgs[0])
+	}
+}
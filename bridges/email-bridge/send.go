@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os/exec"
+	"time"
+)
+
+// The ways in which we may use TLS when talking to an SMTP server.
+const (
+	// TLSAuto uses STARTTLS if the server supports it.
+	TLSAuto = "auto"
+
+	// TLSStartTLS requires the use of STARTTLS.
+	TLSStartTLS = "starttls"
+
+	// TLSImplicit connects via TLS, as is usual upon port 465.
+	TLSImplicit = "implicit"
+
+	// TLSNone never uses TLS.
+	TLSNone = "none"
+)
+
+// deliver sends a message, which includes its headers, to each of our
+// recipients.
+//
+// If an SMTP server has been configured the message is sent to it,
+// otherwise it is piped to sendmail.
+func deliver(msg []byte) error {
+	if *smtpHost != "" {
+		return sendSMTP(msg)
+	}
+	return sendmail(msg)
+}
+
+// sendmail delivers a message by executing sendmail.
+func sendmail(msg []byte) error {
+
+	//
+	// Prepare to run sendmail, with a pipe we can write our message to.
+	//
+	args := append([]string{"-f", *from}, recipients...)
+	cmd := exec.Command(*sendmailPath, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("error running sendmail: %s", err.Error())
+	}
+
+	//
+	// Get the output pipe.
+	//
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error running sendmail: %s", err.Error())
+	}
+
+	//
+	// Run the command, and pipe in the message.
+	//
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("error running sendmail: %s", err.Error())
+	}
+	_, err = stdin.Write(msg)
+	if err != nil {
+		return fmt.Errorf("failed to write to sendmail pipe: %s", err.Error())
+	}
+	stdin.Close()
+
+	//
+	// Read the output of Sendmail.
+	//
+	_, err = ioutil.ReadAll(stdout)
+	if err != nil {
+		return fmt.Errorf("error reading mail output: %s", err.Error())
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("waiting for sendmail to terminate failed: %s", err.Error())
+	}
+	return nil
+}
+
+// sendSMTP delivers a message to our SMTP server.
+func sendSMTP(msg []byte) error {
+
+	host, _, err := net.SplitHostPort(*smtpHost)
+	if err != nil {
+		return err
+	}
+
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: *smtpInsecure,
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	//
+	// Connect, either via TLS or in the clear.
+	//
+	var conn net.Conn
+	if *smtpTLS == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", *smtpHost, cfg)
+	} else {
+		conn, err = dialer.Dial("tcp", *smtpHost)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	//
+	// Upgrade the connection to TLS, if we should.
+	//
+	if *smtpTLS == TLSAuto || *smtpTLS == TLSStartTLS {
+		ok, _ := c.Extension("STARTTLS")
+		if ok {
+			err = c.StartTLS(cfg)
+			if err != nil {
+				return fmt.Errorf("STARTTLS failed: %s", err.Error())
+			}
+		} else if *smtpTLS == TLSStartTLS {
+			return fmt.Errorf("the server %s does not support STARTTLS", *smtpHost)
+		}
+	}
+
+	//
+	// Authenticate, if we should.
+	//
+	// PlainAuth refuses to send our password unless the connection
+	// is encrypted, or to localhost.
+	//
+	if *smtpUser != "" {
+		err = c.Auth(smtp.PlainAuth("", *smtpUser, *smtpPass, host))
+		if err != nil {
+			return fmt.Errorf("authentication failed: %s", err.Error())
+		}
+	}
+
+	//
+	// Send the message.
+	//
+	err = c.Mail(*from)
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		err = c.Rcpt(rcpt)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,331 @@
+//
+// This is the PagerDuty bridge, which reads test-results from redis, and
+// submits them to the PagerDuty Events API (v2).
+//
+// The program should be built like so:
+//
+//     go build .
+//
+// Once built launch it like so:
+//
+//     $ ./pagerduty-bridge -routing-key=xxxx
+//
+// Here `xxxx` is the integration key of the PagerDuty service which
+// should be alerted.
+//
+// Failing tests trigger an incident, and once the test passes again the
+// incident is resolved.  Each test/target has a stable deduplication key,
+// so repeated failures update a single incident rather than raising new
+// ones.
+//
+// Steve
+// --
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/skx/overseer/bridge"
+	"github.com/skx/overseer/logger"
+	"github.com/skx/overseer/test"
+)
+
+// TriggeredKey is the name of the redis set which contains the dedup
+// keys of the incidents we've triggered, so that we only resolve those.
+const TriggeredKey = "overseer.pagerduty.triggered"
+
+// The redis handle
+var r redis.UniversalClient
+
+// Our logger
+var log *logger.Logger
+
+// The URL of the Events API
+var pdURL *string
+
+// The integration key of the service to alert
+var routingKey *string
+
+// The severity to use for tests which don't specify one
+var severity *string
+
+// How many times to attempt each event, and the initial delay between
+// attempts.
+var attempts *int
+var retryDelay *time.Duration
+
+// The HTTP client we use
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// ctx is cancelled when the bridge stops, which interrupts our requests
+// and retries.
+var ctx = context.Background()
+
+// Trigger, or resolve, the incident for a test-result.
+func process(res bridge.Result) error {
+
+	data := res.Fields
+	testType := res.Type
+	testTarget := res.Target
+	input := res.Input
+
+	tlog := log.With(logger.FieldType, testType, logger.FieldTarget, testTarget)
+
+	//
+	// We need a stable ID for each test - get one by hashing the
+	// complete input-line and the target we executed against.
+	//
+	hasher := sha1.New()
+	hasher.Write([]byte(testTarget))
+	hasher.Write([]byte(input))
+	hash := "overseer-" + hex.EncodeToString(hasher.Sum(nil))
+
+	//
+	// If the test passed we resolve the incident, but only if we
+	// triggered one.
+	//
+	if !res.Failed() {
+		triggered, err := r.SIsMember(TriggeredKey, hash).Result()
+		if err != nil {
+			return err
+		}
+		if !triggered {
+			return nil
+		}
+
+		err = send(map[string]interface{}{
+			"routing_key":  *routingKey,
+			"event_action": "resolve",
+			"dedup_key":    hash,
+		})
+		if err != nil {
+			return err
+		}
+
+		tlog.Info("Resolved incident", "dedup_key", hash)
+		return r.SRem(TriggeredKey, hash).Err()
+	}
+
+	//
+	// The test failed, so trigger an incident.
+	//
+	sev := data["severity"]
+	if sev == "" {
+		sev = *severity
+	}
+
+	summary := fmt.Sprintf("The %s test against %s failed: %s", testType, testTarget, data["error"])
+	if len(summary) > 1024 {
+		summary = summary[:1021] + "..."
+	}
+
+	details := map[string]string{
+		"input": input,
+		"error": data["error"],
+	}
+	for _, field := range []string{"id", "tag", "location"} {
+		if data[field] != "" {
+			details[field] = data[field]
+		}
+	}
+
+	payload := map[string]interface{}{
+		"summary":        summary,
+		"source":         testTarget,
+		"severity":       sev,
+		"component":      testType,
+		"custom_details": details,
+	}
+	if data["tag"] != "" {
+		payload["group"] = data["tag"]
+	}
+	if !res.Time.IsZero() {
+		payload["timestamp"] = res.Time.UTC().Format(time.RFC3339)
+	}
+
+	err := send(map[string]interface{}{
+		"routing_key":  *routingKey,
+		"event_action": "trigger",
+		"dedup_key":    hash,
+		"client":       "overseer",
+		"payload":      payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	tlog.Info("Triggered incident", "dedup_key", hash, "severity", sev)
+	return r.SAdd(TriggeredKey, hash).Err()
+}
+
+// send submits an event to the Events API, retrying with a backoff if
+// we're rate-limited, or PagerDuty has a problem.
+//
+// If we're stopped while we wait the error is temporary, so the result
+// will be processed again once we restart.
+func send(event map[string]interface{}) error {
+
+	//
+	// Export the fields to json to post.
+	//
+	jsonValue, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Posting to PagerDuty", "body", string(jsonValue))
+
+	delay := *retryDelay
+	for attempt := 1; ; attempt++ {
+
+		wait, err := post(jsonValue)
+		if err == nil {
+			return nil
+		}
+
+		if wait < 0 {
+			return bridge.Permanent(fmt.Errorf("failed to post to PagerDuty: %s", err.Error()))
+		}
+		if attempt >= *attempts {
+			return fmt.Errorf("failed to post to PagerDuty after %d attempt(s): %s", attempt, err.Error())
+		}
+
+		//
+		// Use the delay we were told to use, if any.
+		//
+		if wait == 0 {
+			wait = delay
+		}
+		log.Warn("Failed to post to PagerDuty, retrying", logger.FieldAttempt, attempt, "delay", wait, logger.FieldError, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("posting to PagerDuty was interrupted after %d attempt(s): %s", attempt, err.Error())
+		}
+
+		delay *= 2
+		if delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+}
+
+// post makes a single attempt to submit an event.
+//
+// If the attempt failed then the returned duration is negative if the
+// event should not be retried, otherwise it is the delay PagerDuty
+// asked us to wait for (which may be zero).
+func post(body []byte) (time.Duration, error) {
+
+	req, err := http.NewRequestWithContext(ctx, "POST", *pdURL, bytes.NewBuffer(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	//
+	// OK now we've submitted the post.
+	//
+	// We should retrieve the status-code + body, if the status-code
+	// is "odd" then we'll show them.
+	//
+	defer res.Body.Close()
+	response, _ := ioutil.ReadAll(res.Body)
+
+	status := res.StatusCode
+	if status >= 200 && status < 300 {
+		return 0, nil
+	}
+
+	err = fmt.Errorf("status code was %d: %s", status, bytes.TrimSpace(response))
+
+	if status == http.StatusTooManyRequests || status >= 500 {
+		secs, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+		return time.Duration(secs) * time.Second, err
+	}
+
+	//
+	// Anything else, such as a 400 for an invalid event, will fail
+	// again.
+	//
+	return -1, err
+}
+
+//
+// Entry Point
+//
+func main() {
+
+	//
+	// Create our bridge, which registers the common flags, and then
+	// add our own.
+	//
+	b, err := bridge.New("pagerduty")
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	pdURL = flag.String("url", "https://events.pagerduty.com/v2/enqueue", "The URL of the PagerDuty Events API")
+	routingKey = flag.String("routing-key", "", "The integration key of the PagerDuty service")
+	severity = flag.String("severity", test.SeverityError, "The severity of failures of tests which don't specify one")
+	attempts = flag.Int("attempts", 5, "The number of times to attempt each event")
+	retryDelay = flag.Duration("retry-delay", time.Second, "The delay before the first retry, which doubles for each subsequent one")
+
+	//
+	// Parse our flags, using the configuration file for defaults,
+	// and connect to redis.
+	//
+	err = b.Parse()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	log = b.Log
+	r = b.Redis
+	ctx = b.Context()
+
+	//
+	// Sanity-check
+	//
+	if *routingKey == "" {
+		fmt.Printf("Usage: pagerduty-bridge -routing-key=xxxx [-redis-host=127.0.0.1:6379] [-redis-pass=secret]\n")
+		os.Exit(1)
+	}
+	if !test.ValidSeverity(*severity) {
+		fmt.Printf("Invalid severity '%s'\n", *severity)
+		os.Exit(1)
+	}
+	if *attempts < 1 {
+		fmt.Printf("The number of attempts must be at least one\n")
+		os.Exit(1)
+	}
+
+	//
+	// Process results until we're stopped.
+	//
+	err = b.Run(process)
+	if err != nil {
+		log.Error("Failed to read test-results", logger.FieldError, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/skx/overseer/bridge"
+)
+
+// fakeAPI is a fake Events API, which returns the given status-codes in
+// turn, and records the events it receives.
+type fakeAPI struct {
+	statuses []int
+	events   []map[string]interface{}
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	var event map[string]interface{}
+	json.Unmarshal(body, &event)
+	f.events = append(f.events, event)
+
+	status := http.StatusAccepted
+	if len(f.events) <= len(f.statuses) {
+		status = f.statuses[len(f.events)-1]
+	}
+	w.WriteHeader(status)
+}
+
+// setup points the bridge at the fake API.
+func setup(t *testing.T, statuses ...int) (*fakeAPI, func()) {
+	api := &fakeAPI{statuses: statuses}
+	server := httptest.NewServer(api)
+
+	url := server.URL
+	count := 3
+	delay := time.Millisecond
+	pdURL = &url
+	attempts = &count
+	retryDelay = &delay
+
+	return api, server.Close
+}
+
+// Test that events are posted.
+func TestSend(t *testing.T) {
+	api, done := setup(t)
+	defer done()
+
+	err := send(map[string]interface{}{"event_action": "resolve", "dedup_key": "overseer-1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(api.events) != 1 || api.events[0]["dedup_key"] != "overseer-1" {
+		t.Errorf("Wrong events received: %v", api.events)
+	}
+}
+
+// Test that rate-limits, and server errors, are retried.
+func TestRetry(t *testing.T) {
+	api, done := setup(t, http.StatusTooManyRequests, http.StatusBadGateway)
+	defer done()
+
+	err := send(map[string]interface{}{"event_action": "trigger"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(api.events) != 3 {
+		t.Errorf("Expected three attempts, got %d", len(api.events))
+	}
+}
+
+// Test that we give up, eventually.
+func TestRetryExhausted(t *testing.T) {
+	api, done := setup(t, 500, 500, 500, 500)
+	defer done()
+
+	err := send(map[string]interface{}{"event_action": "trigger"})
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if len(api.events) != 3 {
+		t.Errorf("Expected three attempts, got %d", len(api.events))
+	}
+}
+
+// Test that we stop retrying when the bridge is stopped, and that the
+// result may be retried later.
+func TestRetryStopped(t *testing.T) {
+	api, done := setup(t, 500, 500, 500, 500)
+	defer done()
+
+	delay := time.Hour
+	retryDelay = &delay
+
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(context.Background())
+	defer func() { ctx = context.Background() }()
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := send(map[string]interface{}{"event_action": "trigger"})
+	if err == nil || bridge.IsPermanent(err) {
+		t.Fatalf("Expected a temporary error, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("The retry wasn't interrupted")
+	}
+	if len(api.events) != 1 {
+		t.Errorf("Expected a single attempt, got %d", len(api.events))
+	}
+}
+
+// Test that invalid events are not retried.
+func TestNoRetry(t *testing.T) {
+	api, done := setup(t, http.StatusBadRequest)
+	defer done()
+
+	err := send(map[string]interface{}{"event_action": "bogus"})
+	if !bridge.IsPermanent(err) {
+		t.Fatalf("Expected a permanent error, got %v", err)
+	}
+	if len(api.events) != 1 {
+		t.Errorf("Expected a single attempt, got %d", len(api.events))
+	}
+}
@@ -32,9 +32,10 @@ import (
 	"sync"
 	"time"
 
-	"github.com/go-redis/redis"
 	"github.com/robfig/cron"
 	_ "github.com/skx/golang-metrics"
+	"github.com/skx/overseer/bridge"
+	"github.com/skx/overseer/logger"
 )
 
 // Avoid threading issues with our last update-time
@@ -46,29 +47,25 @@ var update int64
 // Should we be verbose?
 var verbose *bool
 
-// The redis handle
-var r *redis.Client
+// Our logger
+var log *logger.Logger
 
 // The URL of the purppura server
 var pURL *string
 
-// Given a JSON string decode it and post to the Purppura URL.
-func process(msg []byte) {
+// Post a test-result to the Purppura URL.
+func process(res bridge.Result) error {
 
 	// Update our last received time
 	mutex.Lock()
 	update = time.Now().Unix()
 	mutex.Unlock()
 
-	data := map[string]string{}
+	testType := res.Type
+	testTarget := res.Target
+	input := res.Input
 
-	if err := json.Unmarshal(msg, &data); err != nil {
-		panic(err)
-	}
-
-	testType := data["type"]
-	testTarget := data["target"]
-	input := data["input"]
+	tlog := log.With(logger.FieldType, testType, logger.FieldTarget, testTarget)
 
 	//
 	// We need a stable ID for each test - get one by hashing the
@@ -92,10 +89,10 @@ func process(msg []byte) {
 	//
 	// If the test failed we'll update the detail and trigger a raise
 	//
-	if data["error"] != "" {
+	if res.Failed() {
 		values["detail"] =
 			fmt.Sprintf("<p>The <code>%s</code> test against <code>%s</code> failed:</p><p><pre>%s</pre></p>",
-				testType, testTarget, data["error"])
+				testType, testTarget, res.Error)
 		values["raise"] = "now"
 	}
 
@@ -104,27 +101,23 @@ func process(msg []byte) {
 	//
 	jsonValue, err := json.Marshal(values)
 	if err != nil {
-		fmt.Printf("process: Failed to encode JSON:%s\n", err.Error())
-		os.Exit(1)
+		return bridge.Permanent(err)
 	}
 
 	//
-	// If we're being verbose show what we're going to POST
+	// Show what we're going to POST, if we're being verbose.
 	//
-	if *verbose {
-		fmt.Printf("%s\n", jsonValue)
-	}
+	tlog.Debug("Posting to purppura", "body", string(jsonValue))
 
 	//
 	// Post to purppura
 	//
-	res, err := http.Post(*pURL,
+	response, err := http.Post(*pURL,
 		"application/json",
 		bytes.NewBuffer(jsonValue))
 
 	if err != nil {
-		fmt.Printf("process: Failed to post to purppura:%s\n", err.Error())
-		os.Exit(1)
+		return fmt.Errorf("failed to post to purppura: %s", err.Error())
 	}
 
 	//
@@ -133,18 +126,18 @@ func process(msg []byte) {
 	// We should retrieve the status-code + body, if the status-code
 	// is "odd" then we'll show them.
 	//
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		fmt.Printf("process: Error reading response to post: %s\n", err.Error())
-		return
+		tlog.Error("process: Error reading response to post", logger.FieldError, err)
+		return nil
 	}
-	status := res.StatusCode
+	status := response.StatusCode
 
 	if status != 200 {
-		fmt.Printf("process: Error - Status code was not 200: %d\n", status)
-		fmt.Printf("process: Response - %s\n", body)
+		tlog.Error("process: Status code was not 200", "status", status, "response", string(body))
 	}
+	return nil
 }
 
 // CheckUpdates triggers an alert if we've not received anything recently
@@ -180,7 +173,7 @@ func CheckUpdates() {
 	//
 	jsonValue, err := json.Marshal(values)
 	if err != nil {
-		fmt.Printf("Failed to export to JSON - %s\n", err.Error())
+		log.Error("CheckUpdates: Failed to export to JSON", logger.FieldError, err)
 		os.Exit(1)
 	}
 
@@ -192,7 +185,7 @@ func CheckUpdates() {
 		bytes.NewBuffer(jsonValue))
 
 	if err != nil {
-		fmt.Printf("CheckUpdates: Failed to post purppura-bridge to purppura:%s\n", err.Error())
+		log.Error("CheckUpdates: Failed to post purppura-bridge to purppura", logger.FieldError, err)
 		os.Exit(1)
 	}
 
@@ -205,14 +198,13 @@ func CheckUpdates() {
 	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		fmt.Printf("CheckUpdates: Error reading response to post: %s\n", err.Error())
+		log.Error("CheckUpdates: Error reading response to post", logger.FieldError, err)
 		return
 	}
 	status := res.StatusCode
 
 	if status != 200 {
-		fmt.Printf("CheckUpdates: Error - Status code was not 200: %d\n", status)
-		fmt.Printf("CheckUpdates: Response - %s\n", body)
+		log.Error("CheckUpdates: Status code was not 200", "status", status, "response", string(body))
 	}
 }
 
@@ -245,7 +237,7 @@ func SendHeartbeat() {
 		bytes.NewBuffer(jsonValue))
 
 	if err != nil {
-		fmt.Printf("SendHeartbeat: Failed to post heartbeat to purppura:%s\n", err.Error())
+		log.Error("SendHeartbeat: Failed to post heartbeat to purppura", logger.FieldError, err)
 		os.Exit(1)
 	}
 
@@ -258,14 +250,13 @@ func SendHeartbeat() {
 	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		fmt.Printf("SendHeartbeat: Error reading response to post: %s\n", err.Error())
+		log.Error("SendHeartbeat: Error reading response to post", logger.FieldError, err)
 		return
 	}
 	status := res.StatusCode
 
 	if status != 200 {
-		fmt.Printf("SendHeartbeat: Error - Status code was not 200: %d\n", status)
-		fmt.Printf("SendHeartbeat: Response - %s\n", body)
+		log.Error("SendHeartbeat: Status code was not 200", "status", status, "response", string(body))
 	}
 
 }
@@ -276,39 +267,39 @@ func SendHeartbeat() {
 func main() {
 
 	//
-	// Parse our flags
+	// Create our bridge, which registers the common flags, and then
+	// add our own.
 	//
-	redisHost := flag.String("redis-host", "127.0.0.1:6379", "Specify the address of the redis queue.")
-	redisPass := flag.String("redis-pass", "", "Specify the password of the redis queue.")
+	b, err := bridge.New("purppura")
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
 	pURL = flag.String("purppura", "", "The purppura-server URL")
-	verbose = flag.Bool("verbose", false, "Be verbose?")
-	flag.Parse()
+	verbose = flag.Bool("verbose", false, "Be verbose, the same as -log-level=debug?")
 
 	//
-	// Sanity-check
+	// Parse our flags, using the configuration file for defaults,
+	// and connect to redis.
 	//
-	if *pURL == "" {
-		fmt.Printf("Usage: purppura-bridge -purppura=https://alert.steve.fi/events [-redis-host=127.0.0.1:6379] [-redis-pass=secret]\n")
+	err = b.Parse()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
 		os.Exit(1)
-
+	}
+	log = b.Log
+	if *verbose {
+		log.SetLevel(logger.LevelDebug)
 	}
 
 	//
-	// Create the redis client
-	//
-	r = redis.NewClient(&redis.Options{
-		Addr:     *redisHost,
-		Password: *redisPass,
-		DB:       0, // use default DB
-	})
-
-	//
-	// And run a ping, just to make sure it worked.
+	// Sanity-check
 	//
-	_, err := r.Ping().Result()
-	if err != nil {
-		fmt.Printf("Redis connection failed: %s\n", err.Error())
+	if *pURL == "" {
+		fmt.Printf("Usage: purppura-bridge -purppura=https://alert.steve.fi/events [-redis-host=127.0.0.1:6379] [-redis-pass=secret]\n")
 		os.Exit(1)
+
 	}
 
 	c := cron.New()
@@ -317,24 +308,14 @@ func main() {
 	// Make sure we raise an alert if we don't have recent results.
 	c.AddFunc("@every 5m", func() { CheckUpdates() })
 	c.Start()
+	defer c.Stop()
 
-	for {
-
-		//
-		// Get test-results
-		//
-		msg, _ := r.BLPop(0, "overseer.results").Result()
-
-		//
-		// If they were non-empty, process them.
-		//
-		//   msg[0] will be "overseer.results"
-		//
-		//   msg[1] will be the value removed from the list.
-		//
-		if len(msg) >= 1 {
-			process([]byte(msg[1]))
-		}
-
+	//
+	// Process results until we're stopped.
+	//
+	err = b.Run(process)
+	if err != nil {
+		log.Error("Failed to read test-results", logger.FieldError, err)
+		os.Exit(1)
 	}
 }
@@ -11,7 +11,18 @@
 //     $ ./telegram-bridge -token=xxxx -recipient=YYY
 //
 // Here `xxxx` is the token for the telegram bot API, and YYY is the UID
-// of the user to message.
+// of the user to message, or the ID of a group chat.
+//
+// When a test fails a message is sent, and another once it recovers.
+// Results may be routed to different chats by the tag of the worker:
+//
+//     $ ./telegram-bridge -token=xxxx -recipient=YYY -route=dc1=ZZZ
+//
+// The bot also answers commands:
+//
+//     /status               - Show the failing tests.
+//     /silence <test> 1h    - Don't notify about a test for an hour.
+//     /ack <test>           - Stop reminders about a failing test.
 //
 // Steve
 // --
@@ -20,87 +31,182 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
+	"html"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/go-redis/redis"
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/skx/overseer/bridge"
+	"github.com/skx/overseer/logger"
+	"github.com/skx/overseer/test"
 )
 
-// The redis handle
-var r *redis.Client
+// Our logger
+var log *logger.Logger
 
-// The telegram bot token
-var token *string
+// The chats we notify by default, and those we notify for results with
+// particular tags.
+var recipients []int64
+var routes = routeList{}
 
-// The recipient of the message
-var recipient *string
+// The state of each test, and the messages waiting to be sent.
+var state *tracker
+var box *outbox
 
-// Given a JSON message decode it and post to telegram if it describes a
-// failure.
-func process(msg []byte) error {
+// MaxError, and MaxInput, are the lengths to which the reason for a
+// failure, and the test, are truncated once escaped.  This leaves room
+// for the rest of a message, so that it never exceeds MaxMessage.
+const (
+	MaxError = 1024
+	MaxInput = 1024
+)
 
-	data := map[string]string{}
+// routeList holds the values of the repeatable -route flag, which maps a
+// tag to the chats which should be notified of results with that tag.
+type routeList map[string][]int64
 
-	if err := json.Unmarshal(msg, &data); err != nil {
-		return err
+// String returns the routes, as required by flag.Value.
+func (r routeList) String() string {
+	var out []string
+	for tag, chats := range r {
+		var ids []string
+		for _, chat := range chats {
+			ids = append(ids, strconv.FormatInt(chat, 10))
+		}
+		out = append(out, tag+"="+strings.Join(ids, ","))
 	}
+	return strings.Join(out, " ")
+}
 
-	// If the test passed we don't care
-	if data["error"] == "" {
-		return nil
+// Set adds routes, each of the form "tag=chat,chat", separated by spaces.
+func (r routeList) Set(value string) error {
+	for _, route := range strings.Fields(value) {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("route '%s' is not of the form 'tag=chat,chat'", route)
+		}
+		chats, err := parseChats(parts[1])
+		if err != nil {
+			return err
+		}
+		r[parts[0]] = append(r[parts[0]], chats...)
 	}
+	return nil
+}
 
-	testType := data["type"]
-	testTarget := data["target"]
-	input := data["input"]
+// parseChats parses a comma-separated list of chat IDs.
+func parseChats(value string) ([]int64, error) {
+	var chats []int64
+	for _, id := range strings.Split(value, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat ID '%s'", id)
+		}
+		chats = append(chats, n)
+	}
+	return chats, nil
+}
 
-	// Make the target a link, if it looks like one.
-	if strings.HasPrefix(testTarget, "http") {
-		testTarget = fmt.Sprintf("<a href=\"%s\">%s</a>", testTarget, testTarget)
+// chats returns the chats which should be notified of results with the
+// given tag.
+func chats(tag string) []int64 {
+	if c, ok := routes[tag]; ok {
+		return c
 	}
+	return recipients
+}
 
-	// The message we send to the user.
-	text := fmt.Sprintf("The <code>%s</code> test failed against %s.\n\n%s\n\nThe test was:\n<code>%s</code>", testType, testTarget, data["error"], input)
+// routed returns true if results with the given tag are sent to the chat.
+func routed(tag string, chat int64) bool {
+	for _, c := range chats(tag) {
+		if c == chat {
+			return true
+		}
+	}
+	return false
+}
 
-	//
-	// Create the bot
-	//
-	bot, err := tgbotapi.NewBotAPI(*token)
-	if err != nil {
-		return fmt.Errorf("error creating telegram bot with token '%s': %s", *token, err.Error())
+// known returns true if we send results to the chat.
+func known(chat int64) bool {
+	for _, c := range recipients {
+		if c == chat {
+			return true
+		}
+	}
+	for _, list := range routes {
+		for _, c := range list {
+			if c == chat {
+				return true
+			}
+		}
 	}
+	return false
+}
+
+// escape escapes text for inclusion in a message.
+func escape(text string) string {
+	return html.EscapeString(text)
+}
+
+// Queue a message to each chat which should see a test-result, if it
+// describes a new failure, a failure we should remind people of, or a
+// recovery.
+//
+// The result has been dealt with once the message has been queued, as
+// the queue is stored in redis until the message is sent.
+func process(res bridge.Result) error {
 
 	//
-	// Convert the recipient string to a number.
+	// Results from older workers don't contain the ID of the test.
 	//
-	n := 0
-	n, err = strconv.Atoi(*recipient)
-	if err != nil {
-		return fmt.Errorf("error converting user to notify %s to integer: %s", *recipient, err.Error())
+	id := res.ID
+	if id == "" {
+		tmp := test.Test{Input: res.Input}
+		id = tmp.ID()
 	}
 
-	//
-	// Create the message.
-	//
-	message := tgbotapi.NewMessage(int64(n), text)
-	message.ParseMode = tgbotapi.ModeHTML
+	now := time.Now()
+	tlog := log.With(logger.FieldTestID, id, logger.FieldType, res.Type, logger.FieldTarget, res.Target)
 
-	//
-	// Send the message.
-	//
-	_, err = bot.Send(message)
-	if err != nil {
-		return fmt.Errorf("error sending message to user %s", err.Error())
+	var text string
+	if res.Failed() {
+		notify, f, err := state.failed(res, id, now)
+		if err != nil || !notify {
+			return err
+		}
+
+		if !f.Reminder {
+			text = fmt.Sprintf("The <code>%s</code> test failed against %s.\n\n%s\n\nThe test was:\n<code>%s</code>\nID: <code>%s</code>",
+				escape(f.Type), escape(f.Target), clip(f.Error, MaxError), clip(f.Input, MaxInput), id)
+		} else {
+			text = fmt.Sprintf("The <code>%s</code> test is still failing against %s, after %s.\n\n%s\n\nThe test was:\n<code>%s</code>\nID: <code>%s</code>",
+				escape(f.Type), escape(f.Target), now.Sub(f.Since).Round(time.Second), clip(f.Error, MaxError), clip(f.Input, MaxInput), id)
+		}
+		tlog.Info("Notifying of failure")
+	} else {
+		recovered, f, err := state.passed(id, res.Target)
+		if err != nil || !recovered {
+			return err
+		}
+
+		text = fmt.Sprintf("The <code>%s</code> test recovered against %s, after failing for %s.\n\nThe test was:\n<code>%s</code>",
+			escape(f.Type), escape(f.Target), now.Sub(f.Since).Round(time.Second), clip(f.Input, MaxInput))
+		tlog.Info("Notifying of recovery")
 	}
 
-	//
-	// All done
-	//
+	for _, chat := range chats(res.Tag) {
+		err := box.add(chat, text)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -110,61 +216,92 @@ func process(msg []byte) error {
 func main() {
 
 	//
-	// Parse our flags
+	// Create our bridge, which registers the common flags, and then
+	// add our own.
+	//
+	b, err := bridge.New("telegram")
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	token := flag.String("token", "", "The telegram bot token")
+	recipient := flag.String("recipient", "", "The telegram user, or chat, to notify - or a comma-separated list of them")
+	flag.Var(routes, "route", "Notify these chats of results with the given tag, as 'tag=chat,chat', may be repeated")
+	repeat := flag.Duration("repeat", time.Hour, "Remind the chats of tests which are still failing this often, zero to disable")
+	rateLimit := flag.Duration("rate-limit", 3*time.Second, "The minimum interval between messages to each chat, messages in the meantime are combined")
+	commands := flag.Bool("commands", true, "Answer commands sent to the bot")
+	api := flag.String("api-url", DefaultAPI, "The URL of the Bot API")
+
+	//
+	// Parse our flags, using the configuration file for defaults,
+	// and connect to redis.
 	//
-	redisHost := flag.String("redis-host", "127.0.0.1:6379", "Specify the address of the redis queue.")
-	redisPass := flag.String("redis-pass", "", "Specify the password of the redis queue.")
-	token = flag.String("token", "", "The telegram bot token")
-	recipient = flag.String("recipient", "", "The telegram user to notify")
-	flag.Parse()
+	err = b.Parse()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	log = b.Log
 
 	//
 	// Sanity-check
 	//
-	if *recipient == "" || *token == "" {
+	recipients, err = parseChats(*recipient)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	if len(recipients) == 0 || *token == "" {
 		fmt.Printf("Please set the telegram recipient and token.\n")
 		os.Exit(1)
 
 	}
 
 	//
-	// Create the redis client
+	// Load the state of the tests.
 	//
-	r = redis.NewClient(&redis.Options{
-		Addr:     *redisHost,
-		Password: *redisPass,
-		DB:       0, // use default DB
-	})
+	state, err = newTracker(b.Redis, *repeat)
+	if err != nil {
+		log.Error("Failed to load the state of the tests", logger.FieldError, err)
+		os.Exit(1)
+	}
 
 	//
-	// And run a ping, just to make sure it worked.
+	// Create the bot.
 	//
-	_, err := r.Ping().Result()
+	bot, err := newBot(*token, *api)
 	if err != nil {
-		fmt.Printf("Redis connection failed: %s\n", err.Error())
+		log.Error("Error creating telegram bot", logger.FieldError, err)
 		os.Exit(1)
 	}
 
-	for {
-
-		//
-		// Get test-results
-		//
-		msg, _ := r.BLPop(0, "overseer.results").Result()
-
-		//
-		// If they were non-empty, process them.
-		//
-		//   msg[0] will be "overseer.results"
-		//
-		//   msg[1] will be the value removed from the list.
-		//
-		if len(msg) >= 1 {
-			err := process([]byte(msg[1]))
-			if err != nil {
-				fmt.Printf("error notifying user: %s\n", err.Error())
-				return
-			}
-		}
+	//
+	// Send our messages, and answer commands.
+	//
+	box, err = newOutbox(b.Redis, bot, *rateLimit)
+	if err != nil {
+		log.Error("Failed to load the messages waiting to be sent", logger.FieldError, err)
+		os.Exit(1)
+	}
+	b.Every(time.Second, func() {
+		box.flush(time.Now())
+	})
+	if *commands {
+		go listen(bot, b.Context().Done())
+	}
+
+	//
+	// Process results until we're stopped.
+	//
+	err = b.Run(process)
+	if err != nil {
+		log.Error("Failed to read test-results", logger.FieldError, err)
+		os.Exit(1)
 	}
+
+	//
+	// Send anything which is waiting, rather than losing it.
+	//
+	box.flush(time.Now().Add(*rateLimit))
 }
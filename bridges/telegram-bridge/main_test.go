@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/skx/overseer/bridge"
+)
+
+// sent is a message sent to the fake Bot API.
+type sent struct {
+	Chat int64
+	Text string
+}
+
+// fakeAPI is a fake Bot API, which records the messages it is sent and
+// returns the given updates.
+type fakeAPI struct {
+	sync.Mutex
+
+	messages []sent
+	updates  []map[string]interface{}
+
+	// retryAfter, if set, rejects the next message.
+	retryAfter int
+
+	// reject rejects messages, and broken fails to answer.
+	reject bool
+	broken bool
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	req.ParseForm()
+
+	var result interface{}
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/getMe"):
+		result = map[string]interface{}{"id": 1, "is_bot": true, "first_name": "overseer", "username": "overseer_bot"}
+
+	case strings.HasSuffix(req.URL.Path, "/sendMessage"):
+		if f.broken {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if f.reject {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"ok":          false,
+				"error_code":  400,
+				"description": "Bad Request: can't parse entities",
+			})
+			return
+		}
+		if f.retryAfter > 0 {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"ok":          false,
+				"error_code":  429,
+				"description": "Too Many Requests",
+				"parameters":  map[string]interface{}{"retry_after": f.retryAfter},
+			})
+			f.retryAfter = 0
+			return
+		}
+		chat, _ := strconv.ParseInt(req.Form.Get("chat_id"), 10, 64)
+		f.messages = append(f.messages, sent{Chat: chat, Text: req.Form.Get("text")})
+		result = map[string]interface{}{"message_id": len(f.messages), "date": 0, "chat": map[string]interface{}{"id": chat}}
+
+	case strings.HasSuffix(req.URL.Path, "/getUpdates"):
+		result = f.updates
+		f.updates = nil
+
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+// take returns the messages which have been sent, and forgets them.
+func (f *fakeAPI) take() []sent {
+	f.Lock()
+	defer f.Unlock()
+
+	out := f.messages
+	f.messages = nil
+	return out
+}
+
+// setup creates a bridge which notifies chat 100 by default, and chat 200
+// of results tagged "dc1", via the fake API.
+func setup(t *testing.T) (*fakeAPI, func()) {
+	api := &fakeAPI{}
+	server := httptest.NewServer(api)
+
+	bot, err := newBot("token", server.URL)
+	if err != nil {
+		t.Fatalf("Failed to create bot: %s", err.Error())
+	}
+
+	recipients = []int64{100}
+	routes = routeList{}
+	routes.Set("dc1=200")
+	state, _ = newTracker(nil, time.Hour)
+	box, _ = newOutbox(nil, bot, time.Minute)
+
+	return api, server.Close
+}
+
+// failed returns a failing result.
+func failed(id string, tag string) bridge.Result {
+	return bridge.Result{ID: id, Type: "http", Target: "10.0.0.1", Input: "http://example.com/ must run http", Result: "failed", Error: "<500>", Tag: tag}
+}
+
+// passed returns a passing result.
+func passed(id string, tag string) bridge.Result {
+	res := failed(id, tag)
+	res.Result = "passed"
+	res.Error = ""
+	return res
+}
+
+// Test that routes are parsed.
+func TestRoutes(t *testing.T) {
+	_, done := setup(t)
+	defer done()
+
+	err := routes.Set("dc2=300,301 dc3=-1001")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if c := chats("dc2"); len(c) != 2 || c[0] != 300 || c[1] != 301 {
+		t.Errorf("Wrong chats for dc2: %v", c)
+	}
+	if c := chats("dc3"); len(c) != 1 || c[0] != -1001 {
+		t.Errorf("Wrong chats for dc3: %v", c)
+	}
+	if c := chats("other"); len(c) != 1 || c[0] != 100 {
+		t.Errorf("Wrong chats for other tags: %v", c)
+	}
+	if !known(301) || known(999) {
+		t.Errorf("Wrong known chats")
+	}
+
+	for _, bad := range []string{"dc1", "=100", "dc1=abc"} {
+		if routes.Set(bad) == nil {
+			t.Errorf("Expected an error for '%s'", bad)
+		}
+	}
+}
+
+// Test that failures, and recoveries, are sent to the right chats, and
+// that repeated failures aren't.
+func TestRecovery(t *testing.T) {
+	api, done := setup(t)
+	defer done()
+
+	now := time.Now()
+
+	process(failed("aaaa", ""))
+	process(failed("aaaa", ""))
+	process(failed("bbbb", "dc1"))
+	box.flush(now)
+
+	msgs := api.take()
+	if len(msgs) != 2 {
+		t.Fatalf("Expected two messages, got %v", msgs)
+	}
+	for _, m := range msgs {
+		if m.Chat == 100 && !strings.Contains(m.Text, "aaaa") {
+			t.Errorf("Wrong message for chat 100: %s", m.Text)
+		}
+		if m.Chat == 200 && !strings.Contains(m.Text, "bbbb") {
+			t.Errorf("Wrong message for chat 200: %s", m.Text)
+		}
+		if !strings.Contains(m.Text, "&lt;500&gt;") {
+			t.Errorf("The error wasn't escaped: %s", m.Text)
+		}
+	}
+
+	process(passed("aaaa", ""))
+	process(passed("cccc", ""))
+	box.flush(now.Add(time.Minute))
+
+	msgs = api.take()
+	if len(msgs) != 1 || msgs[0].Chat != 100 || !strings.Contains(msgs[0].Text, "recovered") {
+		t.Errorf("Expected a recovery, got %v", msgs)
+	}
+}
+
+// Test that bursts are combined, and that messages are rate-limited.
+func TestRateLimit(t *testing.T) {
+	api, done := setup(t)
+	defer done()
+
+	now := time.Now()
+
+	box.add(100, "one")
+	box.add(100, "two")
+	box.flush(now)
+	box.add(100, "three")
+	box.flush(now.Add(time.Second))
+
+	msgs := api.take()
+	if len(msgs) != 1 || msgs[0].Text != "one\n\ntwo" {
+		t.Fatalf("Expected a combined message, got %v", msgs)
+	}
+
+	box.flush(now.Add(time.Minute))
+	msgs = api.take()
+	if len(msgs) != 1 || msgs[0].Text != "three" {
+		t.Fatalf("Expected the third message, got %v", msgs)
+	}
+
+	//
+	// If we're told to slow down then we do.
+	//
+	api.retryAfter = 120
+	box.add(100, "four")
+	box.flush(now.Add(2 * time.Minute))
+	box.flush(now.Add(3 * time.Minute))
+	if msgs = api.take(); len(msgs) != 0 {
+		t.Fatalf("Expected no messages, got %v", msgs)
+	}
+	box.flush(now.Add(4 * time.Minute))
+	if msgs = api.take(); len(msgs) != 1 || msgs[0].Text != "four" {
+		t.Fatalf("Expected the fourth message, got %v", msgs)
+	}
+}
+
+// Test that long messages are split.
+func TestCombine(t *testing.T) {
+	long := strings.Repeat("x", 3000)
+
+	text, n := combine([]string{long, long, "short"})
+	if n != 1 || text != long {
+		t.Errorf("Expected a single message, got %d", n)
+	}
+
+	text, n = combine([]string{"one", "two", strings.Repeat("x", MaxMessage), "three"})
+	if n != 2 || text != "one\n\ntwo" {
+		t.Errorf("Expected two messages, got %d", n)
+	}
+}
+
+// Test that text is truncated between characters, before it is escaped.
+func TestClip(t *testing.T) {
+	tests := []struct {
+		text     string
+		max      int
+		expected string
+	}{
+		{"<500>", 20, "&lt;500&gt;"},
+		{"<500>", 10, "&lt;500..."},
+		{"a&b", 7, "a&amp;b"},
+		{"a&b", 6, "a..."},
+		{"éééé", 8, "éééé"},
+		{"éééé", 7, "éé..."},
+		{"éééé", 6, "é..."},
+	}
+
+	for _, tc := range tests {
+		res := clip(tc.text, tc.max)
+		if res != tc.expected || len(res) > tc.max {
+			t.Errorf("clip(%q, %d) was %q, not %q", tc.text, tc.max, res, tc.expected)
+		}
+	}
+
+	//
+	// A long failure still results in a message which fits.
+	//
+	api, done := setup(t)
+	defer done()
+
+	res := failed("aaaa", "")
+	res.Error = strings.Repeat("<é>", 3000)
+	res.Input = strings.Repeat("\"", 3000)
+	process(res)
+	box.flush(time.Now())
+
+	msgs := api.take()
+	if len(msgs) != 1 || len(msgs[0].Text) > MaxMessage || !strings.Contains(msgs[0].Text, "&lt;é&gt;...") {
+		t.Errorf("Expected a truncated message, got %v", msgs)
+	}
+}
+
+// Test that the status of many failing tests fits in a message.
+func TestStatusLong(t *testing.T) {
+	_, done := setup(t)
+	defer done()
+
+	for i := 0; i < 500; i++ {
+		process(failed(fmt.Sprintf("%016d", i), ""))
+	}
+
+	text := status(100, time.Now())
+	if len(text) > MaxMessage || !strings.HasPrefix(text, "500 failing:\n") || !strings.HasSuffix(text, " more.") {
+		t.Errorf("Unexpected status of %d bytes: %s", len(text), text)
+	}
+}
+
+// Test that messages which are rejected, or which we fail to send too
+// often, are dropped rather than blocking the chat.
+func TestDropped(t *testing.T) {
+	api, done := setup(t)
+	defer done()
+
+	now := time.Now()
+
+	api.reject = true
+	box.add(100, "<b>rejected")
+	box.flush(now)
+	api.reject = false
+	box.add(100, "next")
+	box.flush(now.Add(time.Minute))
+
+	if msgs := api.take(); len(msgs) != 1 || msgs[0].Text != "next" {
+		t.Fatalf("Expected the next message, got %v", msgs)
+	}
+
+	//
+	// Other failures are retried, for a while.
+	//
+	api.broken = true
+	box.add(100, "broken")
+	for i := 1; i < MaxAttempts; i++ {
+		box.flush(now.Add(time.Duration(i+1) * time.Minute))
+		if len(box.chats[100].pending) != 1 {
+			t.Fatalf("The message was dropped after %d attempt(s)", i)
+		}
+	}
+	box.flush(now.Add(time.Hour))
+	if len(box.chats[100].pending) != 0 {
+		t.Fatalf("The message wasn't dropped")
+	}
+
+	api.broken = false
+	box.add(100, "fixed")
+	box.flush(now.Add(2 * time.Hour))
+	if msgs := api.take(); len(msgs) != 1 || msgs[0].Text != "fixed" {
+		t.Fatalf("Expected the last message, got %v", msgs)
+	}
+}
+
+// Test that the messages waiting to be sent survive a restart.
+func TestOutboxRestart(t *testing.T) {
+	api, done := setup(t)
+	defer done()
+
+	m := miniredis.RunT(t)
+	r := redis.NewClient(&redis.Options{Addr: m.Addr()})
+
+	var err error
+	box, err = newOutbox(r, box.bot, time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err = box.add(100, "one"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	box.add(200, "two")
+
+	//
+	// Restart, without sending them.
+	//
+	box, err = newOutbox(r, box.bot, time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	box.flush(time.Now())
+
+	msgs := api.take()
+	if len(msgs) != 2 {
+		t.Fatalf("Expected two messages, got %v", msgs)
+	}
+	if m.Exists(OutboxKey) {
+		t.Errorf("The messages weren't removed once they were sent")
+	}
+}
+
+// Test the bot commands.
+func TestCommands(t *testing.T) {
+	_, done := setup(t)
+	defer done()
+
+	now := time.Now()
+
+	if reply := command(100, "status", "", now); reply != "No tests are failing." {
+		t.Errorf("Unexpected status: %s", reply)
+	}
+
+	process(failed("aaaa1111aaaa1111", ""))
+	process(failed("bbbb2222bbbb2222", "dc1"))
+
+	//
+	// Each chat sees the tests routed to it.
+	//
+	reply := command(100, "status", "", now)
+	if !strings.Contains(reply, "aaaa1111aaaa1111") || strings.Contains(reply, "bbbb") {
+		t.Errorf("Unexpected status: %s", reply)
+	}
+	reply = command(200, "status", "", now)
+	if !strings.Contains(reply, "bbbb2222bbbb2222") || strings.Contains(reply, "aaaa") {
+		t.Errorf("Unexpected status: %s", reply)
+	}
+
+	//
+	// Unknown chats are ignored.
+	//
+	if reply = command(999, "status", "", now); reply != "" {
+		t.Errorf("Expected no reply, got %s", reply)
+	}
+
+	//
+	// Silence a test, by a prefix of its ID.
+	//
+	reply = command(100, "silence", "aaaa 2h", now)
+	if !strings.HasPrefix(reply, "Silenced") {
+		t.Fatalf("Failed to silence: %s", reply)
+	}
+	if _, ok := state.silencedUntil("aaaa1111aaaa1111", now.Add(time.Hour)); !ok {
+		t.Errorf("Expected the test to be silenced")
+	}
+	if _, ok := state.silencedUntil("aaaa1111aaaa1111", now.Add(3*time.Hour)); ok {
+		t.Errorf("Expected the silence to have expired")
+	}
+	if reply = command(100, "status", "", now); !strings.Contains(reply, "silenced until") {
+		t.Errorf("Unexpected status: %s", reply)
+	}
+	if reply = command(100, "unsilence", "aaaa", now); !strings.HasPrefix(reply, "Removed") {
+		t.Errorf("Failed to unsilence: %s", reply)
+	}
+
+	//
+	// Acknowledge a test.
+	//
+	if reply = command(100, "ack", "bbbb", now); !strings.HasPrefix(reply, "Acknowledged") {
+		t.Errorf("Failed to acknowledge: %s", reply)
+	}
+	if reply = command(200, "status", "", now); !strings.Contains(reply, "acknowledged") {
+		t.Errorf("Unexpected status: %s", reply)
+	}
+
+	//
+	// Errors.
+	//
+	for _, args := range []string{"", "zzzz", "aaaa 1x"} {
+		reply = command(100, "silence", args, now)
+		if strings.HasPrefix(reply, "Silenced") {
+			t.Errorf("Expected an error silencing '%s'", args)
+		}
+	}
+	if reply = command(100, "bogus", "", now); !strings.HasPrefix(reply, "Unknown") {
+		t.Errorf("Unexpected reply: %s", reply)
+	}
+}
+
+// Test that silenced, and acknowledged, tests don't notify.
+func TestSilence(t *testing.T) {
+	_, done := setup(t)
+	defer done()
+
+	now := time.Now()
+	state.repeat = time.Minute
+
+	state.silence("aaaa1111aaaa1111", now.Add(time.Hour))
+	if notify, _, _ := state.failed(failed("aaaa1111aaaa1111", ""), "aaaa1111aaaa1111", now); notify {
+		t.Errorf("Expected a silenced test not to notify")
+	}
+	if notify, _, _ := state.failed(failed("aaaa1111aaaa1111", ""), "aaaa1111aaaa1111", now.Add(2*time.Hour)); !notify {
+		t.Errorf("Expected the test to notify once the silence expired")
+	}
+
+	//
+	// Reminders are sent, until the test is acknowledged.
+	//
+	notify, f, _ := state.failed(failed("aaaa1111aaaa1111", ""), "aaaa1111aaaa1111", now.Add(3*time.Hour))
+	if !notify || !f.Reminder {
+		t.Errorf("Expected a reminder")
+	}
+	state.ack("aaaa1111aaaa1111")
+	if notify, _, _ := state.failed(failed("aaaa1111aaaa1111", ""), "aaaa1111aaaa1111", now.Add(4*time.Hour)); notify {
+		t.Errorf("Expected an acknowledged test not to notify")
+	}
+}
+
+// Test that commands are read from the Bot API.
+func TestListen(t *testing.T) {
+	api, done := setup(t)
+	defer done()
+
+	api.updates = []map[string]interface{}{
+		{"update_id": 1, "message": map[string]interface{}{
+			"message_id": 1,
+			"date":       0,
+			"chat":       map[string]interface{}{"id": 100},
+			"text":       "/status",
+			"entities":   []map[string]interface{}{{"type": "bot_command", "offset": 0, "length": 7}},
+		}},
+	}
+
+	stop := make(chan struct{})
+	go listen(box.bot, stop)
+
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		box.Lock()
+		n := len(box.chats)
+		box.Unlock()
+		if n > 0 {
+			break
+		}
+	}
+	close(stop)
+
+	box.flush(time.Now())
+	msgs := api.take()
+	if len(msgs) != 1 || msgs[0].Chat != 100 || msgs[0].Text != "No tests are failing." {
+		t.Errorf("Expected a reply, got %v", msgs)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/skx/overseer/bridge"
+)
+
+// FailingKey is the name of the redis hash which contains the tests which
+// are failing, so that we can report their recovery.
+const FailingKey = "overseer.telegram.failing"
+
+// SilencedKey is the name of the redis hash which contains the IDs of the
+// tests which have been silenced, and when the silence ends.
+const SilencedKey = "overseer.telegram.silenced"
+
+// failure describes a test which is failing against a single target.
+type failure struct {
+	ID     string
+	Type   string
+	Target string
+	Input  string
+	Error  string
+	Tag    string
+
+	// Since is when the test started failing.
+	Since time.Time
+
+	// Notified is when we last told somebody about the failure, which
+	// is zero if we haven't.
+	Notified time.Time
+
+	// Acked is true if somebody has acknowledged the failure, in which
+	// case we don't send reminders.
+	Acked bool
+
+	// Reminder is true if we're notifying somebody of a failure they've
+	// already been told about.
+	Reminder bool `json:"-"`
+}
+
+// tracker records the tests which are failing, and those which have been
+// silenced.
+//
+// The state is stored in redis, if we have a connection, so that it
+// survives restarts.
+type tracker struct {
+	sync.Mutex
+
+	r redis.UniversalClient
+
+	// repeat is how often to remind people of a failure, zero to
+	// only tell them once.
+	repeat time.Duration
+
+	// failing is keyed by the ID and target of the test.
+	failing map[string]*failure
+
+	// silenced is keyed by the ID of the test.
+	silenced map[string]time.Time
+}
+
+// newTracker creates a tracker, loading its state from redis if given a
+// connection.
+func newTracker(r redis.UniversalClient, repeat time.Duration) (*tracker, error) {
+	t := &tracker{
+		r:        r,
+		repeat:   repeat,
+		failing:  make(map[string]*failure),
+		silenced: make(map[string]time.Time),
+	}
+	if r == nil {
+		return t, nil
+	}
+
+	failing, err := r.HGetAll(FailingKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range failing {
+		var f failure
+		if json.Unmarshal([]byte(val), &f) == nil {
+			t.failing[key] = &f
+		}
+	}
+
+	silenced, err := r.HGetAll(SilencedKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	for id, val := range silenced {
+		secs, _ := strconv.ParseInt(val, 10, 64)
+		t.silenced[id] = time.Unix(secs, 0)
+	}
+	return t, nil
+}
+
+// save stores the state of a failing test.
+func (t *tracker) save(key string, f *failure) error {
+	if t.r == nil {
+		return nil
+	}
+	j, _ := json.Marshal(f)
+	return t.r.HSet(FailingKey, key, j).Err()
+}
+
+// isSilenced returns true if the test is silenced.
+func (t *tracker) isSilenced(id string, now time.Time) bool {
+	until, ok := t.silenced[id]
+	return ok && now.Before(until)
+}
+
+// failed records the failure of a test, and returns true if somebody
+// should be told about it.
+func (t *tracker) failed(res bridge.Result, id string, now time.Time) (bool, failure, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	key := id + "/" + res.Target
+	f, ok := t.failing[key]
+	if !ok {
+		f = &failure{ID: id, Target: res.Target, Since: now}
+		if !res.Time.IsZero() {
+			f.Since = res.Time
+		}
+		t.failing[key] = f
+	}
+	f.Type = res.Type
+	f.Input = res.Input
+	f.Error = res.Error
+	f.Tag = res.Tag
+
+	//
+	// We notify about new failures, and remind people of old ones,
+	// unless they've been silenced.
+	//
+	notify := false
+	if !t.isSilenced(id, now) {
+		if f.Notified.IsZero() {
+			notify = true
+		} else if t.repeat > 0 && !f.Acked && now.Sub(f.Notified) >= t.repeat {
+			notify = true
+		}
+	}
+
+	out := *f
+	if notify {
+		out.Reminder = !f.Notified.IsZero()
+		f.Notified = now
+		out.Notified = now
+	}
+	return notify, out, t.save(key, f)
+}
+
+// passed records that a test passed, and returns true if it was failing
+// and somebody was told about it.
+func (t *tracker) passed(id string, target string) (bool, failure, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	key := id + "/" + target
+	f, ok := t.failing[key]
+	if !ok {
+		return false, failure{}, nil
+	}
+	delete(t.failing, key)
+
+	var err error
+	if t.r != nil {
+		err = t.r.HDel(FailingKey, key).Err()
+	}
+	return !f.Notified.IsZero(), *f, err
+}
+
+// list returns the failing tests, oldest first.
+func (t *tracker) list() []failure {
+	t.Lock()
+	defer t.Unlock()
+
+	var out []failure
+	for _, f := range t.failing {
+		out = append(out, *f)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Since.Equal(out[j].Since) {
+			return out[i].Since.Before(out[j].Since)
+		}
+		return out[i].ID+out[i].Target < out[j].ID+out[j].Target
+	})
+	return out
+}
+
+// silencedUntil returns the time at which the silence of a test ends, if
+// it is silenced.
+func (t *tracker) silencedUntil(id string, now time.Time) (time.Time, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	if !t.isSilenced(id, now) {
+		return time.Time{}, false
+	}
+	return t.silenced[id], true
+}
+
+// find returns the ID of the failing test which the given ID, or prefix
+// of an ID, identifies.
+//
+// A complete ID is accepted even if the test isn't failing, so that it
+// may be silenced in advance.
+func (t *tracker) find(prefix string) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	if prefix == "" {
+		return "", fmt.Errorf("no test was given")
+	}
+
+	ids := make(map[string]bool)
+	for _, f := range t.failing {
+		if strings.HasPrefix(f.ID, prefix) {
+			ids[f.ID] = true
+		}
+	}
+
+	switch {
+	case len(ids) == 1:
+		for id := range ids {
+			return id, nil
+		}
+	case len(ids) > 1:
+		return "", fmt.Errorf("'%s' matches %d tests", prefix, len(ids))
+	case len(prefix) == 16:
+		return prefix, nil
+	}
+	return "", fmt.Errorf("no failing test matches '%s'", prefix)
+}
+
+// silence silences a test until the given time, or removes the silence
+// if the time is zero.
+func (t *tracker) silence(id string, until time.Time) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if until.IsZero() {
+		delete(t.silenced, id)
+		if t.r != nil {
+			return t.r.HDel(SilencedKey, id).Err()
+		}
+		return nil
+	}
+
+	t.silenced[id] = until
+	if t.r != nil {
+		return t.r.HSet(SilencedKey, id, until.Unix()).Err()
+	}
+	return nil
+}
+
+// ack acknowledges the failure of a test, against each target.
+func (t *tracker) ack(id string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	for key, f := range t.failing {
+		if f.ID != id {
+			continue
+		}
+		f.Acked = true
+		err := t.save(key, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
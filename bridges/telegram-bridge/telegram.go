@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/skx/overseer/logger"
+)
+
+// DefaultAPI is the URL of the Bot API.
+const DefaultAPI = "https://api.telegram.org"
+
+// MaxMessage is the maximum length of a message.
+const MaxMessage = 4096
+
+// endpoint sends each request to a different Bot API server, such as
+// a local fake, as the library doesn't allow the URL to be changed.
+type endpoint struct {
+	base *url.URL
+	next http.RoundTripper
+}
+
+// RoundTrip sends a request to our server.
+func (e endpoint) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := new(http.Request)
+	*out = *req
+
+	u := *req.URL
+	u.Scheme = e.base.Scheme
+	u.Host = e.base.Host
+	u.Path = strings.TrimSuffix(e.base.Path, "/") + req.URL.Path
+	out.URL = &u
+	out.Host = e.base.Host
+
+	return e.next.RoundTrip(out)
+}
+
+// newBot connects to the Bot API at the given URL.
+func newBot(token string, api string) (*tgbotapi.BotAPI, error) {
+
+	//
+	// Requests for updates wait for up to thirty seconds.
+	//
+	client := &http.Client{Timeout: time.Minute}
+
+	if api != DefaultAPI {
+		base, err := url.Parse(api)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = endpoint{base: base, next: http.DefaultTransport}
+	}
+	return tgbotapi.NewBotAPIWithClient(token, client)
+}
+
+// OutboxKey is the name of the redis hash which contains the messages
+// waiting to be sent to each chat, so that they survive restarts.
+const OutboxKey = "overseer.telegram.outbox"
+
+// MaxAttempts is how many times we attempt to send a message, if we fail
+// for a reason other than being rate-limited, before we give up on it.
+const MaxAttempts = 5
+
+// chatQueue holds the messages waiting to be sent to a chat.
+type chatQueue struct {
+	pending  []string
+	next     time.Time
+	attempts int
+}
+
+// outbox sends messages to each chat, no more often than the given
+// interval.  Messages which arrive in the meantime are combined, so that a
+// burst of failures results in a single message.
+//
+// The messages are stored in redis, if we have a connection, until they
+// have been sent.
+type outbox struct {
+	sync.Mutex
+
+	r        redis.UniversalClient
+	bot      *tgbotapi.BotAPI
+	interval time.Duration
+	chats    map[int64]*chatQueue
+}
+
+// newOutbox creates an outbox, sending messages via the given bot, and
+// loading those which were waiting from redis if given a connection.
+func newOutbox(r redis.UniversalClient, bot *tgbotapi.BotAPI, interval time.Duration) (*outbox, error) {
+	o := &outbox{
+		r:        r,
+		bot:      bot,
+		interval: interval,
+		chats:    make(map[int64]*chatQueue),
+	}
+	if r == nil {
+		return o, nil
+	}
+
+	waiting, err := r.HGetAll(OutboxKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range waiting {
+		chat, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		var pending []string
+		if json.Unmarshal([]byte(val), &pending) == nil && len(pending) > 0 {
+			o.chats[chat] = &chatQueue{pending: pending}
+		}
+	}
+	return o, nil
+}
+
+// save stores the messages waiting to be sent to a chat.
+func (o *outbox) save(chat int64, q *chatQueue) error {
+	if o.r == nil {
+		return nil
+	}
+	key := strconv.FormatInt(chat, 10)
+	if len(q.pending) == 0 {
+		return o.r.HDel(OutboxKey, key).Err()
+	}
+	j, _ := json.Marshal(q.pending)
+	return o.r.HSet(OutboxKey, key, j).Err()
+}
+
+// add queues a message to be sent to a chat.
+func (o *outbox) add(chat int64, text string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	q, ok := o.chats[chat]
+	if !ok {
+		q = &chatQueue{}
+		o.chats[chat] = q
+	}
+	q.pending = append(q.pending, text)
+	return o.save(chat, q)
+}
+
+// flush sends the messages for each chat which is due one.
+//
+// Messages which Telegram rejects, other than because we're being
+// rate-limited, or which we've failed to send too often, are dropped so
+// that they don't prevent later messages from being sent.
+func (o *outbox) flush(now time.Time) {
+	o.Lock()
+	defer o.Unlock()
+
+	for chat, q := range o.chats {
+		if len(q.pending) == 0 || now.Before(q.next) {
+			continue
+		}
+
+		text, n := combine(q.pending)
+
+		message := tgbotapi.NewMessage(chat, text)
+		message.ParseMode = tgbotapi.ModeHTML
+		message.DisableWebPagePreview = true
+
+		q.next = now.Add(o.interval)
+
+		_, err := o.bot.Send(message)
+		if err != nil {
+			q.attempts++
+
+			//
+			// If we're being rate-limited then wait as long as
+			// we've been told to, and try again.
+			//
+			e, rejected := err.(tgbotapi.Error)
+			if rejected && e.RetryAfter > 0 {
+				wait := time.Duration(e.RetryAfter) * time.Second
+				if wait > o.interval {
+					q.next = now.Add(wait)
+				}
+				q.attempts = 0
+				rejected = false
+			}
+
+			if !rejected && q.attempts < MaxAttempts {
+				log.Warn("Failed to send message", "chat", chat, "messages", n, "retry", q.next.Sub(now), logger.FieldError, err)
+				continue
+			}
+			log.Error("Failed to send message, dropping it", "chat", chat, "messages", n, logger.FieldAttempt, q.attempts, logger.FieldError, err)
+		} else {
+			log.Debug("Sent message", "chat", chat, "messages", n)
+		}
+
+		q.pending = q.pending[n:]
+		q.attempts = 0
+		err = o.save(chat, q)
+		if err != nil {
+			log.Error("Failed to update the outbox", "chat", chat, logger.FieldError, err)
+		}
+	}
+}
+
+// combine joins as many of the messages as will fit into one, returning
+// the result and the number of messages it contains.
+//
+// Each message is built to fit by itself, as a message containing markup
+// can't safely be truncated.
+func combine(messages []string) (string, int) {
+
+	text := messages[0]
+
+	n := 1
+	for _, msg := range messages[1:] {
+		if len(text)+2+len(msg) > MaxMessage {
+			break
+		}
+		text += "\n\n" + msg
+		n++
+	}
+	return text, n
+}
+
+// clip escapes text for inclusion in a message, truncating it so that the
+// result is no longer than max bytes.
+//
+// The text is truncated between characters, before it is escaped, so that
+// neither a character nor an entity is split.
+func clip(text string, max int) string {
+	res := escape(text)
+	if len(res) <= max {
+		return res
+	}
+
+	res = ""
+	for _, r := range text {
+		e := escape(string(r))
+		if len(res)+len(e)+3 > max {
+			break
+		}
+		res += e
+	}
+	return res + "..."
+}
+
+// listen answers the commands sent to the bot, until told to stop.
+func listen(bot *tgbotapi.BotAPI, stop <-chan struct{}) {
+
+	offset := 0
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		updates, err := bot.GetUpdates(tgbotapi.UpdateConfig{Offset: offset, Timeout: 30})
+		if err != nil {
+			log.Error("Failed to read commands", logger.FieldError, err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-stop:
+				return
+			}
+			continue
+		}
+
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+
+			if u.Message == nil || !u.Message.IsCommand() {
+				continue
+			}
+
+			chat := u.Message.Chat.ID
+			reply := command(chat, u.Message.Command(), u.Message.CommandArguments(), time.Now())
+			if reply != "" {
+				err = box.add(chat, reply)
+				if err != nil {
+					log.Error("Failed to queue reply", "chat", chat, logger.FieldError, err)
+				}
+			}
+		}
+	}
+}
+
+// Help describes the commands we understand.
+var Help = `/status - show the failing tests
+/silence &lt;test&gt; [1h] - don't notify about a test for a while
+/unsilence &lt;test&gt; - remove a silence
+/ack &lt;test&gt; - stop reminders about a test until it recovers
+
+Tests are identified by their ID, or the start of it, as shown by /status.`
+
+// command runs a command sent by a chat, and returns the reply.
+//
+// Commands from chats we don't notify are ignored.
+func command(chat int64, cmd string, args string, now time.Time) string {
+
+	if !known(chat) {
+		log.Warn("Ignoring command from unknown chat", "chat", chat, "command", cmd)
+		return ""
+	}
+
+	fields := strings.Fields(args)
+
+	switch cmd {
+	case "status":
+		return status(chat, now)
+
+	case "silence", "unsilence", "ack":
+		if len(fields) < 1 {
+			return fmt.Sprintf("Usage: /%s &lt;test&gt;", cmd)
+		}
+		id, err := state.find(fields[0])
+		if err != nil {
+			return escape(err.Error())
+		}
+
+		switch cmd {
+		case "silence":
+			d := time.Hour
+			if len(fields) > 1 {
+				d, err = time.ParseDuration(fields[1])
+				if err != nil || d <= 0 {
+					return fmt.Sprintf("Invalid duration '%s', try 30m or 2h", escape(fields[1]))
+				}
+			}
+			until := now.Add(d)
+			err = state.silence(id, until)
+			if err == nil {
+				return fmt.Sprintf("Silenced <code>%s</code> until %s.", id, until.Format("15:04 MST"))
+			}
+
+		case "unsilence":
+			err = state.silence(id, time.Time{})
+			if err == nil {
+				return fmt.Sprintf("Removed the silence of <code>%s</code>.", id)
+			}
+
+		case "ack":
+			err = state.ack(id)
+			if err == nil {
+				return fmt.Sprintf("Acknowledged <code>%s</code>, you won't be reminded about it until it recovers.", id)
+			}
+		}
+		return "Failed: " + escape(err.Error())
+
+	case "start", "help":
+		return Help
+	}
+
+	return "Unknown command, try /help"
+}
+
+// status describes the failing tests which are routed to the given chat.
+func status(chat int64, now time.Time) string {
+
+	var lines []string
+	for _, f := range state.list() {
+		if !routed(f.Tag, chat) {
+			continue
+		}
+
+		line := fmt.Sprintf("<code>%s</code> %s against %s, for %s",
+			f.ID, escape(f.Type), escape(f.Target), now.Sub(f.Since).Round(time.Second))
+		if until, ok := state.silencedUntil(f.ID, now); ok {
+			line += ", silenced until " + until.Format("15:04 MST")
+		}
+		if f.Acked {
+			line += ", acknowledged"
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		return "No tests are failing."
+	}
+
+	//
+	// Show as many as will fit in a message.
+	//
+	text := fmt.Sprintf("%d failing:", len(lines))
+	for i, line := range lines {
+		more := fmt.Sprintf("\n... and %d more.", len(lines)-i)
+		if len(text)+1+len(line)+len(more) > MaxMessage {
+			return text + more
+		}
+		text += "\n" + line
+	}
+	return text
+}
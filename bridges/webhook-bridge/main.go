@@ -0,0 +1,305 @@
+//
+// This is the webhook bridge, which reads test-results from redis, and
+// POSTs them to an arbitrary HTTP endpoint.
+//
+// The program should be built like so:
+//
+//     go build .
+//
+// Once built launch it like so:
+//
+//     $ ./webhook-bridge -url=https://hooks.example.com/overseer \
+//         -template=slack.tmpl -result=failed
+//
+// The body of each request is generated from a text/template, which is
+// given the test-result.  The default template submits the result as a
+// JSON object, with the same fields as those published to redis.
+//
+// Deliveries which fail, due to a network error or a 5xx/429 response,
+// are retried with an exponential backoff.  Those which still fail are
+// retried later, and eventually moved to the dead-letter list.
+//
+// Steve
+// --
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/skx/overseer/bridge"
+	"github.com/skx/overseer/logger"
+)
+
+// Our logger
+var log *logger.Logger
+
+// The URL we submit results to
+var hookURL *string
+
+// The template used to generate the body of each request
+var tmpl *template.Template
+
+// The content-type of the body
+var contentType *string
+
+// Extra headers to add to each request
+var headers headerList
+
+// Authentication
+var basicAuth *string
+var bearer *string
+
+// The secret used to sign each request, and the header the
+// signature is placed in.
+var hmacSecret *string
+var hmacHeader *string
+
+// How many times to attempt each delivery, and the initial delay
+// between attempts.
+var attempts *int
+var retryDelay *time.Duration
+
+// The HTTP client we use
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// ctx is cancelled when the bridge stops, which interrupts our requests
+// and retries.
+var ctx = context.Background()
+
+// DefaultTemplate submits the result as a JSON object.
+var DefaultTemplate = `{{ json .Fields }}`
+
+// headerList holds the values of the repeatable -header flag.
+type headerList []string
+
+// String returns the headers, as required by flag.Value.
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+// Set adds a header, which must be of the form "Name: value".
+func (h *headerList) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header '%s' is not of the form 'Name: value'", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// templateFuncs are the functions available to templates.
+var templateFuncs = template.FuncMap{
+
+	// json encodes a value as JSON, so a string may be safely
+	// embedded in a JSON body via `"text": {{ json .Error }}`.
+	"json": func(v interface{}) (string, error) {
+		j, err := json.Marshal(v)
+		return string(j), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// loadTemplate parses the template in the given file, or the default
+// template if no file is given.
+func loadTemplate(path string) (*template.Template, error) {
+	src := DefaultTemplate
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		src = string(data)
+	}
+	return template.New("webhook").Funcs(templateFuncs).Parse(src)
+}
+
+// sign returns the HMAC-SHA256 signature of the body.
+func sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(*hmacSecret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver makes a single attempt to POST the body to our URL.
+//
+// The error returned is nil if the request succeeded, and retry is
+// true if it failed in a way which might succeed later.
+func deliver(body []byte) (retry bool, err error) {
+
+	req, err := http.NewRequestWithContext(ctx, "POST", *hookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", *contentType)
+	req.Header.Set("User-Agent", "overseer/webhook-bridge")
+	for _, h := range headers {
+		parts := strings.SplitN(h, ":", 2)
+		req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	if *basicAuth != "" {
+		parts := strings.SplitN(*basicAuth, ":", 2)
+		if len(parts) != 2 {
+			return false, fmt.Errorf("basic-auth must be of the form user:password")
+		}
+		req.SetBasicAuth(parts[0], parts[1])
+	}
+	if *bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+*bearer)
+	}
+	if *hmacSecret != "" {
+		req.Header.Set(*hmacHeader, sign(body))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	response, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("status code was %d: %s", res.StatusCode, strings.TrimSpace(string(response)))
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		return true, err
+	}
+	return false, err
+}
+
+// POST a result to our URL, having rendered it via our template.
+//
+// (The result has already been matched against our filters.)
+func process(res bridge.Result) error {
+
+	tlog := log.With(logger.FieldType, res.Type, logger.FieldTarget, res.Target)
+
+	//
+	// Render the body.
+	//
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, res)
+	if err != nil {
+		return bridge.Permanent(fmt.Errorf("failed to render template: %s", err.Error()))
+	}
+
+	//
+	// Deliver it, retrying with a backoff.  If we're stopped while
+	// we wait the result will be delivered again once we restart.
+	//
+	delay := *retryDelay
+	for attempt := 1; ; attempt++ {
+
+		retry, err := deliver(buf.Bytes())
+		if err == nil {
+			tlog.Debug("Delivered result", logger.FieldAttempt, attempt)
+			return nil
+		}
+
+		if !retry {
+			return bridge.Permanent(fmt.Errorf("delivery failed: %s", err.Error()))
+		}
+		if attempt >= *attempts {
+			return fmt.Errorf("delivery failed after %d attempt(s): %s", attempt, err.Error())
+		}
+
+		tlog.Warn("Delivery failed, retrying", logger.FieldAttempt, attempt, "delay", delay, logger.FieldError, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("delivery interrupted after %d attempt(s): %s", attempt, err.Error())
+		}
+
+		delay *= 2
+		if delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+}
+
+//
+// Entry Point
+//
+func main() {
+
+	//
+	// Create our bridge, which registers the common flags, and then
+	// add our own.
+	//
+	b, err := bridge.New("webhook")
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	hookURL = flag.String("url", "", "The URL to POST results to")
+	tmplFile := flag.String("template", "", "The file containing the text/template used to generate the body, by default the result as JSON")
+	contentType = flag.String("content-type", "application/json", "The content-type of the body")
+	flag.Var(&headers, "header", "An extra header to send, as 'Name: value', may be repeated")
+	basicAuth = flag.String("basic-auth", "", "The user:password to authenticate with")
+	bearer = flag.String("bearer", "", "The bearer token to authenticate with")
+	hmacSecret = flag.String("hmac-secret", "", "The secret used to sign the body via HMAC-SHA256")
+	hmacHeader = flag.String("hmac-header", "X-Overseer-Signature", "The header which contains the signature")
+	attempts = flag.Int("attempts", 5, "The number of times to attempt each delivery")
+	retryDelay = flag.Duration("retry-delay", time.Second, "The delay before the first retry, which doubles for each subsequent one")
+	timeout := flag.Duration("timeout", 30*time.Second, "The timeout for each request")
+
+	//
+	// Parse our flags, using the configuration file for defaults,
+	// and connect to redis.
+	//
+	err = b.Parse()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	log = b.Log
+	ctx = b.Context()
+
+	//
+	// Sanity-check
+	//
+	if *hookURL == "" {
+		fmt.Printf("Usage: webhook-bridge -url=https://hooks.example.com/ [-template=file.tmpl] [-redis-host=127.0.0.1:6379]\n")
+		os.Exit(1)
+	}
+	if *attempts < 1 {
+		fmt.Printf("The number of attempts must be at least one\n")
+		os.Exit(1)
+	}
+	client.Timeout = *timeout
+
+	tmpl, err = loadTemplate(*tmplFile)
+	if err != nil {
+		fmt.Printf("Failed to load template: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	//
+	// Process results until we're stopped.
+	//
+	err = b.Run(process)
+	if err != nil {
+		log.Error("Failed to read test-results", logger.FieldError, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skx/overseer/bridge"
+)
+
+// request is a request received by the fake receiver.
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// fakeReceiver returns the given status-codes in turn, and records the
+// requests it receives.
+type fakeReceiver struct {
+	statuses []int
+	requests []request
+}
+
+func (f *fakeReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	f.requests = append(f.requests, request{header: req.Header, body: body})
+
+	status := http.StatusOK
+	if len(f.requests) <= len(f.statuses) {
+		status = f.statuses[len(f.requests)-1]
+	}
+	w.WriteHeader(status)
+}
+
+// setup points the bridge at the fake receiver, using the given template.
+func setup(t *testing.T, src string, statuses ...int) (*fakeReceiver, func()) {
+	recv := &fakeReceiver{statuses: statuses}
+	server := httptest.NewServer(recv)
+
+	url := server.URL
+	ct := "application/json"
+	empty := ""
+	header := "X-Overseer-Signature"
+	count := 3
+	delay := time.Millisecond
+
+	hookURL = &url
+	contentType = &ct
+	basicAuth = &empty
+	bearer = &empty
+	hmacSecret = &empty
+	hmacHeader = &header
+	attempts = &count
+	retryDelay = &delay
+	headers = nil
+
+	path := ""
+	if src != "" {
+		path = filepath.Join(t.TempDir(), "body.tmpl")
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatalf("failed to write template: %s", err.Error())
+		}
+	}
+
+	var err error
+	tmpl, err = loadTemplate(path)
+	if err != nil {
+		t.Fatalf("failed to load template: %s", err.Error())
+	}
+
+	return recv, server.Close
+}
+
+// result returns a failing test-result.
+func result() bridge.Result {
+	return bridge.FromFields(map[string]string{
+		"input":  "http://example.com/ must run http",
+		"result": "failed",
+		"error":  `status code was 500 not "200"`,
+		"type":   "http",
+		"target": "1.2.3.4",
+	})
+}
+
+// Test that the default template submits the result as JSON.
+func TestDefaultTemplate(t *testing.T) {
+	recv, done := setup(t, "")
+	defer done()
+
+	err := process(result())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(recv.requests) != 1 {
+		t.Fatalf("Expected one request, got %d", len(recv.requests))
+	}
+
+	var body map[string]string
+	if err := json.Unmarshal(recv.requests[0].body, &body); err != nil {
+		t.Fatalf("The body isn't JSON: %s", recv.requests[0].body)
+	}
+	if body["error"] != `status code was 500 not "200"` || body["target"] != "1.2.3.4" {
+		t.Errorf("Wrong body: %v", body)
+	}
+
+	h := recv.requests[0].header
+	if h.Get("Content-Type") != "application/json" || h.Get("User-Agent") != "overseer/webhook-bridge" {
+		t.Errorf("Wrong headers: %v", h)
+	}
+	if h.Get("X-Overseer-Signature") != "" {
+		t.Errorf("The body was signed without a secret")
+	}
+}
+
+// Test a custom template, which quotes values via json.
+func TestTemplate(t *testing.T) {
+	recv, done := setup(t, `{"text": {{ json (printf "%s %s: %s" (upper .Result) .Target .Error) }}}`)
+	defer done()
+
+	err := process(result())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := `{"text": "FAILED 1.2.3.4: status code was 500 not \"200\""}`
+	if string(recv.requests[0].body) != expected {
+		t.Errorf("Wrong body: %s", recv.requests[0].body)
+	}
+}
+
+// Test that a template which fails to render isn't retried.
+func TestTemplateFailure(t *testing.T) {
+	recv, done := setup(t, `{{ .Missing }}`)
+	defer done()
+
+	err := process(result())
+	if !bridge.IsPermanent(err) {
+		t.Fatalf("Expected a permanent error, got %v", err)
+	}
+	if len(recv.requests) != 0 {
+		t.Errorf("Expected no requests, got %d", len(recv.requests))
+	}
+}
+
+// Test that the body is signed, and the extra headers sent.
+func TestSignature(t *testing.T) {
+	recv, done := setup(t, "")
+	defer done()
+
+	secret := "s3cret"
+	hmacSecret = &secret
+	token := "t0ken"
+	bearer = &token
+	headers = headerList{"X-Team: ops"}
+
+	err := process(result())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	req := recv.requests[0]
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(req.body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if req.header.Get("X-Overseer-Signature") != expected {
+		t.Errorf("Wrong signature %s, expected %s", req.header.Get("X-Overseer-Signature"), expected)
+	}
+	if sign(req.body) != expected {
+		t.Errorf("sign() gave %s, expected %s", sign(req.body), expected)
+	}
+	if req.header.Get("Authorization") != "Bearer t0ken" || req.header.Get("X-Team") != "ops" {
+		t.Errorf("Wrong headers: %v", req.header)
+	}
+
+	//
+	// A known signature, in case both of the above are wrong.
+	//
+	if sig := sign([]byte("{}")); sig != "sha256=adbde1ce40c89c14215687d5d762a47df6dfaefcfad61e2e86718ffc8498571b" {
+		t.Errorf("Unexpected signature %s", sig)
+	}
+}
+
+// Test that rate-limits, and server errors, are retried.
+func TestRetry(t *testing.T) {
+	recv, done := setup(t, "", http.StatusTooManyRequests, http.StatusBadGateway)
+	defer done()
+
+	err := process(result())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(recv.requests) != 3 {
+		t.Errorf("Expected three attempts, got %d", len(recv.requests))
+	}
+}
+
+// Test that we give up, eventually, in a way which allows the result to
+// be retried later.
+func TestRetryExhausted(t *testing.T) {
+	recv, done := setup(t, "", 500, 500, 500, 500)
+	defer done()
+
+	err := process(result())
+	if err == nil || bridge.IsPermanent(err) {
+		t.Fatalf("Expected a temporary error, got %v", err)
+	}
+	if len(recv.requests) != 3 {
+		t.Errorf("Expected three attempts, got %d", len(recv.requests))
+	}
+}
+
+// Test that we stop retrying when the bridge is stopped, and that the
+// result may be retried later.
+func TestRetryStopped(t *testing.T) {
+	recv, done := setup(t, "", 500, 500, 500, 500)
+	defer done()
+
+	delay := time.Hour
+	retryDelay = &delay
+
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(context.Background())
+	defer func() { ctx = context.Background() }()
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := process(result())
+	if err == nil || bridge.IsPermanent(err) {
+		t.Fatalf("Expected a temporary error, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("The retry wasn't interrupted")
+	}
+	if len(recv.requests) != 1 {
+		t.Errorf("Expected a single attempt, got %d", len(recv.requests))
+	}
+}
+
+// Test that rejected requests are not retried.
+func TestNoRetry(t *testing.T) {
+	recv, done := setup(t, "", http.StatusBadRequest)
+	defer done()
+
+	err := process(result())
+	if !bridge.IsPermanent(err) {
+		t.Fatalf("Expected a permanent error, got %v", err)
+	}
+	if len(recv.requests) != 1 {
+		t.Errorf("Expected a single attempt, got %d", len(recv.requests))
+	}
+}
+
+// Test that a missing template file is reported.
+func TestMissingTemplate(t *testing.T) {
+	_, err := loadTemplate(filepath.Join(os.TempDir(), "does-not-exist.tmpl"))
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+}
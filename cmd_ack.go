@@ -0,0 +1,178 @@
+// Ack
+//
+// The ack sub-command acknowledges failing tests, which stops the
+// escalation of their notifications by `overseer notify`.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/skx/overseer/notify"
+	"github.com/skx/overseer/redisconn"
+)
+
+type ackCmd struct {
+	// How we connect to redis.
+	redisconn.Options
+
+	// Who is acknowledging the failure.
+	By string
+
+	// An optional note.
+	Comment string
+
+	// List the failing tests, rather than acknowledging them.
+	List bool
+
+	// Remove the acknowledgements, rather than adding them.
+	Remove bool
+}
+
+//
+// Glue
+//
+func (*ackCmd) Name() string     { return "ack" }
+func (*ackCmd) Synopsis() string { return "Acknowledge failing tests, stopping their escalation" }
+func (*ackCmd) Usage() string {
+	return `ack :
+  Acknowledge failing tests, given their IDs, so that "overseer notify"
+  stops escalating their notifications.  The receivers which have been
+  told of the failure are told of the acknowledgement.
+
+  The start of an ID is enough, if it identifies a single failing test.
+  The acknowledgement lasts until the test recovers.
+
+  Examples:
+
+    $ overseer ack -list
+    $ overseer ack -comment "Restarting the server" 3f9a1c
+    $ overseer ack -remove 3f9a1c
+`
+}
+
+//
+// Flag setup.
+//
+func (p *ackCmd) SetFlags(f *flag.FlagSet) {
+
+	p.Options.SetFlags(f, conf.Redis)
+
+	f.StringVar(&p.By, "by", os.Getenv("USER"), "Who is acknowledging the failures.")
+	f.StringVar(&p.Comment, "comment", "", "A note to include with the acknowledgement.")
+	f.BoolVar(&p.List, "list", false, "List the failing tests, and their acknowledgements.")
+	f.BoolVar(&p.Remove, "remove", false, "Remove the acknowledgements of the given tests.")
+}
+
+//
+// List the failing tests.
+//
+func (p *ackCmd) list(state *notify.State) error {
+
+	all, err := state.All()
+	if err != nil {
+		return err
+	}
+
+	var entries []*notify.Entry
+	for _, e := range all {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Since.Before(entries[j].Since)
+	})
+
+	now := time.Now()
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tType\tTarget\tFailing\tNotified\tAcknowledged\n")
+	for _, e := range entries {
+		var notified []string
+		for name := range e.Notified {
+			notified = append(notified, name)
+		}
+		sort.Strings(notified)
+
+		//
+		// The acknowledgement may not have been seen by
+		// `overseer notify` yet.
+		//
+		ack := "-"
+		a, err := state.GetAck(e.ID)
+		if err != nil {
+			return err
+		}
+		if a != nil {
+			ack = a.By
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.Type, e.Target,
+			now.Sub(e.Since).Round(time.Second), strings.Join(notified, ","), ack)
+	}
+	return w.Flush()
+}
+
+//
+// Entry-point.
+//
+func (p *ackCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	r, err := p.Options.Connect()
+	if err != nil {
+		fmt.Printf("Redis connection failed: %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+	state := notify.NewState(r)
+
+	if p.List {
+		err = p.list(state)
+		if err != nil {
+			fmt.Printf("Failed to list the failing tests: %s\n", err.Error())
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	if len(f.Args()) == 0 {
+		fmt.Printf("Please specify the ID of the test to acknowledge\n")
+		return subcommands.ExitFailure
+	}
+	if p.By == "" && !p.Remove {
+		fmt.Printf("Please specify who is acknowledging the failure via -by\n")
+		return subcommands.ExitFailure
+	}
+
+	status := subcommands.ExitSuccess
+	for _, arg := range f.Args() {
+		id, err := state.Find(arg)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			status = subcommands.ExitFailure
+			continue
+		}
+
+		if p.Remove {
+			err = state.DeleteAck(id)
+		} else {
+			err = state.PutAck(id, notify.Ack{By: p.By, Comment: p.Comment, Time: time.Now()})
+		}
+		if err != nil {
+			fmt.Printf("Failed to update %s: %s\n", id, err.Error())
+			status = subcommands.ExitFailure
+			continue
+		}
+
+		if p.Remove {
+			fmt.Fprintf(out, "Removed the acknowledgement of %s\n", id)
+		} else {
+			fmt.Fprintf(out, "Acknowledged %s\n", id)
+		}
+	}
+	return status
+}
@@ -25,7 +25,8 @@ func (*dumpCmd) Usage() string {
 	return `dump :
   Dump a parsed configuration file.
 
-  This is particularly useful to show the result of macro-expansion.
+  This is particularly useful to show the result of macro-expansion,
+  and the expansion of CIDR-blocks and host-ranges.
 `
 }
 
@@ -55,6 +56,7 @@ func (p *dumpCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 		// Create an object to parse our file.
 		//
 		helper := parser.New()
+		helper.MaxExpansion = conf.Defaults.MaxExpansion
 
 		//
 		// For each parsed job call `dump_test` to show it
@@ -5,27 +5,58 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/google/subcommands"
+	"github.com/skx/overseer/logger"
 	"github.com/skx/overseer/parser"
+	"github.com/skx/overseer/queue"
+	"github.com/skx/overseer/redisconn"
 	"github.com/skx/overseer/test"
 )
 
 type enqueueCmd struct {
-	RedisDB          int
-	RedisHost        string
-	RedisPassword    string
-	RedisSocket      string
-	RedisDialTimeout time.Duration
+	// How we connect to redis.
+	redisconn.Options
 
-	_r *redis.Client
+	// How long before an enqueued job is regarded as stale?
+	JobTTL time.Duration
+
+	// Should jobs be enqueued as bare input-lines?
+	Raw bool
+
+	// Should we skip tests which are already pending?
+	Dedup bool
+
+	// How long before a pending test may be enqueued again, even
+	// though no worker has started it?
+	PendingTimeout time.Duration
+
+	// The maximum number of jobs we'll allow to be pending.
+	MaxQueue int
+
+	// How we log.
+	Log logger.Options
+
+	// How we publish test-results.
+	Results queue.ResultsOptions
+
+	_r   redis.UniversalClient
+	_log *logger.Logger
+
+	// The number of jobs in the queue.
+	_depth int64
+
+	// The number of jobs we've added, and skipped.
+	_added   int
+	_skipped int
+
+	// Did we refuse to add jobs because the queue was full?
+	_full bool
 }
 
 //
@@ -36,6 +67,19 @@ func (*enqueueCmd) Synopsis() string { return "Enqueue a parsed configuration fi
 func (*enqueueCmd) Usage() string {
 	return `enqueue :
   Add the tests from a parsed configuration file to a central redis queue.
+
+  Each test is stored as a JSON envelope, recording the time it was
+  enqueued and the file it was read from.  If a TTL is set via -ttl
+  then workers will discard jobs which have waited for longer than that.
+
+  Tests which are already waiting in the queue are not added a second
+  time, and -max-queue may be used to refuse to grow the queue beyond
+  a given size.
+
+  When the queue fills a failing test-result of type "enqueue" is
+  published, to raise an alert, and a passing one once it has drained.
+  These results are published only when the state of the queue changes,
+  not upon every run, but bridges will see them as they would any other.
 `
 }
 
@@ -45,47 +89,178 @@ func (*enqueueCmd) Usage() string {
 func (p *enqueueCmd) SetFlags(f *flag.FlagSet) {
 
 	//
-	// Create the default options here
+	// Our defaults come from the configuration file, if present.
+	//
+	defaults := conf.Defaults
+
+	p.Options.SetFlags(f, conf.Redis)
+
+	// Jobs
+	f.DurationVar(&p.JobTTL, "ttl", defaults.TTL, "Jobs not executed within this period are discarded by the workers, zero to disable.")
+	f.BoolVar(&p.Raw, "raw", defaults.Raw, "Enqueue bare input-lines, rather than JSON envelopes, for older workers.")
+	f.BoolVar(&p.Dedup, "dedup", defaults.Dedup, "Skip tests which are already pending in the queue.")
+	f.DurationVar(&p.PendingTimeout, "pending-timeout", defaults.PendingTimeout, "Re-enqueue tests which have been pending for longer than this, even if deduplicating.")
+	f.IntVar(&p.MaxQueue, "max-queue", defaults.MaxQueue, "Refuse to grow the queue beyond this many jobs, zero to disable.")
+
+	// Logging
+	p.Log.SetFlags(f, conf.Log)
+
+	// Results
+	p.Results.SetFlags(f, conf.Results)
+}
+
+//
+// This is a callback invoked by the parser when a job
+// has been successfully parsed.
+//
+// The test is wrapped in an envelope, recording when it was enqueued,
+// and where it came from, unless we're enqueuing bare input-lines.
+//
+func (p *enqueueCmd) enqueueTest(tst test.Test) error {
+
+	log := p._log.With(logger.FieldTestID, tst.ID(), logger.FieldType, tst.Type, logger.FieldTarget, tst.Target)
+
 	//
-	// This is done so we can load defaults via a configuration-file
-	// if present.
+	// If the queue is full then we add nothing.
 	//
-	var defaults enqueueCmd
-	defaults.RedisHost = "localhost:6379"
-	defaults.RedisPassword = ""
-	defaults.RedisDB = 0
-	defaults.RedisSocket = ""
-	defaults.RedisDialTimeout = 5 * time.Second
+	if p.MaxQueue > 0 && p._depth >= int64(p.MaxQueue) {
+		p._full = true
+		p._skipped++
+		log.Debug("Skipped test, the queue is full")
+		return nil
+	}
 
 	//
-	// If we have a configuration file then load it
+	// Older workers only understand a single queue, so bare
+	// input-lines ignore the priority of the test.
 	//
-	if len(os.Getenv("OVERSEER")) > 0 {
-		cfg, err := ioutil.ReadFile(os.Getenv("OVERSEER"))
+	if p.Raw {
+		_, err := p._r.RPush(queue.JobsKey, tst.Input).Result()
 		if err == nil {
-			err = json.Unmarshal(cfg, &defaults)
-			if err != nil {
-				fmt.Printf("WARNING: Error loading overseer.json - %s\n",
-					err.Error())
-			}
-		} else {
-			fmt.Printf("WARNING: Failed to read configuration-file - %s\n", err.Error())
+			p._added++
+			p._depth++
+			log.Debug("Enqueued test")
+		}
+		return err
+	}
+
+	job := queue.New(tst, p.JobTTL)
+
+	//
+	// If the test is already pending then we skip it.
+	//
+	if p.Dedup {
+		pending, err := p.pending(job)
+		if err != nil {
+			return err
+		}
+		if pending {
+			p._skipped++
+			log.Debug("Skipped test, it is already pending")
+			return nil
 		}
 	}
 
-	f.IntVar(&p.RedisDB, "redis-db", defaults.RedisDB, "Specify the database-number for redis.")
-	f.StringVar(&p.RedisHost, "redis-host", defaults.RedisHost, "Specify the address of the redis queue.")
-	f.StringVar(&p.RedisPassword, "redis-pass", defaults.RedisPassword, "Specify the password for the redis queue.")
-	f.StringVar(&p.RedisSocket, "redis-socket", defaults.RedisSocket, "If set, will be used for the redis connections.")
+	raw, err := job.Encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = p._r.RPush(queue.Key(job.Priority), raw).Result()
+	if err != nil {
+
+		// Don't leave the test marked as pending.
+		if p.Dedup {
+			p._r.HDel(queue.PendingKey, job.ID)
+		}
+		return err
+	}
+
+	p._added++
+	p._depth++
+	log.Debug("Enqueued test", "priority", job.Priority)
+	return nil
 }
 
 //
-// This is a callback invoked by the parser when a job
-// has been successfully parsed.
+// Determine whether the given job is already pending, and if not mark
+// it as being so.
 //
-func (p *enqueueCmd) enqueueTest(tst test.Test) error {
-	_, err := p._r.RPush("overseer.jobs", tst.Input).Result()
-	return err
+// The pending tests are stored in a hash, keyed by test ID, with the
+// value being the time the test was enqueued.  Workers remove the entry
+// when they start the job.  In case a worker died, or the job was lost,
+// entries older than our timeout are ignored.
+//
+func (p *enqueueCmd) pending(job queue.Job) (bool, error) {
+
+	added, err := p._r.HSetNX(queue.PendingKey, job.ID, job.Enqueued).Result()
+	if err != nil {
+		return false, err
+	}
+	if added {
+		return false, nil
+	}
+
+	//
+	// The test is already pending, but for how long?
+	//
+	val, err := p._r.HGet(queue.PendingKey, job.ID).Int64()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	if time.Since(time.Unix(val, 0)) < p.PendingTimeout {
+		return true, nil
+	}
+
+	_, err = p._r.HSet(queue.PendingKey, job.ID, job.Enqueued).Result()
+	return false, err
+}
+
+//
+// Publish the state of the queue as a test-result, so that an alert
+// will be raised if the queue has grown beyond our limit, and cleared
+// once it has drained.
+//
+// The result is only published when the state changes, which we track
+// via a key in redis as each run of enqueue is separate.
+//
+func (p *enqueueCmd) reportQueue() error {
+
+	var changed bool
+	if p._full {
+		set, err := p._r.SetNX(queue.FullKey, time.Now().Unix(), 0).Result()
+		if err != nil {
+			return err
+		}
+		changed = set
+	} else {
+		removed, err := p._r.Del(queue.FullKey).Result()
+		if err != nil {
+			return err
+		}
+		changed = removed > 0
+	}
+	if !changed {
+		return nil
+	}
+
+	host, _ := os.Hostname()
+
+	msg := map[string]string{
+		"input":  fmt.Sprintf("overseer enqueue -max-queue %d", p.MaxQueue),
+		"result": "passed",
+		"target": host,
+		"time":   fmt.Sprintf("%d", time.Now().Unix()),
+		"type":   "enqueue",
+		"tag":    "",
+	}
+
+	if p._full {
+		msg["result"] = "failed"
+		msg["error"] = fmt.Sprintf("the job queue contains %d jobs, which is at, or beyond, the limit of %d; %d tests were not enqueued", p._depth, p.MaxQueue, p._skipped)
+	}
+
+	return p.Results.Publish(p._r, msg)
 }
 
 //
@@ -94,33 +269,46 @@ func (p *enqueueCmd) enqueueTest(tst test.Test) error {
 func (p *enqueueCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 
 	//
-	// Connect to the redis-host.
+	// Create our logger.
 	//
-	if p.RedisSocket != "" {
-		p._r = redis.NewClient(&redis.Options{
-			Network:  "unix",
-			Addr:     p.RedisSocket,
-			Password: p.RedisPassword,
-			DB:       p.RedisDB,
-		})
-	} else {
-		p._r = redis.NewClient(&redis.Options{
-			Addr:        p.RedisHost,
-			Password:    p.RedisPassword,
-			DB:          p.RedisDB,
-			DialTimeout: p.RedisDialTimeout,
-		})
+	var err error
+	p._log, err = p.Log.New()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	err = p.Results.Validate()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return subcommands.ExitFailure
 	}
 
 	//
-	// And run a ping, just to make sure it worked.
+	// Connect to the redis-host, and run a ping to make sure
+	// it worked.
 	//
-	_, err := p._r.Ping().Result()
+	p._r, err = p.Options.Connect()
 	if err != nil {
-		fmt.Printf("Redis connection failed: %s\n", err.Error())
+		p._log.Error("Redis connection failed", logger.FieldError, err)
 		return subcommands.ExitFailure
 	}
 
+	//
+	// Find the size of the queue, if we're limiting it.
+	//
+	if p.MaxQueue > 0 {
+		for _, key := range queue.Keys() {
+			var depth int64
+			depth, err = p._r.LLen(key).Result()
+			if err != nil {
+				p._log.Error("Failed to find the size of the queue", logger.FieldError, err)
+				return subcommands.ExitFailure
+			}
+			p._depth += depth
+		}
+	}
+
 	//
 	// For each file on the command-line we can now parse and
 	// enqueue the jobs
@@ -131,6 +319,7 @@ func (p *enqueueCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{
 		// Create an object to parse our file.
 		//
 		helper := parser.New()
+		helper.MaxExpansion = conf.Defaults.MaxExpansion
 
 		//
 		// For each parsed job call `enqueueTest`.
@@ -141,7 +330,7 @@ func (p *enqueueCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{
 		// Did we see an error?
 		//
 		if err != nil {
-			fmt.Printf("Error parsing file: %s\n", err.Error())
+			p._log.Error("Error parsing file", "file", file, logger.FieldError, err)
 		}
 
 		// Did we read from stdin?
@@ -150,5 +339,28 @@ func (p *enqueueCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{
 		}
 	}
 
+	//
+	// Report on the tests we skipped.
+	//
+	if p._full {
+		p._log.Warn("The queue is full, refused to add more jobs", "depth", p._depth, "max_queue", p.MaxQueue)
+	}
+	if p._skipped > 0 {
+		p._log.Info("Skipped tests", "enqueued", p._added, "skipped", p._skipped)
+	}
+
+	//
+	// If we're limiting the queue then report upon its state.
+	//
+	if p.MaxQueue > 0 {
+		err = p.reportQueue()
+		if err != nil {
+			p._log.Error("Failed to report the state of the queue", logger.FieldError, err)
+		}
+	}
+
+	if p._full {
+		return subcommands.ExitFailure
+	}
 	return subcommands.ExitSuccess
 }
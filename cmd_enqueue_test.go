@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/skx/overseer/queue"
+	"github.com/skx/overseer/test"
+)
+
+// newEnqueue returns an enqueue command connected to a fresh redis.
+func newEnqueue(t *testing.T) (*enqueueCmd, *miniredis.Miniredis) {
+	m := miniredis.RunT(t)
+
+	p := &enqueueCmd{
+		Dedup:          true,
+		PendingTimeout: time.Hour,
+		Results:        queue.DefaultResults(),
+		_r:             redis.NewClient(&redis.Options{Addr: m.Addr()}),
+	}
+	return p, m
+}
+
+// newTest returns a test with the given input.
+func newTest(target string) test.Test {
+	return test.Test{
+		Target: target,
+		Type:   "ping",
+		Input:  target + " must run ping",
+	}
+}
+
+// Test that tests which are already pending are skipped.
+func TestEnqueueDedup(t *testing.T) {
+	p, m := newEnqueue(t)
+
+	for i := 0; i < 3; i++ {
+		err := p.enqueueTest(newTest("1.2.3.4"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	err := p.enqueueTest(newTest("5.6.7.8"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if p._added != 2 || p._skipped != 2 {
+		t.Errorf("added %d, skipped %d, expected 2 & 2", p._added, p._skipped)
+	}
+
+	jobs, _ := m.List(queue.JobsKey)
+	if len(jobs) != 2 {
+		t.Errorf("expected two jobs, found %d", len(jobs))
+	}
+
+	tst := newTest("1.2.3.4")
+	if m.HGet(queue.PendingKey, tst.ID()) == "" {
+		t.Errorf("test isn't marked as pending")
+	}
+
+	//
+	// Once the worker starts the job it is no longer pending, so
+	// it may be enqueued again.
+	//
+	m.HDel(queue.PendingKey, tst.ID())
+	err = p.enqueueTest(tst)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if p._added != 3 {
+		t.Errorf("test wasn't enqueued once it was no longer pending")
+	}
+}
+
+// Test that tests which have been pending for too long are enqueued
+// again, in case the worker died.
+func TestEnqueuePendingTimeout(t *testing.T) {
+	p, m := newEnqueue(t)
+
+	tst := newTest("1.2.3.4")
+	stale := time.Now().Add(-2 * time.Hour).Unix()
+	recent := time.Now().Add(-30 * time.Minute).Unix()
+
+	//
+	// Recently pending, so skipped.
+	//
+	m.HSet(queue.PendingKey, tst.ID(), strconv.FormatInt(recent, 10))
+	err := p.enqueueTest(tst)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if p._added != 0 || p._skipped != 1 {
+		t.Errorf("a recently pending test was enqueued")
+	}
+
+	//
+	// Pending for longer than the timeout, so enqueued, and the
+	// time it was enqueued is updated.
+	//
+	m.HSet(queue.PendingKey, tst.ID(), strconv.FormatInt(stale, 10))
+	err = p.enqueueTest(tst)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if p._added != 1 {
+		t.Errorf("a stale pending test wasn't enqueued")
+	}
+
+	val, _ := strconv.ParseInt(m.HGet(queue.PendingKey, tst.ID()), 10, 64)
+	if val <= stale {
+		t.Errorf("the pending time wasn't updated, it is %d", val)
+	}
+
+	//
+	// Without deduplication the hash is ignored entirely.
+	//
+	p.Dedup = false
+	err = p.enqueueTest(tst)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if p._added != 2 {
+		t.Errorf("test wasn't enqueued without deduplication")
+	}
+}
+
+// Test that nothing is added once the queue is full.
+func TestEnqueueMaxQueue(t *testing.T) {
+	p, m := newEnqueue(t)
+	p.MaxQueue = 3
+	p._depth = 1
+
+	for i := 0; i < 5; i++ {
+		err := p.enqueueTest(newTest(fmt.Sprintf("10.0.0.%d", i)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	if p._added != 2 || p._skipped != 3 || !p._full {
+		t.Errorf("added %d, skipped %d, full %t, expected 2, 3, and true", p._added, p._skipped, p._full)
+	}
+
+	jobs, _ := m.List(queue.JobsKey)
+	if len(jobs) != 2 {
+		t.Errorf("expected two jobs, found %d", len(jobs))
+	}
+
+	//
+	// The skipped tests weren't marked as pending.
+	//
+	tst := newTest("10.0.0.4")
+	if m.HGet(queue.PendingKey, tst.ID()) != "" {
+		t.Errorf("a skipped test was marked as pending")
+	}
+}
+
+// Test that the state of the queue is only reported when it changes.
+func TestReportQueue(t *testing.T) {
+	p, m := newEnqueue(t)
+	p.MaxQueue = 10
+
+	// results returns the results published so far.
+	results := func() []map[string]string {
+		var out []map[string]string
+		raw, _ := m.List(queue.ResultsKey)
+		for _, r := range raw {
+			var msg map[string]string
+			if err := json.Unmarshal([]byte(r), &msg); err != nil {
+				t.Fatalf("invalid result %s", r)
+			}
+			out = append(out, msg)
+		}
+		return out
+	}
+
+	//
+	// The queue has never been full, so there's nothing to say.
+	//
+	err := p.reportQueue()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(results()) != 0 {
+		t.Errorf("a result was published for a queue which was never full")
+	}
+
+	//
+	// The queue fills, which is reported once.
+	//
+	p._full = true
+	p._depth = 12
+	p._skipped = 4
+	for i := 0; i < 2; i++ {
+		err = p.reportQueue()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	res := results()
+	if len(res) != 1 {
+		t.Fatalf("expected one result, found %d", len(res))
+	}
+	if res[0]["type"] != "enqueue" || res[0]["result"] != "failed" {
+		t.Errorf("unexpected result %v", res[0])
+	}
+	if res[0]["error"] != "the job queue contains 12 jobs, which is at, or beyond, the limit of 10; 4 tests were not enqueued" {
+		t.Errorf("unexpected error %s", res[0]["error"])
+	}
+	if !m.Exists(queue.FullKey) {
+		t.Errorf("the full state wasn't recorded")
+	}
+
+	//
+	// Then drains, which is reported once too.
+	//
+	p._full = false
+	for i := 0; i < 2; i++ {
+		err = p.reportQueue()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	res = results()
+	if len(res) != 2 {
+		t.Fatalf("expected two results, found %d", len(res))
+	}
+	if res[1]["result"] != "passed" {
+		t.Errorf("unexpected result %v", res[1])
+	}
+	if m.Exists(queue.FullKey) {
+		t.Errorf("the full state wasn't cleared")
+	}
+}
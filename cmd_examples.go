@@ -5,16 +5,40 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"regexp"
 	"sort"
+	"strings"
 
 	"github.com/google/subcommands"
 	"github.com/skx/overseer/protocols"
 )
 
 type examplesCmd struct {
+	// The format to output our examples in.
+	Format string
+}
+
+// protocolDoc describes a single protocol-test, and is used to build
+// the structured output of the examples.
+type protocolDoc struct {
+	// Name is the name of the protocol-test, as used in `must run`.
+	Name string `json:"name"`
+
+	// Title is the title of the protocol-test's documentation.
+	Title string `json:"title"`
+
+	// Description is the body of the protocol-test's documentation.
+	Description string `json:"description"`
+
+	// Examples contains the sample tests from the description.
+	Examples []string `json:"examples"`
+
+	// Arguments contains the arguments the protocol-test accepts.
+	Arguments []protocols.Argument `json:"arguments"`
 }
 
 //
@@ -25,6 +49,9 @@ func (*examplesCmd) Synopsis() string { return "Show example protocol-tests." }
 func (*examplesCmd) Usage() string {
 	return `examples :
   Provide sample usage of each of our protocol-tests.
+
+  The output may be changed via the -format flag, to produce a catalogue
+  of the protocol-tests in JSON, markdown, or man-page format.
 `
 }
 
@@ -32,15 +59,16 @@ func (*examplesCmd) Usage() string {
 // Flag setup.
 //
 func (p *examplesCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.Format, "format", "text", "The format to use for our output: text, json, markdown, or man.")
 }
 
 //
-// Show example output for any protocol-handler matching the
-// pattern specified.
-//
-// If the filter is empty then show all.
+// Find the protocol-handlers which match the given pattern, sorted
+// by name.
 //
-func showExamples(filter string) {
+func matchingHandlers(filter string) []string {
+
+	var res []string
 
 	re := regexp.MustCompile(filter)
 
@@ -56,42 +84,250 @@ func showExamples(filter string) {
 		if len(match) < 1 {
 			continue
 		}
+		res = append(res, name)
+	}
+	return res
+}
+
+//
+// Build the structured documentation of the named protocol-handler.
+//
+// The text returned by `Example()` has the form of a title, underlined
+// with dashes, followed by a description which is indented by a single
+// space.  Any lines in the description which contain "must run" are
+// regarded as examples.
+//
+func protocolDocumentation(name string) protocolDoc {
+
+	x := protocols.ProtocolHandler(name)
+
+	doc := protocolDoc{
+		Name:      name,
+		Title:     name,
+		Arguments: protocols.Schema(x),
+		Examples:  []string{},
+	}
+
+	lines := strings.Split(strings.Trim(x.Example(), "\n"), "\n")
+
+	//
+	// Title + underline
+	//
+	if len(lines) > 1 && strings.HasPrefix(strings.TrimSpace(lines[1]), "---") {
+		doc.Title = strings.TrimSpace(lines[0])
+		lines = lines[2:]
+	}
+
+	//
+	// Remove the single-space indentation, and find the examples.
+	//
+	var body []string
+	for _, line := range lines {
+		line = strings.TrimRight(strings.TrimPrefix(line, " "), " \t")
+		body = append(body, line)
+
+		tmp := strings.TrimSpace(line)
+		if strings.Contains(tmp, " must run ") && !strings.HasPrefix(tmp, "#") {
+			doc.Examples = append(doc.Examples, tmp)
+		}
+	}
+	doc.Description = strings.Trim(strings.Join(body, "\n"), "\n")
+
+	return doc
+}
+
+//
+// Show example output for any protocol-handler matching the
+// pattern specified, as free-form text.
+//
+// If the filter is empty then show all.
+//
+func showExamples(w io.Writer, filter string) {
+
+	// Get the name
+	for _, name := range matchingHandlers(filter) {
 
 		// Create an instance of it
 		x := protocols.ProtocolHandler(name)
 
 		// Show the output of that function
 		out := x.Example()
-		fmt.Printf("%s\n", out)
+		fmt.Fprintf(w, "%s\n", out)
 
-		fmt.Printf("Arguments which are supported are now shown:\n\n")
+		fmt.Fprintf(w, "Arguments which are supported are now shown:\n\n")
 
-		fmt.Printf("  %10s|%s\n", "Name", "Valid Value")
-		fmt.Printf("  ----------------------------------\n")
+		fmt.Fprintf(w, "  %12s|%-18s|%-14s|%-24s|%s\n", "Name", "Flags", "Default", "Valid Value", "Description")
+		fmt.Fprintf(w, "  ------------------------------------------------------------------------------------------\n")
 
 		//
-		// The arguments this test supports
+		// The arguments this test supports, sorted by name.
 		//
-		m := x.Arguments()
+		for _, arg := range protocols.Schema(x) {
 
-		//
-		// Temporary structure to store the keys.
-		//
-		var keys []string
-		for k := range m {
-			keys = append(keys, k)
+			//
+			// Build up the flags for this argument
+			//
+			var flags []string
+			if arg.Required {
+				flags = append(flags, "required")
+			}
+			if arg.Sensitive {
+				flags = append(flags, "sensitive")
+			}
+			if arg.Repeatable {
+				flags = append(flags, "repeatable")
+			}
+
+			fmt.Fprintf(w, "  %12s|%-18s|%-14s|%-24s|%s\n", arg.Name, strings.Join(flags, ","), arg.Default, arg.Pattern, arg.Description)
 		}
-		sort.Strings(keys)
+		fmt.Fprintf(w, "\n\n")
+
+	}
+}
+
+//
+// Show the catalogue of protocol-tests as a JSON array.
+//
+func showJSON(w io.Writer, docs []protocolDoc) error {
+	out, err := json.MarshalIndent(docs, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", out)
+	return nil
+}
+
+//
+// Show the catalogue of protocol-tests as markdown.
+//
+func showMarkdown(w io.Writer, docs []protocolDoc) error {
+
+	fmt.Fprintf(w, "# Protocol Tests\n\n")
+
+	for _, doc := range docs {
+		fmt.Fprintf(w, "## %s\n\n", doc.Name)
 
 		//
-		// Now show the keys + values in sorted order
+		// Indented lines in the description are examples, or
+		// other literal text, so they become code-blocks.
 		//
-		for _, k := range keys {
-			fmt.Printf("  %10s|%s\n", k, m[k])
+		for _, line := range strings.Split(doc.Description, "\n") {
+			if strings.HasPrefix(line, " ") {
+				line = "    " + strings.TrimSpace(line)
+			}
+			fmt.Fprintf(w, "%s\n", line)
+		}
+		fmt.Fprintf(w, "\n")
+
+		if len(doc.Arguments) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "| Name | Type | Required | Default | Valid Value | Description |\n")
+		fmt.Fprintf(w, "| ---- | ---- | -------- | ------- | ----------- | ----------- |\n")
+
+		escape := strings.NewReplacer("|", "\\|")
+		for _, arg := range doc.Arguments {
+			required := "no"
+			if arg.Required {
+				required = "yes"
+			}
+			description := arg.Description
+			if arg.Repeatable {
+				description += " May be repeated."
+			}
+			fmt.Fprintf(w, "| `%s` | %s | %s | %s | `%s` | %s |\n",
+				arg.Name, arg.Type, required, escape.Replace(arg.Default),
+				escape.Replace(arg.Pattern), escape.Replace(description))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return nil
+}
+
+//
+// Show the catalogue of protocol-tests as a man-page.
+//
+func showMan(w io.Writer, docs []protocolDoc) error {
+
+	//
+	// Escape text for troff.
+	//
+	escape := func(in string) string {
+		in = strings.Replace(in, "\\", "\\e", -1)
+		if strings.HasPrefix(in, ".") || strings.HasPrefix(in, "'") {
+			in = "\\&" + in
+		}
+		return in
+	}
+
+	fmt.Fprintf(w, ".TH OVERSEER-PROTOCOLS 7 \"\" \"overseer %s\"\n", version)
+	fmt.Fprintf(w, ".SH NAME\n")
+	fmt.Fprintf(w, "overseer-protocols \\- the protocol-tests supported by overseer\n")
+	fmt.Fprintf(w, ".SH SYNOPSIS\n")
+	fmt.Fprintf(w, "TARGET must run PROTOCOL [with NAME VALUE] ..\n")
+	fmt.Fprintf(w, ".SH PROTOCOLS\n")
+
+	for _, doc := range docs {
+		fmt.Fprintf(w, ".SS %s\n", doc.Name)
+
+		literal := false
+		paragraph := false
+		for _, line := range strings.Split(doc.Description, "\n") {
+
+			// Switch in/out of no-fill mode for indented text.
+			indented := strings.HasPrefix(line, " ")
+			if indented && !literal {
+				fmt.Fprintf(w, ".nf\n.RS\n")
+				literal = true
+				paragraph = false
+			}
+			if !indented && literal && line != "" {
+				fmt.Fprintf(w, ".RE\n.fi\n")
+				literal = false
+			}
+
+			// Blank lines separate paragraphs.
+			if line == "" {
+				paragraph = true
+				continue
+			}
+			if paragraph && !literal {
+				fmt.Fprintf(w, ".PP\n")
+			}
+			paragraph = false
+
+			fmt.Fprintf(w, "%s\n", escape(strings.TrimSpace(line)))
+		}
+		if literal {
+			fmt.Fprintf(w, ".RE\n.fi\n")
+		}
+
+		if len(doc.Arguments) == 0 {
+			continue
 		}
-		fmt.Printf("\n\n")
 
+		fmt.Fprintf(w, ".PP\nArguments:\n")
+		for _, arg := range doc.Arguments {
+			fmt.Fprintf(w, ".TP\n.B %s\n", escape(arg.Name))
+
+			text := arg.Description
+			if arg.Required {
+				text += " (Required.)"
+			}
+			if arg.Repeatable {
+				text += " (May be repeated.)"
+			}
+			if arg.Default != "" {
+				text += " Default: " + arg.Default + "."
+			}
+			if text == "" {
+				text = "Must match: " + arg.Pattern
+			}
+			fmt.Fprintf(w, "%s\n", escape(strings.TrimSpace(text)))
+		}
 	}
+	return nil
 }
 
 //
@@ -99,12 +335,51 @@ func showExamples(filter string) {
 //
 func (p *examplesCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 
-	if len(f.Args()) > 0 {
-		for _, name := range f.Args() {
-			showExamples(name)
+	filters := f.Args()
+	if len(filters) == 0 {
+		filters = []string{".*"}
+	}
+
+	//
+	// The default output is free-form text.
+	//
+	if p.Format == "text" {
+		for _, name := range filters {
+			showExamples(out, name)
 		}
-	} else {
-		showExamples(".*")
+		return subcommands.ExitSuccess
+	}
+
+	//
+	// Otherwise we need to build up the catalogue of
+	// protocol-tests to output.
+	//
+	var docs []protocolDoc
+	seen := make(map[string]bool)
+	for _, filter := range filters {
+		for _, name := range matchingHandlers(filter) {
+			if !seen[name] {
+				docs = append(docs, protocolDocumentation(name))
+				seen[name] = true
+			}
+		}
+	}
+
+	var err error
+	switch p.Format {
+	case "json":
+		err = showJSON(out, docs)
+	case "markdown":
+		err = showMarkdown(out, docs)
+	case "man":
+		err = showMan(out, docs)
+	default:
+		err = fmt.Errorf("unknown format '%s'", p.Format)
+	}
+
+	if err != nil {
+		fmt.Fprintf(out, "Error showing examples: %s\n", err.Error())
+		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/google/subcommands"
+)
+
+// examples runs the examples command, with the given format and filters,
+// and returns its output.
+func examples(t *testing.T, format string, filters ...string) (string, subcommands.ExitStatus) {
+	var buf bytes.Buffer
+	old := out
+	out = &buf
+	defer func() { out = old }()
+
+	p := &examplesCmd{}
+	f := flag.NewFlagSet("examples", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse(append([]string{"-format", format}, filters...)); err != nil {
+		t.Fatalf("failed to parse flags: %s", err.Error())
+	}
+
+	status := p.Execute(context.Background(), f)
+	return buf.String(), status
+}
+
+// Test the default, free-form, output.
+func TestExamplesText(t *testing.T) {
+	text, status := examples(t, "text", "^http$")
+	if status != subcommands.ExitSuccess {
+		t.Fatalf("unexpected status %v", status)
+	}
+	for _, expected := range []string{
+		"\nHTTP Tester\n-----------\n",
+		"Arguments which are supported are now shown:",
+		"\n  follow-redirects|",
+		"      header|sensitive,repeatable|",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("the output doesn't contain %q:\n%s", expected, text)
+		}
+	}
+	if strings.Contains(text, "Ping Tester") {
+		t.Errorf("the output wasn't filtered")
+	}
+}
+
+// Test the JSON catalogue.
+func TestExamplesJSON(t *testing.T) {
+	text, status := examples(t, "json", "^ping$", "^http$", "^ping$")
+	if status != subcommands.ExitSuccess {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	var docs []protocolDoc
+	if err := json.Unmarshal([]byte(text), &docs); err != nil {
+		t.Fatalf("the output isn't JSON: %s\n%s", err.Error(), text)
+	}
+	if len(docs) != 2 || docs[0].Name != "ping" || docs[1].Name != "http" {
+		t.Fatalf("unexpected protocol-tests %v", docs)
+	}
+
+	ping := docs[0]
+	if ping.Title != "Ping Tester" || strings.Join(ping.Examples, "\n") != "host.example.com must run ping" {
+		t.Errorf("unexpected documentation %v", ping)
+	}
+	if !strings.HasPrefix(ping.Description, "The ping tester invokes the system 'ping'") {
+		t.Errorf("the description wasn't unindented: %q", ping.Description)
+	}
+
+	found := false
+	for _, arg := range docs[1].Arguments {
+		if arg.Name == "header" && arg.Sensitive && arg.Repeatable {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("the header argument wasn't described: %v", docs[1].Arguments)
+	}
+}
+
+// Test the markdown catalogue.
+func TestExamplesMarkdown(t *testing.T) {
+	text, status := examples(t, "markdown", "^http$")
+	if status != subcommands.ExitSuccess {
+		t.Fatalf("unexpected status %v", status)
+	}
+	for _, expected := range []string{
+		"# Protocol Tests\n\n## http\n\nThe HTTP tester allows you",
+		"\n    https://steve.fi/ must run http with content 'Steve Kemp'\n",
+		"| Name | Type | Required | Default | Valid Value | Description |\n",
+		"| `status` | string | no | 200 | `^(any\\|[0-9]+(?:,[0-9]+)*)$` | ",
+		"| `header` | string | no |  | `^[A-Za-z0-9_-]+:.*$` | A request-header to send, as 'Name: value'. May be repeated. |\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("the output doesn't contain %q:\n%s", expected, text)
+		}
+	}
+}
+
+// Test the man-page catalogue.
+func TestExamplesMan(t *testing.T) {
+	text, status := examples(t, "man", "^http$")
+	if status != subcommands.ExitSuccess {
+		t.Fatalf("unexpected status %v", status)
+	}
+	if !strings.HasPrefix(text, ".TH OVERSEER-PROTOCOLS 7 \"\" \"overseer "+version+"\"\n.SH NAME\n") {
+		t.Errorf("unexpected header:\n%s", text)
+	}
+	for _, expected := range []string{
+		"\n.SS http\nThe HTTP tester allows you",
+		"\n.PP\nThis test is invoked via input like so:\n.nf\n.RS\nhttp://example.com/ must run http\n.RE\n.fi\n.PP\n",
+		"https://steve.fi/ must run http with pattern 'Steve\\es+Kemp'\n",
+		"\n.PP\nArguments:\n",
+		"\n.TP\n.B status\nThe expected status-code(s), comma-separated, or 'any'. Default: 200.\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("the output doesn't contain %q:\n%s", expected, text)
+		}
+	}
+}
+
+// Test that an unknown format is an error.
+func TestExamplesFormat(t *testing.T) {
+	text, status := examples(t, "yaml")
+	if status != subcommands.ExitFailure || !strings.Contains(text, "unknown format 'yaml'") {
+		t.Errorf("unexpected result %v %s", status, text)
+	}
+}
@@ -0,0 +1,149 @@
+// Notify
+//
+// The notify sub-command reads test-results, and routes them to the
+// receivers described by a file of routing rules.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/skx/overseer/bridge"
+	"github.com/skx/overseer/logger"
+	"github.com/skx/overseer/notify"
+)
+
+type notifyCmd struct {
+	// The file containing our routing rules.
+	Rules string
+
+	// Only check the rules, rather than running.
+	Check bool
+
+	// The bridge which reads our results.
+	_b *bridge.Bridge
+
+	// Any error applying the settings from the configuration file.
+	_err error
+}
+
+//
+// Glue
+//
+func (*notifyCmd) Name() string     { return "notify" }
+func (*notifyCmd) Synopsis() string { return "Route test-results to email, telegram, and webhooks" }
+func (*notifyCmd) Usage() string {
+	return `notify :
+  Read test-results, and notify the receivers chosen by the routing
+  rules in the file given via -rules, until terminated.
+
+  Each receiver is told once when a test starts failing, and again
+  once it recovers.  The state of the failing tests is stored in the
+  redis hash "overseer.notify.failing".
+
+  Failures which follow an escalation policy notify further receivers
+  as time passes, until they're acknowledged via "overseer ack".
+
+  The settings may be given in the "notify" section of the bridges
+  in the configuration file, as for any other bridge:
+
+    bridges:
+      notify:
+        rules: /etc/overseer/notify.yml
+
+  See the README for the format of the rules.
+`
+}
+
+//
+// Flag setup.
+//
+func (p *notifyCmd) SetFlags(f *flag.FlagSet) {
+
+	//
+	// We're a bridge, so we share their flags, and settings.
+	//
+	p._b = bridge.NewWithFlags("notify", f, conf)
+
+	f.StringVar(&p.Rules, "rules", "", "The file containing the routing rules.")
+	f.BoolVar(&p.Check, "check", false, "Check the routing rules, and exit.")
+
+	//
+	// The settings from the configuration file are applied before the
+	// command-line is parsed, so that flags take precedence.
+	//
+	p._err = conf.ApplyBridge("notify", f)
+}
+
+//
+// Entry-point.
+//
+func (p *notifyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if p._err != nil {
+		fmt.Printf("Invalid configuration: %s\n", p._err.Error())
+		return subcommands.ExitFailure
+	}
+	if p.Rules == "" {
+		fmt.Printf("Please specify the routing rules via -rules\n")
+		return subcommands.ExitFailure
+	}
+
+	rules, err := notify.Load(p.Rules)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+	if p.Check {
+		fmt.Printf("%s: %d receivers, %d routes\n", p.Rules, len(rules.Receivers), len(rules.Routes))
+		return subcommands.ExitSuccess
+	}
+
+	//
+	// Create our logger, and connect to redis.
+	//
+	b := p._b
+	err = b.Connect()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	n, err := notify.New(rules, b.Redis, b.Log)
+	if err != nil {
+		b.Log.Error("Failed to create receivers", logger.FieldError, err)
+		return subcommands.ExitFailure
+	}
+
+	//
+	// Send our notifications as they fall due, and escalate the
+	// failures which nobody has acknowledged.
+	//
+	b.Every(time.Second, func() {
+		n.Flush(false)
+	})
+	b.Every(notify.EscalateInterval, func() {
+		err := n.Escalate()
+		if err != nil {
+			b.Log.Error("Failed to escalate notifications", logger.FieldError, err)
+		}
+	})
+
+	//
+	// Process results until we're stopped.
+	//
+	err = b.Run(n.Process)
+	if err != nil {
+		b.Log.Error("Failed to read test-results", logger.FieldError, err)
+		return subcommands.ExitFailure
+	}
+
+	//
+	// Send anything which is waiting, rather than losing it.
+	//
+	n.Flush(true)
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,354 @@
+// Status
+//
+// The status sub-command reports upon the state of the queues, and
+// the workers and bridges which are processing them.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/subcommands"
+	"github.com/skx/overseer/queue"
+	"github.com/skx/overseer/redisconn"
+)
+
+type statusCmd struct {
+	// How we connect to redis.
+	redisconn.Options
+
+	// Should stale workers, and bridges, be removed from the registry?
+	Prune bool
+
+	_r redis.UniversalClient
+}
+
+//
+// Glue
+//
+func (*statusCmd) Name() string     { return "status" }
+func (*statusCmd) Synopsis() string { return "Show the state of the queues, workers, and bridges" }
+func (*statusCmd) Usage() string {
+	return `status :
+  Report upon the depth of the job and result queues, the age of the
+  oldest waiting job, and the workers and bridges which have registered
+  themselves.
+
+  Workers and bridges which have not refreshed their registration
+  recently are reported as stale, and may be removed from the registry
+  via -prune.
+`
+}
+
+//
+// Flag setup.
+//
+func (p *statusCmd) SetFlags(f *flag.FlagSet) {
+
+	p.Options.SetFlags(f, conf.Redis)
+
+	f.BoolVar(&p.Prune, "prune", false, "Remove stale workers, and bridges, from the registry.")
+}
+
+//
+// Show the depth of each queue, and the age of the oldest job.
+//
+func (p *statusCmd) showQueues(w *tabwriter.Writer) error {
+
+	fmt.Fprintf(w, "Queue\tDepth\tOldest\n")
+
+	now := time.Now()
+
+	for _, key := range queue.Keys() {
+		depth, err := p._r.LLen(key).Result()
+		if err != nil {
+			return err
+		}
+
+		//
+		// Jobs are appended to the tail of the list, so the
+		// oldest is at the head.
+		//
+		oldest := "-"
+		if depth > 0 {
+			var raw string
+			raw, err = p._r.LIndex(key, 0).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+
+			job, err := queue.Decode(raw)
+			if err == nil && job.Enqueued != 0 {
+				oldest = job.Age(now).Round(time.Second).String()
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", key, depth, oldest)
+	}
+
+	depth, err := p._r.LLen(queue.ResultsKey).Result()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\t%d\t-\n", queue.ResultsKey, depth)
+
+	depth, err = p._r.XLen(queue.StreamKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\t%d\t-\n", queue.StreamKey, depth)
+
+	depth, err = p._r.LLen(queue.DeadLetterKey).Result()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\t%d\t-\n", queue.DeadLetterKey, depth)
+
+	pending, err := p._r.HLen(queue.PendingKey).Result()
+	if err != nil {
+		return err
+	}
+	expired, err := p._r.Get(queue.ExpiredKey).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nPending tests: %d\n", pending)
+	fmt.Fprintf(w, "Expired jobs: %d\n\n", expired)
+	return nil
+}
+
+//
+// Show the consumer groups reading the results stream.
+//
+// The redis library predates XINFO, so we build the command ourselves,
+// and receive each group as a list of alternating names and values.
+//
+func (p *statusCmd) showGroups(w *tabwriter.Writer) error {
+
+	cmd := redis.NewSliceCmd("xinfo", "groups", queue.StreamKey)
+	p._r.Process(cmd)
+	groups, err := cmd.Result()
+	if err != nil {
+
+		// No stream, no groups.
+		if strings.HasPrefix(err.Error(), "ERR no such key") {
+			return nil
+		}
+		return err
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "Consumer Group\tConsumers\tPending\tLast Delivered\n")
+	for _, g := range groups {
+		fields, ok := g.([]interface{})
+		if !ok {
+			continue
+		}
+		info := make(map[string]string)
+		for i := 0; i+1 < len(fields); i += 2 {
+			info[fmt.Sprintf("%v", fields[i])] = fmt.Sprintf("%v", fields[i+1])
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", info["name"], info["consumers"], info["pending"], info["last-delivered-id"])
+	}
+	fmt.Fprintf(w, "\n")
+	return nil
+}
+
+//
+// Show each registered worker, and return the IDs of those which
+// have gone stale.
+//
+func (p *statusCmd) showWorkers(w *tabwriter.Writer) ([]string, error) {
+
+	ids, err := p._r.SMembers(queue.WorkersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	var stale []string
+	now := time.Now()
+
+	fmt.Fprintf(w, "Worker\tVersion\tFlags\tTag\tLocation\tJobs\tPassed\tFailed\tExpired\tJobs/min\tLast Seen\tCurrent Job\n")
+
+	for _, id := range ids {
+		info, err := p._r.HGetAll(queue.WorkerKey(id)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		//
+		// If the registration has expired, or the heartbeat is
+		// too old, then the worker is stale.
+		//
+		heartbeat, _ := strconv.ParseInt(info["heartbeat"], 10, 64)
+		seen := now.Sub(time.Unix(heartbeat, 0))
+		if len(info) == 0 || seen > queue.HeartbeatExpiry {
+			stale = append(stale, id)
+			continue
+		}
+
+		flags := ""
+		if info["ipv4"] == "1" {
+			flags += "IPv4 "
+		}
+		if info["ipv6"] == "1" {
+			flags += "IPv6"
+		}
+
+		//
+		// Calculate the throughput since the worker started.
+		//
+		rate := 0.0
+		jobs, _ := strconv.ParseInt(info["jobs"], 10, 64)
+		started, _ := strconv.ParseInt(info["started"], 10, 64)
+		uptime := now.Sub(time.Unix(started, 0))
+		if uptime.Minutes() > 0 {
+			rate = float64(jobs) / uptime.Minutes()
+		}
+
+		job := info["job"]
+		if job == "" {
+			job = "-"
+		} else {
+			since, _ := strconv.ParseInt(info["job_started"], 10, 64)
+			job = fmt.Sprintf("%s (%s)", job, now.Sub(time.Unix(since, 0)).Round(time.Second))
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.1f\t%s ago\t%s\n",
+			id, info["version"], flags, info["tag"], info["location"],
+			info["jobs"], info["passed"], info["failed"], info["expired"],
+			rate, seen.Round(time.Second), job)
+	}
+
+	return stale, nil
+}
+
+//
+// Show each registered bridge, and return the IDs of those which
+// have gone stale.
+//
+func (p *statusCmd) showBridges(w *tabwriter.Writer) ([]string, error) {
+
+	ids, err := p._r.SMembers(queue.BridgesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	sort.Strings(ids)
+
+	var stale []string
+	now := time.Now()
+
+	fmt.Fprintf(w, "\nBridge\tName\tReading\tProcessed\tSkipped\tFailed\tDead\tLast Seen\n")
+
+	for _, id := range ids {
+		info, err := p._r.HGetAll(queue.BridgeKey(id)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		heartbeat, _ := strconv.ParseInt(info["heartbeat"], 10, 64)
+		seen := now.Sub(time.Unix(heartbeat, 0))
+		if len(info) == 0 || seen > queue.HeartbeatExpiry {
+			stale = append(stale, id)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s ago\n",
+			id, info["name"], info["mode"], info["processed"],
+			info["skipped"], info["failed"], info["dead"],
+			seen.Round(time.Second))
+	}
+
+	return stale, nil
+}
+
+//
+// Entry-point.
+//
+func (p *statusCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	//
+	// Connect to the redis-host, and run a ping to make sure
+	// it worked.
+	//
+	var err error
+	p._r, err = p.Options.Connect()
+	if err != nil {
+		fmt.Printf("Redis connection failed: %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	err = p.showQueues(w)
+	if err != nil {
+		fmt.Printf("Failed to examine the queues: %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	err = p.showGroups(w)
+	if err != nil {
+		fmt.Printf("Failed to examine the consumer groups: %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	stale, err := p.showWorkers(w)
+	if err != nil {
+		fmt.Printf("Failed to examine the workers: %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+	staleBridges, err := p.showBridges(w)
+	if err != nil {
+		fmt.Printf("Failed to examine the bridges: %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+	w.Flush()
+
+	//
+	// Report upon the stale workers, and bridges, removing them if
+	// we should.
+	//
+	if len(stale) > 0 {
+		fmt.Fprintf(out, "\nStale workers:\n")
+		for _, id := range stale {
+			fmt.Fprintf(out, "  %s\n", id)
+
+			if p.Prune {
+				p._r.SRem(queue.WorkersKey, id)
+				p._r.Del(queue.WorkerKey(id))
+			}
+		}
+		if p.Prune {
+			fmt.Fprintf(out, "Removed %d stale worker(s)\n", len(stale))
+		}
+	}
+	if len(staleBridges) > 0 {
+		fmt.Fprintf(out, "\nStale bridges:\n")
+		for _, id := range staleBridges {
+			fmt.Fprintf(out, "  %s\n", id)
+
+			if p.Prune {
+				p._r.SRem(queue.BridgesKey, id)
+				p._r.Del(queue.BridgeKey(id))
+			}
+		}
+		if p.Prune {
+			fmt.Fprintf(out, "Removed %d stale bridge(s)\n", len(staleBridges))
+		}
+	}
+
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/google/subcommands"
+	"github.com/skx/overseer/queue"
+	"github.com/skx/overseer/redisconn"
+)
+
+// newStatus returns a status command for a redis holding two queued jobs,
+// some results, and a live and a stale worker and bridge.
+func newStatus(t *testing.T) (*statusCmd, *miniredis.Miniredis) {
+	m := miniredis.RunT(t)
+	r := redis.NewClient(&redis.Options{Addr: m.Addr()})
+
+	//
+	// The times are stored in seconds, so we start at the beginning of
+	// one for the ages we report to be those we've set.
+	//
+	now := time.Now().Truncate(time.Second).Add(time.Second)
+	time.Sleep(time.Until(now))
+
+	for i, age := range []time.Duration{90 * time.Second, 30 * time.Second} {
+		job := queue.New(newTest("10.0.0."+strconv.Itoa(i+1)), 0)
+		job.Enqueued = now.Add(-age).Unix()
+		raw, _ := job.Encode()
+		r.RPush(queue.Key(queue.PriorityNormal), raw)
+	}
+	r.RPush(queue.ResultsKey, "{}", "{}", "{}")
+	r.RPush(queue.DeadLetterKey, "{}")
+	r.HSet(queue.PendingKey, "a", "1")
+	r.HSet(queue.PendingKey, "b", "1")
+	r.Set(queue.ExpiredKey, 4, 0)
+	r.XGroupCreateMkStream(queue.StreamKey, "email", "$")
+
+	unix := func(d time.Duration) string {
+		return strconv.FormatInt(now.Add(-d).Unix(), 10)
+	}
+
+	r.SAdd(queue.WorkersKey, "host1-1", "host2-1")
+	r.HMSet(queue.WorkerKey("host1-1"), map[string]interface{}{
+		"version":     "1.2",
+		"tag":         "dc1",
+		"location":    "london",
+		"ipv4":        "1",
+		"ipv6":        "1",
+		"jobs":        "20",
+		"passed":      "18",
+		"failed":      "2",
+		"expired":     "0",
+		"started":     unix(10 * time.Minute),
+		"heartbeat":   unix(5 * time.Second),
+		"job":         "10.0.0.3 must run ping",
+		"job_started": unix(3 * time.Second),
+	})
+	r.HMSet(queue.WorkerKey("host2-1"), map[string]interface{}{
+		"version":   "1.2",
+		"heartbeat": unix(time.Hour),
+	})
+
+	r.SAdd(queue.BridgesKey, "email-1", "webhook-1")
+	r.HMSet(queue.BridgeKey("email-1"), map[string]interface{}{
+		"name":      "email",
+		"mode":      "stream",
+		"processed": "7",
+		"skipped":   "1",
+		"failed":    "0",
+		"dead":      "0",
+		"heartbeat": unix(2 * time.Second),
+	})
+	r.HMSet(queue.BridgeKey("webhook-1"), map[string]interface{}{
+		"name":      "webhook",
+		"heartbeat": unix(time.Hour),
+	})
+
+	p := &statusCmd{Options: redisconn.Defaults()}
+	p.RedisHost = m.Addr()
+	return p, m
+}
+
+// status runs the status command, and returns its output with the columns
+// separated by a single space.
+func status(t *testing.T, p *statusCmd) []string {
+	var buf bytes.Buffer
+	old := out
+	out = &buf
+	defer func() { out = old }()
+
+	if res := p.Execute(context.Background(), flag.NewFlagSet("status", flag.ContinueOnError)); res != subcommands.ExitSuccess {
+		t.Fatalf("unexpected status %v:\n%s", res, buf.String())
+	}
+
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	return lines
+}
+
+// contains returns true if the lines contain the given line.
+func contains(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+// Test the report of the queues, workers, and bridges.
+func TestStatus(t *testing.T) {
+	p, _ := newStatus(t)
+	lines := status(t, p)
+
+	for _, expected := range []string{
+		"Queue Depth Oldest",
+		queue.Key(queue.PriorityHigh) + " 0 -",
+		queue.Key(queue.PriorityNormal) + " 2 1m30s",
+		queue.ResultsKey + " 3 -",
+		queue.StreamKey + " 0 -",
+		queue.DeadLetterKey + " 1 -",
+		"Pending tests: 2",
+		"Expired jobs: 4",
+		"Consumer Group Consumers Pending Last Delivered",
+		"email 0 0 0-0",
+		"Worker Version Flags Tag Location Jobs Passed Failed Expired Jobs/min Last Seen Current Job",
+		"host1-1 1.2 IPv4 IPv6 dc1 london 20 18 2 0 2.0 5s ago 10.0.0.3 must run ping (3s)",
+		"Bridge Name Reading Processed Skipped Failed Dead Last Seen",
+		"email-1 email stream 7 1 0 0 2s ago",
+		"Stale workers:",
+		"host2-1",
+		"Stale bridges:",
+		"webhook-1",
+	} {
+		if !contains(lines, expected) {
+			t.Errorf("the output doesn't contain %q:\n%s", expected, strings.Join(lines, "\n"))
+		}
+	}
+
+	//
+	// Stale workers, and bridges, are only reported.
+	//
+	for _, line := range lines {
+		if strings.HasPrefix(line, "Removed") || strings.HasPrefix(line, "host2-1 ") || strings.HasPrefix(line, "webhook-1 ") {
+			t.Errorf("unexpected line %q", line)
+		}
+	}
+}
+
+// Test that stale workers, and bridges, may be removed.
+func TestStatusPrune(t *testing.T) {
+	p, m := newStatus(t)
+	p.Prune = true
+	lines := status(t, p)
+
+	if !contains(lines, "Removed 1 stale worker(s)") || !contains(lines, "Removed 1 stale bridge(s)") {
+		t.Errorf("the removals weren't reported:\n%s", strings.Join(lines, "\n"))
+	}
+
+	workers, _ := m.Members(queue.WorkersKey)
+	bridges, _ := m.Members(queue.BridgesKey)
+	if strings.Join(workers, ",") != "host1-1" || strings.Join(bridges, ",") != "email-1" {
+		t.Errorf("unexpected registrations %v %v", workers, bridges)
+	}
+	if m.Exists(queue.WorkerKey("host2-1")) || m.Exists(queue.BridgeKey("webhook-1")) {
+		t.Errorf("the stale registrations weren't removed")
+	}
+}
@@ -5,24 +5,28 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/google/subcommands"
 	graphite "github.com/marpaia/graphite-golang"
 	_ "github.com/skx/golang-metrics"
+	"github.com/skx/overseer/config"
+	"github.com/skx/overseer/logger"
 	"github.com/skx/overseer/parser"
 	"github.com/skx/overseer/protocols"
+	"github.com/skx/overseer/queue"
+	"github.com/skx/overseer/redisconn"
 	"github.com/skx/overseer/test"
 )
 
@@ -43,36 +47,77 @@ type workerCmd struct {
 	// Prior to retrying a failed test how long should we pause?
 	RetryDelay time.Duration
 
-	// The redis-host we're going to connect to for our queues.
-	RedisHost string
-
-	// The redis-database we're going to use.
-	RedisDB int
-
-	// The (optional) redis-password we'll use.
-	RedisPassword string
-
-	// The redis-socket we're going to use.
-	// (If used, we ignore the specified host / port)
-	RedisSocket string
-
-	// Redis connection timeout
-	RedisDialTimeout time.Duration
+	// How we connect to redis for our queues.
+	redisconn.Options
 
 	// Tag applied to all results
 	Tag string
 
+	// Location applied to all results
+	Location string
+
 	// How long should tests run for?
 	Timeout time.Duration
 
 	// Should the testing, and the tests, be verbose?
 	Verbose bool
 
+	// How we log.
+	Log logger.Options
+
+	// How we publish test-results.
+	Results queue.ResultsOptions
+
+	// After this many jobs the queues are checked lowest-priority
+	// first, so that low-priority jobs are not starved.
+	Starvation int
+
+	// The number of jobs we've fetched.
+	_fetched int
+
 	// The handle to our redis-server
-	_r *redis.Client
+	_r redis.UniversalClient
+
+	// Our logger, which identifies this worker.
+	_log *logger.Logger
+
+	// The handle to our graphite-server, and its settings.
+	_g       *graphite.Graphite
+	_metrics config.Metrics
+
+	// The flags which were set upon the command-line, which take
+	// precedence over the configuration file when it is reloaded.
+	_flags map[string]bool
+
+	// Configurations which have been reloaded, waiting to be applied.
+	_reload chan *config.Config
+
+	// The state we publish in our registration.
+	_state workerState
+}
+
+// workerState holds the details of what a worker is doing, which are
+// published to redis so that `overseer status` can report upon them.
+type workerState struct {
+	sync.Mutex
+
+	// ID is the unique identifier of this worker.
+	ID string
+
+	// Started is the time the worker was launched.
+	Started time.Time
 
-	// The handle to our graphite-server
-	_g *graphite.Graphite
+	// Job is the (sanitized) input of the job being executed.
+	Job string
+
+	// JobStarted is the time the current job began.
+	JobStarted time.Time
+
+	// Counters for the jobs we've executed, and their results.
+	Jobs    int64
+	Passed  int64
+	Failed  int64
+	Expired int64
 }
 
 // Glue
@@ -81,58 +126,48 @@ func (*workerCmd) Synopsis() string { return "Fetch jobs from the central queue
 func (*workerCmd) Usage() string {
 	return `worker :
   Execute tests pulled from the central redis queue, until terminated.
+
+  Jobs are fetched from the high, normal, and low priority queues in
+  turn, with the order reversed every -starvation jobs.
+
+  Jobs which have outlived the TTL they were enqueued with are discarded,
+  and counted in the redis key "overseer.jobs.expired".
+
+  Each worker registers itself in redis, and refreshes the registration
+  regularly, so that "overseer status" can report upon it.
+
+  Sending the worker a SIGHUP will reload the configuration file, the
+  new settings being applied once any job in progress has completed.
+  Settings given upon the command-line are not changed.
 `
 }
 
-// MetricsFromEnvironment sets up a carbon connection from the environment
-// if suitable values are found
-func (p *workerCmd) MetricsFromEnvironment() {
+// setupMetrics sets up a carbon connection, if a metrics-host has been
+// configured.
+func (p *workerCmd) setupMetrics(m config.Metrics) {
 
-	//
-	// Get the hostname to connect to.
-	//
-	host := os.Getenv("METRICS_HOST")
-	if host == "" {
-		host = os.Getenv("METRICS")
+	p._metrics = m
+
+	if p._g != nil {
+		p._g.Disconnect()
+		p._g = nil
 	}
 
 	// No host then we'll return
-	if host == "" {
+	if m.Host == "" {
 		return
 	}
 
-	// Split the into Host + Port
-	ho, pr, err := net.SplitHostPort(host)
+	host, port, err := m.Address()
 	if err != nil {
-		// If that failed we assume the port was missing
-		ho = host
-		pr = "2003"
-	}
-
-	// Setup the protocol to use
-	protocol := os.Getenv("METRICS_PROTOCOL")
-	if protocol == "" {
-		protocol = "udp"
-	}
-
-	// Ensure that the port is an integer
-	port, err := strconv.Atoi(pr)
-	if err == nil {
-		p._g, err = graphite.GraphiteFactory(protocol, ho, port, "")
-
-		if err != nil {
-			fmt.Printf("Error setting up metrics - skipping - %s\n", err.Error())
-		}
-	} else {
-		fmt.Printf("Error setting up metrics - failed to convert port to number - %s\n", err.Error())
-
+		p._log.Error("Error setting up metrics - skipping", logger.FieldError, err)
+		return
 	}
-}
 
-// verbose shows a message only if we're running verbosely
-func (p *workerCmd) verbose(txt string) {
-	if p.Verbose {
-		fmt.Print(txt)
+	p._g, err = graphite.GraphiteFactory(m.Protocol, host, port, "")
+	if err != nil {
+		p._g = nil
+		p._log.Error("Error setting up metrics - skipping", logger.FieldError, err)
 	}
 }
 
@@ -140,45 +175,18 @@ func (p *workerCmd) verbose(txt string) {
 func (p *workerCmd) SetFlags(f *flag.FlagSet) {
 
 	//
-	// Setup the default options here, these can be loaded/replaced
-	// via a configuration-file if it is present.
-	//
-	var defaults workerCmd
-	defaults.IPv4 = true
-	defaults.IPv6 = true
-	defaults.Retry = true
-	defaults.RetryCount = 5
-	defaults.RetryDelay = 5 * time.Second
-	defaults.Tag = ""
-	defaults.Timeout = 10 * time.Second
-	defaults.Verbose = false
-	defaults.RedisHost = "localhost:6379"
-	defaults.RedisDB = 0
-	defaults.RedisPassword = ""
-	defaults.RedisDialTimeout = 5 * time.Second
-
-	//
-	// If we have a configuration file then load it
+	// Our defaults come from the configuration file, if present.
 	//
-	if len(os.Getenv("OVERSEER")) > 0 {
-		cfg, err := ioutil.ReadFile(os.Getenv("OVERSEER"))
-		if err == nil {
-			err = json.Unmarshal(cfg, &defaults)
-			if err != nil {
-				fmt.Printf("WARNING: Error loading overseer.json - %s\n",
-					err.Error())
-			}
-		} else {
-			fmt.Printf("WARNING: Failed to read configuration-file - %s\n",
-				err.Error())
-		}
-	}
+	defaults := conf.Worker
 
 	//
 	// Allow these defaults to be changed by command-line flags
 	//
 	// Verbose
-	f.BoolVar(&p.Verbose, "verbose", defaults.Verbose, "Show more output.")
+	f.BoolVar(&p.Verbose, "verbose", defaults.Verbose, "Show more output, the same as -log-level=debug.")
+
+	// Logging
+	p.Log.SetFlags(f, conf.Log)
 
 	// Protocols
 	f.BoolVar(&p.IPv4, "4", defaults.IPv4, "Enable IPv4 tests.")
@@ -193,17 +201,32 @@ func (p *workerCmd) SetFlags(f *flag.FlagSet) {
 	f.DurationVar(&p.RetryDelay, "retry-delay", defaults.RetryDelay, "The time to sleep between failing tests.")
 
 	// Redis
-	f.StringVar(&p.RedisHost, "redis-host", defaults.RedisHost, "Specify the address of the redis queue.")
-	f.IntVar(&p.RedisDB, "redis-db", defaults.RedisDB, "Specify the database-number for redis.")
-	f.StringVar(&p.RedisPassword, "redis-pass", defaults.RedisPassword, "Specify the password for the redis queue.")
-	f.StringVar(&p.RedisSocket, "redis-socket", defaults.RedisSocket, "If set, will be used for the redis connections.")
+	p.Options.SetFlags(f, conf.Redis)
 
 	// Tag
 	f.StringVar(&p.Tag, "tag", defaults.Tag, "Specify the tag to add to all test-results.")
+
+	// Location
+	f.StringVar(&p.Location, "location", defaults.Location, "Specify the location of this worker, which is added to all test-results.")
+
+	// Results
+	p.Results.SetFlags(f, conf.Results)
+
+	// Priorities
+	f.IntVar(&p.Starvation, "starvation", defaults.Starvation, "After this many jobs fetch one from the lowest-priority queue first, zero to disable.")
 }
 
 // notify is used to store the result of a test in our redis queue.
-func (p *workerCmd) notify(test test.Test, result error) error {
+//
+// The target is the address the test was run against, which is only
+// published as such; the input is that of the test, so that it keeps
+// the name, or URL, which was submitted.  Any password, or other
+// sensitive argument, is removed from the input before it is published.
+// The ID of the result is that of the original test, so that it matches
+// the ID of the job and of our log messages.
+//
+// Any timings of the phases of the test are included, in milliseconds.
+func (p *workerCmd) notify(test test.Test, target string, result error, timings map[string]time.Duration) error {
 
 	//
 	// If we don't have a redis-server then return immediately.
@@ -219,14 +242,28 @@ func (p *workerCmd) notify(test test.Test, result error) error {
 	// The message we'll publish will be a JSON hash
 	//
 	msg := map[string]string{
-		"input":  test.Input,
+		"id":     test.ID(),
+		"input":  test.Sanitize(),
 		"result": "passed",
-		"target": test.Target,
+		"target": target,
 		"time":   fmt.Sprintf("%d", time.Now().Unix()),
 		"type":   test.Type,
 		"tag":    p.Tag,
 	}
 
+	//
+	// Only add the location, and severity, if we have them.
+	//
+	if p.Location != "" {
+		msg["location"] = p.Location
+	}
+	if test.Severity != "" {
+		msg["severity"] = test.Severity
+	}
+	for phase, d := range timings {
+		msg["timing."+phase] = milliseconds(d)
+	}
+
 	//
 	// Was the test result a failure?  If so update the object
 	// to contain the failure-message, and record that it was
@@ -238,21 +275,23 @@ func (p *workerCmd) notify(test test.Test, result error) error {
 	}
 
 	//
-	// Convert the result-object to a JSON string we can add to
-	// the redis-queue for the notifier to work with.
+	// Update our counters.
 	//
-	j, err := json.Marshal(msg)
-	if err != nil {
-		fmt.Printf("Failed to encode test-result to JSON: %s", err.Error())
-		return err
+	p._state.Lock()
+	if result != nil {
+		p._state.Failed++
+	} else {
+		p._state.Passed++
 	}
+	p._state.Unlock()
 
 	//
-	// Publish the message to the queue.
+	// Publish the message to the list, or stream, for the
+	// notifiers to work with.
 	//
-	_, err = p._r.RPush("overseer.results", j).Result()
+	err := p.Results.Publish(p._r, msg)
 	if err != nil {
-		fmt.Printf("Result addition failed: %s\n", err)
+		p._log.Error("Result addition failed", logger.FieldError, err)
 		return err
 	}
 
@@ -273,6 +312,12 @@ func (p *workerCmd) alphaNumeric(input string) string {
 	return (reg.ReplaceAllString(input, "_"))
 }
 
+// milliseconds formats a duration as a number of milliseconds, as used
+// by our metrics.
+func milliseconds(d time.Duration) string {
+	return fmt.Sprintf("%f", float64(d)/float64(time.Millisecond))
+}
+
 // formatMetrics Format a test for metrics submission.
 //
 // This is a little weird because ideally we'd want to submit to the
@@ -314,6 +359,11 @@ func (p *workerCmd) runTest(tst test.Test, opts test.Options) error {
 	testType := tst.Type
 	testTarget := tst.Target
 
+	//
+	// Each message we log about this test identifies it.
+	//
+	log := p._log.With(logger.FieldTestID, tst.ID(), logger.FieldType, testType)
+
 	//
 	// Look for a suitable protocol handler
 	//
@@ -346,27 +396,21 @@ func (p *workerCmd) runTest(tst test.Test, opts test.Options) error {
 
 		//
 		// We failed to resolve the target, so we have to raise
-		// a failure.  But before we do that we need to sanitize
-		// the test.
-		//
-		tst.Input = tst.Sanitize()
-
-		//
-		// Notify the world about our DNS-failure.
+		// a failure.
 		//
-		p.notify(tst, fmt.Errorf("failed to resolve name %s", testTarget))
+		p.notify(tst, tst.Target, fmt.Errorf("failed to resolve name %s", testTarget), nil)
 
 		//
 		// Otherwise we're done.
 		//
-		fmt.Printf("WARNING: Failed to resolve %s for %s test!\n", testTarget, testType)
+		log.Warn("Failed to resolve target", "host", testTarget, logger.FieldError, err)
 		return err
 	}
 
 	// Calculate the time the DNS-resolution took - in milliseconds.
 	timeB := time.Now()
-	duration := timeB.Sub(timeA)
-	diff := fmt.Sprintf("%f", float64(duration)/float64(time.Millisecond))
+	lookup := timeB.Sub(timeA)
+	diff := milliseconds(lookup)
 
 	// Record time in our metric hash
 	metrics["overseer.dns."+p.alphaNumeric(testTarget)+".duration"] = diff
@@ -398,7 +442,8 @@ func (p *workerCmd) runTest(tst test.Test, opts test.Options) error {
 		//
 		// Show what we're doing.
 		//
-		p.verbose(fmt.Sprintf("Running '%s' test against %s (%s)\n", testType, testTarget, target))
+		tlog := log.With(logger.FieldTarget, target)
+		tlog.Debug("Running test", "host", testTarget)
 
 		//
 		// We'll repeat failing tests up to five times by default
@@ -449,15 +494,18 @@ func (p *workerCmd) runTest(tst test.Test, opts test.Options) error {
 			c++
 
 			//
-			// Run the test
+			// Run the test, giving it a logger which
+			// identifies this attempt.
 			//
+			alog := tlog.With(logger.FieldAttempt, fmt.Sprintf("%d/%d", attempt, maxAttempts))
+			opts.Log = alog
 			result = tmp.RunTest(tst, target, opts)
 
 			//
 			// If the test passed then we're good.
 			//
 			if result == nil {
-				p.verbose(fmt.Sprintf("\t[%d/%d] - Test passed.\n", attempt, maxAttempts))
+				alog.Debug("Test passed")
 
 				// break out of loop
 				attempt = maxAttempts + 1
@@ -470,12 +518,12 @@ func (p *workerCmd) runTest(tst test.Test, opts test.Options) error {
 				// It will be repeated before a notifier
 				// is invoked.
 				//
-				p.verbose(fmt.Sprintf("\t[%d/%d] Test failed: %s\n", attempt, maxAttempts, result.Error()))
+				alog.Debug("Test failed", logger.FieldError, result)
 
 				//
 				// Sleep before retrying the failing test.
 				//
-				p.verbose(fmt.Sprintf("\t\tSleeping for %s before retrying\n", p.RetryDelay.String()))
+				alog.Debug("Sleeping before retrying", "delay", p.RetryDelay)
 				time.Sleep(p.RetryDelay)
 			}
 		}
@@ -487,38 +535,54 @@ func (p *workerCmd) runTest(tst test.Test, opts test.Options) error {
 		//
 		timeB = time.Now()
 		duration := timeB.Sub(timeA)
-		diff = fmt.Sprintf("%f", float64(duration)/float64(time.Millisecond))
+		diff = milliseconds(duration)
 		metrics[p.formatMetrics(tst, "duration")] = diff
 		metrics[p.formatMetrics(tst, "attempts")] = fmt.Sprintf("%d", c)
 
 		//
-		// Post the result of the test to the notifier.
-		//
-		// Before we trigger the notification we need to
-		// update the target to the thing we probed, which might
-		// not necessarily be that which was originally submitted.
+		// Some tests report how long each phase of their last
+		// attempt took.  As they're given an address the time we
+		// took to resolve the target counts towards their DNS.
 		//
-		//  i.e. "mail.steve.org.uk must run ssh" might become
-		// "1.2.3.4 must run ssh" as a result of the DNS lookup.
+		var timings map[string]time.Duration
+		if reporter, ok := tmp.(protocols.TimingReporter); ok {
+			timings = make(map[string]time.Duration)
+			for phase, d := range reporter.Timings() {
+				timings[phase] = d
+			}
+			timings["dns"] += lookup
+
+			for phase, d := range timings {
+				metrics[p.formatMetrics(tst, "timing."+phase)] = milliseconds(d)
+			}
+		}
+
 		//
-		// However because we might run the same test against
-		// multiple hosts we need to do this with a copy so that
-		// we don't lose the original target.
+		// Log the result.
 		//
-		copy := tst
-		copy.Target = target
+		if result != nil {
+			tlog.Warn("Test failed", logger.FieldAttempt, c+1, logger.FieldDuration, duration, logger.FieldError, result)
+		} else {
+			tlog.Info("Test passed", logger.FieldAttempt, c+1, logger.FieldDuration, duration)
+		}
 
 		//
-		// We also want to filter out any password which was found
-		// on the input-line.
+		// Post the result of the test to the notifier.
 		//
-		copy.Input = tst.Sanitize()
-
+		// The target of the result is the thing we probed, which
+		// might not necessarily be that which was originally
+		// submitted.
+		//
+		//  i.e. "mail.steve.org.uk must run ssh" might have been
+		// run against 1.2.3.4 as a result of the DNS lookup.
 		//
-		// Now we can trigger the notification with our updated
-		// copy of the test.
+		// The input is left alone, so that the result describes
+		// the test which was submitted.
 		//
-		p.notify(copy, result)
+		// (Any password found on the input-line is filtered out
+		// when the result is published.)
+		//
+		p.notify(tst, target, result, timings)
 	}
 
 	//
@@ -534,11 +598,13 @@ func (p *workerCmd) runTest(tst test.Test, opts test.Options) error {
 	//  3.  The number of attempts (retries, really) before the
 	//      test was completed.
 	//
+	// Tests which report their timings, such as http, also have
+	// the duration of each phase of their last attempt.
+	//
 	if p._g != nil {
 		for key, val := range metrics {
-			v := os.Getenv("METRICS_VERBOSE")
-			if v != "" {
-				fmt.Printf("%s %s\n", key, val)
+			if p._metrics.Verbose {
+				p._log.Info("Sending metric", "metric", key, "value", val)
 			}
 
 			p._g.SimpleSend(key, val)
@@ -548,49 +614,368 @@ func (p *workerCmd) runTest(tst test.Test, opts test.Options) error {
 	return nil
 }
 
+// queues returns the names of the job-queues, in the order they should
+// be checked for the next job.
+//
+// Usually this is highest-priority first, however every `Starvation`
+// jobs the order is reversed, so that low-priority jobs still make
+// progress when there is a constant stream of more important ones.
+func (p *workerCmd) queues() []string {
+	keys := queue.Keys()
+
+	p._fetched++
+	if p.Starvation > 0 && p._fetched%p.Starvation == 0 {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+	return keys
+}
+
+// fetch retrieves the next job from the queues, waiting for a while
+// for one to become available.
+//
+// If no job becomes available then redis.Nil is returned.
+func (p *workerCmd) fetch() (string, error) {
+
+	keys := p.queues()
+
+	//
+	// A BLPOP of several keys is refused by a Redis Cluster, because
+	// the queues live in different slots.  So there we poll each
+	// queue in turn instead.
+	//
+	if redisconn.IsCluster(p._r) {
+		for _, key := range keys {
+			job, err := p._r.LPop(key).Result()
+			if err == redis.Nil {
+				continue
+			}
+			return job, err
+		}
+		time.Sleep(time.Second)
+		return "", redis.Nil
+	}
+
+	//
+	// res[0] will be the list-name (i.e. "overseer.jobs")
+	//
+	// res[1] will be the value removed from the list.
+	//
+	res, err := p._r.BLPop(queue.HeartbeatInterval, keys...).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(res) < 2 {
+		return "", fmt.Errorf("unexpected reply from BLPOP: %v", res)
+	}
+	return res[1], nil
+}
+
+// processJob decodes a job retrieved from the queue, and executes it
+// unless it has expired.
+func (p *workerCmd) processJob(parse *parser.Parser, raw string, opts test.Options) {
+
+	//
+	// Decode the envelope.
+	//
+	job, err := queue.Decode(raw)
+	if err != nil {
+		p._log.Error("Error decoding job from queue", "job", raw, logger.FieldError, err)
+		return
+	}
+
+	//
+	// The test is no longer pending, so it may be enqueued again.
+	//
+	if job.ID != "" {
+		p._r.HDel(queue.PendingKey, job.ID)
+	}
+
+	//
+	// If the job has expired then drop it, and record that we
+	// did so.
+	//
+	if job.Expired(time.Now()) {
+		p._log.Warn("Discarding expired job",
+			logger.FieldTestID, job.ID,
+			"age", job.Age(time.Now()),
+			"source", job.Source,
+			"line", job.Line)
+
+		p._r.Incr(queue.ExpiredKey)
+		if p._g != nil {
+			p._g.SimpleSend(queue.ExpiredKey, "1")
+		}
+
+		p._state.Lock()
+		p._state.Expired++
+		p._state.Unlock()
+		return
+	}
+
+	//
+	// Parse it
+	//
+	tst, err := parse.ParseLine(job.Input, nil)
+	if err != nil {
+		p._log.Error("Error parsing job from queue", "job", job.Input, logger.FieldError, err)
+		return
+	}
+
+	//
+	// Record where the test came from.
+	//
+	tst.Source = job.Source
+	tst.Line = job.Line
+
+	//
+	// Record what we're doing.
+	//
+	p._state.Lock()
+	p._state.Job = tst.Sanitize()
+	p._state.JobStarted = time.Now()
+	p._state.Jobs++
+	p._state.Unlock()
+
+	p.runTest(tst, opts)
+
+	p._state.Lock()
+	p._state.Job = ""
+	p._state.Unlock()
+}
+
+// register publishes our state to redis, so that `overseer status`
+// can report upon it.
+//
+// The registration expires unless it is refreshed, which allows dead
+// workers to be detected.
+func (p *workerCmd) register() error {
+
+	p._state.Lock()
+	info := map[string]interface{}{
+		"id":        p._state.ID,
+		"version":   version,
+		"ipv4":      p.IPv4,
+		"ipv6":      p.IPv6,
+		"tag":       p.Tag,
+		"location":  p.Location,
+		"started":   p._state.Started.Unix(),
+		"heartbeat": time.Now().Unix(),
+		"job":       p._state.Job,
+		"jobs":      p._state.Jobs,
+		"passed":    p._state.Passed,
+		"failed":    p._state.Failed,
+		"expired":   p._state.Expired,
+	}
+	if p._state.Job != "" {
+		info["job_started"] = p._state.JobStarted.Unix()
+	}
+	key := queue.WorkerKey(p._state.ID)
+	id := p._state.ID
+	p._state.Unlock()
+
+	_, err := p._r.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(key)
+		pipe.HMSet(key, info)
+		pipe.Expire(key, queue.HeartbeatExpiry)
+		pipe.SAdd(queue.WorkersKey, id)
+		return nil
+	})
+	return err
+}
+
+// heartbeat refreshes our registration, forever.
+func (p *workerCmd) heartbeat() {
+	ticker := time.NewTicker(queue.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := p.register()
+		if err != nil {
+			p._log.Error("Failed to update worker registration", logger.FieldError, err)
+		}
+	}
+}
+
+// reloadOnHangup reloads our configuration file whenever we receive
+// a SIGHUP, forever.
+//
+// The new configuration is validated here, but it is applied by the
+// main loop between jobs so that no job is interrupted.
+func (p *workerCmd) reloadOnHangup() {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if configFile == "" {
+			p._log.Warn("Received SIGHUP, but no configuration file is in use")
+			continue
+		}
+
+		cfg, err := config.Load(configFile)
+		if err != nil {
+			p._log.Error("Ignoring the reloaded configuration", logger.FieldError, err)
+			continue
+		}
+
+		// Replace any configuration still waiting to be applied.
+		select {
+		case <-p._reload:
+		default:
+		}
+		p._reload <- cfg
+	}
+}
+
+// setupLog applies our logging options to our logger.
+//
+// Running verbosely is the same as logging at the debug level, unless
+// a level was given explicitly upon the command-line.
+func (p *workerCmd) setupLog() error {
+
+	level, err := logger.ParseLevel(p.Log.Level)
+	if err != nil {
+		return err
+	}
+	format, err := logger.ParseFormat(p.Log.Format)
+	if err != nil {
+		return err
+	}
+	if p.Verbose && !p._flags["log-level"] {
+		level = logger.LevelDebug
+	}
+
+	p._log.SetLevel(level)
+	p._log.SetFormat(format)
+	return nil
+}
+
+// applyConfig updates our settings from a reloaded configuration file,
+// leaving alone any which were set upon the command-line.
+func (p *workerCmd) applyConfig(cfg *config.Config) {
+
+	w := cfg.Worker
+
+	settings := map[string]func(){
+		"4":           func() { p.IPv4 = w.IPv4 },
+		"6":           func() { p.IPv6 = w.IPv6 },
+		"retry":       func() { p.Retry = w.Retry },
+		"retry-count": func() { p.RetryCount = w.RetryCount },
+		"retry-delay": func() { p.RetryDelay = w.RetryDelay },
+		"tag":         func() { p.Tag = w.Tag },
+		"location":    func() { p.Location = w.Location },
+		"timeout":     func() { p.Timeout = w.Timeout },
+		"verbose":     func() { p.Verbose = w.Verbose },
+		"starvation":  func() { p.Starvation = w.Starvation },
+		"log-level":   func() { p.Log.Level = cfg.Log.Level },
+		"log-format":  func() { p.Log.Format = cfg.Log.Format },
+
+		"results":         func() { p.Results.Mode = cfg.Results.Mode },
+		"results-max-len": func() { p.Results.MaxLen = cfg.Results.MaxLen },
+		"results-max-age": func() { p.Results.MaxAge = cfg.Results.MaxAge },
+	}
+
+	p._state.Lock()
+	for name, apply := range settings {
+		if !p._flags[name] {
+			apply()
+		}
+	}
+	p._state.Unlock()
+
+	err := p.setupLog()
+	if err != nil {
+		p._log.Error("Failed to apply the log settings", logger.FieldError, err)
+	}
+
+	if cfg.Metrics != p._metrics {
+		p.setupMetrics(cfg.Metrics)
+	}
+
+	//
+	// We can't change our redis connection without risking the
+	// loss of the job we've fetched, or the result we're about to
+	// publish.
+	//
+	if cfg.Redis != conf.Redis {
+		p._log.Warn("The redis settings have changed, restart the worker to apply them")
+	}
+
+	conf = cfg
+	p._log.Info("Reloaded configuration", "path", cfg.Path)
+
+	//
+	// Publish our new settings.
+	//
+	err = p.register()
+	if err != nil {
+		p._log.Error("Failed to update worker registration", logger.FieldError, err)
+	}
+}
+
 // Entry-point.
 func (p *workerCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 
 	//
-	// Connect to the redis-host.
+	// Record the flags which were set explicitly, which take
+	// precedence over our configuration file.
 	//
-	if p.RedisSocket != "" {
-		p._r = redis.NewClient(&redis.Options{
-			Network:  "unix",
-			Addr:     p.RedisSocket,
-			Password: p.RedisPassword,
-			DB:       p.RedisDB,
-		})
-	} else {
-		p._r = redis.NewClient(&redis.Options{
-			Addr:        p.RedisHost,
-			Password:    p.RedisPassword,
-			DB:          p.RedisDB,
-			DialTimeout: p.RedisDialTimeout,
-		})
+	p._flags = make(map[string]bool)
+	f.Visit(func(fl *flag.Flag) {
+		p._flags[fl.Name] = true
+	})
+
+	//
+	// Create our logger, every message from which identifies us.
+	//
+	host, _ := os.Hostname()
+	p._state.ID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	p._state.Started = time.Now()
+
+	p._log = logger.New(os.Stderr, logger.LevelInfo, logger.FormatText).With(logger.FieldWorker, p._state.ID)
+	err := p.setupLog()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	err = p.Results.Validate()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return subcommands.ExitFailure
 	}
 
 	//
-	// And run a ping, just to make sure it worked.
+	// Connect to the redis-host, and run a ping to make sure
+	// it worked.
 	//
-	_, err := p._r.Ping().Result()
+	p._r, err = p.Options.Connect()
 	if err != nil {
-		fmt.Printf("Redis connection failed: %s\n", err.Error())
+		p._log.Error("Redis connection failed", logger.FieldError, err)
 		return subcommands.ExitFailure
 	}
 
 	//
 	// Setup our metrics-connection, if enabled
 	//
-	p.MetricsFromEnvironment()
+	p.setupMetrics(conf.Metrics)
 
 	//
-	// Setup the options passed to each test, by copying our
-	// global ones.
+	// Prepare to reload our configuration file.
 	//
-	var opts test.Options
-	opts.Verbose = p.Verbose
-	opts.Timeout = p.Timeout
+	p._reload = make(chan *config.Config, 1)
+	go p.reloadOnHangup()
+
+	//
+	// Register ourselves, and keep our registration fresh.
+	//
+	err = p.register()
+	if err != nil {
+		p._log.Error("Failed to register worker", logger.FieldError, err)
+	}
+	go p.heartbeat()
 
 	//
 	// Create a parser for our input
@@ -603,27 +988,34 @@ func (p *workerCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 	for {
 
 		//
-		// Get a job.
+		// If our configuration was reloaded then apply it now,
+		// as we're between jobs.
 		//
-		test, _ := p._r.BLPop(0, "overseer.jobs").Result()
+		select {
+		case cfg := <-p._reload:
+			p.applyConfig(cfg)
+		default:
+		}
 
 		//
-		// Parse it
+		// Setup the options passed to each test, by copying our
+		// global ones.
 		//
-		//   test[0] will be the list-name (i.e. "overseer.jobs")
+		var opts test.Options
+		opts.Verbose = p.Verbose
+		opts.Timeout = p.Timeout
+		opts.Log = p._log
+
 		//
-		//   test[1] will be the value removed from the list.
+		// Get a job, and process it.
 		//
-		if len(test) >= 1 {
-			job, err := parse.ParseLine(test[1], nil)
-
-			if err == nil {
-				p.runTest(job, opts)
-			} else {
-				fmt.Printf("Error parsing job from queue: %s - %s\n", test[1], err.Error())
-			}
+		job, err := p.fetch()
+		if err == nil {
+			p.processJob(parse, job, opts)
+		} else if err != redis.Nil {
+			p._log.Error("Error fetching job from queue", logger.FieldError, err)
+			time.Sleep(time.Second)
 		}
-
 	}
 
 	// Not reached:
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/skx/overseer/logger"
+	"github.com/skx/overseer/queue"
+	"github.com/skx/overseer/test"
+)
+
+// Test that published results are sanitized, but keep the ID of the job,
+// and the target which was submitted.
+func TestNotify(t *testing.T) {
+	m := miniredis.RunT(t)
+
+	p := &workerCmd{
+		Tag:     "dc1",
+		Results: queue.DefaultResults(),
+		_r:      redis.NewClient(&redis.Options{Addr: m.Addr()}),
+	}
+
+	tst := test.Test{
+		Target:    "http://example.com/",
+		Type:      "http",
+		Input:     "http://example.com/ must run http with header 'Authorization: Bearer xxxx'",
+		Arguments: map[string]string{"header": "Authorization: Bearer xxxx"},
+		Sensitive: []string{"header"},
+	}
+	job := queue.New(tst, 0)
+
+	err := p.notify(tst, "1.2.3.4", errors.New("status code was 500 not 200"), map[string]time.Duration{"ttfb": 1500 * time.Microsecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	raw, _ := m.List(queue.ResultsKey)
+	if len(raw) != 1 {
+		t.Fatalf("expected one result, found %d", len(raw))
+	}
+	var msg map[string]string
+	if err := json.Unmarshal([]byte(raw[0]), &msg); err != nil {
+		t.Fatalf("invalid result %s", raw[0])
+	}
+
+	if msg["id"] != job.ID {
+		t.Errorf("the result has the ID %s, but the job has the ID %s", msg["id"], job.ID)
+	}
+	if msg["input"] != "http://example.com/ must run http with header 'Authorization: CENSORED'" {
+		t.Errorf("the input wasn't sanitized: %s", msg["input"])
+	}
+	if msg["target"] != "1.2.3.4" {
+		t.Errorf("the target wasn't the address tested: %s", msg["target"])
+	}
+	if msg["result"] != "failed" || msg["error"] != "status code was 500 not 200" || msg["tag"] != "dc1" {
+		t.Errorf("unexpected result %v", msg)
+	}
+	if msg["timing.ttfb"] != "1.500000" {
+		t.Errorf("unexpected timing %s", msg["timing.ttfb"])
+	}
+}
+
+// Test that the timings of a test are published, including the time the
+// worker took to resolve the target.
+func TestRunTestTimings(t *testing.T) {
+	m := miniredis.RunT(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	p := &workerCmd{
+		IPv4:    true,
+		Results: queue.DefaultResults(),
+		_r:      redis.NewClient(&redis.Options{Addr: m.Addr()}),
+		_log:    logger.New(ioutil.Discard, logger.LevelError, logger.FormatText),
+	}
+
+	tst := test.Test{
+		Target:    server.URL + "/",
+		Type:      "http",
+		Input:     server.URL + "/ must run http",
+		Arguments: map[string]string{},
+	}
+	err := p.runTest(tst, test.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	raw, _ := m.List(queue.ResultsKey)
+	if len(raw) != 1 {
+		t.Fatalf("expected one result, found %d", len(raw))
+	}
+	var msg map[string]string
+	if err := json.Unmarshal([]byte(raw[0]), &msg); err != nil {
+		t.Fatalf("invalid result %s", raw[0])
+	}
+	if msg["result"] != "passed" || msg["target"] != "127.0.0.1" {
+		t.Errorf("unexpected result %v", msg)
+	}
+
+	//
+	// The probe doesn't resolve the address it is given, so the dns
+	// phase is that of the worker.
+	//
+	for _, phase := range []string{"dns", "connect", "ttfb", "total"} {
+		v, err := strconv.ParseFloat(msg["timing."+phase], 64)
+		if err != nil || v < 0 {
+			t.Errorf("the %s phase wasn't published: %v", phase, msg)
+		}
+	}
+	if _, ok := msg["timing.tls"]; ok {
+		t.Errorf("the tls phase was published for plain HTTP: %v", msg)
+	}
+}
@@ -0,0 +1,431 @@
+// Package config contains the configuration file which is shared by
+// each of the overseer sub-commands, and the bridges.
+//
+// The configuration file is YAML, and contains the following sections:
+//
+//   - redis: how to connect to redis.
+//   - worker: the settings of `overseer worker`.
+//   - metrics: where to send metrics.
+//   - bridges: the settings of each bridge, keyed by name.
+//   - defaults: the settings used when enqueuing tests.
+//   - log: the level, and format, of log messages.
+//   - results: how test-results are published.
+//
+// Each value in the file is used as the default of the matching
+// command-line flag, so flags continue to take precedence.
+//
+// For compatibility the older JSON configuration file, which contained
+// the names of the fields of each command, is still accepted.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skx/overseer/logger"
+	"github.com/skx/overseer/parser"
+	"github.com/skx/overseer/queue"
+	"github.com/skx/overseer/redisconn"
+	"gopkg.in/yaml.v2"
+)
+
+// Worker holds the settings of `overseer worker`.
+type Worker struct {
+
+	// IPv4 and IPv6 enable tests against each address-family.
+	IPv4 bool `yaml:"ipv4"`
+	IPv6 bool `yaml:"ipv6"`
+
+	// Retry enables the retrying of failing tests.
+	Retry bool `yaml:"retry"`
+
+	// RetryCount is the number of times a test is attempted.
+	RetryCount int `yaml:"retry-count"`
+
+	// RetryDelay is the time to sleep between attempts.
+	RetryDelay time.Duration `yaml:"retry-delay"`
+
+	// Tag and Location are added to each test-result.
+	Tag      string `yaml:"tag"`
+	Location string `yaml:"location"`
+
+	// Timeout is the timeout for each test.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Verbose shows more output.
+	Verbose bool `yaml:"verbose"`
+
+	// Starvation is how often the lowest-priority queue is checked
+	// first.
+	Starvation int `yaml:"starvation"`
+}
+
+// Metrics holds the details of the carbon-server metrics are sent to.
+type Metrics struct {
+
+	// Host is the address of the server, with an optional port.
+	//
+	// If this is empty metrics are disabled.
+	Host string `yaml:"host"`
+
+	// Protocol is either "udp" or "tcp".
+	Protocol string `yaml:"protocol"`
+
+	// Verbose shows each metric as it is sent.
+	Verbose bool `yaml:"verbose"`
+}
+
+// Defaults holds the settings used when parsing and enqueuing tests.
+type Defaults struct {
+
+	// TTL is how long a job may wait before it is discarded.
+	TTL time.Duration `yaml:"ttl"`
+
+	// Raw enqueues bare input-lines, rather than JSON envelopes.
+	Raw bool `yaml:"raw"`
+
+	// Dedup skips tests which are already pending.
+	Dedup bool `yaml:"dedup"`
+
+	// PendingTimeout is how long a test may be pending before it is
+	// enqueued again, regardless.
+	PendingTimeout time.Duration `yaml:"pending-timeout"`
+
+	// MaxQueue is the maximum size of the queue, zero to disable.
+	MaxQueue int `yaml:"max-queue"`
+
+	// MaxExpansion is the maximum number of tests a CIDR-block, or
+	// host-range, may expand into.
+	MaxExpansion int `yaml:"max-expansion"`
+}
+
+// Config is the contents of a configuration file.
+type Config struct {
+
+	// Redis is how to connect to redis.
+	Redis redisconn.Options `yaml:"redis"`
+
+	// Worker holds the settings of the worker.
+	Worker Worker `yaml:"worker"`
+
+	// Metrics holds the details of the metrics-server.
+	Metrics Metrics `yaml:"metrics"`
+
+	// Bridges holds the settings of each bridge, keyed by name.
+	//
+	// The settings of a bridge are the names and values of its
+	// command-line flags.
+	Bridges map[string]map[string]string `yaml:"bridges"`
+
+	// Defaults holds the settings used when enqueuing tests.
+	Defaults Defaults `yaml:"defaults"`
+
+	// Log holds the level, and format, of log messages.
+	Log logger.Options `yaml:"log"`
+
+	// Results holds the details of how test-results are published.
+	Results queue.ResultsOptions `yaml:"results"`
+
+	// Path is the file the configuration was loaded from, if any.
+	Path string `yaml:"-"`
+}
+
+// Default returns the default configuration.
+//
+// The metrics-server may still be configured via the environmental
+// variables METRICS_HOST, METRICS_PROTOCOL, and METRICS_VERBOSE, but
+// the configuration file takes precedence over them.
+func Default() *Config {
+
+	cfg := &Config{
+		Redis: redisconn.Defaults(),
+		Worker: Worker{
+			IPv4:       true,
+			IPv6:       true,
+			Retry:      true,
+			RetryCount: 5,
+			RetryDelay: 5 * time.Second,
+			Timeout:    10 * time.Second,
+			Starvation: 10,
+		},
+		Metrics: Metrics{
+			Host:     os.Getenv("METRICS_HOST"),
+			Protocol: os.Getenv("METRICS_PROTOCOL"),
+			Verbose:  os.Getenv("METRICS_VERBOSE") != "",
+		},
+		Defaults: Defaults{
+			Dedup:          true,
+			PendingTimeout: 30 * time.Minute,
+			MaxExpansion:   parser.DefaultMaxExpansion,
+		},
+		Log: logger.Options{
+			Level:  "info",
+			Format: "text",
+		},
+		Results: queue.DefaultResults(),
+	}
+
+	if cfg.Metrics.Host == "" {
+		cfg.Metrics.Host = os.Getenv("METRICS")
+	}
+	if cfg.Metrics.Protocol == "" {
+		cfg.Metrics.Protocol = "udp"
+	}
+	return cfg
+}
+
+// FromEnvironment loads the configuration file named by the `OVERSEER`
+// environmental variable, or returns the default configuration if that
+// is not set.
+func FromEnvironment() (*Config, error) {
+	return Load(os.Getenv("OVERSEER"))
+}
+
+// Load reads, and validates, the given configuration file.
+//
+// If the path is empty the default configuration is returned.
+func Load(path string) (*Config, error) {
+
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration file - %s", err.Error())
+	}
+
+	if filepath.Ext(path) == ".json" || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		err = cfg.loadJSON(data)
+	} else {
+		err = yaml.UnmarshalStrict(data, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s - %s", path, err.Error())
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration in %s - %s", path, err.Error())
+	}
+
+	cfg.Path = path
+	return cfg, nil
+}
+
+// loadJSON updates our configuration from the legacy JSON format.
+//
+// In that format the file contained a single object whose keys were
+// the names of the fields of each of the commands.
+func (c *Config) loadJSON(data []byte) error {
+
+	legacy := struct {
+		redisconn.Options
+
+		IPv4       bool
+		IPv6       bool
+		Retry      bool
+		RetryCount int
+		RetryDelay time.Duration
+		Tag        string
+		Location   string
+		Timeout    time.Duration
+		Verbose    bool
+		Starvation int
+
+		JobTTL         time.Duration
+		Raw            bool
+		Dedup          bool
+		PendingTimeout time.Duration
+		MaxQueue       int
+	}{
+		Options:        c.Redis,
+		IPv4:           c.Worker.IPv4,
+		IPv6:           c.Worker.IPv6,
+		Retry:          c.Worker.Retry,
+		RetryCount:     c.Worker.RetryCount,
+		RetryDelay:     c.Worker.RetryDelay,
+		Tag:            c.Worker.Tag,
+		Location:       c.Worker.Location,
+		Timeout:        c.Worker.Timeout,
+		Verbose:        c.Worker.Verbose,
+		Starvation:     c.Worker.Starvation,
+		JobTTL:         c.Defaults.TTL,
+		Raw:            c.Defaults.Raw,
+		Dedup:          c.Defaults.Dedup,
+		PendingTimeout: c.Defaults.PendingTimeout,
+		MaxQueue:       c.Defaults.MaxQueue,
+	}
+
+	err := json.Unmarshal(data, &legacy)
+	if err != nil {
+		return err
+	}
+
+	c.Redis = legacy.Options
+	c.Worker = Worker{
+		IPv4:       legacy.IPv4,
+		IPv6:       legacy.IPv6,
+		Retry:      legacy.Retry,
+		RetryCount: legacy.RetryCount,
+		RetryDelay: legacy.RetryDelay,
+		Tag:        legacy.Tag,
+		Location:   legacy.Location,
+		Timeout:    legacy.Timeout,
+		Verbose:    legacy.Verbose,
+		Starvation: legacy.Starvation,
+	}
+	c.Defaults.TTL = legacy.JobTTL
+	c.Defaults.Raw = legacy.Raw
+	c.Defaults.Dedup = legacy.Dedup
+	c.Defaults.PendingTimeout = legacy.PendingTimeout
+	c.Defaults.MaxQueue = legacy.MaxQueue
+	return nil
+}
+
+// Validate ensures that the configuration is sane, returning an error
+// which names the first setting which is not.
+func (c *Config) Validate() error {
+
+	err := c.Redis.Validate()
+	if err != nil {
+		return fmt.Errorf("redis: %s", err.Error())
+	}
+
+	//
+	// The worker.
+	//
+	if !c.Worker.IPv4 && !c.Worker.IPv6 {
+		return fmt.Errorf("worker: at least one of ipv4 and ipv6 must be enabled")
+	}
+	if c.Worker.RetryCount < 1 {
+		return fmt.Errorf("worker.retry-count: must be at least 1, not %d", c.Worker.RetryCount)
+	}
+	if c.Worker.RetryDelay < 0 {
+		return fmt.Errorf("worker.retry-delay: must not be negative")
+	}
+	if c.Worker.Timeout <= 0 {
+		return fmt.Errorf("worker.timeout: must be greater than zero")
+	}
+	if c.Worker.Starvation < 0 {
+		return fmt.Errorf("worker.starvation: must not be negative")
+	}
+
+	//
+	// The metrics.
+	//
+	if c.Metrics.Protocol != "udp" && c.Metrics.Protocol != "tcp" {
+		return fmt.Errorf("metrics.protocol: must be 'udp' or 'tcp', not '%s'", c.Metrics.Protocol)
+	}
+	if c.Metrics.Host != "" {
+		_, _, err = c.Metrics.Address()
+		if err != nil {
+			return fmt.Errorf("metrics.host: %s", err.Error())
+		}
+	}
+
+	//
+	// The defaults.
+	//
+	if c.Defaults.TTL < 0 {
+		return fmt.Errorf("defaults.ttl: must not be negative")
+	}
+	if c.Defaults.PendingTimeout < 0 {
+		return fmt.Errorf("defaults.pending-timeout: must not be negative")
+	}
+	if c.Defaults.MaxQueue < 0 {
+		return fmt.Errorf("defaults.max-queue: must not be negative")
+	}
+	if c.Defaults.MaxExpansion < 1 {
+		return fmt.Errorf("defaults.max-expansion: must be at least 1")
+	}
+
+	//
+	// The logging.
+	//
+	err = c.Log.Validate()
+	if err != nil {
+		return fmt.Errorf("log: %s", err.Error())
+	}
+
+	//
+	// The results.
+	//
+	err = c.Results.Validate()
+	if err != nil {
+		return fmt.Errorf("results: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Address returns the host and port of the metrics-server, defaulting
+// the port to 2003 if it was not given.
+func (m Metrics) Address() (string, int, error) {
+
+	host, port, err := net.SplitHostPort(m.Host)
+	if err != nil {
+		// If that failed we assume the port was missing
+		host = m.Host
+		port = "2003"
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port '%s'", port)
+	}
+	return host, n, nil
+}
+
+// ApplyBridge uses the settings of the named bridge to set the given
+// flags, which should be done before they are parsed so that the
+// command-line still takes precedence.
+//
+// An error is returned if a setting doesn't match one of the flags.
+func (c *Config) ApplyBridge(name string, f *flag.FlagSet) error {
+
+	settings := c.Bridges[name]
+
+	//
+	// Sort the names, so errors are reported consistently.
+	//
+	var keys []string
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if f.Lookup(key) == nil {
+			return fmt.Errorf("bridges.%s.%s: unknown setting, expected one of %s", name, key, strings.Join(flagNames(f), ", "))
+		}
+		err := f.Set(key, settings[key])
+		if err != nil {
+			return fmt.Errorf("bridges.%s.%s: %s", name, key, err.Error())
+		}
+	}
+	return nil
+}
+
+// flagNames returns the names of the given flags, excluding those
+// which configure redis as they have their own section.
+func flagNames(f *flag.FlagSet) []string {
+	var names []string
+	f.VisitAll(func(fl *flag.Flag) {
+		if !strings.HasPrefix(fl.Name, "redis-") {
+			names = append(names, fl.Name)
+		}
+	})
+	return names
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// write creates a temporary configuration file with the given name and
+// contents, returning its path.
+func write(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err.Error())
+	}
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("failed to write configuration: %s", err.Error())
+	}
+	return path
+}
+
+// Test loading a YAML configuration file.
+func TestLoadYAML(t *testing.T) {
+
+	path := write(t, "overseer.yml", `
+redis:
+  host: redis.example.com:6379
+  tls: true
+worker:
+  tag: production
+  timeout: 30s
+metrics:
+  host: carbon.example.com
+  protocol: tcp
+bridges:
+  email:
+    email: root@example.com
+defaults:
+  ttl: 5m
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if cfg.Redis.RedisHost != "redis.example.com:6379" || !cfg.Redis.RedisTLS {
+		t.Errorf("redis section not loaded: %v", cfg.Redis)
+	}
+	if cfg.Worker.Tag != "production" || cfg.Worker.Timeout != 30*time.Second {
+		t.Errorf("worker section not loaded: %v", cfg.Worker)
+	}
+
+	// Values not in the file keep their defaults.
+	if cfg.Worker.RetryCount != 5 || !cfg.Worker.IPv6 {
+		t.Errorf("worker defaults were lost: %v", cfg.Worker)
+	}
+	if cfg.Defaults.TTL != 5*time.Minute || !cfg.Defaults.Dedup {
+		t.Errorf("defaults section not loaded: %v", cfg.Defaults)
+	}
+	if cfg.Bridges["email"]["email"] != "root@example.com" {
+		t.Errorf("bridges section not loaded: %v", cfg.Bridges)
+	}
+	if cfg.Path != path {
+		t.Errorf("path not recorded: %s", cfg.Path)
+	}
+}
+
+// Test loading the legacy JSON configuration file.
+func TestLoadJSON(t *testing.T) {
+
+	path := write(t, "overseer.json", `{"RedisHost": "redis:6379", "Tag": "legacy", "MaxQueue": 100}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if cfg.Redis.RedisHost != "redis:6379" || cfg.Worker.Tag != "legacy" || cfg.Defaults.MaxQueue != 100 {
+		t.Errorf("legacy configuration not loaded: %v", cfg)
+	}
+	if cfg.Worker.RetryCount != 5 {
+		t.Errorf("worker defaults were lost: %v", cfg.Worker)
+	}
+}
+
+// Test that bad configuration files are rejected, with errors naming
+// the problem.
+func TestInvalid(t *testing.T) {
+
+	tests := map[string]string{
+		"worker:\n  tgs: foo\n":             "field tgs not found",
+		"worker:\n  timeout: soon\n":        "line 2",
+		"worker:\n  retry-count: 0\n":       "worker.retry-count",
+		"worker:\n  ipv4: no\n  ipv6: no\n": "ipv4 and ipv6",
+		"metrics:\n  protocol: http\n":      "metrics.protocol",
+		"metrics:\n  host: carbon:port\n":   "metrics.host",
+		"defaults:\n  max-queue: -1\n":      "defaults.max-queue",
+		"redis:\n  host: ''\n":              "redis:",
+		"log:\n  format: xml\n":             "log: unknown log-format",
+		"results:\n  mode: queue\n":         "results: unknown results mode",
+	}
+
+	for content, expected := range tests {
+		path := write(t, "overseer.yml", content)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		_, err := Load(path)
+		if err == nil {
+			t.Errorf("expected an error loading %q", content)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing '%s', got '%s'", expected, err.Error())
+		}
+	}
+}
+
+// Test applying the settings of a bridge to its flags.
+func TestApplyBridge(t *testing.T) {
+
+	cfg := Default()
+	cfg.Bridges = map[string]map[string]string{
+		"email": {"email": "root@example.com"},
+		"other": {"missing": "1"},
+	}
+
+	f := flag.NewFlagSet("test", flag.ContinueOnError)
+	email := f.String("email", "", "The address to notify")
+
+	err := cfg.ApplyBridge("email", f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if *email != "root@example.com" {
+		t.Errorf("flag not set: %s", *email)
+	}
+
+	err = cfg.ApplyBridge("other", f)
+	if err == nil || !strings.Contains(err.Error(), "bridges.other.missing") {
+		t.Errorf("expected an error for an unknown setting, got %v", err)
+	}
+
+	// A bridge without settings is fine.
+	err = cfg.ApplyBridge("telegram", f)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
@@ -3,6 +3,7 @@ module github.com/skx/overseer
 go 1.12
 
 require (
+	github.com/alicebob/miniredis/v2 v2.33.0
 	github.com/emersion/go-imap v1.2.1
 	github.com/emersion/go-sasl v0.0.0-20220912192320-0145f2c60ead // indirect
 	github.com/go-redis/redis v6.15.9+incompatible
@@ -22,4 +23,5 @@ require (
 	github.com/skx/golang-metrics v0.0.0-20190325085214-453332cf54e8
 	github.com/technoweenie/multipartstreamer v1.0.1 // indirect
 	golang.org/x/tools v0.12.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
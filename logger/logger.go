@@ -0,0 +1,361 @@
+// Package logger contains a simple structured, and levelled, logger.
+//
+// Each message has a level, and a set of key/value fields, and may be
+// written in one of three formats:
+//
+//   - text: human-readable, the default.
+//   - logfmt: key=value pairs, as understood by many log-processors.
+//   - json: one JSON object per line.
+//
+// The same field-names are used by the worker, the probes, and the
+// bridges, so that (for example) every message about a test carries
+// its ID in the `test_id` field.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The names of the fields which are used consistently.
+const (
+	// FieldTestID is the ID of a test, see test.Test.ID.
+	FieldTestID = "test_id"
+
+	// FieldType is the type of a test, such as "http".
+	FieldType = "type"
+
+	// FieldTarget is the target of a test.
+	FieldTarget = "target"
+
+	// FieldAttempt is the number of the attempt to run a test.
+	FieldAttempt = "attempt"
+
+	// FieldDuration is the time something took.
+	FieldDuration = "duration"
+
+	// FieldWorker is the ID of the worker.
+	FieldWorker = "worker"
+
+	// FieldBridge is the ID of a bridge.
+	FieldBridge = "bridge"
+
+	// FieldError is the error which occurred.
+	FieldError = "error"
+)
+
+// Level is the severity of a message.
+type Level int
+
+// The levels, in increasing order of severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the name of the level.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// ParseLevel converts the name of a level to a Level.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log-level '%s', expected debug, info, warn, or error", name)
+}
+
+// Format is the format in which messages are written.
+type Format string
+
+// The formats which are supported.
+const (
+	FormatText   Format = "text"
+	FormatLogfmt Format = "logfmt"
+	FormatJSON   Format = "json"
+)
+
+// ParseFormat validates the name of a format.
+func ParseFormat(name string) (Format, error) {
+	switch Format(strings.ToLower(name)) {
+	case FormatText, "":
+		return FormatText, nil
+	case FormatLogfmt:
+		return FormatLogfmt, nil
+	case FormatJSON:
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf("unknown log-format '%s', expected text, logfmt, or json", name)
+}
+
+// output is the destination shared by a logger, and those derived
+// from it via With.
+type output struct {
+	sync.Mutex
+
+	w      io.Writer
+	level  Level
+	format Format
+
+	// now returns the current time, and is replaced when testing.
+	now func() time.Time
+}
+
+// Logger writes structured messages.
+//
+// A nil Logger is valid, and discards everything, which means code
+// that has been given no logger doesn't need to check.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// New creates a logger which writes messages of the given level, and
+// above, to the writer in the given format.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		out: &output{
+			w:      w,
+			level:  level,
+			format: format,
+			now:    time.Now,
+		},
+	}
+}
+
+// With returns a logger which adds the given key/value pairs to each
+// message it writes.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+
+	return &Logger{out: l.out, fields: fields}
+}
+
+// SetLevel changes the level of this logger, and all those which
+// share its output.
+func (l *Logger) SetLevel(level Level) {
+	if l == nil {
+		return
+	}
+	l.out.Lock()
+	l.out.level = level
+	l.out.Unlock()
+}
+
+// SetFormat changes the format of this logger, and all those which
+// share its output.
+func (l *Logger) SetFormat(format Format) {
+	if l == nil {
+		return
+	}
+	l.out.Lock()
+	l.out.format = format
+	l.out.Unlock()
+}
+
+// Enabled returns true if messages of the given level will be written.
+func (l *Logger) Enabled(level Level) bool {
+	if l == nil {
+		return false
+	}
+	l.out.Lock()
+	defer l.out.Unlock()
+	return level >= l.out.level
+}
+
+// Debug writes a message at the debug level.
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+// Info writes a message at the info level.
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+// Warn writes a message at the warn level.
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+// Error writes a message at the error level.
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+// log formats, and writes, a single message.
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if l == nil {
+		return
+	}
+
+	l.out.Lock()
+	defer l.out.Unlock()
+
+	if level < l.out.level {
+		return
+	}
+
+	//
+	// Collect the fields, with those given last.
+	//
+	all := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	all = append(all, l.fields...)
+	all = append(all, keyvals...)
+
+	var keys []string
+	var values []interface{}
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprintf("%v", all[i])
+		var val interface{} = "MISSING"
+		if i+1 < len(all) {
+			val = value(all[i+1])
+		}
+		keys = append(keys, key)
+		values = append(values, val)
+	}
+
+	now := l.out.now().UTC().Format(time.RFC3339)
+
+	var buf bytes.Buffer
+
+	switch l.out.format {
+	case FormatJSON:
+		buf.WriteString("{")
+		writeJSON(&buf, "time", now)
+		buf.WriteString(",")
+		writeJSON(&buf, "level", level.String())
+		buf.WriteString(",")
+		writeJSON(&buf, "msg", msg)
+		for i, key := range keys {
+			buf.WriteString(",")
+			writeJSON(&buf, key, values[i])
+		}
+		buf.WriteString("}")
+
+	case FormatLogfmt:
+		fmt.Fprintf(&buf, "time=%s level=%s msg=%s", now, level.String(), quote(msg))
+		for i, key := range keys {
+			fmt.Fprintf(&buf, " %s=%s", key, quote(fmt.Sprintf("%v", values[i])))
+		}
+
+	default:
+		fmt.Fprintf(&buf, "%s %-5s %s", now, strings.ToUpper(level.String()), msg)
+		for i, key := range keys {
+			fmt.Fprintf(&buf, " %s=%s", key, quote(fmt.Sprintf("%v", values[i])))
+		}
+	}
+
+	buf.WriteString("\n")
+	l.out.w.Write(buf.Bytes())
+}
+
+// value converts a field-value to the form in which it is logged.
+func value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Duration:
+		return t.String()
+	case error:
+		return t.Error()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
+
+// writeJSON writes a single key and value as JSON.
+func writeJSON(buf *bytes.Buffer, key string, val interface{}) {
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(val)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprintf("%v", val))
+	}
+	buf.Write(k)
+	buf.WriteString(":")
+	buf.Write(v)
+}
+
+// quote quotes a value, if it needs to be quoted for logfmt.
+func quote(s string) string {
+	if s == "" {
+		return `""`
+	}
+	if strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Options holds the configuration of a logger.
+type Options struct {
+
+	// Level is the name of the minimum level to write.
+	Level string `yaml:"level"`
+
+	// Format is the name of the format to write.
+	Format string `yaml:"format"`
+}
+
+// Validate ensures the options are valid.
+func (o Options) Validate() error {
+	_, err := ParseLevel(o.Level)
+	if err != nil {
+		return err
+	}
+	_, err = ParseFormat(o.Format)
+	return err
+}
+
+// SetFlags registers the command-line flags which populate our options,
+// using the given values as the defaults.
+func (o *Options) SetFlags(f *flag.FlagSet, defaults Options) {
+	f.StringVar(&o.Level, "log-level", defaults.Level, "The minimum level of messages to log: debug, info, warn, or error.")
+	f.StringVar(&o.Format, "log-format", defaults.Format, "The format of log messages: text, logfmt, or json.")
+}
+
+// New creates a logger, writing to stderr, from our options.
+func (o Options) New() (*Logger, error) {
+	level, err := ParseLevel(o.Level)
+	if err != nil {
+		return nil, err
+	}
+	format, err := ParseFormat(o.Format)
+	if err != nil {
+		return nil, err
+	}
+	return New(os.Stderr, level, format), nil
+}
@@ -0,0 +1,93 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// create returns a logger writing to a buffer, at a fixed time.
+func create(level Level, format Format) (*Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	l := New(buf, level, format)
+	l.out.now = func() time.Time {
+		return time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	}
+	return l, buf
+}
+
+// Test that messages below our level are discarded.
+func TestLevel(t *testing.T) {
+	l, buf := create(LevelWarn, FormatText)
+
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+
+	out := buf.String()
+	if strings.Contains(out, "debug") || strings.Contains(out, "info") {
+		t.Errorf("unexpected output: %s", out)
+	}
+	if !strings.Contains(out, "WARN  warn") || !strings.Contains(out, "ERROR error") {
+		t.Errorf("missing output: %s", out)
+	}
+
+	l.SetLevel(LevelDebug)
+	l.Debug("now visible")
+	if !strings.Contains(buf.String(), "now visible") {
+		t.Errorf("SetLevel had no effect")
+	}
+}
+
+// Test the logfmt format, including quoting.
+func TestLogfmt(t *testing.T) {
+	l, buf := create(LevelInfo, FormatLogfmt)
+
+	l.With(FieldTestID, "abc").Info("test failed", FieldTarget, "1.2.3.4", FieldDuration, 1500*time.Millisecond, "empty", "")
+
+	expected := `time=2019-06-01T12:00:00Z level=info msg="test failed" test_id=abc target=1.2.3.4 duration=1.5s empty=""` + "\n"
+	if buf.String() != expected {
+		t.Errorf("got %s, expected %s", buf.String(), expected)
+	}
+}
+
+// Test the JSON format produces valid JSON.
+func TestJSON(t *testing.T) {
+	l, buf := create(LevelInfo, FormatJSON)
+
+	l.With(FieldWorker, "host-1").Error("oops", FieldAttempt, 2, "odd")
+
+	var out map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &out)
+	if err != nil {
+		t.Fatalf("invalid JSON %s - %s", buf.String(), err.Error())
+	}
+	if out["level"] != "error" || out["msg"] != "oops" || out["worker"] != "host-1" || out["attempt"] != float64(2) || out["odd"] != "MISSING" {
+		t.Errorf("unexpected output: %v", out)
+	}
+}
+
+// Test that a nil logger is safe.
+func TestNil(t *testing.T) {
+	var l *Logger
+	l.With("a", "b").Info("nothing")
+	if l.Enabled(LevelError) {
+		t.Errorf("a nil logger should be disabled")
+	}
+}
+
+// Test parsing levels & formats.
+func TestParse(t *testing.T) {
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("expected an error")
+	}
+	if lvl, err := ParseLevel("WARNING"); err != nil || lvl != LevelWarn {
+		t.Errorf("failed to parse level")
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
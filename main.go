@@ -5,26 +5,51 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/google/subcommands"
+	"github.com/skx/overseer/config"
 )
 
+// configFile is the path to our configuration file, if any.
+var configFile string
+
+// conf is the configuration loaded from that file, which provides the
+// defaults of the flags of each sub-command.
+var conf *config.Config
+
 //
 // Open the named configuration file, and parse it
 //
 func main() {
 
+	flag.StringVar(&configFile, "config", os.Getenv("OVERSEER"), "The configuration file to load.")
+
 	subcommands.Register(subcommands.HelpCommand(), "")
 	subcommands.Register(subcommands.FlagsCommand(), "")
 	subcommands.Register(subcommands.CommandsCommand(), "")
+	subcommands.Register(&ackCmd{}, "")
 	subcommands.Register(&dumpCmd{}, "")
 	subcommands.Register(&enqueueCmd{}, "")
 	subcommands.Register(&examplesCmd{}, "")
+	subcommands.Register(&notifyCmd{}, "")
+	subcommands.Register(&statusCmd{}, "")
 	subcommands.Register(&versionCmd{}, "")
 	subcommands.Register(&workerCmd{}, "")
 
 	flag.Parse()
+
+	//
+	// Load the configuration file, if any.
+	//
+	var err error
+	conf, err = config.Load(configFile)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
 	ctx := context.Background()
 	os.Exit(int(subcommands.Execute(ctx)))
 
@@ -0,0 +1,223 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The ways in which we may use TLS when talking to an SMTP server.
+const (
+	// TLSAuto uses STARTTLS if the server supports it.
+	TLSAuto = "auto"
+
+	// TLSStartTLS requires the use of STARTTLS.
+	TLSStartTLS = "starttls"
+
+	// TLSImplicit connects via TLS, as is usual upon port 465.
+	TLSImplicit = "implicit"
+
+	// TLSNone never uses TLS.
+	TLSNone = "none"
+)
+
+// EmailConfig describes a receiver which sends email.
+type EmailConfig struct {
+
+	// To is the address to notify, or a comma-separated list of them.
+	To string `yaml:"to"`
+
+	// From is the address to send from, by default the first address
+	// we notify.
+	From string `yaml:"from"`
+
+	// Sendmail is the sendmail binary used if no SMTP server is given.
+	Sendmail string `yaml:"sendmail"`
+
+	// SMTPHost is the host:port of the SMTP server to send email via.
+	SMTPHost string `yaml:"smtp-host"`
+
+	// SMTPTLS is one of TLSAuto, TLSStartTLS, TLSImplicit, or TLSNone.
+	SMTPTLS string `yaml:"smtp-tls"`
+
+	// SMTPUser and SMTPPass are used to authenticate to the server.
+	SMTPUser string `yaml:"smtp-user"`
+	SMTPPass string `yaml:"smtp-pass"`
+
+	// SMTPInsecure disables the verification of the server's
+	// certificate.
+	SMTPInsecure bool `yaml:"smtp-insecure"`
+}
+
+// Validate ensures that the settings are sane.
+func (c EmailConfig) Validate() error {
+	if len(split(c.To)) == 0 {
+		return fmt.Errorf("to: an address must be given")
+	}
+	switch c.SMTPTLS {
+	case "", TLSAuto, TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		return fmt.Errorf("smtp-tls: unknown mode '%s'", c.SMTPTLS)
+	}
+	if c.SMTPHost != "" {
+		_, _, err := net.SplitHostPort(c.SMTPHost)
+		if err != nil {
+			return fmt.Errorf("smtp-host: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// email is a receiver which sends email.
+type email struct {
+	EmailConfig
+	to []string
+}
+
+// newEmail creates a receiver which sends email.
+func newEmail(c EmailConfig) *email {
+	e := &email{EmailConfig: c, to: split(c.To)}
+	if e.From == "" {
+		e.From = e.to[0]
+	}
+	if e.Sendmail == "" {
+		e.Sendmail = "/usr/sbin/sendmail"
+	}
+	if e.SMTPTLS == "" {
+		e.SMTPTLS = TLSAuto
+	}
+	return e
+}
+
+// Send emails the notification.
+func (e *email) Send(n Notification) error {
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", oneLine(n.Subject()))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	msg.WriteString(strings.Replace(n.Text(), "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+
+	if e.SMTPHost != "" {
+		return e.sendSMTP(msg.Bytes())
+	}
+	return e.sendmail(msg.Bytes())
+}
+
+// oneLine removes any line-breaks from a header.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// sendmail delivers a message by executing sendmail.
+func (e *email) sendmail(msg []byte) error {
+
+	args := append([]string{"-f", e.From}, e.to...)
+	cmd := exec.Command(e.Sendmail, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error running sendmail: %s %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// sendSMTP delivers a message to our SMTP server.
+func (e *email) sendSMTP(msg []byte) error {
+
+	host, _, err := net.SplitHostPort(e.SMTPHost)
+	if err != nil {
+		return err
+	}
+
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: e.SMTPInsecure,
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	//
+	// Connect, either via TLS or in the clear.
+	//
+	var conn net.Conn
+	if e.SMTPTLS == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.SMTPHost, cfg)
+	} else {
+		conn, err = dialer.Dial("tcp", e.SMTPHost)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	//
+	// Upgrade the connection to TLS, if we should.
+	//
+	if e.SMTPTLS == TLSAuto || e.SMTPTLS == TLSStartTLS {
+		ok, _ := c.Extension("STARTTLS")
+		if ok {
+			err = c.StartTLS(cfg)
+			if err != nil {
+				return fmt.Errorf("STARTTLS failed: %s", err.Error())
+			}
+		} else if e.SMTPTLS == TLSStartTLS {
+			return fmt.Errorf("the server %s does not support STARTTLS", e.SMTPHost)
+		}
+	}
+
+	//
+	// Authenticate, if we should.
+	//
+	if e.SMTPUser != "" {
+		err = c.Auth(smtp.PlainAuth("", e.SMTPUser, e.SMTPPass, host))
+		if err != nil {
+			return fmt.Errorf("authentication failed: %s", err.Error())
+		}
+	}
+
+	//
+	// Send the message.
+	//
+	err = c.Mail(e.From)
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range e.to {
+		err = c.Rcpt(rcpt)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
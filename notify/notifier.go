@@ -0,0 +1,468 @@
+package notify
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/skx/overseer/bridge"
+	"github.com/skx/overseer/logger"
+	"github.com/skx/overseer/test"
+)
+
+// EscalateInterval is how often the escalation policies of the failing
+// tests are checked.
+const EscalateInterval = 10 * time.Second
+
+// RetryDelay is the delay before a notification which couldn't be sent is
+// retried, which doubles after each attempt up to MaxRetryDelay.
+const RetryDelay = 30 * time.Second
+
+// MaxRetryDelay is the longest delay between attempts to send a
+// notification.
+const MaxRetryDelay = 10 * time.Minute
+
+// Notifier routes test-results to receivers.
+type Notifier struct {
+	sync.Mutex
+
+	// updating is held while the state of a test is updated.
+	updating sync.Mutex
+
+	rules     *Rules
+	receivers map[string]Receiver
+	state     *State
+	log       *logger.Logger
+
+	// batches hold the events waiting to be sent, keyed by the name
+	// of the receiver and the group-interval.
+	batches map[string]*batch
+
+	// now returns the current time, and may be replaced when testing.
+	now func() time.Time
+}
+
+// batch is a group of events, waiting to be sent to a receiver.
+type batch struct {
+	key      string
+	receiver string
+	due      time.Time
+	events   []Event
+
+	// attempts is the number of times we've failed to send the batch.
+	attempts int
+}
+
+// add adds an event to the batch, replacing any earlier event for the
+// same test.
+//
+// If a test recovers before anybody was told that it failed then both
+// events are dropped.
+func (b *batch) add(ev Event) {
+	for i, old := range b.events {
+		if old.key() != ev.key() {
+			continue
+		}
+		if ev.Recovered && !old.Recovered && !old.Reminder {
+			b.events = append(b.events[:i], b.events[i+1:]...)
+			return
+		}
+		b.events[i] = ev
+		return
+	}
+	b.events = append(b.events, ev)
+}
+
+// New creates a notifier, which stores the state of the failing tests in
+// redis, or in memory if the connection is nil.
+func New(rules *Rules, r redis.UniversalClient, log *logger.Logger) (*Notifier, error) {
+
+	n := &Notifier{
+		rules:     rules,
+		receivers: make(map[string]Receiver),
+		state:     NewState(r),
+		log:       log,
+		batches:   make(map[string]*batch),
+		now:       time.Now,
+	}
+
+	for name, rc := range rules.Receivers {
+		recv, err := rc.New()
+		if err != nil {
+			return nil, err
+		}
+		n.receivers[name] = recv
+	}
+	return n, nil
+}
+
+// Process records the state of the test the result describes, and queues
+// notifications for the receivers which should be told of a failure or a
+// recovery.
+//
+// This is a bridge.Handler.
+func (n *Notifier) Process(res bridge.Result) error {
+
+	n.updating.Lock()
+	defer n.updating.Unlock()
+
+	//
+	// Results from older workers don't contain the ID of the test.
+	//
+	id := res.ID
+	if id == "" {
+		tmp := test.Test{Input: res.Input}
+		id = tmp.ID()
+	}
+
+	now := n.now()
+	key := id + "/" + res.Target
+
+	e, err := n.state.Get(key)
+	if err != nil {
+		return err
+	}
+
+	if !res.Failed() {
+		if e == nil {
+			return nil
+		}
+		return n.recovered(key, e, now)
+	}
+
+	//
+	// Record the details of the failure.
+	//
+	if e == nil {
+		e = &Entry{Notified: make(map[string]Notice)}
+		e.ID = id
+		e.Target = res.Target
+		e.Since = now
+		if !res.Time.IsZero() {
+			e.Since = res.Time
+		}
+	}
+	e.Input = res.Input
+	e.Type = res.Type
+	e.Tag = res.Tag
+	e.Location = res.Location
+	e.Severity = res.Severity
+	e.Error = res.Error
+	e.Time = now
+
+	ack, err := n.state.GetAck(id)
+	if err != nil {
+		return err
+	}
+	out := n.acknowledged(e, ack, now)
+
+	//
+	// Find the receivers who haven't been told of the failure, or
+	// who should be reminded of it, and the escalation policies to
+	// follow.
+	//
+	seen := make(map[string]bool)
+
+	for _, route := range n.rules.Route(res, now) {
+		if route.Escalation != "" {
+			if e.Escalations == nil {
+				e.Escalations = make(map[string]time.Duration)
+			}
+			if _, ok := e.Escalations[route.Escalation]; !ok {
+				e.Escalations[route.Escalation] = route.GroupInterval
+			}
+		}
+
+		for _, name := range route.Receivers {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			notice, ok := e.Notified[name]
+			if ok && (route.Repeat == 0 || e.Ack != nil || now.Sub(notice.Time) < route.Repeat) {
+				continue
+			}
+
+			ev := e.Event
+			ev.Reminder = ok
+			out = append(out, pending{name: name, group: route.GroupInterval, ev: ev})
+			e.Notified[name] = Notice{Time: now, Group: route.GroupInterval}
+		}
+	}
+	out = append(out, n.escalate(e, now)...)
+
+	err = n.state.Put(key, e)
+	if err != nil {
+		return err
+	}
+	for _, p := range out {
+		n.queue(p.name, p.group, p.ev)
+	}
+	return nil
+}
+
+// pending is a notification which is waiting to be queued, once the state
+// of the test has been saved.
+type pending struct {
+	name  string
+	group time.Duration
+	ev    Event
+}
+
+// recovered forgets a test which has passed, and queues a recovery for
+// each receiver which was told it was failing.
+func (n *Notifier) recovered(key string, e *Entry, now time.Time) error {
+
+	err := n.state.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	//
+	// The acknowledgement is removed once the test has recovered
+	// against every target, so that it escalates again if it fails
+	// again.
+	//
+	if e.Ack != nil {
+		all, err := n.state.All()
+		if err != nil {
+			return err
+		}
+		failing := false
+		for _, other := range all {
+			if other.ID == e.ID {
+				failing = true
+			}
+		}
+		if !failing {
+			err = n.state.DeleteAck(e.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	ev := e.Event
+	ev.Recovered = true
+	ev.Reminder = false
+	ev.Time = now
+	for name, notice := range e.Notified {
+		n.queue(name, notice.Group, ev)
+	}
+	return nil
+}
+
+// acknowledged records the acknowledgement of a failure, if it has been
+// acknowledged since we last looked, and returns the notifications which
+// tell the receivers who were told of the failure.
+//
+// An acknowledgement which has been removed is forgotten.
+func (n *Notifier) acknowledged(e *Entry, ack *Ack, now time.Time) []pending {
+
+	if ack == nil || e.Ack != nil {
+		e.Ack = ack
+		return nil
+	}
+	e.Ack = ack
+
+	ev := e.Event
+	ev.Acknowledgement = true
+	ev.Time = now
+
+	var names []string
+	for name := range e.Notified {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out []pending
+	for _, name := range names {
+		out = append(out, pending{name: name, group: e.Notified[name].Group, ev: ev})
+	}
+	return out
+}
+
+// escalate returns the notifications for the receivers of the steps of the
+// escalation policies which have fallen due, unless the failure has been
+// acknowledged.
+func (n *Notifier) escalate(e *Entry, now time.Time) []pending {
+
+	if e.Ack != nil {
+		return nil
+	}
+
+	var names []string
+	for name := range e.Escalations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out []pending
+	for _, policy := range names {
+		group := e.Escalations[policy]
+
+		for _, step := range n.rules.Escalations[policy] {
+			if now.Sub(e.Since) < step.After {
+				break
+			}
+			for _, name := range step.Receivers {
+				if _, ok := e.Notified[name]; ok {
+					continue
+				}
+
+				ev := e.Event
+				ev.Time = now
+				if step.After > 0 {
+					ev.Escalation = policy
+				}
+				out = append(out, pending{name: name, group: group, ev: ev})
+				e.Notified[name] = Notice{Time: now, Group: group}
+			}
+		}
+	}
+	return out
+}
+
+// Escalate notifies the receivers of the steps of escalation policies
+// which have fallen due, and tells receivers of acknowledgements, for each
+// failing test.
+//
+// This should be called regularly, as results may not arrive often enough.
+func (n *Notifier) Escalate() error {
+
+	n.updating.Lock()
+	defer n.updating.Unlock()
+
+	all, err := n.state.All()
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for key := range all {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := n.now()
+	for _, key := range keys {
+		e := all[key]
+
+		ack, err := n.state.GetAck(e.ID)
+		if err != nil {
+			return err
+		}
+		before := e.Ack
+		out := n.acknowledged(e, ack, now)
+		out = append(out, n.escalate(e, now)...)
+
+		if len(out) == 0 && (before == nil) == (e.Ack == nil) {
+			continue
+		}
+
+		err = n.state.Put(key, e)
+		if err != nil {
+			return err
+		}
+		for _, p := range out {
+			n.queue(p.name, p.group, p.ev)
+		}
+	}
+	return nil
+}
+
+// queue adds an event to the batch for the given receiver, which is sent
+// once the group-interval has passed.
+func (n *Notifier) queue(name string, group time.Duration, ev Event) {
+	n.Lock()
+	defer n.Unlock()
+
+	key := name + "/" + group.String()
+	b, ok := n.batches[key]
+	if !ok {
+		b = &batch{key: key, receiver: name, due: n.now().Add(group)}
+		n.batches[key] = b
+	}
+	b.add(ev)
+}
+
+// Flush sends the batches which are due, or every batch if all is true.
+//
+// Batches which can't be sent are retried later, unless all is true.
+func (n *Notifier) Flush(all bool) {
+
+	now := n.now()
+
+	n.Lock()
+	var due []*batch
+	for key, b := range n.batches {
+		if all || !now.Before(b.due) {
+			due = append(due, b)
+			delete(n.batches, key)
+		}
+	}
+	n.Unlock()
+
+	for _, b := range due {
+		if len(b.events) == 0 {
+			continue
+		}
+		n.send(b, now, all)
+	}
+}
+
+// send sends a batch to its receiver.
+func (n *Notifier) send(b *batch, now time.Time, final bool) {
+
+	recv, ok := n.receivers[b.receiver]
+	if !ok {
+		n.log.Error("Discarding notification for unknown receiver", "receiver", b.receiver)
+		return
+	}
+
+	//
+	// Failures first, then the oldest first.
+	//
+	sort.SliceStable(b.events, func(i, j int) bool {
+		if b.events[i].Recovered != b.events[j].Recovered {
+			return !b.events[i].Recovered
+		}
+		return b.events[i].Since.Before(b.events[j].Since)
+	})
+
+	msg := Notification{Receiver: b.receiver, Events: b.events}
+	err := recv.Send(msg)
+	if err == nil {
+		n.log.Info("Sent notification", "receiver", b.receiver, "failures", msg.Failures(), "recoveries", msg.Recoveries())
+		return
+	}
+
+	if final {
+		n.log.Error("Failed to send notification", "receiver", b.receiver, "events", len(b.events), logger.FieldError, err)
+		return
+	}
+
+	//
+	// Try again later, along with anything which has been queued
+	// for the receiver in the meantime.
+	//
+	delay := RetryDelay << uint(b.attempts)
+	if delay > MaxRetryDelay || delay <= 0 {
+		delay = MaxRetryDelay
+	}
+	b.attempts++
+	b.due = now.Add(delay)
+
+	n.log.Warn("Failed to send notification, it will be retried", "receiver", b.receiver, "retry", delay, logger.FieldError, err)
+
+	n.Lock()
+	defer n.Unlock()
+	if newer, ok := n.batches[b.key]; ok {
+		for _, ev := range newer.events {
+			b.add(ev)
+		}
+	}
+	n.batches[b.key] = b
+}
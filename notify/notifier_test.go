@@ -0,0 +1,457 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skx/overseer/bridge"
+)
+
+// fake is a receiver which records the notifications it is sent.
+type fake struct {
+	sync.Mutex
+	sent []Notification
+	err  error
+}
+
+// Send records the notification.
+func (f *fake) Send(n Notification) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+	f.sent = append(f.sent, n)
+	return nil
+}
+
+// take returns the notifications which have been sent, and forgets them.
+func (f *fake) take() []Notification {
+	f.Lock()
+	defer f.Unlock()
+
+	out := f.sent
+	f.sent = nil
+	return out
+}
+
+// clock is a fake clock.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Add(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// setup creates a notifier for the given rules, whose receivers are
+// fakes.
+func setup(t *testing.T, rules string) (*Notifier, map[string]*fake, *clock) {
+
+	r, err := Parse([]byte(rules))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	n, err := New(r, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	fakes := make(map[string]*fake)
+	for name := range n.receivers {
+		fakes[name] = &fake{}
+		n.receivers[name] = fakes[name]
+	}
+
+	c := &clock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	n.now = c.Now
+	return n, fakes, c
+}
+
+// result returns a test-result.
+func result(id string, failed bool) bridge.Result {
+	res := bridge.Result{ID: id, Type: "http", Target: "10.0.0.1", Input: "http://example.com/ must run http", Result: "passed"}
+	if failed {
+		res.Result = "failed"
+		res.Error = "timeout"
+	}
+	return res
+}
+
+// Test that receivers are told of failures once, and of recoveries.
+func TestFailureAndRecovery(t *testing.T) {
+
+	n, fakes, c := setup(t, `
+receivers:
+  a: {webhook: {url: "http://localhost/"}}
+routes:
+  - receivers: [a]
+`)
+
+	n.Process(result("aaaa", true))
+	n.Process(result("aaaa", true))
+	n.Process(result("bbbb", false))
+	n.Flush(false)
+
+	sent := fakes["a"].take()
+	if len(sent) != 1 || len(sent[0].Events) != 1 {
+		t.Fatalf("Expected a single failure, got %v", sent)
+	}
+	ev := sent[0].Events[0]
+	if ev.ID != "aaaa" || ev.Recovered || ev.Error != "timeout" || !ev.Since.Equal(c.now) {
+		t.Errorf("Wrong event: %v", ev)
+	}
+
+	c.Add(10 * time.Minute)
+	n.Process(result("aaaa", true))
+	n.Flush(false)
+	if sent = fakes["a"].take(); len(sent) != 0 {
+		t.Fatalf("Expected no notifications, got %v", sent)
+	}
+
+	n.Process(result("aaaa", false))
+	n.Flush(false)
+	sent = fakes["a"].take()
+	if len(sent) != 1 || !sent[0].Events[0].Recovered {
+		t.Fatalf("Expected a recovery, got %v", sent)
+	}
+	if sent[0].Events[0].Duration() != 10*time.Minute {
+		t.Errorf("Wrong duration: %s", sent[0].Events[0].Duration())
+	}
+	if !strings.Contains(sent[0].Subject(), "recovered against 10.0.0.1, after failing for 10m0s") {
+		t.Errorf("Wrong subject: %s", sent[0].Subject())
+	}
+
+	//
+	// Once recovered the state is forgotten.
+	//
+	all, _ := n.state.All()
+	if len(all) != 0 {
+		t.Errorf("Expected no failing tests, got %v", all)
+	}
+}
+
+// Test that notifications are grouped.
+func TestGroup(t *testing.T) {
+
+	n, fakes, c := setup(t, `
+receivers:
+  a: {webhook: {url: "http://localhost/"}}
+routes:
+  - receivers: [a]
+    group-interval: 5m
+`)
+
+	n.Process(result("aaaa", true))
+	c.Add(time.Minute)
+	n.Process(result("bbbb", true))
+	n.Process(result("cccc", true))
+	n.Process(result("cccc", false))
+	n.Flush(false)
+	if sent := fakes["a"].take(); len(sent) != 0 {
+		t.Fatalf("Expected no notifications, got %v", sent)
+	}
+
+	//
+	// The recovery of cccc cancelled its failure, as nobody had
+	// been told of it.
+	//
+	c.Add(4 * time.Minute)
+	n.Flush(false)
+	sent := fakes["a"].take()
+	if len(sent) != 1 || len(sent[0].Events) != 2 {
+		t.Fatalf("Expected two failures, got %v", sent)
+	}
+	if sent[0].Subject() != "Overseer: 2 failing, 0 recovered" {
+		t.Errorf("Wrong subject: %s", sent[0].Subject())
+	}
+	if sent[0].Events[0].ID != "aaaa" || sent[0].Events[1].ID != "bbbb" {
+		t.Errorf("Events are not in order: %v", sent[0].Events)
+	}
+}
+
+// Test that receivers are reminded of tests which are still failing, and
+// that only the first matching route applies unless it continues.
+func TestRepeatAndContinue(t *testing.T) {
+
+	n, fakes, c := setup(t, `
+receivers:
+  a: {webhook: {url: "http://localhost/a"}}
+  b: {webhook: {url: "http://localhost/b"}}
+  c: {webhook: {url: "http://localhost/c"}}
+routes:
+  - match: {type: http}
+    receivers: [a]
+    repeat: 1h
+    continue: true
+  - match: {type: http}
+    receivers: [b]
+  - receivers: [c]
+`)
+
+	n.Process(result("aaaa", true))
+	n.Flush(false)
+	if len(fakes["a"].take()) != 1 || len(fakes["b"].take()) != 1 || len(fakes["c"].take()) != 0 {
+		t.Fatalf("Wrong receivers notified")
+	}
+
+	c.Add(time.Hour)
+	n.Process(result("aaaa", true))
+	n.Flush(false)
+	sent := fakes["a"].take()
+	if len(sent) != 1 || !sent[0].Events[0].Reminder {
+		t.Fatalf("Expected a reminder, got %v", sent)
+	}
+	if len(fakes["b"].take()) != 0 {
+		t.Errorf("Expected no reminder for b")
+	}
+	if !strings.Contains(sent[0].Subject(), "still failing") {
+		t.Errorf("Wrong subject: %s", sent[0].Subject())
+	}
+}
+
+// Test that notifications which can't be sent are retried.
+func TestRetry(t *testing.T) {
+
+	n, fakes, c := setup(t, `
+receivers:
+  a: {webhook: {url: "http://localhost/"}}
+routes:
+  - receivers: [a]
+`)
+
+	fakes["a"].err = fmt.Errorf("broken")
+	n.Process(result("aaaa", true))
+	n.Flush(false)
+
+	fakes["a"].err = nil
+	n.Process(result("bbbb", true))
+	c.Add(RetryDelay - time.Second)
+	n.Flush(false)
+	if sent := fakes["a"].take(); len(sent) != 0 {
+		t.Fatalf("Expected no notifications, got %v", sent)
+	}
+
+	c.Add(time.Second)
+	n.Flush(false)
+	sent := fakes["a"].take()
+	if len(sent) != 1 || len(sent[0].Events) != 2 {
+		t.Fatalf("Expected both failures, got %v", sent)
+	}
+}
+
+// Test the webhook, and telegram, receivers.
+func TestHTTPReceivers(t *testing.T) {
+
+	var mu sync.Mutex
+	var bodies []string
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		r.ParseForm()
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Form.Get("text") != "" {
+			body = []byte(r.Form.Get("chat_id") + ":" + r.Form.Get("text"))
+		}
+		paths = append(paths, r.URL.Path)
+		bodies = append(bodies, string(body))
+
+		if strings.Contains(r.URL.Path, "sendMessage") {
+			fmt.Fprintf(w, `{"ok": true}`)
+		}
+	}))
+	defer server.Close()
+
+	n := Notification{
+		Receiver: "test",
+		Events:   []Event{{ID: "aaaa", Type: "http", Target: "10.0.0.1", Error: "timeout"}},
+	}
+
+	rc := ReceiverConfig{Webhook: &WebhookConfig{URL: server.URL + "/hook", Headers: map[string]string{"X-Test": "yes"}}}
+	recv, err := rc.New()
+	if err == nil {
+		err = recv.Send(n)
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	rc = ReceiverConfig{Webhook: &WebhookConfig{URL: server.URL + "/hook", Template: `{"text": {{ json .Subject }}}`}}
+	recv, _ = rc.New()
+	err = recv.Send(n)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	rc = ReceiverConfig{Telegram: &TelegramConfig{Token: "xxxx", Chat: "1,2", APIURL: server.URL}}
+	recv, _ = rc.New()
+	err = recv.Send(n)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(bodies) != 4 {
+		t.Fatalf("Expected four requests, got %v", bodies)
+	}
+
+	var body map[string]interface{}
+	err = json.Unmarshal([]byte(bodies[0]), &body)
+	if err != nil || body["receiver"] != "test" || body["failures"] != 1.0 {
+		t.Errorf("Wrong body: %s", bodies[0])
+	}
+	if bodies[1] != `{"text": "The http test failed against 10.0.0.1"}` {
+		t.Errorf("Wrong body: %s", bodies[1])
+	}
+	if paths[2] != "/botxxxx/sendMessage" || !strings.HasPrefix(bodies[2], "1:The http test failed") || !strings.HasPrefix(bodies[3], "2:") {
+		t.Errorf("Wrong messages: %v %v", paths, bodies)
+	}
+}
+
+// Test the email receiver, via a fake sendmail.
+func TestEmail(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	sendmail := filepath.Join(dir, "sendmail")
+	output := filepath.Join(dir, "output")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\ncat >> %s\n", output, output)
+	err = ioutil.WriteFile(sendmail, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("Failed to write script: %s", err.Error())
+	}
+
+	rc := ReceiverConfig{Email: &EmailConfig{To: "a@example.com, b@example.com", Sendmail: sendmail}}
+	recv, _ := rc.New()
+	err = recv.Send(Notification{
+		Receiver: "test",
+		Events:   []Event{{ID: "aaaa", Type: "http", Target: "10.0.0.1", Input: "http://example.com/ must run http", Error: "timeout"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	data, _ := ioutil.ReadFile(output)
+	for _, expected := range []string{
+		"-f a@example.com a@example.com b@example.com\n",
+		"To: a@example.com, b@example.com\r\n",
+		"Subject: The http test failed against 10.0.0.1\r\n",
+		"Error: timeout\r\n",
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected the email to contain %q:\n%s", expected, data)
+		}
+	}
+}
+
+// Test that failures escalate, until they're acknowledged.
+func TestEscalation(t *testing.T) {
+
+	n, fakes, c := setup(t, `
+receivers:
+  chat: {webhook: {url: "http://localhost/chat"}}
+  oncall: {webhook: {url: "http://localhost/oncall"}}
+  pager: {webhook: {url: "http://localhost/pager"}}
+escalations:
+  standard:
+    - after: 30m
+      receivers: [pager]
+    - receivers: [chat]
+    - after: 15m
+      receivers: [oncall]
+routes:
+  - escalation: standard
+`)
+
+	n.Process(result("aaaa", true))
+	n.Flush(false)
+	if len(fakes["chat"].take()) != 1 || len(fakes["oncall"].take()) != 0 {
+		t.Fatalf("Expected only the chat to be notified")
+	}
+
+	c.Add(15 * time.Minute)
+	n.Escalate()
+	n.Flush(false)
+	sent := fakes["oncall"].take()
+	if len(sent) != 1 || sent[0].Events[0].Escalation != "standard" {
+		t.Fatalf("Expected the failure to escalate, got %v", sent)
+	}
+	if !strings.Contains(sent[0].Text(), "Escalated: nobody has acknowledged the failure after 15m0s") {
+		t.Errorf("Wrong text: %s", sent[0].Text())
+	}
+	if len(fakes["chat"].take()) != 0 || len(fakes["pager"].take()) != 0 {
+		t.Fatalf("Expected only the oncall to be notified")
+	}
+
+	//
+	// Acknowledge the failure, by the start of its ID.
+	//
+	id, err := n.state.Find("aa")
+	if err != nil || id != "aaaa" {
+		t.Fatalf("Failed to find the test: %v", err)
+	}
+	n.state.PutAck(id, Ack{By: "steve", Comment: "On it", Time: c.now})
+
+	c.Add(time.Minute)
+	n.Escalate()
+	n.Flush(false)
+	for _, name := range []string{"chat", "oncall"} {
+		sent = fakes[name].take()
+		if len(sent) != 1 || !sent[0].Events[0].Acknowledgement {
+			t.Fatalf("Expected %s to be told of the acknowledgement, got %v", name, sent)
+		}
+		if sent[0].Subject() != "The http test failing against 10.0.0.1 was acknowledged by steve" {
+			t.Errorf("Wrong subject: %s", sent[0].Subject())
+		}
+	}
+
+	//
+	// Nobody is paged, or told of the acknowledgement again.
+	//
+	c.Add(time.Hour)
+	n.Escalate()
+	n.Process(result("aaaa", true))
+	n.Flush(false)
+	for name, f := range fakes {
+		if sent = f.take(); len(sent) != 0 {
+			t.Errorf("Expected no notifications for %s, got %v", name, sent)
+		}
+	}
+
+	//
+	// Once the test recovers the acknowledgement is forgotten.
+	//
+	n.Process(result("aaaa", false))
+	n.Flush(false)
+	if len(fakes["chat"].take()) != 1 || len(fakes["oncall"].take()) != 1 || len(fakes["pager"].take()) != 0 {
+		t.Errorf("Expected the chat and oncall to be told of the recovery")
+	}
+	if ack, _ := n.state.GetAck("aaaa"); ack != nil {
+		t.Errorf("Expected the acknowledgement to be removed")
+	}
+	if _, err := n.state.Find("aa"); err == nil {
+		t.Errorf("Expected no failing test to be found")
+	}
+}
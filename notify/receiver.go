@@ -0,0 +1,236 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Receiver sends notifications to a destination, such as an email address.
+type Receiver interface {
+
+	// Send delivers a notification.
+	Send(n Notification) error
+}
+
+// ReceiverConfig describes a receiver, of which exactly one field must
+// be set.
+type ReceiverConfig struct {
+
+	// Email sends email, via SMTP or sendmail.
+	Email *EmailConfig `yaml:"email"`
+
+	// Telegram sends messages to telegram chats.
+	Telegram *TelegramConfig `yaml:"telegram"`
+
+	// Webhook POSTs notifications to an HTTP endpoint.
+	Webhook *WebhookConfig `yaml:"webhook"`
+}
+
+// Validate ensures that exactly one type of receiver is configured, and
+// that its settings are sane.
+func (rc ReceiverConfig) Validate() error {
+
+	n := 0
+	var err error
+	if rc.Email != nil {
+		n++
+		err = rc.Email.Validate()
+		if err != nil {
+			return fmt.Errorf("email.%s", err.Error())
+		}
+	}
+	if rc.Telegram != nil {
+		n++
+		err = rc.Telegram.Validate()
+		if err != nil {
+			return fmt.Errorf("telegram.%s", err.Error())
+		}
+	}
+	if rc.Webhook != nil {
+		n++
+		err = rc.Webhook.Validate()
+		if err != nil {
+			return fmt.Errorf("webhook.%s", err.Error())
+		}
+	}
+
+	if n != 1 {
+		return fmt.Errorf("exactly one of email, telegram, or webhook must be given")
+	}
+	return nil
+}
+
+// New creates the receiver.
+func (rc ReceiverConfig) New() (Receiver, error) {
+	switch {
+	case rc.Email != nil:
+		return newEmail(*rc.Email), nil
+	case rc.Telegram != nil:
+		return newTelegram(*rc.Telegram)
+	case rc.Webhook != nil:
+		return newWebhook(*rc.Webhook)
+	}
+	return nil, fmt.Errorf("no receiver is configured")
+}
+
+// Event describes a change in the state of a test, which receivers are
+// told of.
+type Event struct {
+
+	// ID is the stable ID of the test.
+	ID string `json:"id"`
+
+	// Input is the test, as read from the configuration file.
+	Input string `json:"input"`
+
+	// Type is the type of the test, such as "http".
+	Type string `json:"type"`
+
+	// Target is the address the test was executed against.
+	Target string `json:"target"`
+
+	// Tag and Location describe the worker which executed the test.
+	Tag      string `json:"tag,omitempty"`
+	Location string `json:"location,omitempty"`
+
+	// Severity is the severity of the test, if set.
+	Severity string `json:"severity,omitempty"`
+
+	// Error is the reason the test failed.
+	Error string `json:"error,omitempty"`
+
+	// Recovered is true if the test has passed again.
+	Recovered bool `json:"recovered"`
+
+	// Reminder is true if the receiver has already been told that the
+	// test is failing.
+	Reminder bool `json:"reminder,omitempty"`
+
+	// Escalation is the name of the escalation policy which caused the
+	// receiver to be told, if the test had been failing for a while.
+	Escalation string `json:"escalation,omitempty"`
+
+	// Ack is the acknowledgement of the failure, if it has been
+	// acknowledged.
+	Ack *Ack `json:"ack,omitempty"`
+
+	// Acknowledgement is true if the event announces that the failure
+	// has been acknowledged.
+	Acknowledgement bool `json:"acknowledgement,omitempty"`
+
+	// Since is when the test started failing.
+	Since time.Time `json:"since"`
+
+	// Time is when the event happened.
+	Time time.Time `json:"time"`
+}
+
+// key identifies the test, and target, which the event describes.
+//
+// Acknowledgements are distinct from failures, so that a receiver which
+// hasn't yet been told of a failure is told of both.
+func (e Event) key() string {
+	if e.Acknowledgement {
+		return e.ID + "/" + e.Target + "/ack"
+	}
+	return e.ID + "/" + e.Target
+}
+
+// Duration returns how long the test has been failing, or was failing
+// for if it has recovered.
+func (e Event) Duration() time.Duration {
+	return e.Time.Sub(e.Since).Round(time.Second)
+}
+
+// Summary describes the event in a single line.
+func (e Event) Summary() string {
+	switch {
+	case e.Recovered:
+		return fmt.Sprintf("The %s test recovered against %s, after failing for %s", e.Type, e.Target, e.Duration())
+	case e.Acknowledgement && e.Ack != nil:
+		return fmt.Sprintf("The %s test failing against %s was acknowledged by %s", e.Type, e.Target, e.Ack.By)
+	case e.Reminder:
+		return fmt.Sprintf("The %s test is still failing against %s, after %s", e.Type, e.Target, e.Duration())
+	}
+	return fmt.Sprintf("The %s test failed against %s", e.Type, e.Target)
+}
+
+// Notification is a group of events, sent to a single receiver.
+type Notification struct {
+
+	// Receiver is the name of the receiver.
+	Receiver string `json:"receiver"`
+
+	// Events are the events, failures first.
+	Events []Event `json:"events"`
+}
+
+// Failures returns the number of events which are failures.
+func (n Notification) Failures() int {
+	count := 0
+	for _, e := range n.Events {
+		if !e.Recovered && !e.Acknowledgement {
+			count++
+		}
+	}
+	return count
+}
+
+// Recoveries returns the number of events which are recoveries.
+func (n Notification) Recoveries() int {
+	count := 0
+	for _, e := range n.Events {
+		if e.Recovered {
+			count++
+		}
+	}
+	return count
+}
+
+// Acknowledgements returns the number of events which are
+// acknowledgements.
+func (n Notification) Acknowledgements() int {
+	return len(n.Events) - n.Failures() - n.Recoveries()
+}
+
+// Subject summarises the notification in a single line.
+func (n Notification) Subject() string {
+	if len(n.Events) == 1 {
+		return n.Events[0].Summary()
+	}
+	subject := fmt.Sprintf("Overseer: %d failing, %d recovered", n.Failures(), n.Recoveries())
+	if acks := n.Acknowledgements(); acks > 0 {
+		subject += fmt.Sprintf(", %d acknowledged", acks)
+	}
+	return subject
+}
+
+// Text describes each of the events in the notification.
+func (n Notification) Text() string {
+
+	var out []string
+	for _, e := range n.Events {
+		lines := []string{e.Summary() + "."}
+		if e.Tag != "" || e.Location != "" {
+			lines = append(lines, fmt.Sprintf("Worker: %s", strings.Trim(e.Tag+" "+e.Location, " ")))
+		}
+		lines = append(lines, "Test: "+e.Input)
+		if !e.Recovered {
+			lines = append(lines, "Error: "+e.Error)
+		}
+		if e.Escalation != "" && !e.Recovered {
+			lines = append(lines, fmt.Sprintf("Escalated: nobody has acknowledged the failure after %s", e.Duration()))
+		}
+		if e.Ack != nil {
+			ack := fmt.Sprintf("Acknowledged: by %s at %s", e.Ack.By, e.Ack.Time.Format("15:04 MST"))
+			if e.Ack.Comment != "" {
+				ack += " - " + e.Ack.Comment
+			}
+			lines = append(lines, ack)
+		}
+		lines = append(lines, "ID: "+e.ID)
+		out = append(out, strings.Join(lines, "\n"))
+	}
+	return strings.Join(out, "\n\n")
+}
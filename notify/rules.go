@@ -0,0 +1,413 @@
+// Package notify routes test-results to the people who should hear about
+// them, as described by a file of routing rules.
+//
+// The rules file is YAML, and contains the receivers which may be
+// notified, and the routes which select the receivers of each result:
+//
+//	receivers:
+//	  team-chat:
+//	    telegram:
+//	      token: xxxx
+//	      chat: -1001234
+//	  oncall:
+//	    email:
+//	      to: oncall@example.com
+//	routes:
+//	  - match:
+//	      tag: dc1
+//	      severity: critical
+//	      time: 09:00-17:30
+//	      days: mon-fri
+//	    receivers: [team-chat]
+//	    group-interval: 5m
+//	    continue: true
+//	  - receivers: [oncall]
+//
+// The routes are tried in order, and the first which matches a result is
+// used, unless it sets `continue` in which case the later routes are
+// tried too.
+//
+// Each receiver is told once when a test starts failing, and again once
+// it recovers.
+//
+// A route may also name an escalation policy, which notifies further
+// receivers if the test is still failing, and nobody has acknowledged
+// it, after a while:
+//
+//	escalations:
+//	  standard:
+//	    - receivers: [team-chat]
+//	    - after: 15m
+//	      receivers: [oncall]
+//	    - after: 30m
+//	      receivers: [pager]
+//	routes:
+//	  - escalation: standard
+package notify
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skx/overseer/bridge"
+	"gopkg.in/yaml.v2"
+)
+
+// Rules is the contents of a rules file.
+type Rules struct {
+
+	// Receivers are the destinations of notifications, keyed by name.
+	Receivers map[string]ReceiverConfig `yaml:"receivers"`
+
+	// Routes select the receivers of each result.
+	Routes []Route `yaml:"routes"`
+
+	// Escalations are the escalation policies, keyed by name.
+	Escalations map[string][]Step `yaml:"escalations"`
+}
+
+// Step is a single step of an escalation policy.
+type Step struct {
+
+	// After is how long the test must have been failing, without
+	// being acknowledged, before the receivers are notified.
+	After time.Duration `yaml:"after"`
+
+	// Receivers are the names of the receivers to notify.
+	Receivers []string `yaml:"receivers"`
+}
+
+// Route selects the receivers of the results which it matches.
+type Route struct {
+
+	// Match describes the results which the route applies to.
+	Match Match `yaml:"match"`
+
+	// Receivers are the names of the receivers to notify.
+	Receivers []string `yaml:"receivers"`
+
+	// Escalation is the name of the escalation policy to follow.
+	Escalation string `yaml:"escalation"`
+
+	// GroupInterval is how long to collect notifications for before
+	// sending them together, zero to send them as soon as possible.
+	GroupInterval time.Duration `yaml:"group-interval"`
+
+	// Repeat is how often to remind the receivers of tests which are
+	// still failing, zero to only tell them once.
+	Repeat time.Duration `yaml:"repeat"`
+
+	// Continue allows the later routes to match too.
+	Continue bool `yaml:"continue"`
+}
+
+// Match describes the results which a route applies to.
+//
+// Each field, except the time and days, is a comma-separated list of
+// globs any of which may match, and an empty field matches everything.
+type Match struct {
+
+	// Type is the type of the test, such as "http".
+	Type string `yaml:"type"`
+
+	// Target is the address the test was executed against.
+	Target string `yaml:"target"`
+
+	// Tag and Location describe the worker which executed the test.
+	Tag      string `yaml:"tag"`
+	Location string `yaml:"location"`
+
+	// Severity is the severity of the test.
+	Severity string `yaml:"severity"`
+
+	// Time is a comma-separated list of the times of day at which the
+	// route applies, such as "09:00-17:30".  A range which ends before
+	// it starts, such as "22:00-06:00", spans midnight.
+	Time string `yaml:"time"`
+
+	// Days is a comma-separated list of the days, or ranges of days,
+	// on which the route applies, such as "mon-fri,sun".
+	Days string `yaml:"days"`
+
+	// Timezone is the zone the time and days are in, by default the
+	// local zone.
+	Timezone string `yaml:"timezone"`
+
+	// The parsed time-ranges, days, and zone.
+	//
+	// If no days were given each of the days is false.
+	times []timeRange
+	days  [7]bool
+	zone  *time.Location
+}
+
+// timeRange is a range of the minutes of a day.
+type timeRange struct {
+	start int
+	end   int
+}
+
+// dayNames are the names of the days, in the order of time.Weekday.
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Load reads, and validates, the given rules file.
+func Load(file string) (*Rules, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules - %s", err.Error())
+	}
+	return Parse(data)
+}
+
+// Parse parses, and validates, the contents of a rules file.
+func Parse(data []byte) (*Rules, error) {
+
+	var rules Rules
+	err := yaml.UnmarshalStrict(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rules - %s", err.Error())
+	}
+
+	err = rules.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules - %s", err.Error())
+	}
+	return &rules, nil
+}
+
+// Validate ensures that the rules are sane, returning an error which names
+// the first setting which is not.
+//
+// The times, and days, of each route are parsed, so this must be called
+// before the routes are used.
+func (r *Rules) Validate() error {
+
+	for name, rc := range r.Receivers {
+		err := rc.Validate()
+		if err != nil {
+			return fmt.Errorf("receivers.%s: %s", name, err.Error())
+		}
+	}
+
+	for name, steps := range r.Escalations {
+		if len(steps) == 0 {
+			return fmt.Errorf("escalations.%s: at least one step must be given", name)
+		}
+		for i, step := range steps {
+			if step.After < 0 {
+				return fmt.Errorf("escalations.%s[%d].after: must not be negative", name, i)
+			}
+			if len(step.Receivers) == 0 {
+				return fmt.Errorf("escalations.%s[%d]: at least one receiver must be given", name, i)
+			}
+			for _, recv := range step.Receivers {
+				if _, ok := r.Receivers[recv]; !ok {
+					return fmt.Errorf("escalations.%s[%d].receivers: unknown receiver '%s'", name, i, recv)
+				}
+			}
+		}
+
+		//
+		// The steps are followed in the order they fall due.
+		//
+		sort.SliceStable(steps, func(i, j int) bool { return steps[i].After < steps[j].After })
+	}
+
+	if len(r.Routes) == 0 {
+		return fmt.Errorf("routes: at least one route must be given")
+	}
+
+	for i := range r.Routes {
+		route := &r.Routes[i]
+
+		if len(route.Receivers) == 0 && route.Escalation == "" {
+			return fmt.Errorf("routes[%d]: at least one receiver, or an escalation, must be given", i)
+		}
+		for _, name := range route.Receivers {
+			if _, ok := r.Receivers[name]; !ok {
+				return fmt.Errorf("routes[%d].receivers: unknown receiver '%s'", i, name)
+			}
+		}
+		if route.Escalation != "" {
+			if _, ok := r.Escalations[route.Escalation]; !ok {
+				return fmt.Errorf("routes[%d].escalation: unknown escalation '%s'", i, route.Escalation)
+			}
+		}
+		if route.GroupInterval < 0 {
+			return fmt.Errorf("routes[%d].group-interval: must not be negative", i)
+		}
+		if route.Repeat < 0 {
+			return fmt.Errorf("routes[%d].repeat: must not be negative", i)
+		}
+
+		err := route.Match.compile()
+		if err != nil {
+			return fmt.Errorf("routes[%d].match.%s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+// compile parses the times, days, and zone of the match.
+func (m *Match) compile() error {
+
+	m.zone = time.Local
+	if m.Timezone != "" {
+		zone, err := time.LoadLocation(m.Timezone)
+		if err != nil {
+			return fmt.Errorf("timezone: %s", err.Error())
+		}
+		m.zone = zone
+	}
+
+	m.times = nil
+	for _, val := range split(m.Time) {
+		parts := strings.SplitN(val, "-", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("time: '%s' is not of the form 'HH:MM-HH:MM'", val)
+		}
+		start, err := parseClock(parts[0])
+		if err != nil {
+			return fmt.Errorf("time: %s", err.Error())
+		}
+		end, err := parseClock(parts[1])
+		if err != nil {
+			return fmt.Errorf("time: %s", err.Error())
+		}
+		m.times = append(m.times, timeRange{start: start, end: end})
+	}
+
+	m.days = [7]bool{}
+	for _, val := range split(m.Days) {
+		parts := strings.SplitN(val, "-", 2)
+		first, err := parseDay(parts[0])
+		if err != nil {
+			return fmt.Errorf("days: %s", err.Error())
+		}
+		last := first
+		if len(parts) == 2 {
+			last, err = parseDay(parts[1])
+			if err != nil {
+				return fmt.Errorf("days: %s", err.Error())
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			m.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses a time of day, such as "09:30", returning the number
+// of minutes since midnight.
+func parseClock(val string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(val))
+	if err != nil {
+		if strings.TrimSpace(val) == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("'%s' is not a time of day, such as '09:30'", val)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseDay parses the name of a day, such as "mon".
+func parseDay(val string) (int, error) {
+	val = strings.ToLower(strings.TrimSpace(val))
+	for i, name := range dayNames {
+		if val == name || val == strings.ToLower(time.Weekday(i).String()) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("'%s' is not a day, such as 'mon'", val)
+}
+
+// split splits a comma-separated list, ignoring empty entries.
+func split(val string) []string {
+	var out []string
+	for _, v := range strings.Split(val, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Matches returns true if the route applies to the result, at the given
+// time.
+func (m Match) Matches(res bridge.Result, now time.Time) bool {
+	return bridge.MatchPatterns(m.Type, res.Type) &&
+		bridge.MatchPatterns(m.Target, res.Target) &&
+		bridge.MatchPatterns(m.Tag, res.Tag) &&
+		bridge.MatchPatterns(m.Location, res.Location) &&
+		bridge.MatchPatterns(m.Severity, res.Severity) &&
+		m.active(now)
+}
+
+// active returns true if the given time is within the times, and days,
+// of the match.
+func (m Match) active(now time.Time) bool {
+
+	if m.zone != nil {
+		now = now.In(m.zone)
+	}
+	day := int(now.Weekday())
+	minute := now.Hour()*60 + now.Minute()
+
+	if len(m.times) == 0 {
+		return m.onDay(day)
+	}
+
+	for _, t := range m.times {
+		switch {
+		case t.start <= t.end:
+			if minute >= t.start && minute < t.end && m.onDay(day) {
+				return true
+			}
+		default:
+			//
+			// The range spans midnight, so the morning belongs
+			// to the day on which the range started.
+			//
+			if minute >= t.start && m.onDay(day) {
+				return true
+			}
+			if minute < t.end && m.onDay((day+6)%7) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// onDay returns true if the route applies on the given day, which it does
+// on every day if none were given.
+func (m Match) onDay(day int) bool {
+	return m.days == [7]bool{} || m.days[day]
+}
+
+// Route returns the routes which apply to the result, at the given time,
+// in order.
+func (r *Rules) Route(res bridge.Result, now time.Time) []*Route {
+
+	var out []*Route
+	for i := range r.Routes {
+		route := &r.Routes[i]
+		if !route.Match.Matches(res, now) {
+			continue
+		}
+		out = append(out, route)
+		if !route.Continue {
+			break
+		}
+	}
+	return out
+}
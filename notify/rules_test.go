@@ -0,0 +1,186 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skx/overseer/bridge"
+)
+
+// rulesFile is a valid rules file.
+var rulesFile = `
+receivers:
+  chat:
+    telegram:
+      token: xxxx
+      chat: -1001,42
+  oncall:
+    email:
+      to: oncall@example.com, boss@example.com
+  pager:
+    webhook:
+      url: https://pager.example.com/
+      headers:
+        Authorization: Bearer xxxx
+routes:
+  - match:
+      severity: critical
+    receivers: [pager]
+    continue: true
+  - match:
+      tag: dc1,dc2
+      target: 10.0.*
+      time: 09:00-17:30
+      days: mon-fri
+      timezone: UTC
+    receivers: [chat]
+    group-interval: 5m
+  - receivers: [oncall]
+`
+
+// Test that a rules file is parsed.
+func TestParse(t *testing.T) {
+
+	rules, err := Parse([]byte(rulesFile))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(rules.Receivers) != 3 || len(rules.Routes) != 3 {
+		t.Fatalf("Wrong number of receivers, or routes")
+	}
+	if rules.Routes[1].GroupInterval != 5*time.Minute {
+		t.Errorf("Wrong group-interval: %s", rules.Routes[1].GroupInterval)
+	}
+	if rules.Receivers["pager"].Webhook.Headers["Authorization"] != "Bearer xxxx" {
+		t.Errorf("Wrong headers")
+	}
+}
+
+// Test that invalid rules are rejected, with a useful error.
+func TestParseInvalid(t *testing.T) {
+
+	tests := map[string]string{
+		`routes: []`:                   "at least one route",
+		`routes: [{receivers: [bob]}]`: "unknown receiver 'bob'",
+		`routes: [{match: {}}]`:        "at least one receiver",
+		`bogus: 1`:                     "field bogus not found",
+		`receivers: {a: {}}`:           "exactly one of",
+		`receivers: {a: {email: {to: x}, webhook: {url: "http://x/"}}}`:                              "exactly one of",
+		`receivers: {a: {email: {}}}`:                                                                "receivers.a: email.to",
+		`receivers: {a: {email: {to: x, smtp-tls: maybe}}}`:                                          "smtp-tls",
+		`receivers: {a: {telegram: {token: x, chat: bob}}}`:                                          "invalid chat ID",
+		`receivers: {a: {webhook: {url: "ftp://x/"}}}`:                                               "webhook.url",
+		`receivers: {a: {webhook: {url: "http://x/", template: "{{"}}}`:                              "webhook.template",
+		"receivers: {a: {email: {to: x}}}\nroutes: [{receivers: [a], match: {time: 9-5}}]":           "match.time",
+		"receivers: {a: {email: {to: x}}}\nroutes: [{receivers: [a], match: {days: mon-fun}}]":       "match.days",
+		"receivers: {a: {email: {to: x}}}\nroutes: [{receivers: [a], match: {timezone: Mars/Base}}]": "match.timezone",
+		"receivers: {a: {email: {to: x}}}\nroutes: [{receivers: [a], group-interval: -1s}]":          "group-interval",
+		"receivers: {a: {email: {to: x}}}\nroutes: [{escalation: x}]":                                "unknown escalation 'x'",
+		"escalations: {x: []}":                 "escalations.x: at least one step",
+		"escalations: {x: [{receivers: [b]}]}": "unknown receiver 'b'",
+		"receivers: {a: {email: {to: x}}}\nescalations: {x: [{after: -1m, receivers: [a]}]}": "escalations.x[0].after",
+	}
+
+	for input, expected := range tests {
+		_, err := Parse([]byte(input))
+		if err == nil {
+			t.Errorf("Expected an error parsing '%s'", input)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error containing '%s', got '%s'", expected, err.Error())
+		}
+	}
+}
+
+// Test the times, and days, at which routes apply.
+func TestActive(t *testing.T) {
+
+	tests := []struct {
+		time   string
+		days   string
+		when   string
+		active bool
+	}{
+		{"", "", "2024-01-01 03:00", true},
+		{"09:00-17:30", "", "2024-01-01 09:00", true},
+		{"09:00-17:30", "", "2024-01-01 17:29", true},
+		{"09:00-17:30", "", "2024-01-01 17:30", false},
+		{"09:00-17:30", "", "2024-01-01 08:59", false},
+		{"09:00-12:00,13:00-17:00", "", "2024-01-01 12:30", false},
+		{"09:00-12:00,13:00-17:00", "", "2024-01-01 13:30", true},
+
+		// 2024-01-01 was a Monday.
+		{"", "mon-fri", "2024-01-01 12:00", true},
+		{"", "mon-fri", "2024-01-06 12:00", false},
+		{"", "sat,sunday", "2024-01-07 12:00", true},
+		{"", "fri-mon", "2024-01-07 12:00", true},
+		{"", "fri-mon", "2024-01-03 12:00", false},
+
+		// Ranges which span midnight belong to the day they
+		// start upon.
+		{"22:00-06:00", "fri", "2024-01-05 23:00", true},
+		{"22:00-06:00", "fri", "2024-01-06 05:00", true},
+		{"22:00-06:00", "fri", "2024-01-05 05:00", false},
+		{"22:00-06:00", "fri", "2024-01-06 07:00", false},
+		{"00:00-24:00", "", "2024-01-06 23:59", true},
+	}
+
+	for _, tst := range tests {
+		m := Match{Time: tst.time, Days: tst.days, Timezone: "UTC"}
+		err := m.compile()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		when, _ := time.Parse("2006-01-02 15:04", tst.when)
+		if m.active(when) != tst.active {
+			t.Errorf("Expected %s/%s at %s to be %v", tst.time, tst.days, tst.when, tst.active)
+		}
+	}
+
+	//
+	// The time is converted to the zone of the route.
+	//
+	m := Match{Time: "09:00-17:00", Timezone: "America/New_York"}
+	m.compile()
+	when, _ := time.Parse("2006-01-02 15:04", "2024-01-01 15:00")
+	if !m.active(when) {
+		t.Errorf("Expected 15:00 UTC to be 10:00 in New York")
+	}
+}
+
+// Test that results are routed, honouring `continue`.
+func TestRoute(t *testing.T) {
+
+	rules, err := Parse([]byte(rulesFile))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	monday, _ := time.Parse("2006-01-02 15:04", "2024-01-01 12:00")
+	sunday, _ := time.Parse("2006-01-02 15:04", "2024-01-07 12:00")
+
+	tests := []struct {
+		res       bridge.Result
+		when      time.Time
+		receivers []string
+	}{
+		{bridge.Result{Tag: "dc1", Target: "10.0.0.1"}, monday, []string{"chat"}},
+		{bridge.Result{Tag: "dc1", Target: "10.0.0.1"}, sunday, []string{"oncall"}},
+		{bridge.Result{Tag: "dc3", Target: "10.0.0.1"}, monday, []string{"oncall"}},
+		{bridge.Result{Tag: "dc2", Target: "10.1.0.1"}, monday, []string{"oncall"}},
+		{bridge.Result{Tag: "dc2", Target: "10.0.0.1", Severity: "critical"}, monday, []string{"pager", "chat"}},
+		{bridge.Result{Severity: "critical"}, sunday, []string{"pager", "oncall"}},
+	}
+
+	for _, tst := range tests {
+		var names []string
+		for _, route := range rules.Route(tst.res, tst.when) {
+			names = append(names, route.Receivers...)
+		}
+		if strings.Join(names, ",") != strings.Join(tst.receivers, ",") {
+			t.Errorf("Expected %v to be routed to %v, not %v", tst.res, tst.receivers, names)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// FailingKey is the name of the redis hash which contains the state of
+// each failing test, keyed by the ID of the test and its target.
+const FailingKey = "overseer.notify.failing"
+
+// AcksKey is the name of the redis hash which contains the
+// acknowledgements of failing tests, keyed by the ID of the test.
+const AcksKey = "overseer.notify.acks"
+
+// Entry is the state of a failing test.
+type Entry struct {
+
+	// Event describes the latest failure of the test, and its
+	// acknowledgement.
+	Event
+
+	// Notified records the receivers which have been told of the
+	// failure, keyed by name.
+	Notified map[string]Notice `json:"notified"`
+
+	// Escalations are the escalation policies the failure follows,
+	// with the group-interval of the route which chose each.
+	Escalations map[string]time.Duration `json:"escalations,omitempty"`
+}
+
+// Ack is the acknowledgement of a failing test, which stops the escalation
+// of its notifications.
+type Ack struct {
+
+	// By is who acknowledged the failure.
+	By string `json:"by"`
+
+	// Comment is an optional note, such as "Looking into it".
+	Comment string `json:"comment,omitempty"`
+
+	// Time is when the failure was acknowledged.
+	Time time.Time `json:"time"`
+}
+
+// Notice records that a receiver has been told of a failure.
+type Notice struct {
+
+	// Time is when the receiver was last told of the failure.
+	Time time.Time `json:"time"`
+
+	// Group is the group-interval the receiver was told with, which
+	// its recovery is sent with too.
+	Group time.Duration `json:"group"`
+}
+
+// State holds the entries of the failing tests.
+//
+// The entries are stored in redis, if we have a connection, so that
+// they survive restarts and are shared by each `overseer notify`.
+type State struct {
+	sync.Mutex
+
+	r    redis.UniversalClient
+	mem  map[string]string
+	acks map[string]string
+}
+
+// NewState creates a state which is stored in redis, or in memory if the
+// connection is nil.
+func NewState(r redis.UniversalClient) *State {
+	return &State{r: r, mem: make(map[string]string), acks: make(map[string]string)}
+}
+
+// Get returns the entry of a test, or nil if it isn't failing.
+func (s *State) Get(key string) (*Entry, error) {
+
+	var val string
+	if s.r != nil {
+		var err error
+		val, err = s.r.HGet(FailingKey, key).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.Lock()
+		val = s.mem[key]
+		s.Unlock()
+		if val == "" {
+			return nil, nil
+		}
+	}
+
+	return decodeEntry(val), nil
+}
+
+// decodeEntry parses an entry, ignoring any error so that a corrupt entry
+// is replaced rather than blocking notifications forever.
+func decodeEntry(val string) *Entry {
+	var e Entry
+	json.Unmarshal([]byte(val), &e)
+	if e.Notified == nil {
+		e.Notified = make(map[string]Notice)
+	}
+	return &e
+}
+
+// Put stores the entry of a test.
+func (s *State) Put(key string, e *Entry) error {
+
+	j, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if s.r != nil {
+		return s.r.HSet(FailingKey, key, j).Err()
+	}
+
+	s.Lock()
+	s.mem[key] = string(j)
+	s.Unlock()
+	return nil
+}
+
+// Delete removes the entry of a test.
+func (s *State) Delete(key string) error {
+	if s.r != nil {
+		return s.r.HDel(FailingKey, key).Err()
+	}
+
+	s.Lock()
+	delete(s.mem, key)
+	s.Unlock()
+	return nil
+}
+
+// All returns the entries of each failing test, keyed as they were stored.
+func (s *State) All() (map[string]*Entry, error) {
+
+	var vals map[string]string
+	if s.r != nil {
+		var err error
+		vals, err = s.r.HGetAll(FailingKey).Result()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.Lock()
+		vals = make(map[string]string)
+		for k, v := range s.mem {
+			vals[k] = v
+		}
+		s.Unlock()
+	}
+
+	out := make(map[string]*Entry)
+	for key, val := range vals {
+		out[key] = decodeEntry(val)
+	}
+	return out, nil
+}
+
+// GetAck returns the acknowledgement of a test, or nil if it hasn't been
+// acknowledged.
+func (s *State) GetAck(id string) (*Ack, error) {
+
+	var val string
+	if s.r != nil {
+		var err error
+		val, err = s.r.HGet(AcksKey, id).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.Lock()
+		val = s.acks[id]
+		s.Unlock()
+		if val == "" {
+			return nil, nil
+		}
+	}
+
+	var ack Ack
+	err := json.Unmarshal([]byte(val), &ack)
+	if err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+// PutAck acknowledges a test.
+func (s *State) PutAck(id string, ack Ack) error {
+
+	j, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	if s.r != nil {
+		return s.r.HSet(AcksKey, id, j).Err()
+	}
+
+	s.Lock()
+	s.acks[id] = string(j)
+	s.Unlock()
+	return nil
+}
+
+// DeleteAck removes the acknowledgement of a test.
+func (s *State) DeleteAck(id string) error {
+	if s.r != nil {
+		return s.r.HDel(AcksKey, id).Err()
+	}
+
+	s.Lock()
+	delete(s.acks, id)
+	s.Unlock()
+	return nil
+}
+
+// Find returns the ID of the failing test which the given ID, or prefix
+// of an ID, identifies.
+func (s *State) Find(prefix string) (string, error) {
+
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	if prefix == "" {
+		return "", fmt.Errorf("no test was given")
+	}
+
+	all, err := s.All()
+	if err != nil {
+		return "", err
+	}
+
+	ids := make(map[string]bool)
+	for _, e := range all {
+		if strings.HasPrefix(e.ID, prefix) {
+			ids[e.ID] = true
+		}
+	}
+
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("no failing test matches '%s'", prefix)
+	case 1:
+		for id := range ids {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("'%s' matches %d failing tests", prefix, len(ids))
+}
@@ -0,0 +1,129 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TelegramAPI is the URL of the telegram Bot API.
+const TelegramAPI = "https://api.telegram.org"
+
+// TelegramMax is the maximum length of a telegram message.
+const TelegramMax = 4096
+
+// TelegramConfig describes a receiver which sends telegram messages.
+type TelegramConfig struct {
+
+	// Token is the token of the bot.
+	Token string `yaml:"token"`
+
+	// Chat is the user, or group chat, to message, or a comma-separated
+	// list of them.
+	Chat string `yaml:"chat"`
+
+	// APIURL is the URL of the Bot API, by default TelegramAPI.
+	APIURL string `yaml:"api-url"`
+}
+
+// Validate ensures that the settings are sane.
+func (c TelegramConfig) Validate() error {
+	if c.Token == "" {
+		return fmt.Errorf("token: a bot token must be given")
+	}
+	chats, err := parseChats(c.Chat)
+	if err != nil {
+		return fmt.Errorf("chat: %s", err.Error())
+	}
+	if len(chats) == 0 {
+		return fmt.Errorf("chat: a chat must be given")
+	}
+	return nil
+}
+
+// parseChats parses a comma-separated list of chat IDs.
+func parseChats(value string) ([]int64, error) {
+	var chats []int64
+	for _, id := range split(value) {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat ID '%s'", id)
+		}
+		chats = append(chats, n)
+	}
+	return chats, nil
+}
+
+// telegram is a receiver which sends telegram messages.
+type telegram struct {
+	api    string
+	chats  []int64
+	client *http.Client
+}
+
+// newTelegram creates a receiver which sends telegram messages.
+func newTelegram(c TelegramConfig) (*telegram, error) {
+	chats, err := parseChats(c.Chat)
+	if err != nil {
+		return nil, err
+	}
+
+	api := c.APIURL
+	if api == "" {
+		api = TelegramAPI
+	}
+	return &telegram{
+		api:    strings.TrimSuffix(api, "/") + "/bot" + c.Token,
+		chats:  chats,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Send messages each of our chats.
+func (t *telegram) Send(n Notification) error {
+
+	text := n.Text()
+	if len(text) > TelegramMax {
+		text = text[:TelegramMax-3] + "..."
+	}
+
+	for _, chat := range t.chats {
+		err := t.send(chat, text)
+		if err != nil {
+			return fmt.Errorf("failed to message %d: %s", chat, err.Error())
+		}
+	}
+	return nil
+}
+
+// send sends a message to a single chat.
+func (t *telegram) send(chat int64, text string) error {
+
+	form := url.Values{}
+	form.Set("chat_id", strconv.FormatInt(chat, 10))
+	form.Set("text", text)
+	form.Set("disable_web_page_preview", "true")
+
+	resp, err := t.client.PostForm(t.api+"/sendMessage", form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	if err != nil {
+		return fmt.Errorf("invalid response, status %s", resp.Status)
+	}
+	if !reply.OK {
+		return fmt.Errorf("%s", reply.Description)
+	}
+	return nil
+}
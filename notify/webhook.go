@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// WebhookConfig describes a receiver which POSTs to an HTTP endpoint.
+type WebhookConfig struct {
+
+	// URL is the endpoint to POST to.
+	URL string `yaml:"url"`
+
+	// Headers are added to each request.
+	Headers map[string]string `yaml:"headers"`
+
+	// Template generates the body of each request, which by default is
+	// the notification as a JSON object.
+	Template string `yaml:"template"`
+
+	// ContentType is the content-type of the body.
+	ContentType string `yaml:"content-type"`
+}
+
+// Validate ensures that the settings are sane.
+func (c WebhookConfig) Validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("url: '%s' is not an http, or https, URL", c.URL)
+	}
+	if c.Template != "" {
+		_, err = template.New("webhook").Funcs(templateFuncs).Parse(c.Template)
+		if err != nil {
+			return fmt.Errorf("template: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// templateFuncs are the functions available to webhook templates.
+var templateFuncs = template.FuncMap{
+
+	// json encodes a value as JSON, so a string may be safely
+	// embedded in a JSON body via `"text": {{ json .Subject }}`.
+	"json": func(v interface{}) (string, error) {
+		j, err := json.Marshal(v)
+		return string(j), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// webhook is a receiver which POSTs to an HTTP endpoint.
+type webhook struct {
+	WebhookConfig
+	tmpl   *template.Template
+	client *http.Client
+}
+
+// newWebhook creates a receiver which POSTs to an HTTP endpoint.
+func newWebhook(c WebhookConfig) (*webhook, error) {
+	w := &webhook{
+		WebhookConfig: c,
+		client:        &http.Client{Timeout: 30 * time.Second},
+	}
+	if w.ContentType == "" {
+		w.ContentType = "application/json"
+	}
+	if c.Template != "" {
+		var err error
+		w.tmpl, err = template.New("webhook").Funcs(templateFuncs).Parse(c.Template)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Send POSTs the notification.
+//
+// The template is given the notification, so it may use `.Receiver`,
+// `.Events`, `.Subject`, `.Text`, `.Failures`, and `.Recoveries`.
+func (w *webhook) Send(n Notification) error {
+
+	var body bytes.Buffer
+	if w.tmpl != nil {
+		err := w.tmpl.Execute(&body, n)
+		if err != nil {
+			return fmt.Errorf("failed to render template: %s", err.Error())
+		}
+	} else {
+		err := json.NewEncoder(&body).Encode(map[string]interface{}{
+			"receiver":   n.Receiver,
+			"subject":    n.Subject(),
+			"failures":   n.Failures(),
+			"recoveries": n.Recoveries(),
+			"events":     n.Events,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", w.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.ContentType)
+	for name, value := range w.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", w.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package parser
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxExpansion is the default limit upon the number of targets
+// which a single CIDR-block, or host-range, may be expanded into.
+const DefaultMaxExpansion = 1024
+
+// rangeRegexp matches a numeric host-range such as `[01-12]`.
+var rangeRegexp = regexp.MustCompile(`\[([0-9]+)-([0-9]+)\]`)
+
+// expandTarget expands the given target into the list of targets it
+// describes.
+//
+// Two forms of target are expanded:
+//
+//	10.0.4.0/28               -> Each address in the network.
+//	web[01-12].example.com    -> web01.example.com .. web12.example.com
+//
+// Within a URL only the host may be a range, such as in
+// `http://web[01-12].example.com/`, as a "[" in the rest of a URL, or
+// around an IPv6 address, has a meaning of its own.
+//
+// If the target doesn't need to be expanded then nil is returned.
+func (s *Parser) expandTarget(target string) ([]string, error) {
+
+	//
+	// Is the target a CIDR-block?
+	//
+	if strings.Contains(target, "/") && !strings.Contains(target, "://") {
+		_, network, err := net.ParseCIDR(target)
+		if err == nil {
+			return s.expandCIDR(target, network)
+		}
+	}
+
+	//
+	// Is the target a URL with a host-range?
+	//
+	if i := strings.Index(target, "://"); i >= 0 {
+		start := i + len("://")
+		end := strings.IndexAny(target[start:], "/?#")
+		if end < 0 {
+			end = len(target)
+		} else {
+			end += start
+		}
+
+		host := target[start:end]
+		if strings.HasPrefix(host, "[") || !rangeRegexp.MatchString(host) {
+			return nil, nil
+		}
+
+		hosts, err := s.expandRange(host)
+		if err != nil {
+			return nil, err
+		}
+		var res []string
+		for _, h := range hosts {
+			res = append(res, target[:start]+h+target[end:])
+		}
+		return res, nil
+	}
+
+	//
+	// Is the target a host-range?
+	//
+	if rangeRegexp.MatchString(target) {
+		return s.expandRange(target)
+	}
+
+	return nil, nil
+}
+
+// expandCIDR returns each of the addresses in the given network.
+//
+// For IPv4 networks larger than a /31 the network and broadcast
+// addresses are skipped, as they'd not be useful to test.
+func (s *Parser) expandCIDR(target string, network *net.IPNet) ([]string, error) {
+
+	ones, bits := network.Mask.Size()
+
+	//
+	// Ensure we don't have too many hosts, being careful not to
+	// overflow when calculating the size of large IPv6 networks.
+	//
+	if bits-ones > 30 || (1<<uint(bits-ones)) > s.MaxExpansion {
+		return nil, fmt.Errorf("expanding %s would exceed the limit of %d targets", target, s.MaxExpansion)
+	}
+	count := 1 << uint(bits-ones)
+
+	//
+	// Should we skip the network & broadcast addresses?
+	//
+	skip := network.IP.To4() != nil && bits-ones > 1
+
+	var res []string
+
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+
+	for i := 0; i < count; i++ {
+		if !skip || (i != 0 && i != count-1) {
+			res = append(res, ip.String())
+		}
+
+		// Increment the address, carrying as required.
+		for j := len(ip) - 1; j >= 0; j-- {
+			ip[j]++
+			if ip[j] != 0 {
+				break
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// expandRange expands the first host-range in the target, recursing
+// to handle any further ranges which might be present.
+//
+// If the start of the range has a leading zero then the results will
+// be zero-padded to the same width, so `[01-12]` produces `01`, `02`,
+// .. `12`, whereas `[1-12]` produces `1`, `2`, .. `12`.
+func (s *Parser) expandRange(target string) ([]string, error) {
+
+	loc := rangeRegexp.FindStringSubmatchIndex(target)
+	if loc == nil {
+		return []string{target}, nil
+	}
+
+	prefix := target[:loc[0]]
+	suffix := target[loc[1]:]
+	first := target[loc[2]:loc[3]]
+	last := target[loc[4]:loc[5]]
+
+	start, err := strconv.Atoi(first)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range in %s - %s", target, err.Error())
+	}
+	end, err := strconv.Atoi(last)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range in %s - %s", target, err.Error())
+	}
+	if start > end {
+		return nil, fmt.Errorf("invalid range in %s - %d is greater than %d", target, start, end)
+	}
+	if end-start+1 > s.MaxExpansion {
+		return nil, fmt.Errorf("expanding %s would exceed the limit of %d targets", target, s.MaxExpansion)
+	}
+
+	//
+	// Zero-pad if the start of the range had a leading zero.
+	//
+	format := "%d"
+	if len(first) > 1 && first[0] == '0' {
+		format = fmt.Sprintf("%%0%dd", len(first))
+	}
+
+	var res []string
+	for i := start; i <= end; i++ {
+
+		// Expand any remaining ranges in the tail.
+		tails, err := s.expandRange(suffix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tail := range tails {
+			res = append(res, prefix+fmt.Sprintf(format, i)+tail)
+		}
+
+		if len(res) > s.MaxExpansion {
+			return nil, fmt.Errorf("expanding %s would exceed the limit of %d targets", target, s.MaxExpansion)
+		}
+	}
+
+	return res, nil
+}
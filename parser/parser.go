@@ -25,6 +25,7 @@ import (
 	"strings"
 
 	"github.com/skx/overseer/protocols"
+	"github.com/skx/overseer/queue"
 	"github.com/skx/overseer/test"
 )
 
@@ -34,6 +35,14 @@ type Parser struct {
 	//
 	// Macros comprise of a name and a list of hostnames.
 	MACROS map[string][]string
+
+	// MaxExpansion is the maximum number of targets which a single
+	// CIDR-block, or host-range, may be expanded into.
+	MaxExpansion int
+
+	// The file, and line-number, currently being parsed.
+	file string
+	line int
 }
 
 // ParsedTest is the function-signature of a callback function
@@ -44,6 +53,7 @@ type ParsedTest func(x test.Test) error
 func New() *Parser {
 	m := new(Parser)
 	m.MACROS = make(map[string][]string)
+	m.MaxExpansion = DefaultMaxExpansion
 	return m
 }
 
@@ -115,6 +125,17 @@ func (s *Parser) ParseFile(filename string, cb ParsedTest) error {
 	//
 	line := ""
 
+	//
+	// Record where we are, so that parsed tests know where they
+	// came from.
+	//
+	s.file = filename
+	defer func() {
+		s.file = ""
+		s.line = 0
+	}()
+	number := 0
+
 	//
 	// Loop
 	//
@@ -126,6 +147,15 @@ func (s *Parser) ParseFile(filename string, cb ParsedTest) error {
 		tmp := scanner.Text()
 		tmp = strings.TrimSpace(tmp)
 
+		//
+		// Continued lines are reported as the line they
+		// started upon.
+		//
+		number++
+		if line == "" {
+			s.line = number
+		}
+
 		//
 		// Append to our existing line.
 		//
@@ -195,6 +225,10 @@ func (s *Parser) ParseLine(input string, cb ParsedTest) (test.Test, error) {
 	//
 	//  TARGET must run PROTOCOL [OPTIONAL EXTRA ARGS]
 	//
+	// NOTE: TARGET may be a CIDR-block, such as 10.0.4.0/28, or
+	//       contain a numeric range, such as web[01-12].example.com,
+	//       in which case it is expanded into one test per target.
+	//
 
 	//
 	// Is this a macro-definition?
@@ -309,19 +343,53 @@ func (s *Parser) ParseLine(input string, cb ParsedTest) (test.Test, error) {
 		return result, nil
 	}
 
+	//
+	// Is this target a CIDR-block, or a host-range?
+	//
+	// If so we expand it, in the same way as a macro, and parse
+	// the expanded versions in turn.
+	//
+	targets, err := s.expandTarget(testTarget)
+	if err != nil {
+		return result, fmt.Errorf("%s in input '%s'", err.Error(), input)
+	}
+	if len(targets) > 0 {
+
+		split := regexp.MustCompile(`^([^\s]+)\s+(.*)$`)
+		line := split.FindStringSubmatch(input)
+
+		for _, target := range targets {
+			_, err = s.ParseLine(fmt.Sprintf("%s %s", target, line[2]), cb)
+			if err != nil {
+				return result, err
+			}
+		}
+		return result, nil
+	}
+
 	//
 	// Create a temporary structure to hold our test
 	//
 	result.MaxRetries = -1
+	result.Priority = queue.PriorityNormal
 	result.Target = testTarget
 	result.Type = testType
 	result.Input = input
-	result.Arguments = s.ParseArguments(input)
+	result.Source = s.file
+	result.Line = s.line
+	values := s.ParseArgumentValues(input)
+	result.Arguments = make(map[string]string)
+	for name, vals := range values {
+		result.Arguments[name] = vals[len(vals)-1]
+	}
 
 	//
 	// See which arguments the object supports
 	//
-	expected := handler.Arguments()
+	expected := make(map[string]protocols.Argument)
+	for _, arg := range protocols.Schema(handler) {
+		expected[arg.Name] = arg
+	}
 
 	//
 	// If there are arguments which are unknown then this is an error
@@ -332,7 +400,8 @@ func (s *Parser) ParseLine(input string, cb ParsedTest) (test.Test, error) {
 
 		// Is there a custom per-test override?
 		if arg == "retries" {
-			maxRetries, err := strconv.ParseInt(val, 10, 32)
+			var maxRetries int64
+			maxRetries, err = strconv.ParseInt(val, 10, 32)
 			if err != nil {
 				return result, fmt.Errorf("non-numeric argument '%s' for test-type '%s' in input '%s'", arg, testType, input)
 			}
@@ -343,25 +412,74 @@ func (s *Parser) ParseLine(input string, cb ParsedTest) (test.Test, error) {
 			continue
 		}
 
+		// Is there a priority for this test?
+		if arg == "priority" {
+			if !queue.ValidPriority(val) {
+				return result, fmt.Errorf("invalid priority '%s' for test-type '%s' in input '%s' - expected one of %s", val, testType, input, strings.Join(queue.Priorities, ", "))
+			}
+			result.Priority = val
+
+			// We don't want to pass a non-test var to the actual test
+			delete(result.Arguments, arg)
+			continue
+		}
+
+		// Is there a severity for this test?
+		if arg == "severity" {
+			if !test.ValidSeverity(val) {
+				return result, fmt.Errorf("invalid severity '%s' for test-type '%s' in input '%s' - expected one of %s", val, testType, input, strings.Join(test.Severities, ", "))
+			}
+			result.Severity = val
+
+			// We don't want to pass a non-test var to the actual test
+			delete(result.Arguments, arg)
+			continue
+		}
+
 		//
 		// Is that argument present in the arguments the
 		// tester supports?
 		//
-		pattern := expected[arg]
-		if pattern == "" {
+		schema, ok := expected[arg]
+		if !ok {
 			return result, fmt.Errorf("unsupported argument '%s' for test-type '%s' in input '%s'", arg, testType, input)
 		}
 
 		//
-		// Otherwise we need to look for a match
+		// Arguments which may be repeated keep every value,
+		// rather than the last.
 		//
-		expr := regexp.MustCompile(pattern)
-		match := expr.FindStringSubmatch(val)
+		vals := []string{val}
+		if schema.Repeatable {
+			vals = values[arg]
+			result.Arguments[arg] = strings.Join(vals, test.Separator)
+		}
 
-		if match == nil {
-			return result, fmt.Errorf("unsupported argument '%s' for test-type '%s' in input '%s' - did not match pattern '%s'", arg, testType, input, pattern)
+		//
+		// Otherwise we need to ensure the value is valid.
+		//
+		for _, val := range vals {
+			err = schema.Validate(val)
+			if err != nil {
+				return result, fmt.Errorf("unsupported argument '%s' for test-type '%s' in input '%s' - %s", arg, testType, input, err.Error())
+			}
 		}
 
+		//
+		// Record the names of arguments which shouldn't be shown.
+		//
+		if schema.Sensitive {
+			result.Sensitive = append(result.Sensitive, arg)
+		}
+	}
+
+	//
+	// Ensure that any mandatory arguments were supplied.
+	//
+	for _, arg := range expected {
+		if _, ok := result.Arguments[arg.Name]; arg.Required && !ok {
+			return result, fmt.Errorf("missing required argument '%s' for test-type '%s' in input '%s'", arg.Name, testType, input)
+		}
 	}
 
 	//
@@ -397,11 +515,23 @@ func (s *Parser) TrimQuotes(in string, c byte) string {
 //
 // And extracts the values of the named options.
 //
-// Any option that is wrapped in matching quotes has them removed.
+// Any option that is wrapped in matching quotes has them removed, and
+// if an option is given more than once the last value is used.
 //
 func (s *Parser) ParseArguments(input string) map[string]string {
 	res := make(map[string]string)
 
+	for name, values := range s.ParseArgumentValues(input) {
+		res[name] = values[len(values)-1]
+	}
+	return res
+}
+
+// ParseArgumentValues is like ParseArguments, but returns every value of
+// each named option, in the order they were given.
+func (s *Parser) ParseArgumentValues(input string) map[string][]string {
+	res := make(map[string][]string)
+
 	//
 	// Look for each option
 	//
@@ -417,21 +547,16 @@ func (s *Parser) ParseArguments(input string) map[string]string {
 		value = s.TrimQuotes(value, '\'')
 		value = s.TrimQuotes(value, '"')
 
-		// Store the value in our map - unless there is already a value
-		// present.
+		// Store the value in our map.
 		//
-		// This works the way you'd expect because our regular expression
-		// is parsing "backwards". So parsing:
+		// Our regular expression is parsing "backwards". So parsing:
 		//
 		//   with foo bar with foo baz with foo steve
 		//
-		// We first store "steve", then we would store "baz" and
-		// finally "bar".  We skip this because of the non-empty
-		// test here, which means the last value is kept.
+		// We first find "steve", then "baz" and finally "bar", so
+		// each value is prepended to keep them in order.
 		//
-		if res[name] == "" {
-			res[name] = value
-		}
+		res[name] = append([]string{value}, res[name]...)
 
 		// Continue matching the tail of the string.
 		input = prefix
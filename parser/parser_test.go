@@ -485,7 +485,7 @@ func TestDuplicateArguments(t *testing.T) {
 func TestInvalidOptions(t *testing.T) {
 	tests := []string{
 		"http://example.com/ must run http with CONTENT 'moi'",
-		"http://example.com/ must run http with header 'foo: bar'",
+		"http://example.com/ must run http with headers 'foo: bar'",
 		"http://example.com/ must run http with statsu 300 ",
 	}
 
@@ -647,3 +647,418 @@ http://example.com/ must run http with username 'steve' with password 'ke'mp'
 		t.Errorf("We see no evidence of censorship")
 	}
 }
+
+// Test expanding CIDR-blocks into multiple tests.
+func TestCIDRExpansion(t *testing.T) {
+
+	tests := map[string][]string{
+		"10.0.4.0/30 must run ping": {
+			"10.0.4.1 must run ping",
+			"10.0.4.2 must run ping",
+		},
+		"10.0.4.8/31 must run ssh": {
+			"10.0.4.8 must run ssh",
+			"10.0.4.9 must run ssh",
+		},
+		"10.0.4.7/32 must run ssh with port 2222": {
+			"10.0.4.7 must run ssh with port 2222",
+		},
+		"2001:db8::/127 must run ping": {
+			"2001:db8:: must run ping",
+			"2001:db8::1 must run ping",
+		},
+	}
+
+	for input, expected := range tests {
+
+		var found []string
+
+		p := New()
+		_, err := p.ParseLine(input, func(tst test.Test) error {
+			found = append(found, tst.Input)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Error parsing %s - %s", input, err.Error())
+			continue
+		}
+
+		if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Expansion of %s was wrong, got %v", input, found)
+		}
+	}
+}
+
+// Test expanding host-ranges into multiple tests.
+func TestRangeExpansion(t *testing.T) {
+
+	tests := map[string][]string{
+		"web[01-03].example.com must run ssh": {
+			"web01.example.com must run ssh",
+			"web02.example.com must run ssh",
+			"web03.example.com must run ssh",
+		},
+		"http://web[9-10].example.com/ must run http with status 200": {
+			"http://web9.example.com/ must run http with status 200",
+			"http://web10.example.com/ must run http with status 200",
+		},
+		"https://web[1-2].example.com/page[1-3]?n=[4-5] must run http": {
+			"https://web1.example.com/page[1-3]?n=[4-5] must run http",
+			"https://web2.example.com/page[1-3]?n=[4-5] must run http",
+		},
+		"http://example.com/page[1-3] must run http": {
+			"http://example.com/page[1-3] must run http",
+		},
+		"http://[2001:db8::1]:8080/10.0.0.0/30 must run http": {
+			"http://[2001:db8::1]:8080/10.0.0.0/30 must run http",
+		},
+		"db[1-2]-[1-2].example.com must run ping": {
+			"db1-1.example.com must run ping",
+			"db1-2.example.com must run ping",
+			"db2-1.example.com must run ping",
+			"db2-2.example.com must run ping",
+		},
+	}
+
+	for input, expected := range tests {
+
+		var found []string
+
+		p := New()
+		_, err := p.ParseLine(input, func(tst test.Test) error {
+			found = append(found, tst.Input)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Error parsing %s - %s", input, err.Error())
+			continue
+		}
+
+		if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Expansion of %s was wrong, got %v", input, found)
+		}
+	}
+}
+
+// Test that ranges inside macros are expanded too.
+func TestRangeMacroExpansion(t *testing.T) {
+
+	count := 0
+
+	p := New()
+	_, err := p.ParseLine("HOSTS are web[1-4].example.com, db1.example.com", nil)
+	if err != nil {
+		t.Errorf("Error defining macro - %s", err.Error())
+	}
+	_, err = p.ParseLine("HOSTS must run ssh", func(tst test.Test) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Error parsing macro - %s", err.Error())
+	}
+	if count != 5 {
+		t.Errorf("Expected five tests, found %d", count)
+	}
+}
+
+// Test that invalid, or overly-large, expansions are errors.
+func TestInvalidExpansion(t *testing.T) {
+
+	tests := []string{
+		"10.0.0.0/8 must run ping",
+		"2001:db8::/64 must run ping",
+		"web[1-5000].example.com must run ssh",
+		"web[1-40]-[1-40].example.com must run ssh",
+		"web[10-1].example.com must run ssh",
+	}
+
+	for _, input := range tests {
+
+		p := New()
+		_, err := p.ParseLine(input, nil)
+		if err == nil {
+			t.Errorf("Expected an error parsing %s, but found none!", input)
+		}
+	}
+
+	// The limit may be changed.
+	p := New()
+	p.MaxExpansion = 2
+	_, err := p.ParseLine("web[1-3].example.com must run ssh", nil)
+	if err == nil {
+		t.Errorf("Expected an error exceeding our expansion-limit")
+	}
+}
+
+// Test that missing required arguments are errors.
+func TestRequiredArguments(t *testing.T) {
+	tests := []string{
+		"example.com must run tcp",
+		"example.com must run dns with lookup example.com",
+		"example.com must run mysql with password secret",
+	}
+
+	// Create a parser
+	p := New()
+
+	// Parse each line
+	for _, input := range tests {
+
+		_, err := p.ParseLine(input, nil)
+		if err == nil {
+			t.Errorf("We expected an error parsing %s, but found none!", input)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), "missing required argument") {
+			t.Errorf("The error we received was the wrong error: %s", err.Error())
+		}
+	}
+}
+
+// Test that arguments are validated against their type.
+func TestArgumentTypes(t *testing.T) {
+	tests := []string{
+		"example.com must run tcp with port 99999999999999999999999",
+		"example.com must run tcp with port 22 with banner '(unclosed'",
+		"example.com must run dns with lookup example.com with type SRV",
+	}
+
+	// Create a parser
+	p := New()
+
+	// Parse each line
+	for _, input := range tests {
+
+		_, err := p.ParseLine(input, nil)
+		if err == nil {
+			t.Errorf("We expected an error parsing %s, but found none!", input)
+		}
+	}
+}
+
+// Test that sensitive arguments are censored.
+func TestSanitizeSensitive(t *testing.T) {
+
+	p := New()
+	tst, err := p.ParseLine("db.example.com must run mysql with username root with password 'sekrit'", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing line: %s", err.Error())
+	}
+
+	if len(tst.Sensitive) != 1 || tst.Sensitive[0] != "password" {
+		t.Errorf("Expected the password to be recorded as sensitive, got %v", tst.Sensitive)
+	}
+
+	safe := tst.Sanitize()
+	if strings.Contains(safe, "sekrit") {
+		t.Errorf("Password is still visible: %s", safe)
+	}
+	if !strings.Contains(safe, "with username 'root'") {
+		t.Errorf("Non-sensitive argument was missing: %s", safe)
+	}
+}
+
+// Test that only the headers which carry credentials are censored.
+func TestSanitizeHeaders(t *testing.T) {
+
+	tests := []struct {
+		header   string
+		censored bool
+	}{
+		{"Accept: text/plain", false},
+		{"Host: vhost.example.com", false},
+		{"X-Keyboard: qwerty", false},
+		{"Authorization: Bearer sekrit", true},
+		{"proxy-authorization: Basic sekrit", true},
+		{"Cookie: session=sekrit", true},
+		{"X-Api-Key: sekrit", true},
+		{"X-Auth-Token: sekrit", true},
+	}
+
+	p := New()
+	for _, tc := range tests {
+		tst, err := p.ParseLine("https://example.com/ must run http with header '"+tc.header+"'", nil)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing line: %s", err.Error())
+		}
+
+		name := strings.SplitN(tc.header, ":", 2)[0]
+		expected := "https://example.com/ must run http with header '" + tc.header + "'"
+		if tc.censored {
+			expected = "https://example.com/ must run http with header '" + name + ": CENSORED'"
+		}
+		if safe := tst.Sanitize(); safe != expected {
+			t.Errorf("Expected %s, got %s", expected, safe)
+		}
+	}
+}
+
+// Test that parsed tests record where they came from.
+func TestSourceLocation(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "prefix")
+	if err != nil {
+		t.Errorf("Error creating temporary-directory %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+
+	// Write to the file
+	lines := `
+# A comment
+127.0.0.1 must run ssh
+
+127.0.0.1 \
+  must run redis
+`
+	err = ioutil.WriteFile(file.Name(), []byte(lines), 0644)
+	if err != nil {
+		t.Errorf("Error writing our test-case")
+	}
+
+	var found []int
+
+	p := New()
+	err = p.ParseFile(file.Name(), func(tst test.Test) error {
+		if tst.Source != file.Name() {
+			t.Errorf("Test had the wrong source: %s", tst.Source)
+		}
+		found = append(found, tst.Line)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected no error, but found %s", err.Error())
+	}
+
+	if len(found) != 2 || found[0] != 3 || found[1] != 5 {
+		t.Errorf("Tests had the wrong line-numbers: %v", found)
+	}
+}
+
+// Test the priority option.
+func TestPriority(t *testing.T) {
+
+	tests := map[string]string{
+		"http://example.com/ must run http":                    "normal",
+		"http://example.com/ must run http with priority high": "high",
+		"http://example.com/ must run http with priority low":  "low",
+	}
+
+	// Create a parser
+	p := New()
+
+	for input, priority := range tests {
+
+		tst, err := p.ParseLine(input, nil)
+		if err != nil {
+			t.Errorf("We did not expect an error parsing %s - got %s!", input, err)
+			continue
+		}
+
+		if tst.Priority != priority {
+			t.Errorf("Invalid priority. Expected %s, got %s", priority, tst.Priority)
+		}
+		if _, ok := tst.Arguments["priority"]; ok {
+			t.Errorf("The priority should not be passed to the test")
+		}
+	}
+
+	_, err := p.ParseLine("http://example.com/ must run http with priority urgent", nil)
+	if err == nil {
+		t.Errorf("Expected an error with an unknown priority")
+	}
+}
+
+// Test the severity option.
+func TestSeverity(t *testing.T) {
+
+	tests := map[string]string{
+		"http://example.com/ must run http":                        "",
+		"http://example.com/ must run http with severity critical": "critical",
+		"http://example.com/ must run http with severity warning":  "warning",
+	}
+
+	// Create a parser
+	p := New()
+
+	for input, severity := range tests {
+
+		tst, err := p.ParseLine(input, nil)
+		if err != nil {
+			t.Errorf("We did not expect an error parsing %s - got %s!", input, err)
+			continue
+		}
+
+		if tst.Severity != severity {
+			t.Errorf("Invalid severity. Expected %s, got %s", severity, tst.Severity)
+		}
+		if _, ok := tst.Arguments["severity"]; ok {
+			t.Errorf("The severity should not be passed to the test")
+		}
+	}
+
+	_, err := p.ParseLine("http://example.com/ must run http with severity dire", nil)
+	if err == nil {
+		t.Errorf("Expected an error with an unknown severity")
+	}
+}
+
+// Test that arguments which may be repeated keep every value.
+func TestRepeatableArguments(t *testing.T) {
+
+	p := New()
+	tst, err := p.ParseLine("https://example.com/ must run http with header 'Accept: text/plain' with status 301 with header 'Authorization: Bearer sekrit' with expect-header 'Location: ^https:'", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing line: %s", err.Error())
+	}
+
+	headers := tst.Values("header")
+	if len(headers) != 2 || headers[0] != "Accept: text/plain" || headers[1] != "Authorization: Bearer sekrit" {
+		t.Errorf("Wrong headers: %v", headers)
+	}
+	if v := tst.Values("expect-header"); len(v) != 1 || v[0] != "Location: ^https:" {
+		t.Errorf("Wrong expected headers: %v", v)
+	}
+	if v := tst.Values("content"); v != nil {
+		t.Errorf("Expected no values, got %v", v)
+	}
+
+	safe := tst.Sanitize()
+	if strings.Contains(safe, "sekrit") {
+		t.Errorf("Header is still visible: %s", safe)
+	}
+	if !strings.Contains(safe, "with header 'Accept: text/plain' with header 'Authorization: CENSORED'") {
+		t.Errorf("Expected only the credential to be censored: %s", safe)
+	}
+
+	//
+	// Each value must be valid.
+	//
+	_, err = p.ParseLine("https://example.com/ must run http with header 'Accept: text/plain' with header 'Accept'", nil)
+	if err == nil || !strings.Contains(err.Error(), "did not match pattern") {
+		t.Errorf("Expected an error for an invalid header, got %v", err)
+	}
+}
+
+// Test that arguments may be checked further than their patterns allow.
+func TestArgumentCheck(t *testing.T) {
+
+	p := New()
+	_, err := p.ParseLine("https://example.com/ must run http with json '$.status == ok' with json 'len($.workers) >= 2'", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing line: %s", err.Error())
+	}
+
+	tests := map[string]string{
+		"https://example.com/ must run http with json '$.depth <'":     "missing value after '<'",
+		"https://example.com/ must run http with json '$.depth < ten'": "'ten' is not a number",
+		"https://example.com/ must run http with json '$.workers[x]'":  "invalid index 'x'",
+		"https://example.com/ must run http with json-path '$.a[0'":    "missing ']'",
+	}
+	for input, expected := range tests {
+		_, err = p.ParseLine(input, nil)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error containing '%s' parsing %s, got %v", expected, input, err)
+		}
+	}
+}
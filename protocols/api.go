@@ -8,6 +8,7 @@ package protocols
 
 import (
 	"sync"
+	"time"
 
 	"github.com/skx/overseer/test"
 )
@@ -22,6 +23,10 @@ type ProtocolTest interface {
 	// with a regular expression which will be used to validate a non-empty
 	// argument.
 	//
+	// A protocol-test may additionally implement the ArgumentSchema
+	// interface to mark arguments as required or sensitive, and to
+	// document their types and default values.
+	//
 	Arguments() map[string]string
 
 	// Example should return a string describing how your protocol-test
@@ -40,6 +45,18 @@ type ProtocolTest interface {
 	RunTest(tst test.Test, target string, opts test.Options) error
 }
 
+// TimingReporter is an optional interface which a protocol-test may
+// implement to report how long each phase of the last test it ran took,
+// such as "connect" or "ttfb".
+//
+// The timings are published with the result of the test, and sent to the
+// metrics-host.
+type TimingReporter interface {
+
+	// Timings returns the duration of each phase, keyed by name.
+	Timings() map[string]time.Duration
+}
+
 // This is a map of known-tests.
 var handlers = struct {
 	m map[string]TestCtor
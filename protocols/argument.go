@@ -0,0 +1,179 @@
+package protocols
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArgumentType describes the kind of value an argument accepts.
+type ArgumentType string
+
+// The types of argument which are understood.
+const (
+	// TypeString is a free-form string, validated only by its pattern.
+	TypeString ArgumentType = "string"
+
+	// TypeInt is an integer.
+	TypeInt ArgumentType = "int"
+
+	// TypeDuration is a duration such as "300ms" or "2s".
+	TypeDuration ArgumentType = "duration"
+
+	// TypeEnum is one of a fixed set of values.
+	TypeEnum ArgumentType = "enum"
+
+	// TypeRegexp is a regular expression.
+	TypeRegexp ArgumentType = "regex"
+)
+
+// Argument describes a single argument which a protocol-test accepts.
+type Argument struct {
+	// Name is the name of the argument, as used in `with NAME VALUE`.
+	Name string `json:"name"`
+
+	// Type is the kind of value the argument accepts.
+	Type ArgumentType `json:"type"`
+
+	// Pattern is the regular expression used to validate a value.
+	//
+	// If this is empty for an enum then a pattern will be built
+	// from the list of Values.
+	Pattern string `json:"pattern"`
+
+	// Values contains the valid values of an enum.
+	Values []string `json:"values,omitempty"`
+
+	// Required is true if the argument must be specified.
+	Required bool `json:"required"`
+
+	// Sensitive is true if the value should never be displayed,
+	// for example a password.
+	Sensitive bool `json:"sensitive"`
+
+	// Repeatable is true if the argument may be given more than
+	// once, in which case every value is kept rather than the last.
+	Repeatable bool `json:"repeatable"`
+
+	// Default documents the value used if the argument is not given.
+	Default string `json:"default,omitempty"`
+
+	// Description is a short, human-readable, description.
+	Description string `json:"description"`
+
+	// Check optionally validates a value further, once it has
+	// matched the pattern and type.
+	Check func(value string) error `json:"-"`
+}
+
+// ArgumentSchema is an optional interface which a protocol-test may
+// implement to describe its arguments in more detail than is possible
+// via `Arguments`.
+type ArgumentSchema interface {
+
+	// Schema returns the description of each supported argument.
+	Schema() []Argument
+}
+
+// pattern returns the regular expression used to validate this argument,
+// building one for an enum which didn't supply it.
+func (a Argument) pattern() string {
+	if a.Pattern != "" {
+		return a.Pattern
+	}
+	if a.Type == TypeEnum {
+		return "^(" + strings.Join(a.Values, "|") + ")$"
+	}
+	return ".*"
+}
+
+// Validate ensures that the given value is acceptable for this argument.
+func (a Argument) Validate(value string) error {
+
+	//
+	// Match against the pattern first.
+	//
+	pattern := a.pattern()
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	if re.FindStringSubmatch(value) == nil {
+		return fmt.Errorf("did not match pattern '%s'", pattern)
+	}
+
+	//
+	// Now ensure the value matches the type.
+	//
+	switch a.Type {
+	case TypeInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("'%s' is not a valid integer", value)
+		}
+	case TypeDuration:
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("'%s' is not a valid duration", value)
+		}
+	case TypeRegexp:
+		if _, err := regexp.Compile(value); err != nil {
+			return fmt.Errorf("'%s' is not a valid regular expression - %s", value, err.Error())
+		}
+	}
+
+	if a.Check != nil {
+		return a.Check(value)
+	}
+	return nil
+}
+
+// Schema returns the description of the arguments the given
+// protocol-test accepts, sorted by name.
+//
+// If the protocol-test doesn't implement the ArgumentSchema interface
+// then a simple schema is built from the output of `Arguments`.
+func Schema(handler ProtocolTest) []Argument {
+
+	var res []Argument
+
+	if s, ok := handler.(ArgumentSchema); ok {
+		res = append(res, s.Schema()...)
+	} else {
+		for name, pattern := range handler.Arguments() {
+			res = append(res, Argument{
+				Name:      name,
+				Type:      TypeString,
+				Pattern:   pattern,
+				Sensitive: name == "password",
+			})
+		}
+	}
+
+	//
+	// Ensure each argument has a pattern.
+	//
+	for i, a := range res {
+		res[i].Pattern = a.pattern()
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// ArgumentPatterns converts a schema into the map of argument-names and
+// regular expressions returned by `Arguments`.
+//
+// This allows a protocol-test which implements `Schema` to avoid
+// duplicating the patterns it accepts.
+func ArgumentPatterns(schema []Argument) map[string]string {
+	known := make(map[string]string)
+
+	for _, a := range schema {
+		known[a.Name] = a.pattern()
+	}
+	return known
+}
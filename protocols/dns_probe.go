@@ -132,13 +132,33 @@ func (s *DNSTest) localQuery(server string, qname string, lookupType string) (*d
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *DNSTest) Arguments() map[string]string {
+	return ArgumentPatterns(s.Schema())
+}
 
-	known := map[string]string{
-		"type":   "A|AAAA|MX|NS|TXT",
-		"lookup": ".*",
-		"result": ".*",
+// Schema describes the arguments which this protocol-test understands.
+func (s *DNSTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "lookup",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Required:    true,
+			Description: "The name to lookup.",
+		},
+		{
+			Name:        "result",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "The expected result, comma-separated if there are several.",
+		},
+		{
+			Name:        "type",
+			Type:        TypeEnum,
+			Values:      []string{"A", "AAAA", "MX", "NS", "TXT"},
+			Required:    true,
+			Description: "The type of record to lookup.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -36,12 +36,33 @@ type FINGERTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *FINGERTest) Arguments() map[string]string {
-	known := map[string]string{
-		"content": ".*",
-		"port":    "^[0-9]+$",
-		"user":    ".*",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *FINGERTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "content",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "Text which must be present in the response.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "79",
+			Description: "The port to connect to.",
+		},
+		{
+			Name:        "user",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Required:    true,
+			Description: "The user to query.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -49,13 +49,40 @@ type FTPTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *FTPTest) Arguments() map[string]string {
-	known := map[string]string{
-		"content":  ".*",
-		"password": ".*",
-		"port":     "^[0-9]+$",
-		"username": ".*",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *FTPTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "content",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "Text which must be present in the retrieved file.",
+		},
+		{
+			Name:        "password",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Sensitive:   true,
+			Description: "The password to login with.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "21",
+			Description: "The port to connect to.",
+		},
+		{
+			Name:        "username",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Default:     "anonymous",
+			Description: "The username to login with.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -156,7 +183,8 @@ func (s *FTPTest) RunTest(tst test.Test, target string, opts test.Options) error
 		}
 	}
 
-	fmt.Printf("Username: %s -> %s\n", username, password)
+	opts.Log.Debug("FTP login", "username", username)
+
 	//
 	// If the user specified a different port update to use it.
 	//
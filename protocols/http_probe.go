@@ -50,6 +50,13 @@
 //
 //    https://expired.badssl.com/ must run http with tls insecure
 //
+// If the server uses a private CA you may give its certificate instead,
+// and if it requires a client certificate you may give that too:
+//
+//    https://internal.example.com/ must run http with ca /etc/ssl/ca.pem with client-cert /etc/ssl/client.pem with client-key /etc/ssl/client.key
+//
+// (The files are read by the worker which runs the test.)
+//
 // By default tests will fail if you're probing an SSL-site which has
 // a certificate which will expire within the next 14 days.  To change
 // the time-period specify it explicitly like so, if not stated the
@@ -65,6 +72,62 @@
 //
 //    https://steve.fi/ must run http with expiration any
 //
+// The certificate which is checked is the one presented by the address
+// being tested, and you may make assertions about it too: the names it
+// must be valid for, its issuer, the type and minimum size of its key,
+// its signature algorithm, or its SHA-256 fingerprint:
+//
+//    https://example.com/ must run http with cert-name example.com with cert-name www.example.com with cert-issuer 'O=Example CA'
+//    https://example.com/ must run http with cert-key rsa-2048,ecdsa-256 with cert-signature SHA256-RSA,ECDSA-SHA256
+//    https://example.com/ must run http with cert-fingerprint 5e:8f:16:06:2e:a3:cd:2c:4a:0d:54:78:76:ba:a6:f3:8c:ab:f6:25:e3:e1:6b:f5:9a:6f:e6:52:4e:9f:e0:27
+//
+// Several keys, algorithms, or fingerprints may be allowed by joining
+// them with a comma.  These assertions are made even with "tls insecure",
+// so you may pin a self-signed certificate by its fingerprint, but its
+// expiration isn't checked.
+//
+// Custom request-headers may be sent, such as an API key or the Host
+// of a virtual host, by repeating the header setting:
+//
+//    https://api.example.com/ must run http with header 'Authorization: Bearer xxxx' with header 'Accept: application/json'
+//
+// (The values of the headers are never displayed, as they may contain
+// secrets.)
+//
+// Similarly the response must contain each header given via the
+// expect-header setting, with a value matching the regular expression
+// which follows the name.  An empty expression only requires that the
+// header is present:
+//
+//    https://example.com/ must run http with expect-header 'Strict-Transport-Security: max-age=[0-9]+' with expect-header 'Cache-Control:'
+//
+//    http://example.com/ must run http with status 301 with expect-header 'Location: ^https://example.com/'
+//
+// If the response is JSON, such as from a health API, you may test the
+// value at a given path:
+//
+//    https://example.com/health must run http with json-path '$.status' with json-value 'ok'
+//
+// Or make assertions about it, which may be repeated.  Numbers may be
+// compared via <, <=, >, and >=, any value via == and !=, and the text
+// of a value may be matched against a regular expression via =~.  The
+// functions len() and type() return the length of an array, object, or
+// string, and the type of a value:
+//
+//    https://example.com/health must run http with json '$.queue_depth < 100' with json 'len($.workers) >= 2'
+//    https://example.com/health must run http with json 'type($.items) == array' with json '$.version =~ ^2\.'
+//
+// Paths start with "$", and may contain keys and indexes such as
+// $.workers[0].name, or $["key.with.dots"].  An assertion without a
+// comparison only requires that the path is present.
+//
+// The duration of each phase of the request is reported with the result
+// of the test, and a slow response may be regarded as a failure, either
+// because the first byte of the response took too long to arrive, or
+// because the whole response did:
+//
+//    https://example.com/ must run http with max-ttfb 300ms with max-duration 2s
+//
 // Finally if you submit a "data" argument, like in this next example
 // the request made will be a HTTP POST:
 //
@@ -79,8 +142,21 @@
 //    https://steve.fi/Security/XSS/Tutorial/filter.cgi must run http with method PUT with data "text=test%20me" with content "test me"
 //
 //
-// NOTE: This test deliberately does not follow redirections, to allow
-// enhanced testing.
+// By default redirections are not followed, so that you may test the
+// redirection itself.  If you wish to test a chain of redirections, such
+// as a login or a move to HTTPS, you may follow up to a given number of
+// them, and test where you end up:
+//
+//    http://example.com/ must run http with follow-redirects 5 with expect-url '^https://www.example.com/$'
+//
+// The connections to the host of the test are still made to the address
+// being tested, whereas other hosts are resolved as usual.  The number of
+// redirections followed may be tested too:
+//
+//    http://example.com/ must run http with follow-redirects 5 with expect-redirects 2
+//
+// Cookies are kept between the redirections, and failures describe each
+// of them.
 //
 
 package protocols
@@ -89,40 +165,177 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/skx/overseer/logger"
 	"github.com/skx/overseer/test"
 )
 
+// headerPattern matches the `Name: value` of a header argument.
+const headerPattern = `^[A-Za-z0-9_-]+:.*$`
+
 // HTTPTest is our object.
 type HTTPTest struct {
+	// timings holds the duration of each phase of the last request.
+	timings map[string]time.Duration
 }
 
 // Arguments returns the names of arguments which this protocol-test
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *HTTPTest) Arguments() map[string]string {
-	known := map[string]string{
-		"user-agent": ".*",
-		"content":    ".*",
-		"data":       ".*",
-		"expiration": "^(any|[0-9]+[hd]?)$",
-		"method":     "^(GET|HEAD|POST|PUT|PATCH|DELETE)$",
-		"password":   ".*",
-		"pattern":    ".*",
-		"status":     "^(any|[0-9]+(?:,[0-9]+)*)$",
-		"tls":        "insecure",
-		"username":   ".*",
-	}
-	return known
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *HTTPTest) Schema() []Argument {
+	args := append(certificateArguments(), []Argument{
+		{
+			Name:        "content",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "Text which must be present in the response-body.",
+		},
+		{
+			Name:        "data",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "Data to submit, making the request a POST by default.",
+		},
+		{
+			Name:        "expect-header",
+			Type:        TypeString,
+			Pattern:     headerPattern,
+			Repeatable:  true,
+			Description: "A response-header which must be present, as 'Name: regex'.",
+		},
+		{
+			Name:        "expect-redirects",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Description: "The number of redirections which must be followed.",
+		},
+		{
+			Name:        "expect-url",
+			Type:        TypeRegexp,
+			Pattern:     ".*",
+			Description: "A regular expression the final URL must match.",
+		},
+		{
+			Name:        "expiration",
+			Type:        TypeString,
+			Pattern:     "^(any|[0-9]+[hd]?)$",
+			Default:     "14d",
+			Description: "Fail if the TLS certificate expires within this period.",
+		},
+		{
+			Name:        "follow-redirects",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "0",
+			Description: "The maximum number of redirections to follow.",
+		},
+		{
+			Name:        "header",
+			Type:        TypeString,
+			Pattern:     headerPattern,
+			Repeatable:  true,
+			Sensitive:   true,
+			Description: "A request-header to send, as 'Name: value'.",
+		},
+		{
+			Name:        "json",
+			Type:        TypeString,
+			Pattern:     `^\s*(len\(|type\()?\$`,
+			Repeatable:  true,
+			Description: "An assertion upon the JSON response-body, such as '$.queue_depth < 100'.",
+			Check: func(value string) error {
+				_, err := parseJSONAssertion(value)
+				return err
+			},
+		},
+		{
+			Name:        "json-path",
+			Type:        TypeString,
+			Pattern:     `^\$`,
+			Description: "A path which must be present in the JSON response-body.",
+			Check: func(value string) error {
+				_, err := parseJSONPath(value)
+				return err
+			},
+		},
+		{
+			Name:        "json-value",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "The value expected at the json-path.",
+		},
+		{
+			Name:        "max-duration",
+			Type:        TypeDuration,
+			Pattern:     "^[0-9.a-z]+$",
+			Description: "Fail if the request, and reading the response, takes longer than this.",
+		},
+		{
+			Name:        "max-ttfb",
+			Type:        TypeDuration,
+			Pattern:     "^[0-9.a-z]+$",
+			Description: "Fail if the first byte of the response takes longer than this to arrive.",
+		},
+		{
+			Name:        "method",
+			Type:        TypeEnum,
+			Values:      []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+			Default:     "GET",
+			Description: "The HTTP-method to use.",
+		},
+		{
+			Name:        "password",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Sensitive:   true,
+			Description: "The password to use for HTTP basic-authentication.",
+		},
+		{
+			Name:        "pattern",
+			Type:        TypeRegexp,
+			Pattern:     ".*",
+			Description: "A regular expression the response-body must match.",
+		},
+		{
+			Name:        "status",
+			Type:        TypeString,
+			Pattern:     "^(any|[0-9]+(?:,[0-9]+)*)$",
+			Default:     "200",
+			Description: "The expected status-code(s), comma-separated, or 'any'.",
+		},
+		{
+			Name:        "user-agent",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Default:     "overseer/probe",
+			Description: "The User-Agent to send.",
+		},
+		{
+			Name:        "username",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "The username to use for HTTP basic-authentication.",
+		},
+	}...)
+	return append(args, tlsArguments()...)
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -180,6 +393,7 @@ HTTP Tester
 
    https://expired.badssl.com/ must run http with tls insecure
 
+` + tlsUsage("https://internal.example.com/ must run http") + `
  By default tests will fail if you're probing an SSL-site which has
  a certificate which will expire within the next 14 days.  To change
  the time-period specify it explicitly like so, if not stated the
@@ -195,6 +409,62 @@ HTTP Tester
 
    https://steve.fi/ must run http with expiration any
 
+ The certificate which is checked is the one presented by the address
+ being tested, and you may make assertions about it too: the names it
+ must be valid for, its issuer, the type and minimum size of its key,
+ its signature algorithm, or its SHA-256 fingerprint:
+
+   https://example.com/ must run http with cert-name example.com with cert-name www.example.com with cert-issuer 'O=Example CA'
+   https://example.com/ must run http with cert-key rsa-2048,ecdsa-256 with cert-signature SHA256-RSA,ECDSA-SHA256
+   https://example.com/ must run http with cert-fingerprint 5e:8f:16:06:2e:a3:cd:2c:4a:0d:54:78:76:ba:a6:f3:8c:ab:f6:25:e3:e1:6b:f5:9a:6f:e6:52:4e:9f:e0:27
+
+ Several keys, algorithms, or fingerprints may be allowed by joining
+ them with a comma.  These assertions are made even with "tls insecure",
+ so you may pin a self-signed certificate by its fingerprint, but its
+ expiration isn't checked.
+
+ Custom request-headers may be sent, such as an API key or the Host
+ of a virtual host, by repeating the header setting:
+
+   https://api.example.com/ must run http with header 'Authorization: Bearer xxxx' with header 'Accept: application/json'
+
+ (The values of the headers are never displayed, as they may contain
+ secrets.)
+
+ Similarly the response must contain each header given via the
+ expect-header setting, with a value matching the regular expression
+ which follows the name.  An empty expression only requires that the
+ header is present:
+
+   https://example.com/ must run http with expect-header 'Strict-Transport-Security: max-age=[0-9]+' with expect-header 'Cache-Control:'
+
+   http://example.com/ must run http with status 301 with expect-header 'Location: ^https://example.com/'
+
+ If the response is JSON, such as from a health API, you may test the
+ value at a given path:
+
+   https://example.com/health must run http with json-path '$.status' with json-value 'ok'
+
+ Or make assertions about it, which may be repeated.  Numbers may be
+ compared via <, <=, >, and >=, any value via == and !=, and the text
+ of a value may be matched against a regular expression via =~.  The
+ functions len() and type() return the length of an array, object, or
+ string, and the type of a value:
+
+   https://example.com/health must run http with json '$.queue_depth < 100' with json 'len($.workers) >= 2'
+   https://example.com/health must run http with json 'type($.items) == array' with json '$.version =~ ^2\.'
+
+ Paths start with "$", and may contain keys and indexes such as
+ $.workers[0].name, or $["key.with.dots"].  An assertion without a
+ comparison only requires that the path is present.
+
+ The duration of each phase of the request is reported with the result
+ of the test, and a slow response may be regarded as a failure, either
+ because the first byte of the response took too long to arrive, or
+ because the whole response did:
+
+   https://example.com/ must run http with max-ttfb 300ms with max-duration 2s
+
  Finally if you submit a "data" argument, like in this next example
  the request made will be a HTTP POST:
 
@@ -208,8 +478,21 @@ HTTP Tester
 
     https://steve.fi/Security/XSS/Tutorial/filter.cgi must run http with method PUT with data "text=test%20me" with content "test me"
 
- Do note that the HTTP-probe never follow redirections, to allow enhanced
- testing.
+ By default redirections are not followed, so that you may test the
+ redirection itself.  If you wish to test a chain of redirections, such
+ as a login or a move to HTTPS, you may follow up to a given number of
+ them, and test where you end up:
+
+   http://example.com/ must run http with follow-redirects 5 with expect-url '^https://www.example.com/$'
+
+ The connections to the host of the test are still made to the address
+ being tested, whereas other hosts are resolved as usual.  The number of
+ redirections followed may be tested too:
+
+   http://example.com/ must run http with follow-redirects 5 with expect-redirects 2
+
+ Cookies are kept between the redirections, and failures describe each
+ of them.
 `
 	return str
 }
@@ -227,32 +510,33 @@ HTTP Tester
 //
 //    target => "176.9.183.100"
 //
-func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) error {
+func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) (err error) {
 
 	//
-	// Determine the port to connect to, initially via the protocol
-	// in the string, but allow the URI to override that.
+	// Forget the timings of any earlier request.
 	//
-	// e.g: We expect
+	s.timings = nil
+
 	//
-	//  http://example.com/      -> 80
-	//  https://example.com/     -> 443
-	//  http://example.com:8080/ -> 8080
+	// The host we're testing, which is the only one whose address
+	// we replace if we follow redirections.
 	//
-	port := "80"
 	u, err := url.Parse(tst.Target)
 	if err != nil {
 		return err
 	}
-	if u.Scheme == "http" {
-		port = "80"
-	}
-	if u.Scheme == "https" {
-		port = "443"
-	}
-	if u.Port() != "" {
-		port = u.Port()
-	}
+	host := u.Hostname()
+
+	//
+	// The redirections we've followed, which are reported if the
+	// test fails.
+	//
+	var hops []redirect
+	defer func() {
+		if err != nil && len(hops) > 0 {
+			err = fmt.Errorf("%s, after following %s", err.Error(), describeRedirects(hops))
+		}
+	}()
 
 	//
 	// Be clear about the IP vs. the hostname.
@@ -282,6 +566,23 @@ func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) erro
 	//
 	//lint:ignore SA4009 we're deliberately forcing a specific IPv4 vs. IPv6 address
 	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		//
+		// The transport gives us the host and port it wants,
+		// with the port defaulting from the scheme.
+		//
+		name, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		//
+		// Other hosts, which we've been redirected to, are
+		// connected to as normal.
+		//
+		if !strings.EqualFold(name, host) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
 		//
 		// Assume an IPv4 address by default.
 		//
@@ -310,25 +611,70 @@ func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) erro
 	}
 
 	//
-	// If we're running insecurely then ignore SSL errors
+	// Configure TLS, which might ignore SSL errors, or present a
+	// client certificate.
+	//
+	// The server-name is left empty so that it's taken from the
+	// host of each request, as we may be redirected.
+	//
+	tr.TLSClientConfig, err = tlsConfig(tst, "")
+	if err != nil {
+		return err
+	}
+
+	//
+	// By default we don't follow redirections.
+	//
+	follow := 0
+	if tst.Arguments["follow-redirects"] != "" {
+		follow, err = strconv.Atoi(tst.Arguments["follow-redirects"])
+		if err != nil {
+			return err
+		}
+	}
+
+	//
+	// The state of the TLS connection to the address we're testing,
+	// whose certificate we check, taken from the first response
+	// which came from it.
 	//
-	if tst.Arguments["tls"] == "insecure" {
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	var pinned *tls.ConnectionState
+	record := func(response *http.Response) {
+		if pinned == nil && response.TLS != nil && strings.EqualFold(response.Request.URL.Hostname(), host) {
+			pinned = response.TLS
+		}
 	}
 
 	//
-	// Create a client with a timeout, disabled redirection, and
+	// Create a client with a timeout, limited redirection, and
 	// the magical transport we've just created.
 	//
 	var netClient = &http.Client{
 		Timeout: opts.Timeout,
 
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
+			record(req.Response)
+			if len(via) > follow {
+				return http.ErrUseLastResponse
+			}
+
+			hops = append(hops, redirect{URL: via[len(via)-1].URL.String(), Status: req.Response.StatusCode})
+			opts.Log.Debug("Following redirection", "from", via[len(via)-1].URL.String(), "to", req.URL.String())
+			return nil
 		},
 		Transport: tr,
 	}
 
+	//
+	// Keep cookies between redirections, so that logins work.
+	//
+	if follow > 0 {
+		netClient.Jar, err = cookiejar.New(nil)
+		if err != nil {
+			return err
+		}
+	}
+
 	//
 	// Now we can make a request-object
 	//
@@ -381,6 +727,39 @@ func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) erro
 		req.Header.Set("User-Agent", "overseer/probe")
 	}
 
+	//
+	// Add any custom headers, which replace those above, but may
+	// themselves be repeated.
+	//
+	// The Host header is special, as it is sent from the request
+	// itself rather than its headers.
+	//
+	custom := make(map[string]bool)
+	for _, header := range tst.Values("header") {
+		name, value := splitHeader(header)
+		name = http.CanonicalHeaderKey(name)
+
+		switch {
+		case name == "Host":
+			req.Host = value
+		case custom[name]:
+			req.Header.Add(name, value)
+		default:
+			req.Header.Set(name, value)
+		}
+		custom[name] = true
+	}
+
+	//
+	// Trace the request, so that we can report how long each
+	// phase of it took.
+	//
+	timer := &httpTimer{start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timer.trace()))
+	defer func() {
+		s.timings = timer.timings()
+	}()
+
 	//
 	// Perform the request
 	//
@@ -394,10 +773,19 @@ func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) erro
 	//
 	defer response.Body.Close()
 	body, err := ioutil.ReadAll(response.Body)
+	timer.done()
 	if err != nil {
 		return err
 	}
 	status := response.StatusCode
+	record(response)
+
+	//
+	// Record the end of the chain of redirections.
+	//
+	if len(hops) > 0 {
+		hops = append(hops, redirect{URL: response.Request.URL.String(), Status: status})
+	}
 
 	//
 	// The default status-code(s) we accept as being OK.
@@ -451,6 +839,67 @@ func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) erro
 		}
 	}
 
+	//
+	// Did we end up where we expected?
+	//
+	if tst.Arguments["expect-url"] != "" {
+		final := response.Request.URL.String()
+
+		re, err := regexp.Compile(tst.Arguments["expect-url"])
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(final) {
+			return fmt.Errorf("final URL was '%s', which didn't match the regular expression '%s'", final, tst.Arguments["expect-url"])
+		}
+	}
+
+	//
+	// Did we follow as many redirections as we expected?
+	//
+	if tst.Arguments["expect-redirects"] != "" {
+		expected, err := strconv.Atoi(tst.Arguments["expect-redirects"])
+		if err != nil {
+			return err
+		}
+
+		followed := 0
+		if len(hops) > 0 {
+			followed = len(hops) - 1
+		}
+		if followed != expected {
+			return fmt.Errorf("followed %d redirections, not %d", followed, expected)
+		}
+	}
+
+	//
+	// Does the response contain the headers we expect?
+	//
+	for _, header := range tst.Values("expect-header") {
+		name, pattern := splitHeader(header)
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid regular expression for header '%s' - %s", name, err.Error())
+		}
+
+		values := response.Header[http.CanonicalHeaderKey(name)]
+		if len(values) == 0 {
+			return fmt.Errorf("header '%s' was not present", name)
+		}
+
+		found := false
+		for _, value := range values {
+			if re.MatchString(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("header '%s' was '%s', which didn't match the regular expression '%s'", name, strings.Join(values, ", "), pattern)
+		}
+	}
+
 	//
 	// Is the user looking for a literal body-match?
 	//
@@ -476,15 +925,36 @@ func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) erro
 		}
 	}
 
+	//
+	// Is the user making assertions about a JSON response?
+	//
+	err = s.checkJSON(tst, body)
+	if err != nil {
+		return err
+	}
+
+	//
+	// Was the response slower than we'd like?
+	//
+	err = s.checkTimings(tst, timer)
+	if err != nil {
+		return err
+	}
+
 	//
 	// If we reached here then our actual test was fine.
 	//
 	// However as a special extension we're going to test the
-	// certificate expiration date for any SSL sites.  We'll
-	// do that now.
+	// certificate of any SSL site, as presented by the address
+	// we're testing.  We'll do that now.
 	//
 	if strings.HasPrefix(tst.Target, "https:") {
 
+		err = checkCertificate(tst, address, pinned)
+		if err != nil {
+			return err
+		}
+
 		//
 		// The default expiration-time 14 days.
 		//
@@ -494,7 +964,10 @@ func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) erro
 		// If the validity was set to `any` that means we just
 		// don't care, so we don't even need to test the result.
 		//
-		if tst.Arguments["expiration"] == "any" {
+		// Similarly if we were told to ignore bogus certificates
+		// we shouldn't complain about expired ones.
+		//
+		if tst.Arguments["expiration"] == "any" || tst.Arguments["tls"] == "insecure" {
 			return nil
 		}
 
@@ -539,18 +1012,17 @@ func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) erro
 		}
 
 		//
-		// Check the expiration
+		// Check the expiration of the whole chain.
 		//
-		hours, cn, err := s.SSLExpiration(tst.Target, opts.Verbose)
-
-		if err == nil {
-			// Is the age too short?
-			if int64(hours) < int64(period) {
-
-				return fmt.Errorf("SSL certificate '%s' will expire in %d hours (%d days)", cn, hours, int(hours/24))
-			}
+		hours, cn, err := s.SSLExpiration(pinned, opts.Log)
+		if err != nil {
+			return fmt.Errorf("failed to check the certificate presented by %s - %s", address, err.Error())
 		}
 
+		// Is the age too short?
+		if int64(hours) < int64(period) {
+			return fmt.Errorf("SSL certificate '%s' presented by %s will expire in %d hours (%d days)", cn, address, hours, int(hours/24))
+		}
 	}
 
 	//
@@ -559,60 +1031,263 @@ func (s *HTTPTest) RunTest(tst test.Test, target string, opts test.Options) erro
 	return nil
 }
 
-// SSLExpiration returns the number of hours remaining for a given
-// SSL certificate chain.
-func (s *HTTPTest) SSLExpiration(host string, verbose bool) (int64, string, error) {
+// Timings returns the duration of each phase of the last request, which
+// are:
+//
+//    dns      Resolving the names of any hosts we were redirected to.
+//    connect  Making TCP connections.
+//    tls      Performing TLS handshakes.
+//    ttfb     From the start of the request until the first byte of
+//             the (final) response was received.
+//    total    From the start of the request until the response had
+//             been read.
+//
+// Phases which didn't happen are omitted.  We're given the address to
+// connect to, so the dns phase only covers the hosts of any redirections
+// which are followed; the worker adds the time it took to resolve the
+// host being tested before it publishes the timings.
+//
+// This implements the TimingReporter interface.
+func (s *HTTPTest) Timings() map[string]time.Duration {
+	return s.timings
+}
 
-	// Expiry time, in hours
-	var hours int64
-	hours = -1
+// checkTimings tests the durations of the request against any limits.
+func (s *HTTPTest) checkTimings(tst test.Test, timer *httpTimer) error {
 
-	// The common-name of the certificate involved.
-	cn := ""
+	timer.Lock()
+	defer timer.Unlock()
 
-	//
-	// If the string matches https://, then strip it off
-	//
-	re, err := regexp.Compile(`^https:\/\/([^\/]+)`)
+	if tst.Arguments["max-ttfb"] != "" {
+		limit, err := time.ParseDuration(tst.Arguments["max-ttfb"])
+		if err != nil {
+			return err
+		}
+		if timer.ttfb > limit {
+			return fmt.Errorf("time to first byte was %s, more than %s", timer.ttfb.Round(time.Millisecond), limit)
+		}
+	}
+
+	if tst.Arguments["max-duration"] != "" {
+		limit, err := time.ParseDuration(tst.Arguments["max-duration"])
+		if err != nil {
+			return err
+		}
+		if timer.total > limit {
+			return fmt.Errorf("request took %s, more than %s", timer.total.Round(time.Millisecond), limit)
+		}
+	}
+	return nil
+}
+
+// httpTimer records how long each phase of a request takes, via the hooks
+// of a httptrace.ClientTrace.
+//
+// The phases are summed across redirections, and across the connections
+// which are raced when a host has several addresses.
+type httpTimer struct {
+	sync.Mutex
+
+	start time.Time
+
+	dnsStart time.Time
+	tlsStart time.Time
+	connects map[string]time.Time
+
+	dns     time.Duration
+	connect time.Duration
+	tls     time.Duration
+	ttfb    time.Duration
+	total   time.Duration
+}
+
+// trace returns the hooks which record our timings.
+func (t *httpTimer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.Lock()
+			t.dnsStart = time.Now()
+			t.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.Lock()
+			t.dns += time.Since(t.dnsStart)
+			t.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			t.Lock()
+			if t.connects == nil {
+				t.connects = make(map[string]time.Time)
+			}
+			t.connects[network+"/"+addr] = time.Now()
+			t.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.Lock()
+			if start, ok := t.connects[network+"/"+addr]; ok && err == nil {
+				t.connect += time.Since(start)
+			}
+			t.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.Lock()
+			t.tlsStart = time.Now()
+			t.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.Lock()
+			t.tls += time.Since(t.tlsStart)
+			t.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.Lock()
+			t.ttfb = time.Since(t.start)
+			t.Unlock()
+		},
+	}
+}
+
+// done records that the response has been read.
+func (t *httpTimer) done() {
+	t.Lock()
+	t.total = time.Since(t.start)
+	t.Unlock()
+}
+
+// timings returns the durations of the phases which happened.
+func (t *httpTimer) timings() map[string]time.Duration {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.total == 0 {
+		t.total = time.Since(t.start)
+	}
+
+	out := map[string]time.Duration{"total": t.total}
+	for name, d := range map[string]time.Duration{"dns": t.dns, "connect": t.connect, "tls": t.tls, "ttfb": t.ttfb} {
+		if d > 0 {
+			out[name] = d
+		}
+	}
+	return out
+}
+
+// checkJSON tests the assertions made about a JSON response-body.
+func (s *HTTPTest) checkJSON(tst test.Test, body []byte) error {
+
+	var assertions []*jsonAssertion
+	for _, expr := range tst.Values("json") {
+		a, err := parseJSONAssertion(expr)
+		if err != nil {
+			return err
+		}
+		assertions = append(assertions, a)
+	}
+
+	path := tst.Arguments["json-path"]
+	value, hasValue := tst.Arguments["json-value"]
+	if path == "" && hasValue {
+		return fmt.Errorf("json-value requires json-path")
+	}
+
+	var simple *jsonAssertion
+	if path != "" {
+		var err error
+		simple, err = parseJSONAssertion(path)
+		if err != nil {
+			return err
+		}
+		assertions = append(assertions, simple)
+	}
+
+	if len(assertions) == 0 {
+		return nil
+	}
+
+	var doc interface{}
+	err := json.Unmarshal(body, &doc)
 	if err != nil {
-		return 0, "", err
+		return fmt.Errorf("body wasn't valid JSON - %s", err.Error())
 	}
-	res := re.FindAllStringSubmatch(host, -1)
-	for _, v := range res {
-		host = v[1]
+
+	for _, a := range assertions {
+		err = a.Check(doc)
+		if err != nil {
+			return err
+		}
 	}
 
 	//
-	// If no port is specified default to :443
+	// The json-value is compared as a string, so that
+	// `with json-value 3` matches both 3 and "3".
 	//
-	p := strings.Index(host, ":")
-	if p == -1 {
-		host += ":443"
+	if simple != nil && hasValue {
+		val, _ := simple.lookup(doc)
+		if jsonString(val) != value {
+			return fmt.Errorf("%s was %s, not '%s'", path, jsonQuote(val), value)
+		}
 	}
+	return nil
+}
 
-	//
-	// Show what we're doing.
-	//
-	if verbose {
-		fmt.Printf("SSLExpiration testing: %s\n", host)
+// redirect is a single step in a chain of redirections.
+type redirect struct {
+	// URL is the URL which was fetched.
+	URL string
+
+	// Status is the status-code of the response.
+	Status int
+}
+
+// describeRedirects describes a chain of redirections, for example:
+//
+//    http://example.com/ (301) -> https://example.com/ (200)
+//
+func describeRedirects(hops []redirect) string {
+	var steps []string
+	for _, hop := range hops {
+		steps = append(steps, fmt.Sprintf("%s (%d)", hop.URL, hop.Status))
 	}
+	return strings.Join(steps, " -> ")
+}
 
-	conn, err := tls.Dial("tcp", host, nil)
-	if err != nil {
-		return 0, "", err
+// splitHeader splits a header argument, such as "Accept: text/plain", into
+// its name and value.
+func splitHeader(header string) (string, string) {
+	i := strings.Index(header, ":")
+	if i < 0 {
+		return strings.TrimSpace(header), ""
+	}
+	return strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:])
+}
+
+// SSLExpiration returns the number of hours remaining for the SSL
+// certificate chain of a connection, along with the common-name of the
+// certificate which expires soonest.
+//
+// The chains are those which were verified when the connection was made,
+// so there must be at least one.
+func (s *HTTPTest) SSLExpiration(state *tls.ConnectionState, log *logger.Logger) (int64, string, error) {
+
+	// Expiry time, in hours
+	var hours int64
+	hours = -1
+
+	// The common-name of the certificate involved.
+	cn := ""
+
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return 0, "", fmt.Errorf("no verified certificate chain")
 	}
-	defer conn.Close()
 
 	timeNow := time.Now()
-	for _, chain := range conn.ConnectionState().VerifiedChains {
+	for _, chain := range state.VerifiedChains {
 		for _, cert := range chain {
 
 			// Get the expiration time, in hours.
 			expiresIn := int64(cert.NotAfter.Sub(timeNow).Hours())
 
-			if verbose {
-				fmt.Printf("SSLExpiration - certificate: %s expires in %d hours (%d days)\n", cert.Subject.CommonName, expiresIn, expiresIn/24)
-			}
+			log.Debug("SSLExpiration certificate", "cn", cert.Subject.CommonName, "hours", expiresIn, "days", expiresIn/24)
 
 			// If we've not checked anything this is the benchmark
 			if hours == -1 {
@@ -0,0 +1,278 @@
+package protocols
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skx/overseer/test"
+)
+
+// httpTest returns a test of the given URL, with the given arguments, of
+// which repeated values are separated by newlines.
+func httpTest(target string, args map[string]string) test.Test {
+	if args == nil {
+		args = make(map[string]string)
+	}
+	return test.Test{
+		Target:    target,
+		Type:      "http",
+		Input:     target + " must run http",
+		Arguments: args,
+	}
+}
+
+// serve starts a server with the given handler, and returns a URL for it
+// which uses the given hostname rather than its address, along with the
+// address.  The probe connects to the address, as the worker would.
+func serve(t *testing.T, hostname string, handler http.Handler) (string, string) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return rename(t, server.URL, hostname)
+}
+
+// rename replaces the host of the URL of a test-server.
+func rename(t *testing.T, address string, hostname string) (string, string) {
+	u, err := url.Parse(address)
+	if err != nil {
+		t.Fatalf("invalid URL %s", address)
+	}
+	ip, port, _ := net.SplitHostPort(u.Host)
+	u.Host = net.JoinHostPort(hostname, port)
+	return u.String() + "/", ip
+}
+
+// runHTTP runs the given test against the address.
+func runHTTP(tst test.Test, address string) (*HTTPTest, error) {
+	probe := &HTTPTest{}
+	err := probe.RunTest(tst, address, test.Options{Timeout: 5 * time.Second})
+	return probe, err
+}
+
+// Test that custom headers are sent, and that a Host header replaces the
+// host of the request.
+func TestHTTPHeaders(t *testing.T) {
+	var got *http.Request
+	target, address := serve(t, "example.invalid", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req
+	}))
+
+	tst := httpTest(target, map[string]string{
+		"header": strings.Join([]string{
+			"Authorization: Bearer xxxx",
+			"Accept: text/plain",
+			"accept: application/json",
+			"User-Agent: custom/1.0",
+			"Host: vhost.example.com",
+		}, test.Separator),
+	})
+	_, err := runHTTP(tst, address)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if got.Header.Get("Authorization") != "Bearer xxxx" {
+		t.Errorf("wrong Authorization header: %v", got.Header)
+	}
+	if strings.Join(got.Header["Accept"], ",") != "text/plain,application/json" {
+		t.Errorf("the repeated header wasn't sent twice: %v", got.Header["Accept"])
+	}
+	if got.UserAgent() != "custom/1.0" {
+		t.Errorf("the user-agent wasn't replaced: %s", got.UserAgent())
+	}
+	if got.Host != "vhost.example.com" {
+		t.Errorf("the Host header wasn't used: %s", got.Host)
+	}
+	if len(got.Header["Host"]) != 0 {
+		t.Errorf("the Host header was sent as a header too")
+	}
+}
+
+// Test that the response must contain the headers we expect.
+func TestHTTPExpectHeader(t *testing.T) {
+	target, address := serve(t, "example.invalid", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		w.Header().Add("Vary", "Accept")
+		w.Header().Add("Vary", "Cookie")
+	}))
+
+	tests := []struct {
+		expect []string
+		err    string
+	}{
+		{[]string{"Strict-Transport-Security: max-age=[0-9]+"}, ""},
+		{[]string{"strict-transport-security: ^max-age"}, ""},
+		{[]string{"Vary:"}, ""},
+		{[]string{"Vary: ^Cookie$"}, ""},
+		{[]string{"Vary: ^Accept$", "Strict-Transport-Security: includeSubDomains"},
+			"header 'Strict-Transport-Security' was 'max-age=31536000', which didn't match the regular expression 'includeSubDomains'"},
+		{[]string{"Vary: Origin"},
+			"header 'Vary' was 'Accept, Cookie', which didn't match the regular expression 'Origin'"},
+		{[]string{"Cache-Control:"},
+			"header 'Cache-Control' was not present"},
+		{[]string{"Vary: ("},
+			"invalid regular expression for header 'Vary' - error parsing regexp: missing closing ): `(`"},
+	}
+
+	for _, tc := range tests {
+		tst := httpTest(target, map[string]string{"expect-header": strings.Join(tc.expect, test.Separator)})
+		_, err := runHTTP(tst, address)
+
+		if tc.err == "" && err != nil {
+			t.Errorf("%v: unexpected error: %s", tc.expect, err.Error())
+		}
+		if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.expect, tc.err, err)
+		}
+	}
+}
+
+// Test following redirections, which change host, and the reporting of
+// them when the test fails.
+func TestHTTPRedirects(t *testing.T) {
+
+	//
+	// The final server is reached by its address, as it isn't the
+	// host we're testing.
+	//
+	final := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("done"))
+	}))
+	defer final.Close()
+
+	//
+	// The first sets a cookie, which it requires after redirecting
+	// to itself, and then redirects to the final server.
+	//
+	target, address := serve(t, "example.invalid", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+			http.Redirect(w, req, "/login", http.StatusMovedPermanently)
+		case "/login":
+			if _, err := req.Cookie("session"); err != nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.Redirect(w, req, final.URL+"/home", http.StatusFound)
+		}
+	}))
+
+	hops := map[int]string{
+		1: target + " (301) -> " + target + "login (302)",
+		2: target + " (301) -> " + target + "login (302) -> " + final.URL + "/home (200)",
+	}
+
+	tests := []struct {
+		args map[string]string
+		err  string
+	}{
+		// Redirections aren't followed by default.
+		{nil, "status code was 301 not 200"},
+		{map[string]string{"status": "301", "expect-redirects": "0"}, ""},
+		{map[string]string{"follow-redirects": "0", "status": "301", "expect-url": "/$"}, ""},
+
+		// We stop once we've followed enough.
+		{map[string]string{"follow-redirects": "1"}, "status code was 302 not 200, after following " + hops[1]},
+		{map[string]string{"follow-redirects": "1", "status": "302", "expect-redirects": "1"}, ""},
+
+		// Otherwise we reach the end, with the cookie.
+		{map[string]string{"follow-redirects": "2", "content": "done"}, ""},
+		{map[string]string{"follow-redirects": "5", "expect-redirects": "2"}, ""},
+		{map[string]string{"follow-redirects": "5", "expect-redirects": "3"}, "followed 2 redirections, not 3, after following " + hops[2]},
+		{map[string]string{"follow-redirects": "5", "expect-url": `^http://127\.0\.0\.1:[0-9]+/home$`}, ""},
+		{map[string]string{"follow-redirects": "5", "expect-url": "^https://"},
+			"final URL was '" + final.URL + "/home', which didn't match the regular expression '^https://', after following " + hops[2]},
+		{map[string]string{"follow-redirects": "5", "content": "missing"}, "body didn't contain 'missing', after following " + hops[2]},
+	}
+
+	for _, tc := range tests {
+		_, err := runHTTP(httpTest(target, tc.args), address)
+
+		if tc.err == "" && err != nil {
+			t.Errorf("%v: unexpected error: %s", tc.args, err.Error())
+		}
+		if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+// Test the limits on the duration of a request, and the phases which are
+// reported.
+func TestHTTPTimings(t *testing.T) {
+
+	//
+	// The response starts after 100ms, and ends 200ms later.
+	//
+	target, address := serve(t, "example.invalid", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("slow"))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(" response"))
+	}))
+
+	tests := []struct {
+		args   map[string]string
+		prefix string
+		suffix string
+	}{
+		{map[string]string{"max-ttfb": "2s", "max-duration": "3s"}, "", ""},
+		{map[string]string{"max-ttfb": "50ms"}, "time to first byte was ", ", more than 50ms"},
+		{map[string]string{"max-ttfb": "2s", "max-duration": "250ms"}, "request took ", ", more than 250ms"},
+	}
+
+	for _, tc := range tests {
+		probe, err := runHTTP(httpTest(target, tc.args), address)
+
+		if tc.prefix == "" && err != nil {
+			t.Errorf("%v: unexpected error: %s", tc.args, err.Error())
+		}
+		if tc.prefix != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.prefix) || !strings.HasSuffix(err.Error(), tc.suffix)) {
+			t.Errorf("%v: expected error %q...%q, got %v", tc.args, tc.prefix, tc.suffix, err)
+		}
+
+		//
+		// The timings are reported either way.  We connect to the
+		// address we're given, so there's no dns phase, and there's
+		// no tls phase for plain HTTP.
+		//
+		timings := probe.Timings()
+		for _, phase := range []string{"connect", "ttfb", "total"} {
+			if _, ok := timings[phase]; !ok {
+				t.Errorf("%v: the %s phase wasn't reported: %v", tc.args, phase, timings)
+			}
+		}
+		for _, phase := range []string{"dns", "tls"} {
+			if _, ok := timings[phase]; ok {
+				t.Errorf("%v: the %s phase was reported: %v", tc.args, phase, timings)
+			}
+		}
+		if timings["ttfb"] < 100*time.Millisecond || timings["ttfb"] > timings["total"] || timings["total"] < 300*time.Millisecond {
+			t.Errorf("%v: unexpected timings %v", tc.args, timings)
+		}
+	}
+}
+
+// Test that the names of the hosts we're redirected to are resolved, and
+// that takes part in the dns phase.
+func TestHTTPTimingsRedirect(t *testing.T) {
+	final := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer final.Close()
+	elsewhere, _ := rename(t, final.URL, "localhost")
+
+	target, address := serve(t, "example.invalid", http.RedirectHandler(elsewhere, http.StatusFound))
+
+	probe, err := runHTTP(httpTest(target, map[string]string{"follow-redirects": "1"}), address)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, ok := probe.Timings()["dns"]; !ok {
+		t.Errorf("the dns phase wasn't reported: %v", probe.Timings())
+	}
+}
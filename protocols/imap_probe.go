@@ -29,12 +29,33 @@ type IMAPTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *IMAPTest) Arguments() map[string]string {
-	known := map[string]string{
-		"port":     "^[0-9]+$",
-		"username": ".*",
-		"password": ".*",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *IMAPTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "password",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Sensitive:   true,
+			Description: "The password to login with.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "143",
+			Description: "The port to connect to.",
+		},
+		{
+			Name:        "username",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "The username to login with.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -11,11 +11,17 @@
 // Because IMAPS uses TLS it will test the validity of the certificate as
 // part of the test, if you wish to disable this add `with tls insecure`.
 //
+// If the server uses a private CA you may give its certificate instead,
+// and if it requires a client certificate you may give that too:
+//
+//    host.example.com must run imaps with ca /etc/ssl/ca.pem with client-cert /etc/ssl/client.pem with client-key /etc/ssl/client.key
+//
+// (The files are read by the worker which runs the test.)
+//
 
 package protocols
 
 import (
-	"crypto/tls"
 	"fmt"
 	"net"
 	"strconv"
@@ -33,13 +39,33 @@ type IMAPSTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *IMAPSTest) Arguments() map[string]string {
-	known := map[string]string{
-		"port":     "^[0-9]+$",
-		"tls":      "insecure",
-		"username": ".*",
-		"password": ".*",
-	}
-	return known
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *IMAPSTest) Schema() []Argument {
+	return append([]Argument{
+		{
+			Name:        "password",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Sensitive:   true,
+			Description: "The password to login with.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "993",
+			Description: "The port to connect to.",
+		},
+		{
+			Name:        "username",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "The username to login with.",
+		},
+	}, tlsArguments()...)
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -58,7 +84,8 @@ IMAPS Tester
 
  Because IMAPS uses TLS this test will ensure the validity of the certificate as
  part of the test, if you wish to disable this add "with tls insecure".
-`
+
+` + tlsUsage("host.example.com must run imaps")
 
 	return str
 }
@@ -87,14 +114,6 @@ func (s *IMAPSTest) RunTest(tst test.Test, target string, opts test.Options) err
 		}
 	}
 
-	//
-	// Should we skip validation of the SSL certificate?
-	//
-	insecure := false
-	if tst.Arguments["tls"] == "insecure" {
-		insecure = true
-	}
-
 	//
 	// Default to connecting to an IPv4-address
 	//
@@ -115,21 +134,15 @@ func (s *IMAPSTest) RunTest(tst test.Test, target string, opts test.Options) err
 	}
 
 	//
-	// Setup the default TLS config.
+	// Setup the TLS config.
 	//
 	// We need to setup the hostname that the TLS certificate
 	// will verify upon, from our input-line.
 	//
 	data := strings.Fields(tst.Input)
-	tlsSetup := &tls.Config{ServerName: data[0]}
-
-	//
-	// Disable verification if we're being insecure.
-	//
-	if insecure {
-		tlsSetup = &tls.Config{
-			InsecureSkipVerify: true,
-		}
+	tlsSetup, err := tlsConfig(tst, data[0])
+	if err != nil {
+		return err
 	}
 
 	//
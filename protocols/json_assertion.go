@@ -0,0 +1,335 @@
+package protocols
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// jsonOperators are the comparisons a JSON assertion may make, longest
+// first so that "<=" is found before "<".
+var jsonOperators = []string{"==", "!=", "<=", ">=", "=~", "<", ">"}
+
+// jsonAssertion is a test against a JSON document, such as:
+//
+//    $.status == ok
+//    $.queue_depth < 100
+//    len($.workers) >= 2
+//    type($.items) == array
+//    $.version =~ ^2\.
+//
+// Without an operator the assertion only requires that the path exists.
+type jsonAssertion struct {
+	// input is the assertion as given.
+	input string
+
+	// left is the text of the left-hand side, such as "len($.workers)",
+	// which is used to name the path in failures.
+	left string
+
+	// fn is the function applied to the value the path identifies,
+	// which is "len", "type", or empty.
+	fn string
+
+	// path is the keys, and indexes, which identify the value.
+	path []interface{}
+
+	// op is the operator, if any.
+	op string
+
+	// right is the text of the right-hand side, and value is it parsed.
+	right string
+	value interface{}
+
+	// re is the regular expression for the "=~" operator.
+	re *regexp.Regexp
+}
+
+// parseJSONAssertion parses an assertion.
+func parseJSONAssertion(input string) (*jsonAssertion, error) {
+
+	a := &jsonAssertion{input: input}
+
+	//
+	// Find the operator, ignoring anything within quotes or brackets
+	// as it may be a part of the path.
+	//
+	left := strings.TrimSpace(input)
+	quote := byte(0)
+	depth := 0
+	for i := 0; i < len(input) && a.op == ""; i++ {
+		c := input[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case depth == 0:
+			for _, op := range jsonOperators {
+				if strings.HasPrefix(input[i:], op) {
+					a.op = op
+					left = strings.TrimSpace(input[:i])
+					a.right = strings.TrimSpace(input[i+len(op):])
+					break
+				}
+			}
+		}
+	}
+	a.left = left
+
+	//
+	// Is a function applied to the path?
+	//
+	for _, fn := range []string{"len", "type"} {
+		if strings.HasPrefix(left, fn+"(") && strings.HasSuffix(left, ")") {
+			a.fn = fn
+			left = strings.TrimSpace(left[len(fn)+1 : len(left)-1])
+		}
+	}
+
+	var err error
+	a.path, err = parseJSONPath(left)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// Parse the value we compare against.
+	//
+	if a.op == "" {
+		return a, nil
+	}
+	if a.right == "" {
+		return nil, fmt.Errorf("missing value after '%s' in '%s'", a.op, input)
+	}
+
+	switch a.op {
+	case "=~":
+		pattern := a.right
+		var str string
+		if json.Unmarshal([]byte(pattern), &str) == nil {
+			pattern = str
+		}
+		a.re, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression in '%s' - %s", input, err.Error())
+		}
+	case "<", "<=", ">", ">=":
+		a.value, err = strconv.ParseFloat(a.right, 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a number, in '%s'", a.right, input)
+		}
+	default:
+		//
+		// The value is JSON, but a bare word is a string so that
+		// `$.status == ok` works as you'd expect.
+		//
+		if json.Unmarshal([]byte(a.right), &a.value) != nil {
+			a.value = a.right
+		}
+
+		//
+		// The name of a type is always a string, even "null".
+		//
+		if _, ok := a.value.(string); a.fn == "type" && !ok {
+			a.value = a.right
+		}
+	}
+	return a, nil
+}
+
+// parseJSONPath parses a path such as `$.workers[0].name`, or
+// `$["key.with.dots"]`, into its keys and indexes.
+func parseJSONPath(path string) ([]interface{}, error) {
+
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("the path '%s' doesn't start with '$'", path)
+	}
+
+	var steps []interface{}
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("empty key in the path '%s'", path)
+			}
+			steps = append(steps, key)
+			rest = rest[end+1:]
+
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("missing ']' in the path '%s'", path)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, inner[1:len(inner)-1])
+			} else {
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index '%s' in the path '%s'", inner, path)
+				}
+				steps = append(steps, n)
+			}
+			rest = rest[end+1:]
+
+		default:
+			return nil, fmt.Errorf("unexpected '%s' in the path '%s'", rest, path)
+		}
+	}
+	return steps, nil
+}
+
+// lookup returns the value the path identifies, and false if there is none.
+//
+// Negative indexes count from the end of an array.
+func (a *jsonAssertion) lookup(doc interface{}) (interface{}, bool) {
+	cur := doc
+	for _, step := range a.path {
+		switch s := step.(type) {
+		case string:
+			obj, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			cur, ok = obj[s]
+			if !ok {
+				return nil, false
+			}
+		case int:
+			arr, ok := cur.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			if s < 0 {
+				s += len(arr)
+			}
+			if s < 0 || s >= len(arr) {
+				return nil, false
+			}
+			cur = arr[s]
+		}
+	}
+	return cur, true
+}
+
+// Check tests the assertion against a decoded JSON document, returning an
+// error which names the path if it fails.
+func (a *jsonAssertion) Check(doc interface{}) error {
+
+	val, ok := a.lookup(doc)
+	if !ok {
+		return fmt.Errorf("%s was not present", a.left)
+	}
+
+	//
+	// Apply any function.
+	//
+	switch a.fn {
+	case "len":
+		switch v := val.(type) {
+		case []interface{}:
+			val = float64(len(v))
+		case map[string]interface{}:
+			val = float64(len(v))
+		case string:
+			val = float64(len([]rune(v)))
+		default:
+			return fmt.Errorf("%s has no length, as its type is %s", a.left, jsonType(val))
+		}
+	case "type":
+		val = jsonType(val)
+	}
+
+	if a.op == "" {
+		return nil
+	}
+
+	//
+	// Now compare.
+	//
+	pass := false
+	switch a.op {
+	case "==":
+		pass = reflect.DeepEqual(val, a.value)
+	case "!=":
+		pass = !reflect.DeepEqual(val, a.value)
+	case "=~":
+		pass = a.re.MatchString(jsonString(val))
+	default:
+		n, ok := val.(float64)
+		if !ok {
+			return fmt.Errorf("%s was %s, which isn't a number", a.left, jsonQuote(val))
+		}
+		limit := a.value.(float64)
+		switch a.op {
+		case "<":
+			pass = n < limit
+		case "<=":
+			pass = n <= limit
+		case ">":
+			pass = n > limit
+		case ">=":
+			pass = n >= limit
+		}
+	}
+
+	if !pass {
+		return fmt.Errorf("%s was %s, not %s %s", a.left, jsonQuote(val), a.op, a.right)
+	}
+	return nil
+}
+
+// jsonType returns the type of a decoded JSON value.
+func jsonType(val interface{}) string {
+	switch val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jsonString returns a decoded JSON value as a string, which is the value
+// itself for a string, or its JSON otherwise.
+func jsonString(val interface{}) string {
+	if str, ok := val.(string); ok {
+		return str
+	}
+	out, _ := json.Marshal(val)
+	return string(out)
+}
+
+// jsonQuote returns the JSON of a decoded value for use in an error,
+// shortened if it is long.
+func jsonQuote(val interface{}) string {
+	out, _ := json.Marshal(val)
+	if len(out) > 64 {
+		return string(out[:61]) + "..."
+	}
+	return string(out)
+}
@@ -0,0 +1,182 @@
+package protocols
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// document is the JSON which our assertions are tested against.
+const document = `{
+  "status": "ok",
+  "queue_depth": 42,
+  "version": "2.1.0",
+  "ready": true,
+  "nothing": null,
+  "workers": [{"name": "a"}, {"name": "b"}, {"name": "c"}],
+  "labels": {"env": "prod"},
+  "name": "Ünïcode",
+  "key.with.dots": 1,
+  "a<b": "lt",
+  "x==y": 2
+}`
+
+// Test assertions against a document, and the errors when they fail.
+func TestJSONAssertions(t *testing.T) {
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(document), &doc); err != nil {
+		t.Fatalf("invalid document: %s", err.Error())
+	}
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		// Presence.
+		{`$.status`, ""},
+		{`$.nothing`, ""},
+		{`$.nope`, "$.nope was not present"},
+		{`$.status.nope`, "$.status.nope was not present"},
+
+		// Equality, where a bare word is a string.
+		{`$.status == ok`, ""},
+		{`$.status == "ok"`, ""},
+		{`$.status==ok`, ""},
+		{`$.status == down`, `$.status was "ok", not == down`},
+		{`$.queue_depth == 42`, ""},
+		{`$.queue_depth == "42"`, `$.queue_depth was 42, not == "42"`},
+		{`$.ready == true`, ""},
+		{`$.nothing == null`, ""},
+		{`$.labels == {"env": "prod"}`, ""},
+		{`$.status != down`, ""},
+		{`$.status != ok`, `$.status was "ok", not != ok`},
+
+		// Numeric comparisons, where "<=" isn't mistaken for "<".
+		{`$.queue_depth < 100`, ""},
+		{`$.queue_depth < 42`, "$.queue_depth was 42, not < 42"},
+		{`$.queue_depth <= 42`, ""},
+		{`$.queue_depth<=41.5`, "$.queue_depth was 42, not <= 41.5"},
+		{`$.queue_depth > 42`, "$.queue_depth was 42, not > 42"},
+		{`$.queue_depth >= 42`, ""},
+		{`$.queue_depth>=43`, "$.queue_depth was 42, not >= 43"},
+		{`$.status < 5`, `$.status was "ok", which isn't a number`},
+		{`$.nothing >= 0`, "$.nothing was null, which isn't a number"},
+
+		// Regular expressions, quoted or bare, against the text of
+		// the value.
+		{`$.version =~ ^2\.`, ""},
+		{`$.version =~ "^2\\.1"`, ""},
+		{`$.version =~ '^2'`, `$.version was "2.1.0", not =~ '^2'`},
+		{`$.version =~ ^3`, `$.version was "2.1.0", not =~ ^3`},
+		{`$.queue_depth =~ ^4[0-9]$`, ""},
+		{`$.labels =~ "env":"prod"`, ""},
+
+		// Functions.
+		{`len($.workers) == 3`, ""},
+		{`len($.workers) >= 4`, "len($.workers) was 3, not >= 4"},
+		{`len($.labels) == 1`, ""},
+		{`len($.name) == 7`, ""},
+		{`len($.queue_depth) > 0`, "len($.queue_depth) has no length, as its type is number"},
+		{`len($.nope) > 0`, "len($.nope) was not present"},
+		{`type($.workers) == array`, ""},
+		{`type($.labels) == object`, ""},
+		{`type($.status) == string`, ""},
+		{`type($.queue_depth) == number`, ""},
+		{`type($.ready) == boolean`, ""},
+		{`type($.nothing) == null`, ""},
+		{`type($.status) == "string"`, ""},
+		{`type($.status) != null`, ""},
+		{`type($.status) == number`, `type($.status) was "string", not == number`},
+
+		// Keys in brackets may contain dots, or operators.
+		{`$["key.with.dots"] == 1`, ""},
+		{`$['a<b'] == lt`, ""},
+		{`$["x==y"] >= 2`, ""},
+		{`$["x==y"] != 2`, `$["x==y"] was 2, not != 2`},
+		{`$.labels["env"] == prod`, ""},
+
+		// Indexes, which may count from the end.
+		{`$.workers[0].name == a`, ""},
+		{`$.workers[ 1 ].name == b`, ""},
+		{`$.workers[-1].name == c`, ""},
+		{`$.workers[-3].name == a`, ""},
+		{`$.workers[-4]`, "$.workers[-4] was not present"},
+		{`$.workers[3].name == a`, "$.workers[3].name was not present"},
+		{`$.labels[0]`, "$.labels[0] was not present"},
+		{`$.workers.name`, "$.workers.name was not present"},
+	}
+
+	for _, tc := range tests {
+		a, err := parseJSONAssertion(tc.input)
+		if err != nil {
+			t.Errorf("%s: failed to parse: %s", tc.input, err.Error())
+			continue
+		}
+
+		err = a.Check(doc)
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.input, err.Error())
+		}
+		if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%s: expected error %q, got %v", tc.input, tc.err, err)
+		}
+	}
+}
+
+// Test that invalid assertions are rejected.
+func TestJSONAssertionErrors(t *testing.T) {
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{`status == ok`, "the path 'status' doesn't start with '$'"},
+		{`$.status ==`, "missing value after '==' in '$.status =='"},
+		{`$.queue_depth < many`, "'many' is not a number, in '$.queue_depth < many'"},
+		{`$.queue_depth >= "10"`, `'"10"' is not a number, in '$.queue_depth >= "10"'`},
+		{`len($.workers) > two`, "'two' is not a number, in 'len($.workers) > two'"},
+		{`$.version =~ (`, "invalid regular expression in '$.version =~ (' - error parsing regexp: missing closing ): `(`"},
+		{`$..status`, "empty key in the path '$..status'"},
+		{`$.workers[0`, "missing ']' in the path '$.workers[0'"},
+		{`$.workers[first]`, "invalid index 'first' in the path '$.workers[first]'"},
+		{`$status`, "unexpected 'status' in the path '$status'"},
+	}
+
+	for _, tc := range tests {
+		_, err := parseJSONAssertion(tc.input)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("%s: expected error %q, got %v", tc.input, tc.err, err)
+		}
+	}
+}
+
+// Test the json-path, and json-value, of the HTTP probe.
+func TestJSONPathValue(t *testing.T) {
+
+	tests := []struct {
+		args map[string]string
+		body string
+		err  string
+	}{
+		{map[string]string{"json-path": "$.status", "json-value": "ok"}, `{"status": "ok"}`, ""},
+		{map[string]string{"json-path": "$.count", "json-value": "3"}, `{"count": 3}`, ""},
+		{map[string]string{"json-path": "$.count", "json-value": "3"}, `{"count": "3"}`, ""},
+		{map[string]string{"json-path": "$.status", "json-value": "ok"}, `{"status": "down"}`, `$.status was "down", not 'ok'`},
+		{map[string]string{"json-path": "$.status"}, `{"state": "ok"}`, "$.status was not present"},
+		{map[string]string{"json-value": "ok"}, `{"status": "ok"}`, "json-value requires json-path"},
+		{map[string]string{"json": "$.status"}, `<html>`, "body wasn't valid JSON - invalid character '<' looking for beginning of value"},
+		{nil, `<html>`, ""},
+	}
+
+	for _, tc := range tests {
+		tst := httpTest("http://example.com/", tc.args)
+		err := (&HTTPTest{}).checkJSON(tst, []byte(tc.body))
+
+		if tc.err == "" && err != nil {
+			t.Errorf("%v: unexpected error: %s", tc.args, err.Error())
+		}
+		if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.err, err)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"strings"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/skx/overseer/logger"
 	"github.com/skx/overseer/test"
 )
 
@@ -30,12 +31,34 @@ type MYSQLTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *MYSQLTest) Arguments() map[string]string {
-	known := map[string]string{
-		"port":     "^[0-9]+$",
-		"username": ".*",
-		"password": ".*",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *MYSQLTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "password",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Sensitive:   true,
+			Description: "The password to login with.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "3306",
+			Description: "The port to connect to.",
+		},
+		{
+			Name:        "username",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Required:    true,
+			Description: "The username to login with.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -122,10 +145,12 @@ func (s *MYSQLTest) RunTest(tst test.Test, target string, opts test.Options) err
 	dsn := config.FormatDSN()
 
 	//
-	// Show the DSN, if appropriate.
+	// Show the DSN, without the password.
 	//
-	if opts.Verbose {
-		fmt.Printf("\tMySQL DSN is %s\n", dsn)
+	if opts.Log.Enabled(logger.LevelDebug) {
+		censored := *config
+		censored.Passwd = "CENSORED"
+		opts.Log.Debug("MySQL DSN", "dsn", censored.FormatDSN())
 	}
 
 	//
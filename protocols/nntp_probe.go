@@ -34,11 +34,26 @@ type NNTPTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *NNTPTest) Arguments() map[string]string {
-	known := map[string]string{
-		"port":  "^[0-9]+$",
-		"group": ".*",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *NNTPTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "group",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "A newsgroup which must exist.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "119",
+			Description: "The port to connect to.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -28,13 +28,39 @@ type POP3Test struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *POP3Test) Arguments() map[string]string {
-	known := map[string]string{
-		"port":     "^[0-9]+$",
-		"tls":      "insecure",
-		"username": ".*",
-		"password": ".*",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *POP3Test) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "password",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Sensitive:   true,
+			Description: "The password to login with.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "110",
+			Description: "The port to connect to.",
+		},
+		{
+			Name:        "tls",
+			Type:        TypeEnum,
+			Values:      []string{"insecure"},
+			Description: "Disable validation of the TLS certificate.",
+		},
+		{
+			Name:        "username",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "The username to login with.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
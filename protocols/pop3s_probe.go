@@ -11,11 +11,17 @@
 // Because POP3S uses TLS it will test the validity of the certificate as
 // part of the test, if you wish to disable this add `with tls insecure`.
 //
+// If the server uses a private CA you may give its certificate instead,
+// and if it requires a client certificate you may give that too:
+//
+//    host.example.com must run pop3s with ca /etc/ssl/ca.pem with client-cert /etc/ssl/client.pem with client-key /etc/ssl/client.key
+//
+// (The files are read by the worker which runs the test.)
+//
 
 package protocols
 
 import (
-	"crypto/tls"
 	"fmt"
 	"strconv"
 	"strings"
@@ -32,13 +38,33 @@ type POP3STest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *POP3STest) Arguments() map[string]string {
-	known := map[string]string{
-		"port":     "^[0-9]+$",
-		"tls":      "insecure",
-		"username": ".*",
-		"password": ".*",
-	}
-	return known
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *POP3STest) Schema() []Argument {
+	return append([]Argument{
+		{
+			Name:        "password",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Sensitive:   true,
+			Description: "The password to login with.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "995",
+			Description: "The port to connect to.",
+		},
+		{
+			Name:        "username",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "The username to login with.",
+		},
+	}, tlsArguments()...)
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -56,7 +82,8 @@ POP3S Tester
 
  Because POP3S uses TLS it will test the validity of the certificate as
  part of the test, if you wish to disable this add 'with tls insecure'.
-`
+
+` + tlsUsage("host.example.com must run pop3s")
 	return str
 }
 
@@ -84,14 +111,6 @@ func (s *POP3STest) RunTest(tst test.Test, target string, opts test.Options) err
 		}
 	}
 
-	//
-	// Should we skip validation of the SSL certificate?
-	//
-	insecure := false
-	if tst.Arguments["tls"] == "insecure" {
-		insecure = true
-	}
-
 	//
 	// Default to connecting to an IPv4-address
 	//
@@ -105,21 +124,15 @@ func (s *POP3STest) RunTest(tst test.Test, target string, opts test.Options) err
 	}
 
 	//
-	// Setup the default TLS config.
+	// Setup the TLS config.
 	//
 	// We need to setup the hostname that the TLS certificate
 	// will verify upon, from our input-line.
 	//
 	data := strings.Fields(tst.Input)
-	tlsSetup := &tls.Config{ServerName: data[0]}
-
-	//
-	// If we're being insecure then remove the verification
-	//
-	if insecure {
-		tlsSetup = &tls.Config{
-			InsecureSkipVerify: true,
-		}
+	tlsSetup, err := tlsConfig(tst, data[0])
+	if err != nil {
+		return err
 	}
 
 	//
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	_ "github.com/lib/pq" // Don't need to import this
 	"github.com/skx/overseer/test"
@@ -34,13 +35,41 @@ type PSQLTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *PSQLTest) Arguments() map[string]string {
-	known := map[string]string{
-		"port":     "^[0-9]+$",
-		"username": ".*",
-		"password": ".*",
-		"tls":      "^(disable|require|verify-ca|verify-full)$",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *PSQLTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "password",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Sensitive:   true,
+			Description: "The password to login with.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "5432",
+			Description: "The port to connect to.",
+		},
+		{
+			Name:        "tls",
+			Type:        TypeEnum,
+			Values:      []string{"disable", "require", "verify-ca", "verify-full"},
+			Default:     "disable",
+			Description: "The TLS mode to connect with.",
+		},
+		{
+			Name:        "username",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Required:    true,
+			Description: "The username to login with.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -103,11 +132,9 @@ func (s *PSQLTest) RunTest(tst test.Test, target string, opts test.Options) erro
 	connect := fmt.Sprintf("host=%s port='%d' user='%s' password='%s' connect_timeout='%d' sslmode='%s'", target, port, tst.Arguments["username"], tst.Arguments["password"], opts.Timeout, ssl)
 
 	//
-	// Show the config, if appropriate.
+	// Show the config, without the password.
 	//
-	if opts.Verbose {
-		fmt.Printf("\tPSQL connection string is %s\n", connect)
-	}
+	opts.Log.Debug("PSQL connection string", "connect", strings.Replace(connect, fmt.Sprintf("password='%s'", tst.Arguments["password"]), "password='CENSORED'", 1))
 
 	//
 	// Connect to the database
@@ -40,14 +40,45 @@ type REDISTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *REDISTest) Arguments() map[string]string {
-	known := map[string]string{
-		"list":     ".*",
-		"set":      ".*",
-		"max_size": "^[0-9]+$",
-		"password": ".*",
-		"port":     "^[0-9]+$",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *REDISTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "list",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "The name of a list to test the size of.",
+		},
+		{
+			Name:        "max_size",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Description: "The maximum size of the list or set.",
+		},
+		{
+			Name:        "password",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Sensitive:   true,
+			Description: "The password to connect with.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "6379",
+			Description: "The port to connect to.",
+		},
+		{
+			Name:        "set",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "The name of a set to test the size of.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -29,10 +29,20 @@ type RSYNCTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *RSYNCTest) Arguments() map[string]string {
-	known := map[string]string{
-		"port": "^[0-9]+$",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *RSYNCTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "873",
+			Description: "The port to connect to.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -15,6 +15,13 @@
 // non-trusted you'll need to disable the validity checking by appending
 // `with tls insecure`.
 //
+// If the server uses a private CA you may give its certificate instead,
+// and if it requires a client certificate you may give that too:
+//
+//    host.example.com must run smtp with ca /etc/ssl/ca.pem with client-cert /etc/ssl/client.pem with client-key /etc/ssl/client.key
+//
+// (The files are read by the worker which runs the test.)
+//
 // A complete example, testing a login, will look like this:
 //
 //    host.example.com must run smtp [with port 587] with username 'steve@example.com' with password 'secret'  [with tls insecure]
@@ -24,7 +31,6 @@
 package protocols
 
 import (
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -43,13 +49,33 @@ type SMTPTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *SMTPTest) Arguments() map[string]string {
-	known := map[string]string{
-		"port":     "^[0-9]+$",
-		"username": ".*",
-		"password": ".*",
-		"tls":      "insecure",
-	}
-	return known
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *SMTPTest) Schema() []Argument {
+	return append([]Argument{
+		{
+			Name:        "password",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Sensitive:   true,
+			Description: "The password to login with.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "25",
+			Description: "The port to connect to.",
+		},
+		{
+			Name:        "username",
+			Type:        TypeString,
+			Pattern:     ".*",
+			Description: "The username to login with.",
+		},
+	}, tlsArguments()...)
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
@@ -72,6 +98,7 @@ SMTP Tester
  non-trusted you'll need to disable the validity checking by appending
  'with tls insecure'.
 
+` + tlsUsage("host.example.com must run smtp") + `
  A complete example, testing a login, will look like this:
 
     host.example.com must run smtp [with port 587] with username 'steve@example.com' with password 's3cr3t'  [with tls insecure]
@@ -127,19 +154,12 @@ func (s *SMTPTest) RunTest(tst test.Test, target string, opts test.Options) erro
 		return err
 	}
 
-	// The default TLS configuration verifies the certificate
-	// matches the hostname of our target.
-	tlsconfig := &tls.Config{
-		ServerName: tst.Target,
-	}
-
-	// However if the user is being insecure then we'll validate
-	// nothing - allowing self-signed certificates, and hostname
-	// mismatches.
-	if tst.Arguments["tls"] == "insecure" {
-		tlsconfig = &tls.Config{
-			InsecureSkipVerify: true,
-		}
+	// The TLS configuration verifies the certificate matches the
+	// hostname of our target, unless the user is being insecure.
+	tlsconfig, err := tlsConfig(tst, tst.Target)
+	if err != nil {
+		conn.Close()
+		return err
 	}
 
 	// Create the SMTP-client
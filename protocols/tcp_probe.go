@@ -39,11 +39,26 @@ type TCPTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *TCPTest) Arguments() map[string]string {
-	known := map[string]string{
-		"port":   "^[0-9]+$",
-		"banner": ".*",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *TCPTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "banner",
+			Type:        TypeRegexp,
+			Pattern:     ".*",
+			Description: "A regular expression the banner must match.",
+		},
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Required:    true,
+			Description: "The port to connect to.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
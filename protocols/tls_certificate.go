@@ -0,0 +1,186 @@
+package protocols
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/skx/overseer/test"
+)
+
+// certificateArguments returns the arguments which make assertions about
+// the certificate a server presents.
+func certificateArguments() []Argument {
+	return []Argument{
+		{
+			Name:        "cert-fingerprint",
+			Type:        TypeString,
+			Pattern:     "^[0-9A-Fa-f:]+(,[0-9A-Fa-f:]+)*$",
+			Description: "The SHA-256 fingerprint(s) the certificate must have, comma-separated.",
+		},
+		{
+			Name:        "cert-issuer",
+			Type:        TypeRegexp,
+			Pattern:     ".*",
+			Description: "A regular expression the issuer of the certificate must match.",
+		},
+		{
+			Name:        "cert-key",
+			Type:        TypeString,
+			Pattern:     "^[A-Za-z0-9]+(-[0-9]+)?(,[A-Za-z0-9]+(-[0-9]+)?)*$",
+			Description: "The type and minimum size of the certificate's key, such as 'rsa-2048,ecdsa-256'.",
+		},
+		{
+			Name:        "cert-name",
+			Type:        TypeString,
+			Pattern:     "^[^ ]+$",
+			Repeatable:  true,
+			Description: "A hostname, or IP, the certificate must be valid for.",
+		},
+		{
+			Name:        "cert-signature",
+			Type:        TypeString,
+			Pattern:     "^[A-Za-z0-9-]+(,[A-Za-z0-9-]+)*$",
+			Description: "The signature algorithm(s) of the certificate, comma-separated, such as 'SHA256-RSA'.",
+		},
+	}
+}
+
+// checkCertificate tests the certificate presented by the given address
+// against any of the assertions above.
+//
+// The assertions are made against the certificate the server presented,
+// even if it wasn't verified because `with tls insecure` was given.
+func checkCertificate(tst test.Test, address string, state *tls.ConnectionState) error {
+
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no certificate was presented by %s", address)
+	}
+	cert := state.PeerCertificates[0]
+
+	//
+	// Is the certificate valid for the names we expect?
+	//
+	for _, name := range tst.Values("cert-name") {
+		if cert.VerifyHostname(name) != nil {
+			return fmt.Errorf("certificate presented by %s isn't valid for '%s', only for %s", address, name, strings.Join(certificateNames(cert), ", "))
+		}
+	}
+
+	//
+	// Was it issued by whom we expect?
+	//
+	if tst.Arguments["cert-issuer"] != "" {
+		re, err := regexp.Compile(tst.Arguments["cert-issuer"])
+		if err != nil {
+			return err
+		}
+		issuer := cert.Issuer.String()
+		if !re.MatchString(issuer) {
+			return fmt.Errorf("certificate presented by %s was issued by '%s', which didn't match the regular expression '%s'", address, issuer, tst.Arguments["cert-issuer"])
+		}
+	}
+
+	//
+	// Does it have the right kind of key?
+	//
+	if tst.Arguments["cert-key"] != "" {
+		kind, size := certificateKey(cert)
+
+		found := false
+		for _, want := range strings.Split(tst.Arguments["cert-key"], ",") {
+			min := 0
+			if i := strings.Index(want, "-"); i >= 0 {
+				min, _ = strconv.Atoi(want[i+1:])
+				want = want[:i]
+			}
+			if strings.EqualFold(kind, want) && size >= min {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("certificate presented by %s has the key %s-%d, not %s", address, kind, size, strings.Replace(tst.Arguments["cert-key"], ",", " or ", -1))
+		}
+	}
+
+	//
+	// Is it signed with the algorithm we expect?
+	//
+	if tst.Arguments["cert-signature"] != "" {
+		algorithm := cert.SignatureAlgorithm.String()
+
+		found := false
+		for _, want := range strings.Split(tst.Arguments["cert-signature"], ",") {
+			if strings.EqualFold(algorithm, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("certificate presented by %s is signed with %s, not %s", address, algorithm, strings.Replace(tst.Arguments["cert-signature"], ",", " or ", -1))
+		}
+	}
+
+	//
+	// Is it the very certificate we expect?
+	//
+	if tst.Arguments["cert-fingerprint"] != "" {
+		sum := sha256.Sum256(cert.Raw)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		found := false
+		for _, want := range strings.Split(tst.Arguments["cert-fingerprint"], ",") {
+			if strings.EqualFold(fingerprint, strings.Replace(want, ":", "", -1)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("certificate presented by %s has the fingerprint %s, not %s", address, fingerprint, strings.Replace(tst.Arguments["cert-fingerprint"], ",", " or ", -1))
+		}
+	}
+
+	return nil
+}
+
+// certificateNames returns the names, and addresses, a certificate is
+// valid for.
+func certificateNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// certificateKey returns the type of a certificate's key, such as "rsa",
+// and its size in bits.
+func certificateKey(cert *x509.Certificate) (string, int) {
+	kind := strings.ToLower(cert.PublicKeyAlgorithm.String())
+
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return kind, key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return kind, key.Curve.Params().BitSize
+	}
+
+	//
+	// Ed25519 keys are always 256 bits.
+	//
+	if kind == "ed25519" {
+		return kind, 256
+	}
+	return kind, 0
+}
@@ -0,0 +1,364 @@
+package protocols
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTLS starts a HTTPS server, quietly, with the certificate of the
+// httptest package, which is valid for example.com and 127.0.0.1.  It
+// returns a URL for the server using the given hostname, its address, and
+// the path of a CA certificate which verifies it.
+func serveTLS(t *testing.T, hostname string, handler http.Handler) (string, string, string) {
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, data, 0644); err != nil {
+		t.Fatalf("failed to write certificate: %s", err.Error())
+	}
+
+	target, address := rename(t, server.URL, hostname)
+	return target, address, ca
+}
+
+// authority is a private CA, which issues certificates for our servers.
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	path string
+}
+
+// newAuthority creates a CA which expires after the given duration, and
+// writes its certificate to a file.
+func newAuthority(t *testing.T, cn string, lifetime time.Duration) *authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err.Error())
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(lifetime),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatalf("failed to write certificate: %s", err.Error())
+	}
+	return &authority{cert: cert, key: key, path: path}
+}
+
+// issue returns a certificate for the given name, and 127.0.0.1, which
+// expires after the given duration.
+func (a *authority) issue(t *testing.T, name string, lifetime time.Duration) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err.Error())
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err.Error())
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveIssued starts a HTTPS server, quietly, with the given certificate,
+// and returns a URL for it using the given hostname, and its address.
+func serveIssued(t *testing.T, hostname string, cert tls.Certificate, handler http.Handler) (string, string) {
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return rename(t, server.URL, hostname)
+}
+
+// Test the assertions about the certificate presented by the server.
+func TestHTTPCertificate(t *testing.T) {
+	target, address, ca := serveTLS(t, "example.com", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	//
+	// The fingerprint of the server's certificate, which we find from
+	// the certificate file, in the usual form.
+	//
+	data, _ := ioutil.ReadFile(ca)
+	block, _ := pem.Decode(data)
+	sum := sha256.Sum256(block.Bytes)
+	var pairs []string
+	for _, b := range sum {
+		pairs = append(pairs, strings.ToUpper(hex.EncodeToString([]byte{b})))
+	}
+	fingerprint := strings.Join(pairs, ":")
+	plain := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		args map[string]string
+		err  string
+	}{
+		{map[string]string{}, ""},
+		{map[string]string{"cert-name": "example.com"}, ""},
+		{map[string]string{"cert-name": "example.com\n127.0.0.1"}, ""},
+		{map[string]string{"cert-name": "example.com\nwww.example.org"},
+			"certificate presented by 127.0.0.1 isn't valid for 'www.example.org', only for example.com, *.example.com, 127.0.0.1, ::1"},
+		{map[string]string{"cert-issuer": "O=Acme Co"}, ""},
+		{map[string]string{"cert-issuer": "Let's Encrypt"},
+			"certificate presented by 127.0.0.1 was issued by 'O=Acme Co', which didn't match the regular expression 'Let's Encrypt'"},
+		{map[string]string{"cert-key": "rsa-2048"}, ""},
+		{map[string]string{"cert-key": "ecdsa-256,RSA"}, ""},
+		{map[string]string{"cert-key": "rsa-4096,ecdsa-256"},
+			"certificate presented by 127.0.0.1 has the key rsa-2048, not rsa-4096 or ecdsa-256"},
+		{map[string]string{"cert-signature": "SHA256-RSA"}, ""},
+		{map[string]string{"cert-signature": "ECDSA-SHA256"},
+			"certificate presented by 127.0.0.1 is signed with SHA256-RSA, not ECDSA-SHA256"},
+		{map[string]string{"cert-fingerprint": fingerprint}, ""},
+		{map[string]string{"cert-fingerprint": "00:11," + plain}, ""},
+		{map[string]string{"cert-fingerprint": "00:11,22:33"},
+			"certificate presented by 127.0.0.1 has the fingerprint " + plain + ", not 00:11 or 22:33"},
+	}
+
+	for _, tc := range tests {
+		tc.args["ca"] = ca
+		_, err := runHTTP(httpTest(target, tc.args), address)
+
+		if tc.err == "" && err != nil {
+			t.Errorf("%v: unexpected error: %s", tc.args, err.Error())
+		}
+		if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.err, err)
+		}
+	}
+
+	//
+	// Without the CA the certificate isn't trusted, unless we're told
+	// not to care, but it may still be tested.
+	//
+	_, err := runHTTP(httpTest(target, nil), address)
+	if err == nil || !strings.Contains(err.Error(), "x509: certificate signed by unknown authority") {
+		t.Errorf("expected the certificate to be untrusted, got %v", err)
+	}
+	_, err = runHTTP(httpTest(target, map[string]string{"tls": "insecure", "cert-fingerprint": fingerprint}), address)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
+
+// Test the expiration of the certificate.
+func TestHTTPCertificateExpiration(t *testing.T) {
+	target, address, ca := serveTLS(t, "example.com", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	tests := []struct {
+		args map[string]string
+		err  string
+	}{
+		{map[string]string{}, ""},
+		{map[string]string{"expiration": "7d"}, ""},
+		{map[string]string{"expiration": "100000d"}, "SSL certificate '' presented by 127.0.0.1 will expire in "},
+		{map[string]string{"expiration": "1000000h"}, "SSL certificate '' presented by 127.0.0.1 will expire in "},
+		{map[string]string{"expiration": "any"}, ""},
+		{map[string]string{"expiration": "100000d", "tls": "insecure"}, ""},
+	}
+
+	for _, tc := range tests {
+		tc.args["ca"] = ca
+		_, err := runHTTP(httpTest(target, tc.args), address)
+
+		if tc.err == "" && err != nil {
+			t.Errorf("%v: unexpected error: %s", tc.args, err.Error())
+		}
+		if tc.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.err) || !strings.HasSuffix(err.Error(), " days)")) {
+			t.Errorf("%v: expected error %q..., got %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+// Test that the certificate which is checked is the one presented by the
+// address being tested, rather than by the host of the test, or of any
+// redirection.
+func TestHTTPCertificatePinned(t *testing.T) {
+
+	//
+	// Another server, which has an ECDSA certificate, unlike ours.
+	//
+	cert, key := writeCertificate(t, t.TempDir())
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err.Error())
+	}
+	other := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	other.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	other.StartTLS()
+	defer other.Close()
+
+	//
+	// Our hostname can't be resolved, so the certificate must come from
+	// the connection to the address.
+	//
+	target, address, _ := serveTLS(t, "pinned.invalid", http.RedirectHandler(other.URL+"/", http.StatusFound))
+
+	args := map[string]string{"tls": "insecure", "cert-name": "example.com", "cert-key": "rsa-2048", "status": "302"}
+	_, err = runHTTP(httpTest(target, args), address)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	//
+	// Following the redirection to the other server we still check
+	// our certificate, rather than the last one.
+	//
+	args = map[string]string{"tls": "insecure", "cert-key": "rsa-2048", "follow-redirects": "1"}
+	_, err = runHTTP(httpTest(target, args), address)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	//
+	// But the other server is checked if it is the one being tested.
+	//
+	_, err = runHTTP(httpTest(other.URL+"/", args), "127.0.0.1")
+	if err == nil || err.Error() != "certificate presented by 127.0.0.1 has the key ecdsa-256, not rsa-2048" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// Test the expiration of a chain issued by a private CA, which is trusted
+// via the ca argument.  The certificate which expires soonest, whether the
+// server's or the CA's, is the one reported.
+func TestHTTPCertificateChainExpiration(t *testing.T) {
+	empty := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	//
+	// The server's certificate expires first.
+	//
+	ca := newAuthority(t, "Overseer Test Root", 365*24*time.Hour)
+	target, address := serveIssued(t, "example.com", ca.issue(t, "example.com", 10*24*time.Hour+30*time.Minute), empty)
+
+	tests := []struct {
+		args map[string]string
+		err  string
+	}{
+		{map[string]string{"expiration": "7d"}, ""},
+		{map[string]string{"expiration": "240h"}, ""},
+		{map[string]string{}, "SSL certificate 'example.com' presented by 127.0.0.1 will expire in 240 hours (10 days)"},
+		{map[string]string{"expiration": "241h"}, "SSL certificate 'example.com' presented by 127.0.0.1 will expire in 240 hours (10 days)"},
+	}
+
+	for _, tc := range tests {
+		tc.args["ca"] = ca.path
+		_, err := runHTTP(httpTest(target, tc.args), address)
+
+		if tc.err == "" && err != nil {
+			t.Errorf("%v: unexpected error: %s", tc.args, err.Error())
+		}
+		if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.err, err)
+		}
+	}
+
+	//
+	// The CA expires first.
+	//
+	short := newAuthority(t, "Overseer Short Root", 5*24*time.Hour+30*time.Minute)
+	target, address = serveIssued(t, "example.com", short.issue(t, "example.com", 30*24*time.Hour), empty)
+
+	_, err := runHTTP(httpTest(target, map[string]string{"ca": short.path, "expiration": "6d"}), address)
+	if err == nil || err.Error() != "SSL certificate 'Overseer Short Root' presented by 127.0.0.1 will expire in 120 hours (5 days)" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	//
+	// Without the CA the chain isn't trusted.
+	//
+	_, err = runHTTP(httpTest(target, map[string]string{"ca": ca.path}), address)
+	if err == nil || !strings.Contains(err.Error(), "x509: certificate signed by unknown authority") {
+		t.Errorf("expected the certificate to be untrusted, got %v", err)
+	}
+}
+
+// Test that following a redirection to a different host, whose chain is
+// also verified, the expiration which is checked is still that of the
+// address being tested.
+func TestHTTPCertificatePinnedExpiration(t *testing.T) {
+	ca := newAuthority(t, "Overseer Test Root", 365*24*time.Hour)
+	empty := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	//
+	// localhost is resolved by the probe, as it isn't the host being
+	// tested.  One certificate is about to expire, the other isn't.
+	//
+	soon, _ := serveIssued(t, "localhost", ca.issue(t, "localhost", 2*24*time.Hour), empty)
+	later, _ := serveIssued(t, "localhost", ca.issue(t, "localhost", 90*24*time.Hour), empty)
+
+	tests := []struct {
+		redirect string
+		err      string
+	}{
+		{soon, ""},
+		{later, "SSL certificate 'example.com' presented by 127.0.0.1 will expire in "},
+	}
+
+	for _, tc := range tests {
+
+		//
+		// The server we test is the opposite of the one it
+		// redirects to.
+		//
+		lifetime := 90 * 24 * time.Hour
+		if tc.err != "" {
+			lifetime = 3 * 24 * time.Hour
+		}
+		target, address := serveIssued(t, "example.com", ca.issue(t, "example.com", lifetime), http.RedirectHandler(tc.redirect, http.StatusFound))
+
+		args := map[string]string{"ca": ca.path, "follow-redirects": "1", "expiration": "14d"}
+		_, err := runHTTP(httpTest(target, args), address)
+
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.redirect, err.Error())
+		}
+		if tc.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.err)) {
+			t.Errorf("%s: expected error %q..., got %v", tc.redirect, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package protocols
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/skx/overseer/test"
+)
+
+// tlsArguments returns the arguments which configure TLS, which are shared
+// by each protocol-test which uses it.
+func tlsArguments() []Argument {
+	return []Argument{
+		{
+			Name:        "ca",
+			Type:        TypeString,
+			Pattern:     ".+",
+			Description: "The CA certificate(s) used to verify the server, rather than the system's.",
+		},
+		{
+			Name:        "client-cert",
+			Type:        TypeString,
+			Pattern:     ".+",
+			Description: "The client certificate to present, for mutual TLS.",
+		},
+		{
+			Name:        "client-key",
+			Type:        TypeString,
+			Pattern:     ".+",
+			Description: "The key for the client certificate.",
+		},
+		{
+			Name:        "tls",
+			Type:        TypeEnum,
+			Values:      []string{"insecure"},
+			Description: "Disable validation of the TLS certificate.",
+		},
+	}
+}
+
+// tlsConfig returns the TLS configuration for a test, which verifies the
+// certificate of the named server unless `with tls insecure` was given.
+//
+// The certificates are read when the test is run, so the paths refer to
+// files upon the worker.
+func tlsConfig(tst test.Test, serverName string) (*tls.Config, error) {
+
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: tst.Arguments["tls"] == "insecure",
+	}
+
+	//
+	// Verify the server via a private CA?
+	//
+	if ca := tst.Arguments["ca"]; ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate %s - %s", ca, err.Error())
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+	}
+
+	//
+	// Present a client certificate?
+	//
+	cert, key := tst.Arguments["client-cert"], tst.Arguments["client-key"]
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, fmt.Errorf("a client certificate requires both client-cert and client-key")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate - %s", err.Error())
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	return cfg, nil
+}
+
+// tlsUsage describes the arguments which configure TLS, for the Example()
+// of a protocol-test, using the given input.
+func tlsUsage(input string) string {
+	return fmt.Sprintf(` If the server uses a private CA you may give its certificate instead,
+ and if it requires a client certificate you may give that too:
+
+    %s with ca /etc/ssl/ca.pem with client-cert /etc/ssl/client.pem with client-key /etc/ssl/client.key
+
+ (The files are read by the worker which runs the test.)
+`, input)
+}
@@ -0,0 +1,158 @@
+package protocols
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skx/overseer/test"
+)
+
+// writeCertificate writes a self-signed certificate, and its key, to the
+// given directory, returning their paths.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err.Error())
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Overseer Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err.Error())
+	}
+	priv, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err.Error())
+	}
+
+	cert := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: priv}), 0600)
+	}
+	if err != nil {
+		t.Fatalf("failed to write certificate: %s", err.Error())
+	}
+	return cert, keyFile
+}
+
+// Test the defaults, and disabling verification.
+func TestTLSConfigDefault(t *testing.T) {
+	cfg, err := tlsConfig(test.Test{}, "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if cfg.ServerName != "example.com" || cfg.InsecureSkipVerify || cfg.RootCAs != nil || len(cfg.Certificates) != 0 {
+		t.Errorf("unexpected configuration %v", cfg)
+	}
+
+	cfg, err = tlsConfig(test.Test{Arguments: map[string]string{"tls": "insecure"}}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !cfg.InsecureSkipVerify {
+		t.Errorf("verification wasn't disabled")
+	}
+}
+
+// Test that a CA certificate is used to verify the server.
+func TestTLSConfigCA(t *testing.T) {
+	dir := t.TempDir()
+	cert, _ := writeCertificate(t, dir)
+
+	cfg, err := tlsConfig(test.Test{Arguments: map[string]string{"ca": cert}}, "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if cfg.RootCAs == nil {
+		t.Fatalf("the CA wasn't loaded")
+	}
+
+	data, _ := ioutil.ReadFile(cert)
+	block, _ := pem.Decode(data)
+	parsed, _ := x509.ParseCertificate(block.Bytes)
+	_, err = parsed.Verify(x509.VerifyOptions{Roots: cfg.RootCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		t.Errorf("the certificate wasn't trusted: %s", err.Error())
+	}
+
+	//
+	// A file without any certificates.
+	//
+	empty := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(empty, []byte("not a certificate\n"), 0644)
+
+	_, err = tlsConfig(test.Test{Arguments: map[string]string{"ca": empty}}, "")
+	if err == nil || err.Error() != "no certificates found in "+empty {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	//
+	// A file which can't be read.
+	//
+	missing := filepath.Join(dir, "missing.pem")
+	_, err = tlsConfig(test.Test{Arguments: map[string]string{"ca": missing}}, "")
+	if err == nil || !strings.HasPrefix(err.Error(), "failed to read CA certificate "+missing+" - ") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// Test that a client certificate is presented.
+func TestTLSConfigClientCert(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCertificate(t, dir)
+
+	cfg, err := tlsConfig(test.Test{Arguments: map[string]string{"client-cert": cert, "client-key": key}}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(cfg.Certificates) != 1 || len(cfg.Certificates[0].Certificate) != 1 {
+		t.Errorf("the client certificate wasn't loaded")
+	}
+
+	tests := []struct {
+		args map[string]string
+		err  string
+	}{
+		{map[string]string{"client-cert": cert}, "a client certificate requires both client-cert and client-key"},
+		{map[string]string{"client-key": key}, "a client certificate requires both client-cert and client-key"},
+		{map[string]string{"client-cert": filepath.Join(dir, "missing.pem"), "client-key": key}, "failed to load client certificate - open "},
+		{map[string]string{"client-cert": cert, "client-key": cert}, "failed to load client certificate - tls: "},
+	}
+	for _, tc := range tests {
+		_, err := tlsConfig(test.Test{Arguments: tc.args}, "")
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+// Test that the protocol-tests which use TLS describe its arguments.
+func TestTLSUsage(t *testing.T) {
+	for _, name := range []string{"http", "imaps", "pop3s", "smtp"} {
+		example := ProtocolHandler(name).Example()
+		if strings.Count(example, " must run "+name+" with ca /etc/ssl/ca.pem") != 1 {
+			t.Errorf("the %s tester doesn't describe the TLS arguments:\n%s", name, example)
+		}
+	}
+}
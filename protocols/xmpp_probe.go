@@ -28,10 +28,20 @@ type XMPPTest struct {
 // understands, along with corresponding regular-expressions to validate
 // their values.
 func (s *XMPPTest) Arguments() map[string]string {
-	known := map[string]string{
-		"port": "^[0-9]+$",
+	return ArgumentPatterns(s.Schema())
+}
+
+// Schema describes the arguments which this protocol-test understands.
+func (s *XMPPTest) Schema() []Argument {
+	return []Argument{
+		{
+			Name:        "port",
+			Type:        TypeInt,
+			Pattern:     "^[0-9]+$",
+			Default:     "5222",
+			Description: "The port to connect to.",
+		},
 	}
-	return known
 }
 
 // Example returns sample usage-instructions for self-documentation purposes.
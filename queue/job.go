@@ -0,0 +1,178 @@
+// Package queue contains the details of the jobs which are stored in
+// the central redis queue, by `overseer enqueue`, to be executed by
+// `overseer worker`.
+//
+// Historically each job was the bare input-line of a test, now jobs
+// are stored as a JSON envelope containing the test along with some
+// metadata.  Bare input-lines are still accepted for compatibility.
+package queue
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/skx/overseer/test"
+)
+
+// JobsKey is the name of the redis list which holds pending jobs of
+// normal priority.
+//
+// Jobs of other priorities are held in lists with the priority appended
+// to this name, see `Key`.
+const JobsKey = "overseer.jobs"
+
+// PendingKey is the name of the redis hash which holds the IDs of the
+// tests which are waiting in the queue, along with the time they were
+// enqueued.
+const PendingKey = "overseer.jobs.pending"
+
+// FullKey is the name of the redis key which is set while the queue is
+// full, so that `overseer enqueue` reports the queue filling, and then
+// draining, once rather than upon every run.
+const FullKey = "overseer.jobs.full"
+
+// ExpiredKey is the name of the redis counter which records the number
+// of jobs which were discarded because they had expired.
+const ExpiredKey = "overseer.jobs.expired"
+
+// The priorities which jobs may have.
+const (
+	// PriorityHigh is for jobs which should be executed first.
+	PriorityHigh = "high"
+
+	// PriorityNormal is the priority given to jobs by default.
+	PriorityNormal = "normal"
+
+	// PriorityLow is for jobs which should be executed last.
+	PriorityLow = "low"
+)
+
+// Priorities contains the known priorities, highest first.
+var Priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ValidPriority returns true if the given priority is known.
+func ValidPriority(priority string) bool {
+	for _, p := range Priorities {
+		if p == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the name of the redis list which holds jobs of the
+// given priority.
+//
+// Jobs of normal, or unknown, priority are stored in `overseer.jobs`,
+// as they always have been.
+func Key(priority string) string {
+	if priority == PriorityNormal || !ValidPriority(priority) {
+		return JobsKey
+	}
+	return JobsKey + "." + priority
+}
+
+// Keys returns the names of the redis lists which hold jobs, highest
+// priority first.
+func Keys() []string {
+	var keys []string
+	for _, p := range Priorities {
+		keys = append(keys, Key(p))
+	}
+	return keys
+}
+
+// Job is the envelope in which a single test is stored in the queue.
+type Job struct {
+	// Input contains the test to be executed, as read by the parser.
+	Input string `json:"input"`
+
+	// ID is the stable identifier of the test.
+	ID string `json:"id,omitempty"`
+
+	// Priority is the priority of the job.
+	Priority string `json:"priority,omitempty"`
+
+	// Source is the file the test was read from.
+	Source string `json:"source,omitempty"`
+
+	// Line is the line of the file the test was read from.
+	Line int `json:"line,omitempty"`
+
+	// Enqueued is the time the job was enqueued, in seconds past
+	// the epoch.
+	Enqueued int64 `json:"enqueued,omitempty"`
+
+	// TTL is the number of seconds after which the job is regarded
+	// as being stale, and should not be executed.
+	//
+	// Zero means the job never expires.
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// New creates a new job to execute the given test, which will expire
+// after the given period.
+func New(tst test.Test, ttl time.Duration) Job {
+	priority := tst.Priority
+	if priority == "" {
+		priority = PriorityNormal
+	}
+
+	return Job{
+		Input:    tst.Input,
+		ID:       tst.ID(),
+		Priority: priority,
+		Source:   tst.Source,
+		Line:     tst.Line,
+		Enqueued: time.Now().Unix(),
+		TTL:      int64(ttl / time.Second),
+	}
+}
+
+// Decode converts the value retrieved from the queue into a job.
+//
+// Values which are not JSON objects are regarded as being bare
+// input-lines, as were enqueued by older releases.
+func Decode(raw string) (Job, error) {
+	var job Job
+
+	if !strings.HasPrefix(strings.TrimSpace(raw), "{") {
+		job.Input = raw
+		job.Priority = PriorityNormal
+		return job, nil
+	}
+
+	err := json.Unmarshal([]byte(raw), &job)
+	if job.Priority == "" {
+		job.Priority = PriorityNormal
+	}
+	return job, err
+}
+
+// Encode converts the job into the form stored in the queue.
+func (j Job) Encode() (string, error) {
+	out, err := json.Marshal(j)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Age returns the length of time since the job was enqueued.
+//
+// Jobs with no enqueue-time, i.e. bare input-lines, have no age.
+func (j Job) Age(now time.Time) time.Duration {
+	if j.Enqueued == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(j.Enqueued, 0))
+}
+
+// Expired returns true if the job has a TTL and is older than it.
+func (j Job) Expired(now time.Time) bool {
+	if j.TTL <= 0 || j.Enqueued == 0 {
+		return false
+	}
+	return j.Age(now) > time.Duration(j.TTL)*time.Second
+}
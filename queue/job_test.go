@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skx/overseer/test"
+)
+
+// Test that jobs survive being encoded and decoded.
+func TestRoundTrip(t *testing.T) {
+
+	tst := test.Test{
+		Input:  "example.com must run ssh",
+		Source: "hosts.conf",
+		Line:   17,
+	}
+
+	job := New(tst, time.Minute)
+
+	raw, err := job.Encode()
+	if err != nil {
+		t.Fatalf("Error encoding job: %s", err.Error())
+	}
+
+	out, err := Decode(raw)
+	if err != nil {
+		t.Fatalf("Error decoding job: %s", err.Error())
+	}
+
+	if out != job {
+		t.Errorf("Decoded job differed: %v != %v", out, job)
+	}
+	if out.ID == "" {
+		t.Errorf("Job had no ID")
+	}
+	if out.Priority != PriorityNormal {
+		t.Errorf("Job had the wrong priority: %s", out.Priority)
+	}
+}
+
+// Test that bare input-lines are still accepted.
+func TestDecodeRaw(t *testing.T) {
+
+	job, err := Decode("example.com must run ssh")
+	if err != nil {
+		t.Fatalf("Error decoding bare job: %s", err.Error())
+	}
+	if job.Input != "example.com must run ssh" {
+		t.Errorf("Wrong input: %s", job.Input)
+	}
+	if job.Expired(time.Now()) {
+		t.Errorf("Bare jobs should never expire")
+	}
+
+	_, err = Decode("{not json")
+	if err == nil {
+		t.Errorf("Expected an error decoding bogus JSON")
+	}
+}
+
+// Test expiry.
+func TestExpired(t *testing.T) {
+
+	now := time.Now()
+
+	job := Job{Input: "x", Enqueued: now.Add(-2 * time.Minute).Unix(), TTL: 60}
+	if !job.Expired(now) {
+		t.Errorf("Job should have expired")
+	}
+
+	job.TTL = 600
+	if job.Expired(now) {
+		t.Errorf("Job should not have expired")
+	}
+
+	job.TTL = 0
+	if job.Expired(now) {
+		t.Errorf("Job without a TTL should never expire")
+	}
+}
@@ -0,0 +1,137 @@
+package queue
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// StreamKey is the name of the redis stream which holds test-results,
+// when they're published to a stream.
+const StreamKey = "overseer.results.stream"
+
+// DeadLetterKey is the name of the redis list to which bridges move the
+// test-results which they can't process, such as those which are not
+// valid JSON, or which have failed too many times.
+const DeadLetterKey = "overseer.results.dead"
+
+// The ways in which test-results may be published.
+const (
+	// ResultsList publishes each result to the ResultsKey list,
+	// from which a single consumer may pop it.
+	ResultsList = "list"
+
+	// ResultsStream publishes each result to the StreamKey stream,
+	// which each consumer-group reads independently.
+	ResultsStream = "stream"
+
+	// ResultsBoth publishes each result to both the list and the
+	// stream, which is useful when migrating from one to the other.
+	ResultsBoth = "both"
+)
+
+// ResultsOptions holds the details of how test-results are published.
+type ResultsOptions struct {
+
+	// Mode is one of ResultsList, ResultsStream, or ResultsBoth.
+	Mode string `yaml:"mode"`
+
+	// MaxLen is the (approximate) number of entries the stream is
+	// trimmed to as results are added, zero to disable.
+	MaxLen int64 `yaml:"max-len"`
+
+	// MaxAge is the age beyond which entries are trimmed from the
+	// stream as results are added, zero to disable.
+	//
+	// This requires Redis 6.2, or later.
+	MaxAge time.Duration `yaml:"max-age"`
+}
+
+// DefaultResults returns the default options, which publish results to
+// the list, as older bridges expect.
+func DefaultResults() ResultsOptions {
+	return ResultsOptions{
+		Mode:   ResultsList,
+		MaxLen: 100000,
+	}
+}
+
+// SetFlags registers the command-line flags which populate our options,
+// using the given values as the defaults.
+func (o *ResultsOptions) SetFlags(f *flag.FlagSet, defaults ResultsOptions) {
+	f.StringVar(&o.Mode, "results", defaults.Mode, "Publish test-results to a redis 'list', 'stream', or 'both'.")
+	f.Int64Var(&o.MaxLen, "results-max-len", defaults.MaxLen, "Trim the results stream to approximately this many entries, zero to disable.")
+	f.DurationVar(&o.MaxAge, "results-max-age", defaults.MaxAge, "Trim entries older than this from the results stream, zero to disable.")
+}
+
+// Validate ensures the options are valid.
+func (o ResultsOptions) Validate() error {
+	switch o.Mode {
+	case ResultsList, ResultsStream, ResultsBoth:
+	default:
+		return fmt.Errorf("unknown results mode '%s', expected list, stream, or both", o.Mode)
+	}
+	if o.MaxLen < 0 {
+		return fmt.Errorf("max-len cannot be negative")
+	}
+	if o.MaxAge < 0 {
+		return fmt.Errorf("max-age cannot be negative")
+	}
+	return nil
+}
+
+// Publish adds a test-result to the list, the stream, or both.
+//
+// In the list the result is stored as a JSON object, in the stream
+// each of its keys becomes a field of the entry.
+func (o ResultsOptions) Publish(client redis.UniversalClient, msg map[string]string) error {
+
+	if o.Mode != ResultsStream {
+		j, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		_, err = client.RPush(ResultsKey, j).Result()
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.Mode == ResultsList {
+		return nil
+	}
+
+	values := make(map[string]interface{}, len(msg))
+	for k, v := range msg {
+		values[k] = v
+	}
+
+	_, err := client.XAdd(&redis.XAddArgs{
+		Stream:       StreamKey,
+		MaxLenApprox: o.MaxLen,
+		Values:       values,
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	//
+	// The redis library predates XTRIM MINID, so we build the
+	// command ourselves.
+	//
+	if o.MaxAge > 0 {
+		cmd := redis.NewIntCmd("xtrim", StreamKey, "minid", "~", MinID(time.Now().Add(-o.MaxAge)))
+		client.Process(cmd)
+		return cmd.Err()
+	}
+	return nil
+}
+
+// MinID returns the lowest ID of the entries which a stream will contain
+// if everything added before the given time is removed.
+func MinID(t time.Time) string {
+	return fmt.Sprintf("%d-0", t.UnixNano()/int64(time.Millisecond))
+}
@@ -0,0 +1,53 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+// Test that the results options are validated.
+func TestResultsValidate(t *testing.T) {
+
+	valid := []ResultsOptions{
+		DefaultResults(),
+		{Mode: ResultsStream},
+		{Mode: ResultsBoth, MaxLen: 10, MaxAge: time.Hour},
+	}
+	for _, o := range valid {
+		if err := o.Validate(); err != nil {
+			t.Errorf("Unexpected error for %v: %s", o, err.Error())
+		}
+	}
+
+	invalid := []ResultsOptions{
+		{Mode: ""},
+		{Mode: "queue"},
+		{Mode: ResultsStream, MaxLen: -1},
+		{Mode: ResultsStream, MaxAge: -time.Second},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Errorf("Expected an error for %v", o)
+		}
+	}
+}
+
+// Test the generation of stream IDs.
+func TestIDs(t *testing.T) {
+
+	when := time.Unix(1600000000, 123000000)
+	if id := MinID(when); id != "1600000000123-0" {
+		t.Errorf("Wrong minimum ID: %s", id)
+	}
+
+	tests := map[string]string{
+		"1600000000123-0": "1600000000123-1",
+		"5-41":            "5-42",
+		"bogus":           "bogus",
+	}
+	for in, expected := range tests {
+		if out := NextID(in); out != expected {
+			t.Errorf("NextID(%s) gave %s, not %s", in, out, expected)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package queue
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Result is a test-result read from the results stream.
+type Result struct {
+
+	// ID is the ID of the stream entry, which is used to acknowledge it.
+	ID string
+
+	// Values are the fields of the result, such as "type" and "error".
+	Values map[string]string
+
+	// Deliveries is the number of times the result has been delivered
+	// to a member of the consumer group, including this one.
+	Deliveries int64
+}
+
+// JSON returns the result as a JSON object, the same form in which it
+// is stored in the results list.
+func (r Result) JSON() []byte {
+	j, _ := json.Marshal(r.Values)
+	return j
+}
+
+// Consumer reads test-results from the results stream, as a member of
+// a consumer group.
+//
+// Each consumer group sees every result, so several bridges may each
+// process all results by using different groups.  Several instances of
+// the same bridge may share the load by using the same group, with
+// different consumer names.
+//
+// Results must be acknowledged, via Ack, once processed.  Results which
+// are not are delivered again:
+//
+//   - To the same consumer, when it is restarted.
+//   - To any consumer in the group, once they've been pending for
+//     longer than ClaimIdle.  This recovers results read by a consumer
+//     which has died, and retries those which failed.
+type Consumer struct {
+
+	// Client is the connection to redis.
+	Client redis.UniversalClient
+
+	// Group is the name of the consumer group.
+	Group string
+
+	// Name is the name of this consumer, which must be unique within
+	// the group.
+	Name string
+
+	// ClaimIdle is how long a result may be pending before another
+	// consumer claims it.
+	ClaimIdle time.Duration
+
+	// Count is the maximum number of results to read at once.
+	Count int64
+
+	// recovered is set once we've read our own pending results, and
+	// recoverFrom is the ID from which we continue reading them.
+	recovered   bool
+	recoverFrom string
+
+	// claimed is the last time we looked for idle results to claim.
+	claimed time.Time
+}
+
+// ConsumerOptions holds the settings of a bridge which may read from
+// the results stream, rather than the results list.
+type ConsumerOptions struct {
+
+	// Stream is true if results are read from the stream.
+	Stream bool
+
+	// Group and Name are the names of the consumer group, and the
+	// consumer within it.
+	Group string
+	Name  string
+
+	// ClaimIdle is how long a result may be pending before it is
+	// claimed by another consumer.
+	ClaimIdle time.Duration
+}
+
+// SetFlags registers the command-line flags which populate our options.
+//
+// The group defaults to the name of the bridge, so that each bridge
+// sees every result, and the results are read from the stream if they
+// are being published to it.
+func (o *ConsumerOptions) SetFlags(f *flag.FlagSet, bridge string, results ResultsOptions) {
+	host, _ := os.Hostname()
+
+	f.BoolVar(&o.Stream, "stream", results.Mode != ResultsList, "Read test-results from the redis stream, rather than the list.")
+	f.StringVar(&o.Group, "group", bridge, "The consumer group to read the stream as.")
+	f.StringVar(&o.Name, "consumer", host, "The name of this consumer within the group, which must be unique.")
+	f.DurationVar(&o.ClaimIdle, "claim-idle", 5*time.Minute, "Claim results which have been pending, unacknowledged, for this long.")
+}
+
+// Consumer creates a consumer from our options, creating the consumer
+// group if necessary.
+func (o ConsumerOptions) Consumer(client redis.UniversalClient) (*Consumer, error) {
+	if o.Group == "" || o.Name == "" {
+		return nil, fmt.Errorf("the consumer group and name must be set")
+	}
+
+	c := &Consumer{
+		Client:    client,
+		Group:     o.Group,
+		Name:      o.Name,
+		ClaimIdle: o.ClaimIdle,
+	}
+	return c, c.Setup()
+}
+
+// Setup creates our consumer group, if it doesn't already exist.
+//
+// A new group begins with the results added after it is created.
+func (c *Consumer) Setup() error {
+	err := c.Client.XGroupCreateMkStream(StreamKey, c.Group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group %s - %s", c.Group, err.Error())
+	}
+	return nil
+}
+
+// Read returns the next results to process, waiting up to the given
+// duration for new results to arrive.
+//
+// If no results are available then an empty slice is returned.
+func (c *Consumer) Read(block time.Duration) ([]Result, error) {
+
+	count := c.Count
+	if count <= 0 {
+		count = 10
+	}
+
+	//
+	// When we start we process anything we read, but didn't
+	// acknowledge, before we were stopped.
+	//
+	for !c.recovered {
+		res, n, err := c.claim(count, 0, true)
+		if err != nil {
+			return nil, err
+		}
+		if n < count {
+			c.recovered = true
+		}
+		if len(res) > 0 {
+			return res, nil
+		}
+	}
+
+	//
+	// Periodically claim results which another consumer has been
+	// sitting on, or which we failed to process.
+	//
+	if c.ClaimIdle > 0 && time.Since(c.claimed) >= c.ClaimIdle {
+		res, _, err := c.claim(count, c.ClaimIdle, false)
+		if err != nil || len(res) > 0 {
+			return res, err
+		}
+		c.claimed = time.Now()
+	}
+
+	streams, err := c.Client.XReadGroup(&redis.XReadGroupArgs{
+		Group:    c.Group,
+		Consumer: c.Name,
+		Streams:  []string{StreamKey, ">"},
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Result
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			res = append(res, Result{
+				ID:         msg.ID,
+				Values:     values(msg.Values),
+				Deliveries: 1,
+			})
+		}
+	}
+	return res, nil
+}
+
+// claim takes ownership of pending results, either our own or those
+// which have been idle for the given time.
+//
+// The number of pending results which were examined is returned too.
+func (c *Consumer) claim(count int64, idle time.Duration, own bool) ([]Result, int64, error) {
+
+	args := &redis.XPendingExtArgs{
+		Stream: StreamKey,
+		Group:  c.Group,
+		Start:  "-",
+		End:    "+",
+		Count:  count,
+	}
+
+	//
+	// Our own results are read once, in order, so that any we fail
+	// to process aren't returned again immediately.
+	//
+	if own {
+		args.Consumer = c.Name
+		if c.recoverFrom != "" {
+			args.Start = c.recoverFrom
+		}
+	}
+
+	pending, err := c.Client.XPendingExt(args).Result()
+	if err == redis.Nil {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var res []Result
+	for _, p := range pending {
+		if own {
+			c.recoverFrom = NextID(p.Id)
+		}
+		if p.Idle < idle {
+			continue
+		}
+
+		//
+		// If another consumer claimed the result first then we
+		// get nothing back.
+		//
+		ids, err := c.Client.XClaimJustID(&redis.XClaimArgs{
+			Stream:   StreamKey,
+			Group:    c.Group,
+			Consumer: c.Name,
+			MinIdle:  idle,
+			Messages: []string{p.Id},
+		}).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		//
+		// If the result has been trimmed from the stream then
+		// there's nothing to process, so drop it.
+		//
+		msgs, err := c.Client.XRangeN(StreamKey, p.Id, p.Id, 1).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(msgs) == 0 {
+			c.Ack(p.Id)
+			continue
+		}
+
+		res = append(res, Result{
+			ID:         p.Id,
+			Values:     values(msgs[0].Values),
+			Deliveries: p.RetryCount + 1,
+		})
+	}
+	return res, int64(len(pending)), nil
+}
+
+// Ack acknowledges that a result has been processed, so that it won't be
+// delivered again.
+func (c *Consumer) Ack(id string) error {
+	return c.Client.XAck(StreamKey, c.Group, id).Err()
+}
+
+// NextID returns the stream ID which follows the given one.
+func NextID(id string) string {
+	var ms, seq uint64
+	_, err := fmt.Sscanf(id, "%d-%d", &ms, &seq)
+	if err != nil {
+		return id
+	}
+	return fmt.Sprintf("%d-%d", ms, seq+1)
+}
+
+// values converts the fields of a stream entry to strings.
+func values(in map[string]interface{}) map[string]string {
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		out[k] = fmt.Sprintf("%v", v)
+	}
+	return out
+}
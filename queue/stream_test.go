@@ -0,0 +1,262 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// setup returns a redis client, and the server it is connected to, with
+// the clock of the server fixed at the current time.
+func setup(t *testing.T) (redis.UniversalClient, *miniredis.Miniredis) {
+	m := miniredis.RunT(t)
+	m.SetTime(time.Now())
+	return redis.NewClient(&redis.Options{Addr: m.Addr()}), m
+}
+
+// consumer returns a member of the given group, which has been set up.
+func consumer(t *testing.T, client redis.UniversalClient, group, name string) *Consumer {
+	c, err := ConsumerOptions{Group: group, Name: name, ClaimIdle: time.Minute}.Consumer(client)
+	if err != nil {
+		t.Fatalf("failed to create consumer: %s", err.Error())
+	}
+	return c
+}
+
+// publish adds the given number of results to the stream.
+func publish(t *testing.T, client redis.UniversalClient, o ResultsOptions, count int) {
+	for i := 0; i < count; i++ {
+		err := o.Publish(client, map[string]string{"input": fmt.Sprintf("test %d", i)})
+		if err != nil {
+			t.Fatalf("failed to publish: %s", err.Error())
+		}
+	}
+}
+
+// read reads from a consumer, without blocking, and returns the inputs
+// of the results, along with the results themselves.
+func read(t *testing.T, c *Consumer) ([]string, []Result) {
+	res, err := c.Read(-1)
+	if err != nil {
+		t.Fatalf("failed to read: %s", err.Error())
+	}
+	var inputs []string
+	for _, r := range res {
+		inputs = append(inputs, r.Values["input"])
+	}
+	return inputs, res
+}
+
+// Test that each group sees every result, once.
+func TestConsumerGroups(t *testing.T) {
+	client, _ := setup(t)
+
+	a := consumer(t, client, "email", "host1")
+	b := consumer(t, client, "webhook", "host1")
+
+	publish(t, client, ResultsOptions{Mode: ResultsStream}, 3)
+
+	for _, c := range []*Consumer{a, b} {
+		inputs, res := read(t, c)
+		if fmt.Sprintf("%v", inputs) != "[test 0 test 1 test 2]" {
+			t.Errorf("group %s read %v", c.Group, inputs)
+		}
+		for _, r := range res {
+			if r.Deliveries != 1 {
+				t.Errorf("result %s was delivered %d times", r.ID, r.Deliveries)
+			}
+			c.Ack(r.ID)
+		}
+
+		inputs, _ = read(t, c)
+		if len(inputs) != 0 {
+			t.Errorf("group %s read %v again", c.Group, inputs)
+		}
+	}
+}
+
+// Test that a consumer which is restarted processes the results it read,
+// but didn't acknowledge, before anything new.
+func TestConsumerRestart(t *testing.T) {
+	client, _ := setup(t)
+
+	c := consumer(t, client, "email", "host1")
+	publish(t, client, ResultsOptions{Mode: ResultsStream}, 5)
+
+	_, res := read(t, c)
+	if len(res) != 5 {
+		t.Fatalf("read %d results, expected 5", len(res))
+	}
+	c.Ack(res[0].ID)
+	c.Ack(res[2].ID)
+
+	publish(t, client, ResultsOptions{Mode: ResultsStream}, 1)
+
+	//
+	// Restart, reading the pending results one at a time.
+	//
+	c = consumer(t, client, "email", "host1")
+	c.Count = 1
+
+	var recovered []string
+	for i := 0; i < 3; i++ {
+		inputs, res := read(t, c)
+		if len(res) != 1 {
+			t.Fatalf("read %v, expected one result", inputs)
+		}
+		if res[0].Deliveries != 2 {
+			t.Errorf("result %s was delivered %d times, expected 2", res[0].ID, res[0].Deliveries)
+		}
+		recovered = append(recovered, inputs...)
+	}
+	if fmt.Sprintf("%v", recovered) != "[test 1 test 3 test 4]" {
+		t.Errorf("recovered %v", recovered)
+	}
+
+	//
+	// Even though we didn't acknowledge those we move on to the
+	// new result, rather than looping over them.
+	//
+	inputs, res := read(t, c)
+	if fmt.Sprintf("%v", inputs) != "[test 0]" || res[0].Deliveries != 1 {
+		t.Errorf("read %v, expected the new result", inputs)
+	}
+}
+
+// Test that the results read by a consumer which has died are claimed by
+// another, once they've been idle for long enough.
+func TestConsumerClaim(t *testing.T) {
+	client, m := setup(t)
+
+	dead := consumer(t, client, "email", "host1")
+	alive := consumer(t, client, "email", "host2")
+
+	publish(t, client, ResultsOptions{Mode: ResultsStream}, 3)
+
+	_, res := read(t, dead)
+	if len(res) != 3 {
+		t.Fatalf("read %d results, expected 3", len(res))
+	}
+	dead.Ack(res[1].ID)
+
+	//
+	// The results haven't been idle for long enough to be claimed,
+	// and the other consumer has nothing new to read.
+	//
+	inputs, _ := read(t, alive)
+	if len(inputs) != 0 {
+		t.Errorf("claimed %v too soon", inputs)
+	}
+
+	//
+	// Later they may be claimed.  (We look for idle results at
+	// most once per ClaimIdle, so forget that we just did.)
+	//
+	m.SetTime(time.Now().Add(2 * time.Minute))
+	alive.claimed = time.Time{}
+
+	inputs, res = read(t, alive)
+	if fmt.Sprintf("%v", inputs) != "[test 0 test 2]" {
+		t.Fatalf("claimed %v", inputs)
+	}
+	for _, r := range res {
+		if r.Deliveries != 2 {
+			t.Errorf("result %s was delivered %d times, expected 2", r.ID, r.Deliveries)
+		}
+		alive.Ack(r.ID)
+	}
+
+	//
+	// They now belong to the other consumer, so the dead one gets
+	// nothing back if it restarts.
+	//
+	dead = consumer(t, client, "email", "host1")
+	inputs, _ = read(t, dead)
+	if len(inputs) != 0 {
+		t.Errorf("the restarted consumer read %v", inputs)
+	}
+
+	pending, err := client.XPending(StreamKey, "email").Result()
+	if err != nil {
+		t.Fatalf("failed to find pending results: %s", err.Error())
+	}
+	if pending.Count != 0 {
+		t.Errorf("%d results are still pending", pending.Count)
+	}
+}
+
+// Test that a pending result which has been trimmed from the stream is
+// dropped when it is claimed.
+func TestConsumerTrimmed(t *testing.T) {
+	client, m := setup(t)
+
+	dead := consumer(t, client, "email", "host1")
+	alive := consumer(t, client, "email", "host2")
+
+	publish(t, client, ResultsOptions{Mode: ResultsStream}, 2)
+	_, res := read(t, dead)
+	if len(res) != 2 {
+		t.Fatalf("read %d results, expected 2", len(res))
+	}
+
+	client.XDel(StreamKey, res[0].ID)
+
+	m.SetTime(time.Now().Add(2 * time.Minute))
+	inputs, _ := read(t, alive)
+	if fmt.Sprintf("%v", inputs) != "[test 1]" {
+		t.Errorf("claimed %v", inputs)
+	}
+
+	//
+	// The trimmed result is no longer pending, so it won't be seen
+	// again.  (Redis 7 drops it when it is claimed, older versions
+	// return it, and we then find it missing and acknowledge it.)
+	//
+	pending, err := client.XPending(StreamKey, "email").Result()
+	if err != nil {
+		t.Fatalf("failed to find pending results: %s", err.Error())
+	}
+	if pending.Count != 1 {
+		t.Errorf("%d results are pending, expected 1", pending.Count)
+	}
+}
+
+// Test that results are published to the list, the stream, or both, and
+// that the stream is trimmed by age.
+func TestPublish(t *testing.T) {
+	client, m := setup(t)
+
+	publish(t, client, ResultsOptions{Mode: ResultsList}, 1)
+	publish(t, client, ResultsOptions{Mode: ResultsStream}, 2)
+	publish(t, client, ResultsOptions{Mode: ResultsBoth}, 4)
+
+	if n := client.LLen(ResultsKey).Val(); n != 5 {
+		t.Errorf("the list holds %d results, expected 5", n)
+	}
+	if n := client.XLen(StreamKey).Val(); n != 6 {
+		t.Errorf("the stream holds %d results, expected 6", n)
+	}
+
+	//
+	// Results from two hours ago, which the next result trims via
+	// MINID as they are older than an hour.
+	//
+	client.Del(StreamKey)
+	m.SetTime(time.Now().Add(-2 * time.Hour))
+	publish(t, client, ResultsOptions{Mode: ResultsStream}, 3)
+
+	m.SetTime(time.Now().Add(-30 * time.Minute))
+	publish(t, client, ResultsOptions{Mode: ResultsStream}, 1)
+	if n := client.XLen(StreamKey).Val(); n != 4 {
+		t.Errorf("the stream holds %d results, expected 4", n)
+	}
+
+	m.SetTime(time.Now())
+	publish(t, client, ResultsOptions{Mode: ResultsStream, MaxAge: time.Hour}, 1)
+	if n := client.XLen(StreamKey).Val(); n != 2 {
+		t.Errorf("the stream holds %d results, expected 2 after trimming", n)
+	}
+}
@@ -0,0 +1,35 @@
+package queue
+
+import "time"
+
+// WorkersKey is the name of the redis set which contains the IDs of
+// the workers which have registered themselves.
+const WorkersKey = "overseer.workers"
+
+// ResultsKey is the name of the redis list which holds test-results.
+const ResultsKey = "overseer.results"
+
+// HeartbeatInterval is how often workers update their registration.
+const HeartbeatInterval = 10 * time.Second
+
+// HeartbeatExpiry is how long a worker's registration lasts, without
+// being refreshed, before it disappears.
+const HeartbeatExpiry = 3 * HeartbeatInterval
+
+// WorkerKey returns the name of the redis hash which describes the
+// worker with the given ID.
+func WorkerKey(id string) string {
+	return "overseer.worker." + id
+}
+
+// BridgesKey is the name of the redis set which contains the IDs of
+// the bridges which have registered themselves.
+const BridgesKey = "overseer.bridges"
+
+// BridgeKey returns the name of the redis hash which describes the
+// bridge with the given ID.
+//
+// Bridges use the same heartbeat interval, and expiry, as workers.
+func BridgeKey(id string) string {
+	return "overseer.bridge." + id
+}
@@ -0,0 +1,302 @@
+// Package redisconn contains the code which connects to redis.
+//
+// The same options are used by each of the overseer sub-commands, and
+// by the bridges, so that redis is configured identically everywhere.
+// A connection may be made to:
+//
+//   - A single server, via TCP or a unix-domain socket.
+//   - A Sentinel-managed server, which will be followed on failover.
+//   - A Redis Cluster.
+//
+// Each of these may be reached via TLS, optionally presenting a client
+// certificate, and authenticated via either a password or an ACL
+// username & password.
+package redisconn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Options holds the details of how to connect to redis.
+//
+// The field-names match those used in the legacy JSON configuration
+// file, and the YAML tags those used in the `redis` section of the
+// configuration file.
+type Options struct {
+
+	// RedisHost is the address of the server.
+	//
+	// For Sentinel, and Cluster, this may be a comma-separated
+	// list of addresses.
+	RedisHost string `yaml:"host"`
+
+	// RedisDB is the database-number to use.
+	//
+	// Redis Cluster only supports database zero.
+	RedisDB int `yaml:"db"`
+
+	// RedisUser is the ACL username to authenticate as, if any.
+	RedisUser string `yaml:"user"`
+
+	// RedisPassword is the password to authenticate with, if any.
+	RedisPassword string `yaml:"password"`
+
+	// RedisSocket is the path to a unix-domain socket, which will be
+	// used in preference to RedisHost if set.
+	RedisSocket string `yaml:"socket"`
+
+	// RedisDialTimeout is the timeout for establishing connections.
+	RedisDialTimeout time.Duration `yaml:"dial-timeout"`
+
+	// RedisTLS enables TLS.
+	RedisTLS bool `yaml:"tls"`
+
+	// RedisCA is the path to a PEM file of CA certificates used to
+	// verify the server, instead of the system pool.
+	RedisCA string `yaml:"ca"`
+
+	// RedisCert and RedisKey are the paths to the client certificate
+	// and key to present to the server, if any.
+	RedisCert string `yaml:"cert"`
+	RedisKey  string `yaml:"key"`
+
+	// RedisInsecure disables the verification of the server certificate.
+	RedisInsecure bool `yaml:"insecure"`
+
+	// RedisSentinelMaster is the name of the master to find via
+	// Sentinel, in which case RedisHost lists the sentinels.
+	RedisSentinelMaster string `yaml:"sentinel-master"`
+
+	// RedisCluster connects to a Redis Cluster, in which case RedisHost
+	// lists one or more of the nodes of the cluster.
+	RedisCluster bool `yaml:"cluster"`
+}
+
+// Defaults returns the default options.
+func Defaults() Options {
+	return Options{
+		RedisHost:        "localhost:6379",
+		RedisDialTimeout: 5 * time.Second,
+	}
+}
+
+// SetFlags registers the command-line flags which populate our options,
+// using the given values as the defaults.
+func (o *Options) SetFlags(f *flag.FlagSet, defaults Options) {
+	f.StringVar(&o.RedisHost, "redis-host", defaults.RedisHost, "Specify the address of the redis queue, or a comma-separated list for Sentinel/Cluster.")
+	f.IntVar(&o.RedisDB, "redis-db", defaults.RedisDB, "Specify the database-number for redis.")
+	f.StringVar(&o.RedisUser, "redis-user", defaults.RedisUser, "Specify the ACL username for the redis queue.")
+	f.StringVar(&o.RedisPassword, "redis-pass", defaults.RedisPassword, "Specify the password for the redis queue.")
+	f.StringVar(&o.RedisSocket, "redis-socket", defaults.RedisSocket, "If set, will be used for the redis connections.")
+	f.DurationVar(&o.RedisDialTimeout, "redis-timeout", defaults.RedisDialTimeout, "Redis connection timeout.")
+	f.BoolVar(&o.RedisTLS, "redis-tls", defaults.RedisTLS, "Connect to redis via TLS.")
+	f.StringVar(&o.RedisCA, "redis-ca", defaults.RedisCA, "The CA certificate(s) used to verify the redis server.")
+	f.StringVar(&o.RedisCert, "redis-cert", defaults.RedisCert, "The client certificate to present to the redis server.")
+	f.StringVar(&o.RedisKey, "redis-key", defaults.RedisKey, "The key for the client certificate.")
+	f.BoolVar(&o.RedisInsecure, "redis-insecure", defaults.RedisInsecure, "Don't verify the certificate of the redis server.")
+	f.StringVar(&o.RedisSentinelMaster, "redis-sentinel-master", defaults.RedisSentinelMaster, "Find the named master via the Sentinel(s) given in -redis-host.")
+	f.BoolVar(&o.RedisCluster, "redis-cluster", defaults.RedisCluster, "Treat -redis-host as the node(s) of a Redis Cluster.")
+}
+
+// addrs returns the list of addresses we were given.
+func (o *Options) addrs() []string {
+	var res []string
+	for _, addr := range strings.Split(o.RedisHost, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// TLSConfig returns the TLS configuration to use, or nil if TLS has
+// not been enabled.
+//
+// TLS is enabled via RedisTLS, or implicitly by specifying a CA or a
+// client certificate.
+func (o *Options) TLSConfig() (*tls.Config, error) {
+
+	if !o.RedisTLS && o.RedisCA == "" && o.RedisCert == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: o.RedisInsecure,
+	}
+
+	if o.RedisCA != "" {
+		pem, err := ioutil.ReadFile(o.RedisCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate %s - %s", o.RedisCA, err.Error())
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.RedisCA)
+		}
+	}
+
+	if o.RedisCert != "" || o.RedisKey != "" {
+		if o.RedisCert == "" || o.RedisKey == "" {
+			return nil, fmt.Errorf("a client certificate requires both a certificate and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(o.RedisCert, o.RedisKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate - %s", err.Error())
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// authenticate returns a hook which authenticates new connections as
+// our ACL user, and selects our database.
+//
+// The redis library only knows how to send `AUTH password`, so if we
+// have a username we don't give it the password, and instead send
+// `AUTH username password` ourselves.  The library would select the
+// database before calling us, which fails until we're authenticated,
+// so we must select it too.
+func (o *Options) authenticate() func(*redis.Conn) error {
+	if o.RedisUser == "" {
+		return nil
+	}
+
+	user := o.RedisUser
+	pass := o.RedisPassword
+	db := o.RedisDB
+
+	return func(conn *redis.Conn) error {
+		cmd := redis.NewStatusCmd("auth", user, pass)
+		conn.Process(cmd)
+		if cmd.Err() != nil || db == 0 {
+			return cmd.Err()
+		}
+		return conn.Select(db).Err()
+	}
+}
+
+// Validate ensures the options are consistent.
+func (o *Options) Validate() error {
+	if o.RedisSocket == "" && len(o.addrs()) == 0 {
+		return fmt.Errorf("no redis address was specified")
+	}
+	if o.RedisSentinelMaster != "" && o.RedisCluster {
+		return fmt.Errorf("redis Sentinel and Cluster are mutually exclusive")
+	}
+	if o.RedisCluster && o.RedisDB != 0 {
+		return fmt.Errorf("redis Cluster only supports database zero")
+	}
+	if o.RedisSocket != "" && (o.RedisSentinelMaster != "" || o.RedisCluster) {
+		return fmt.Errorf("a redis socket cannot be used with Sentinel or Cluster")
+	}
+	return nil
+}
+
+// Client creates a client from our options.
+//
+// No connection is made until the client is used.
+func (o *Options) Client() (redis.UniversalClient, error) {
+
+	err := o.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := o.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// If we're authenticating with a username then the hook
+	// takes care of sending the password, and of selecting the
+	// database.
+	//
+	onConnect := o.authenticate()
+	password := o.RedisPassword
+	db := o.RedisDB
+	if onConnect != nil {
+		password = ""
+		db = 0
+	}
+
+	switch {
+	case o.RedisSocket != "":
+		return redis.NewClient(&redis.Options{
+			Network:     "unix",
+			Addr:        o.RedisSocket,
+			Password:    password,
+			DB:          db,
+			DialTimeout: o.RedisDialTimeout,
+			OnConnect:   onConnect,
+			TLSConfig:   cfg,
+		}), nil
+
+	case o.RedisSentinelMaster != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    o.RedisSentinelMaster,
+			SentinelAddrs: o.addrs(),
+			Password:      password,
+			DB:            db,
+			DialTimeout:   o.RedisDialTimeout,
+			OnConnect:     onConnect,
+			TLSConfig:     cfg,
+		}), nil
+
+	case o.RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:       o.addrs(),
+			Password:    password,
+			DialTimeout: o.RedisDialTimeout,
+			OnConnect:   onConnect,
+			TLSConfig:   cfg,
+		}), nil
+	}
+
+	return redis.NewClient(&redis.Options{
+		Addr:        o.addrs()[0],
+		Password:    password,
+		DB:          db,
+		DialTimeout: o.RedisDialTimeout,
+		OnConnect:   onConnect,
+		TLSConfig:   cfg,
+	}), nil
+}
+
+// Connect creates a client from our options, and ensures that it can
+// reach the server.
+func (o *Options) Connect() (redis.UniversalClient, error) {
+
+	client, err := o.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = client.Ping().Result()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// IsCluster returns true if the given client is connected to a
+// Redis Cluster.
+//
+// In a cluster commands which operate upon several keys, such as a
+// BLPOP of each of our job-queues, fail unless the keys live in the
+// same slot.
+func IsCluster(client redis.UniversalClient) bool {
+	_, ok := client.(*redis.ClusterClient)
+	return ok
+}
@@ -0,0 +1,110 @@
+package redisconn
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// Test that inconsistent options are rejected.
+func TestValidate(t *testing.T) {
+
+	tests := []Options{
+		{},
+		{RedisHost: " , "},
+		{RedisHost: "a:6379", RedisCluster: true, RedisSentinelMaster: "mymaster"},
+		{RedisHost: "a:6379", RedisCluster: true, RedisDB: 3},
+		{RedisSocket: "/tmp/redis.sock", RedisSentinelMaster: "mymaster"},
+	}
+
+	for _, opts := range tests {
+		if opts.Validate() == nil {
+			t.Errorf("expected an error validating %v", opts)
+		}
+	}
+
+	opts := Defaults()
+	if opts.Validate() != nil {
+		t.Errorf("the default options were invalid")
+	}
+}
+
+// Test that the right kind of client is created.
+func TestClient(t *testing.T) {
+
+	opts := Defaults()
+	client, err := opts.Client()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, ok := client.(*redis.Client); !ok {
+		t.Errorf("expected a simple client, got %T", client)
+	}
+
+	opts.RedisHost = "a:7000, b:7000"
+	opts.RedisCluster = true
+	client, err = opts.Client()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !IsCluster(client) {
+		t.Errorf("expected a cluster client, got %T", client)
+	}
+}
+
+// Test that a client certificate requires a key.
+func TestTLSConfig(t *testing.T) {
+
+	opts := Defaults()
+	cfg, err := opts.TLSConfig()
+	if cfg != nil || err != nil {
+		t.Errorf("TLS should be disabled by default")
+	}
+
+	opts.RedisTLS = true
+	opts.RedisInsecure = true
+	cfg, err = opts.TLSConfig()
+	if err != nil || cfg == nil || !cfg.InsecureSkipVerify {
+		t.Errorf("unexpected TLS configuration %v - %v", cfg, err)
+	}
+
+	opts.RedisCert = "/tmp/client.pem"
+	_, err = opts.TLSConfig()
+	if err == nil {
+		t.Errorf("expected an error with a certificate but no key")
+	}
+}
+
+// Test that an ACL user may use a database other than zero, which must
+// only be selected once we've authenticated.
+func TestConnectUser(t *testing.T) {
+	m := miniredis.RunT(t)
+	m.RequireUserAuth("overseer", "secret")
+
+	opts := Defaults()
+	opts.RedisHost = m.Addr()
+	opts.RedisUser = "overseer"
+	opts.RedisPassword = "secret"
+	opts.RedisDB = 3
+
+	client, err := opts.Connect()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer client.Close()
+
+	err = client.Set("key", "value", 0).Err()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !m.DB(3).Exists("key") || m.DB(0).Exists("key") {
+		t.Errorf("the database wasn't selected")
+	}
+
+	opts.RedisPassword = "wrong"
+	_, err = opts.Connect()
+	if err == nil {
+		t.Errorf("expected an error with the wrong password")
+	}
+}
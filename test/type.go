@@ -18,9 +18,14 @@
 package test
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
+
+	"github.com/skx/overseer/logger"
 )
 
 // Test contains a single test definition as identified by the parser.
@@ -43,19 +48,106 @@ type Test struct {
 	// MaxRetries overrides the global overseer setting for max test retries, if >= 0
 	MaxRetries int
 
+	// Priority contains the priority of the test, which is used to
+	// select the queue the test is stored in: high, normal, or low.
+	Priority string
+
+	// Severity contains the severity of a failure of the test, if one
+	// was given, which is passed to the notifiers.
+	Severity string
+
 	// Arguments contains a map of any optional arguments supplied to
 	// test test.
 	//
 	// In the example above the map would contain one key `port`,
 	// with the value `2121` (as a string).
 	//
+	// Arguments which may be repeated contain each value, joined
+	// by Separator.  Use Values to retrieve them.
+	//
 	Arguments map[string]string
+
+	// Sensitive contains the names of any arguments whose values
+	// should not be displayed, such as passwords.
+	Sensitive []string
+
+	// Source contains the name of the file the test was read from,
+	// if any.
+	Source string
+
+	// Line contains the line-number of the file the test was read
+	// from, if any.
+	Line int
 }
 
-// Sanitize returns a copy of the input string, but with any password
-// removed
+// Separator joins the values of an argument which was given more than once.
+//
+// Input is read a line at a time, so a newline never appears in a value.
+const Separator = "\n"
+
+// The severities a test may be given, most severe first.
+//
+// These match the severities used by PagerDuty, and others.
+const (
+	SeverityCritical = "critical"
+	SeverityError    = "error"
+	SeverityWarning  = "warning"
+	SeverityInfo     = "info"
+)
+
+// Severities contains the known severities, most severe first.
+var Severities = []string{SeverityCritical, SeverityError, SeverityWarning, SeverityInfo}
+
+// ValidSeverity returns true if the given severity is known.
+func ValidSeverity(severity string) bool {
+	for _, s := range Severities {
+		if s == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// ID returns a stable identifier for the test, derived from its input.
+func (obj *Test) ID() string {
+	hash := sha1.Sum([]byte(obj.Input))
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// Values returns each value of the given argument, in the order they were
+// given, or nil if it wasn't given.
+func (obj *Test) Values(name string) []string {
+	val, ok := obj.Arguments[name]
+	if !ok {
+		return nil
+	}
+	return strings.Split(val, Separator)
+}
+
+// credentialHeader returns true if the named request-header carries a
+// credential, such as `Authorization`, `Cookie`, or `X-Api-Key`.
+func credentialHeader(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "authorization", "proxy-authorization", "cookie":
+		return true
+	}
+	return strings.HasSuffix(name, "-key") || strings.HasSuffix(name, "-token")
+}
+
+// Sanitize returns a copy of the input string, but with any password,
+// or other sensitive argument, removed.
+//
+// Only the values of the headers which carry credentials are removed,
+// as the others are useful to see.
 func (obj *Test) Sanitize() string {
 
+	// The arguments we'll censor
+	censor := map[string]bool{"password": true}
+	for _, k := range obj.Sensitive {
+		censor[k] = true
+	}
+
 	// The basic test
 	res := fmt.Sprintf("%s must run %s", obj.Target, obj.Type)
 
@@ -68,17 +160,26 @@ func (obj *Test) Sanitize() string {
 
 	// Now append the arguments and their values.
 	for _, k := range keys {
-		tmp := ""
+		for _, v := range obj.Values(k) {
+			tmp := ""
 
-		// Censor passwords
-		if k == "password" {
-			tmp = " with password 'CENSORED'"
-		} else {
+			// Censor passwords, and other sensitive values
+			if censor[k] && k == "header" {
+				parts := strings.SplitN(v, ":", 2)
+				if credentialHeader(parts[0]) {
+					tmp = fmt.Sprintf(" with %s '%s: CENSORED'", k, parts[0])
+				} else {
+					tmp = fmt.Sprintf(" with %s '%s'", k, v)
+				}
+			} else if censor[k] {
+				tmp = fmt.Sprintf(" with %s 'CENSORED'", k)
+			} else {
 
-			// Otherwise leave alone.
-			tmp = fmt.Sprintf(" with %s '%s'", k, obj.Arguments[k])
+				// Otherwise leave alone.
+				tmp = fmt.Sprintf(" with %s '%s'", k, v)
+			}
+			res += tmp
 		}
-		res += tmp
 	}
 
 	return res
@@ -93,4 +194,8 @@ type Options struct {
 
 	// Should the protocol-tests run verbosely?
 	Verbose bool
+
+	// Log is used by the protocol-tests to report what they're doing,
+	// at the debug level.  It may be nil.
+	Log *logger.Logger
 }